@@ -0,0 +1,68 @@
+package libmitm
+
+import (
+	"errors"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// AcceptAction is what an AcceptCallback decides for a new connection.
+type AcceptAction int
+
+const (
+	// AcceptConnection proceeds with the handshake.
+	AcceptConnection AcceptAction = iota
+	// RejectConnection answers the SYN with a RST.
+	RejectConnection
+	// DelayConnection proceeds with the handshake after Delay.
+	DelayConnection
+)
+
+// AcceptDecision is the result of an AcceptCallback.
+type AcceptDecision struct {
+	Action AcceptAction
+	// Delay is how long a DelayConnection decision holds the handshake.
+	Delay time.Duration
+}
+
+// AcceptCallback decides on a TCP connection request before the handshake
+// completes. id.LocalAddress and LocalPort are the original destination,
+// id.RemoteAddress and RemotePort the client.
+type AcceptCallback func(id stack.TransportEndpointID) AcceptDecision
+
+// WithAcceptCallback runs fn on every TCP connection request, before the
+// SYN is answered, for admission control at the earliest point. fn runs
+// after the handshake rate limits of WithMaxHandshakeRate, so SYNs dropped
+// there never reach it, and before the memory budget and all per-flow
+// handling. Delaying holds the client's SYN unanswered; clients retransmit
+// it after about a second, which the stack ignores while the request is
+// pending, and give up after a few retransmissions, so long delays look
+// like an unreachable server. UDP flows are not subject to the callback.
+func WithAcceptCallback(fn AcceptCallback) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("accept callback must not be nil")
+		}
+		t.acceptCallback = fn
+		return nil
+	}
+}
+
+// admit consults the accept callback on id, waiting out any delay. It
+// reports whether the connection may proceed.
+func (t *TUN) admit(id stack.TransportEndpointID) bool {
+	if t.acceptCallback == nil {
+		return true
+	}
+	d := t.acceptCallback(id)
+	switch d.Action {
+	case RejectConnection:
+		return false
+	case DelayConnection:
+		if d.Delay > 0 {
+			time.Sleep(d.Delay)
+		}
+	}
+	return true
+}
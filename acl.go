@@ -0,0 +1,147 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ACLAction is what an ACLRule does with the dials it matches.
+type ACLAction int
+
+const (
+	// ACLAllow lets matching dials proceed. It is not the zero value, so
+	// a rule without an action is rejected rather than allowing.
+	ACLAllow ACLAction = iota + 1
+	// ACLDeny refuses matching dials.
+	ACLDeny
+)
+
+var errACLDenied = errors.New("destination denied by acl")
+
+// ACLRule matches the upstream destinations of flows. It matches if all
+// of its conditions that are set match.
+type ACLRule struct {
+	// Action is ACLAllow or ACLDeny.
+	Action ACLAction
+	// Network matches flows over "tcp" or "udp".
+	Network string
+	// CIDR matches upstream addresses in the prefix, e.g. "10.0.0.0/8".
+	// It never matches upstreams dialed by hostname.
+	CIDR string
+	// MinPort and MaxPort match upstream ports in the inclusive range,
+	// if MaxPort is not zero.
+	MinPort int
+	MaxPort int
+	// DomainSuffix matches a domain and its subdomains, e.g. "example.com"
+	// matches "example.com" and "www.example.com". The upstream hostname
+	// and the flow's Domain, SNI and Host are matched, so sniffing lets
+	// rules match flows to bare IPs.
+	DomainSuffix string
+}
+
+type aclRule struct {
+	ACLRule
+	prefix *net.IPNet
+	suffix string
+}
+
+type accessList struct {
+	rules  []aclRule
+	denied atomic.Int64
+}
+
+// WithACL checks every upstream address against rules before it is
+// dialed: the first matching rule decides whether the dial may proceed,
+// and addresses matching none are allowed, so a final rule without
+// conditions sets the default. The address checked is the one the flow
+// is redirected to, and every address of a failover chain or of
+// WeightedTargets is checked in turn. Denied TCP flows are reset and
+// denied UDP flows dropped, and reported as EventACLDenied.
+func WithACL(rules ...ACLRule) Option {
+	return func(t *TUN) error {
+		for _, r := range rules {
+			rule := aclRule{ACLRule: r, suffix: normalizeDomain(r.DomainSuffix)}
+			if r.Action != ACLAllow && r.Action != ACLDeny {
+				return fmt.Errorf("unknown acl action: %d", r.Action)
+			}
+			switch r.Network {
+			case "", "tcp", "udp":
+			default:
+				return fmt.Errorf("unknown acl network %q", r.Network)
+			}
+			if r.CIDR != "" {
+				_, prefix, err := net.ParseCIDR(r.CIDR)
+				if err != nil {
+					return err
+				}
+				rule.prefix = prefix
+			}
+			if r.MaxPort != 0 && (r.MinPort < 0 || r.MinPort > r.MaxPort || r.MaxPort > 65535) {
+				return fmt.Errorf("invalid acl port range %d-%d", r.MinPort, r.MaxPort)
+			}
+			t.acl.rules = append(t.acl.rules, rule)
+		}
+		return nil
+	}
+}
+
+// ACLDenied returns the number of dials denied by the rules of WithACL.
+func (t *TUN) ACLDenied() int64 {
+	return t.acl.denied.Load()
+}
+
+// admitACL returns errACLDenied if the rules deny flow to dial address.
+func (t *TUN) admitACL(flow *Flow, address string) error {
+	if len(t.acl.rules) == 0 {
+		return nil
+	}
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(p)
+	ip := net.ParseIP(host)
+	for i := range t.acl.rules {
+		r := &t.acl.rules[i]
+		if !r.matches(flow, host, ip, port) {
+			continue
+		}
+		if r.Action == ACLAllow {
+			return nil
+		}
+		t.acl.denied.Add(1)
+		t.emit(newEvent(EventACLDenied, flow, fmt.Sprintf("connection to %s denied by acl", address)))
+		return fmt.Errorf("dial %s: %w", address, errACLDenied)
+	}
+	return nil
+}
+
+func (r *aclRule) matches(flow *Flow, host string, ip net.IP, port int) bool {
+	if r.Network != "" && r.Network != flow.Network {
+		return false
+	}
+	if r.prefix != nil && (ip == nil || !r.prefix.Contains(ip)) {
+		return false
+	}
+	if r.MaxPort != 0 && (port < r.MinPort || port > r.MaxPort) {
+		return false
+	}
+	if r.suffix != "" {
+		var names []string
+		if ip == nil {
+			names = append(names, host)
+		}
+		names = append(names, flow.Domain, flow.SNI, flow.Host)
+		for _, name := range names {
+			if name = normalizeDomain(name); name == r.suffix || strings.HasSuffix(name, "."+r.suffix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
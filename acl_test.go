@@ -0,0 +1,75 @@
+package libmitm
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestACLRules(t *testing.T) {
+	tun := &TUN{}
+	err := tun.Apply(WithACL(
+		ACLRule{Action: ACLDeny, CIDR: "192.0.2.0/24", MinPort: 80, MaxPort: 90},
+		ACLRule{Action: ACLAllow, DomainSuffix: "example.com"},
+		ACLRule{Action: ACLDeny, Network: "udp"},
+		ACLRule{Action: ACLDeny, DomainSuffix: "blocked.test"},
+	))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for _, tc := range []struct {
+		network, address, sni string
+		denied                bool
+	}{
+		{"tcp", "192.0.2.1:80", "", true},
+		{"tcp", "192.0.2.1:91", "", false},
+		{"tcp", "192.0.2.1:80", "www.example.com", true},
+		{"udp", "www.example.com:53", "", false},
+		{"udp", "203.0.113.1:53", "", true},
+		{"tcp", "203.0.113.1:443", "cdn.blocked.test", true},
+		{"tcp", "notblocked.test:443", "", false},
+	} {
+		flow := &Flow{Network: tc.network, SNI: tc.sni}
+		err := tun.admitACL(flow, tc.address)
+		if denied := errors.Is(err, errACLDenied); denied != tc.denied {
+			t.Errorf("%s %s (sni %q): %v, want denied %v", tc.network, tc.address, tc.sni, err, tc.denied)
+		}
+	}
+	if n := tun.ACLDenied(); n != 4 {
+		t.Errorf("%d dials denied, want 4", n)
+	}
+}
+
+func TestACLInvalidRules(t *testing.T) {
+	for _, r := range []ACLRule{
+		// The zero action is neither allow nor deny.
+		{CIDR: "192.0.2.0/24"},
+		{Action: ACLDeny, Network: "icmp"},
+		{Action: ACLDeny, CIDR: "192.0.2.1"},
+		{Action: ACLDeny, MinPort: 90, MaxPort: 80},
+	} {
+		if err := (&TUN{}).Apply(WithACL(r)); err == nil {
+			t.Errorf("accepted %+v", r)
+		}
+	}
+}
+
+func TestACLDeniedFlow(t *testing.T) {
+	upstream := echoServer(t)
+	_, port, _ := net.SplitHostPort(upstream)
+	events := make(chan *Event, 16)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithACL(ACLRule{Action: ACLDeny, CIDR: "127.0.0.0/8", MinPort: 1, MaxPort: 65535}),
+		withEventChannel(events),
+	)
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err == nil {
+		defer conn.Close()
+		conn.Write([]byte("x"))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("denied flow to port %s was forwarded", port)
+		}
+	}
+	waitForEvent(t, events, EventACLDenied)
+}
@@ -0,0 +1,178 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCircuitOpen is returned for dials to an upstream whose circuit
+// breaker is open.
+var errCircuitOpen = errors.New("upstream circuit open")
+
+// WithCircuitBreaker stops dialing an upstream address for cooldown after
+// threshold consecutive dial failures, the first of them no longer than
+// window ago. While the circuit is open, dials to the address fail
+// immediately, so a failover chain or weighted targets move on to an
+// alternative without waiting for another timeout. After the cooldown a
+// single dial is let through as a probe: its success closes the circuit,
+// its failure opens it again.
+//
+// Each trip is reported as EventCircuitOpen, and the addresses currently
+// skipped are listed by UnhealthyUpstreams. WeightedTargets skip the
+// targets the breaker holds open instead of tracking failures themselves.
+func WithCircuitBreaker(threshold int, window, cooldown time.Duration) Option {
+	return func(t *TUN) error {
+		if threshold <= 0 || window <= 0 || cooldown <= 0 {
+			return errors.New("circuit breaker: threshold, window and cooldown must be positive")
+		}
+		t.breaker = newCircuitBreaker(threshold, window, cooldown)
+		return nil
+	}
+}
+
+// CircuitTrips returns how often a circuit breaker opened.
+func (t *TUN) CircuitTrips() int64 {
+	if t.breaker == nil {
+		return 0
+	}
+	return t.breaker.trips.Load()
+}
+
+// UnhealthyUpstreams returns the sorted upstream addresses whose circuit
+// is open or probing.
+func (t *TUN) UnhealthyUpstreams() []string {
+	if t.breaker == nil {
+		return nil
+	}
+	return t.breaker.unhealthy()
+}
+
+// circuitBreaker tracks the health of upstream addresses, for the TUN and
+// for WeightedTargets.
+type circuitBreaker struct {
+	threshold int
+	// window bounds the time from the first to the last of threshold
+	// failures. If zero, failures count until a dial succeeds.
+	window   time.Duration
+	cooldown time.Duration
+	trips    atomic.Int64
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+// circuit is the breaker state of one upstream address. It is open while
+// openUntil is set, and probing while a dial after the cooldown is in
+// flight.
+type circuit struct {
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	probing      bool
+}
+
+// allow reports whether address may be dialed now.
+func (b *circuitBreaker) allow(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuits[address]
+	if c == nil || c.openUntil.IsZero() {
+		return true
+	}
+	if c.probing || time.Now().Before(c.openUntil) {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// report records the outcome of a dial to address and reports whether it
+// opened the circuit.
+func (b *circuitBreaker) report(address string, err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuits[address]
+	if err == nil {
+		// Healthy upstreams are not tracked, keeping the map bounded by
+		// the failing ones.
+		delete(b.circuits, address)
+		return false
+	}
+	now := time.Now()
+	if c == nil {
+		c = &circuit{}
+		b.circuits[address] = c
+	}
+	if c.probing {
+		c.probing = false
+		c.openUntil = now.Add(b.cooldown)
+		b.trips.Add(1)
+		return true
+	}
+	if c.failures == 0 || b.window > 0 && now.Sub(c.firstFailure) > b.window {
+		c.failures, c.firstFailure = 0, now
+	}
+	c.failures++
+	if c.failures < b.threshold {
+		return false
+	}
+	c.failures = 0
+	c.openUntil = now.Add(b.cooldown)
+	b.trips.Add(1)
+	return true
+}
+
+// skipUntil returns when address may be dialed again if its circuit is
+// open, which is in the past once the cooldown is over, or a cooldown from
+// now while a probe is in flight. It returns the zero time for healthy
+// addresses.
+func (b *circuitBreaker) skipUntil(address string) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuits[address]
+	switch {
+	case c == nil || c.openUntil.IsZero():
+		return time.Time{}
+	case c.probing:
+		return time.Now().Add(b.cooldown)
+	}
+	return c.openUntil
+}
+
+func (b *circuitBreaker) unhealthy() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var addresses []string
+	for address, c := range b.circuits {
+		if !c.openUntil.IsZero() {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// breakerReport passes the outcome of a dial to address for flow to the
+// circuit breaker.
+func (t *TUN) breakerReport(flow *Flow, address string, err error) {
+	if t.breaker.report(address, err) {
+		t.emit(newEvent(EventCircuitOpen, flow, fmt.Sprintf("circuit to %s opened for %s", address, t.breaker.cooldown)))
+	}
+}
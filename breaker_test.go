@@ -0,0 +1,105 @@
+package libmitm
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute, 50*time.Millisecond)
+	errDial := errors.New("dial failed")
+	const address = "192.0.2.1:80"
+
+	if b.report(address, errDial) {
+		t.Fatal("opened after one failure")
+	}
+	if !b.report(address, errDial) {
+		t.Fatal("did not open after two failures")
+	}
+	if b.allow(address) {
+		t.Error("allowed a dial while open")
+	}
+	if got := b.unhealthy(); !reflect.DeepEqual(got, []string{address}) {
+		t.Errorf("unhealthy %v", got)
+	}
+
+	// After the cooldown a single probe is let through; its failure
+	// opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow(address) {
+		t.Fatal("no probe after the cooldown")
+	}
+	if b.allow(address) {
+		t.Error("allowed a second dial while probing")
+	}
+	if !b.report(address, errDial) {
+		t.Error("failed probe did not open the circuit")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow(address) {
+		t.Fatal("no probe after the cooldown")
+	}
+	b.report(address, nil)
+	if !b.allow(address) || len(b.unhealthy()) != 0 {
+		t.Error("successful probe did not close the circuit")
+	}
+	if n := b.trips.Load(); n != 2 {
+		t.Errorf("%d trips, want 2", n)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := newCircuitBreaker(2, 20*time.Millisecond, time.Minute)
+	errDial := errors.New("dial failed")
+	b.report("192.0.2.1:80", errDial)
+	time.Sleep(30 * time.Millisecond)
+	if b.report("192.0.2.1:80", errDial) {
+		t.Error("failures further apart than the window opened the circuit")
+	}
+}
+
+// closedAddress returns a loopback address nothing listens on.
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+// TestCircuitBreakerTargets checks that weighted targets skip the targets
+// the circuit breaker holds open.
+func TestCircuitBreakerTargets(t *testing.T) {
+	dead, live := closedAddress(t), echoServer(t)
+	targets := NewWeightedTargets(0, 0)
+	targets.Add(dead, 100)
+	targets.Add(live, 1)
+	events := make(chan *Event, 64)
+	c := startTestTUN(t,
+		WithCircuitBreaker(1, time.Minute, time.Minute),
+		withRedirectors(flowRedirector(func(f *Flow) *Decision { return &Decision{Targets: targets} }), nil),
+		withEventChannel(events),
+	)
+
+	for i := 0; i < 3; i++ {
+		conn, err := c.dialTCP(t, testRemote(80))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		roundTrip(t, conn, "balanced")
+		conn.Close()
+	}
+	if got := c.tun.UnhealthyUpstreams(); !reflect.DeepEqual(got, []string{dead}) {
+		t.Errorf("unhealthy upstreams %v, want %s", got, dead)
+	}
+	if n := c.tun.CircuitTrips(); n != 1 {
+		t.Errorf("%d trips, want the dead target to be dialed once", n)
+	}
+	waitForEvent(t, events, EventCircuitOpen)
+}
@@ -0,0 +1,149 @@
+package libmitm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// classifierTimeout bounds how long the forwarder waits for the first
+	// bytes of a flow before classifying what it has.
+	classifierTimeout = 500 * time.Millisecond
+
+	// maxDatagramSize is the largest UDP payload.
+	maxDatagramSize = 65535
+)
+
+// Classifier labels a flow from its first bytes.
+type Classifier func(head []byte) string
+
+// DatagramClassifier labels a UDP flow from its first datagram and may
+// choose its upstream address as target, e.g. from the SNI of a QUIC
+// Initial. An empty target, as for datagrams it cannot parse, keeps the
+// address based routing.
+type DatagramClassifier func(first []byte) (label, target string)
+
+type classifierConfig struct {
+	peekN int
+	fn    Classifier
+	udpFn DatagramClassifier
+}
+
+// WithClassifier peeks up to peekN bytes from every TCP flow before it is
+// redirected and passes them to fn. The returned label is exposed as
+// Flow.Label to a FlowRedirector, so routing can depend on the payload.
+// The peeked bytes are replayed to the upstream unchanged.
+//
+// Peeking waits at most classifierTimeout, so flows in which the server
+// speaks first are classified with whatever the client sent so far,
+// possibly nothing.
+func WithClassifier(peekN int, fn Classifier) Option {
+	return func(t *TUN) error {
+		if peekN <= 0 || fn == nil {
+			return errors.New("classifier: peek size must be positive and classifier non-nil")
+		}
+		t.classifier.peekN, t.classifier.fn = peekN, fn
+		return nil
+	}
+}
+
+// WithUDPClassifier passes the first datagram of every UDP flow to fn
+// before the flow is redirected. The label is exposed as Flow.Label to a
+// FlowRedirector, and a non-empty target replaces the original destination
+// as the upstream unless the redirector chooses an address itself. The
+// datagram is forwarded once the upstream is connected.
+func WithUDPClassifier(fn DatagramClassifier) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("udp classifier must not be nil")
+		}
+		t.classifier.udpFn = fn
+		return nil
+	}
+}
+
+// classify returns the classifier label for conn and a connection that
+// replays the peeked bytes.
+func (c *classifierConfig) classify(conn net.Conn) (string, net.Conn) {
+	if c.fn == nil {
+		return "", conn
+	}
+	head, conn := peek(conn, c.peekN, classifierTimeout)
+	return c.fn(head), conn
+}
+
+// peek reads up to n bytes from conn, waiting at most timeout, and returns
+// them together with a connection that yields them again on Read.
+func peek(conn net.Conn, n int, timeout time.Duration) ([]byte, net.Conn) {
+	buf := make([]byte, n)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	read, _ := io.ReadFull(conn, buf)
+	conn.SetReadDeadline(time.Time{})
+
+	head := buf[:read]
+	if read == 0 {
+		return head, conn
+	}
+	return head, &peekedConn{Conn: conn, head: head}
+}
+
+// classifyDatagram classifies flow by the first datagram read from conn,
+// setting its label and target, and returns a connection that replays the
+// datagram.
+func (c *classifierConfig) classifyDatagram(flow *Flow, conn net.Conn) net.Conn {
+	if c.udpFn == nil {
+		return conn
+	}
+	buf := make([]byte, maxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(classifierTimeout))
+	n, _ := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if n == 0 {
+		return conn
+	}
+
+	first := append([]byte(nil), buf[:n]...)
+	flow.Label, flow.target = c.udpFn(first)
+	return &peekedDatagramConn{Conn: conn, first: first}
+}
+
+// peekedDatagramConn replays the first datagram before reading from the
+// underlying Conn. Like any datagram, it is truncated if b is too short.
+type peekedDatagramConn struct {
+	net.Conn
+	first []byte
+}
+
+func (c *peekedDatagramConn) Read(b []byte) (int, error) {
+	if c.first != nil {
+		n := copy(b, c.first)
+		c.first = nil
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// peekedConn replays head before reading from the underlying Conn.
+type peekedConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.head) > 0 {
+		n := copy(b, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite half-closes the underlying Conn.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
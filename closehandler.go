@@ -0,0 +1,37 @@
+package libmitm
+
+import "fmt"
+
+// CloseHandler is notified when a forwarded connection ends, once for
+// every connection the establish handler was notified of, and
+// independently of it. localAddr is the same local address of the
+// upstream connection the establish handler received, message describes
+// the connection and its traffic, and err is the error that ended the
+// forwarding, or nil if it ended with EOF. Closed is called on the
+// forwarding goroutine and should return quickly.
+type CloseHandler interface {
+	Closed(localAddr string, message string, err error)
+}
+
+// FlowCloseHandler is an extended CloseHandler that also receives the
+// connection ID, the Flow.ID a FlowEstablishHandler received and the ID
+// of the connection's events and metrics, since local addresses are
+// reused across connections. When a close handler implements
+// FlowCloseHandler, ClosedFlow is called instead of Closed.
+type FlowCloseHandler interface {
+	ClosedFlow(id string, localAddr string, message string, err error)
+}
+
+// reportClosed notifies the close handler of the end of c.
+func (t *TUN) reportClosed(localAddr string, c *activeConn, err error) {
+	if t.CloseHandler == nil {
+		return
+	}
+	msg := fmt.Sprintf("%s %s to %s closed after %d bytes up and %d bytes down", c.flow.Network,
+		sourceId(c.flow.id), addressId(c.flow.id), c.stats.up.Load(), c.stats.down.Load())
+	if fch, ok := t.CloseHandler.(FlowCloseHandler); ok {
+		fch.ClosedFlow(c.flow.ID, localAddr, msg, err)
+	} else {
+		t.CloseHandler.Closed(localAddr, msg, err)
+	}
+}
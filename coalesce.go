@@ -0,0 +1,151 @@
+package libmitm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type coalesceConfig struct {
+	delay    time.Duration
+	maxBytes int
+}
+
+// WithWriteCoalesce buffers small writes towards the upstream for up to
+// delay, or until maxBytes are pending, before flushing them with a single
+// write. Chatty protocols then cost fewer syscalls, while each small write
+// is delayed by up to delay; writes of maxBytes or more are never delayed.
+//
+// Coalescing is the inverse of TCP_NODELAY and cannot be combined with
+// WithUpstreamNoDelay(true).
+func WithWriteCoalesce(delay time.Duration, maxBytes int) Option {
+	return func(t *TUN) error {
+		if delay <= 0 || maxBytes <= 0 {
+			return errors.New("write coalescing: delay and size must be positive")
+		}
+		if t.upstreamNoDelay != nil && *t.upstreamNoDelay {
+			return errors.New("write coalescing cannot be combined with upstream TCP_NODELAY")
+		}
+		t.coalesce = coalesceConfig{delay: delay, maxBytes: maxBytes}
+		return nil
+	}
+}
+
+// WithUpstreamNoDelay sets TCP_NODELAY on upstream TCP connections. Go
+// enables it by default.
+func WithUpstreamNoDelay(v bool) Option {
+	return func(t *TUN) error {
+		if v && t.coalesce.delay > 0 {
+			return errors.New("upstream TCP_NODELAY cannot be combined with write coalescing")
+		}
+		t.upstreamNoDelay = &v
+		return nil
+	}
+}
+
+// upstreamWriter returns the writer used to copy a flow to remote and a
+// function that flushes anything still buffered. From the top, writes pass
+// the coalescer, the compressor and the rate limiter.
+func (t *TUN) upstreamWriter(network string, remote net.Conn) (io.Writer, func() error) {
+	if tc, ok := remote.(*net.TCPConn); ok && t.upstreamNoDelay != nil {
+		tc.SetNoDelay(*t.upstreamNoDelay)
+	}
+	var w io.Writer = remote
+	if t.globalRate.limiter != nil {
+		w = &rateLimitedWriter{
+			w:             w,
+			limiter:       t.globalRate.limiter,
+			split:         network == "tcp",
+			throttled:     &t.globalRate.throttled,
+			throttledTime: &t.globalRate.throttledTime,
+		}
+	}
+	if network != "tcp" {
+		return w, func() error { return nil }
+	}
+
+	flush := func() error { return nil }
+	if t.compression != nil {
+		sw := t.compression.NewWriter(w)
+		w, flush = &compressingWriter{sw: sw}, sw.Close
+	}
+	if t.coalesce.delay > 0 {
+		c := &coalescingWriter{w: w, delay: t.coalesce.delay, maxBytes: t.coalesce.maxBytes}
+		closeCompressor := flush
+		w, flush = c, func() error {
+			if err := c.Flush(); err != nil {
+				return err
+			}
+			return closeCompressor()
+		}
+	}
+	return w, flush
+}
+
+// coalescingWriter delays small writes to merge them.
+type coalescingWriter struct {
+	w        io.Writer
+	delay    time.Duration
+	maxBytes int
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	err   error
+}
+
+func (c *coalescingWriter) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.buf)+len(b) < c.maxBytes {
+		c.buf = append(c.buf, b...)
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.delay, func() {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				c.flushLocked()
+			})
+		}
+		return len(b), nil
+	}
+
+	if err := c.flushLocked(); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(b)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// Flush writes out any buffered data.
+func (c *coalescingWriter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *coalescingWriter) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.err != nil || len(c.buf) == 0 {
+		return c.err
+	}
+	// Only drop what was written, so that no byte is written twice.
+	n, err := c.w.Write(c.buf)
+	if err == nil && n < len(c.buf) {
+		err = io.ErrShortWrite
+	}
+	c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+	c.err = err
+	return err
+}
@@ -0,0 +1,91 @@
+package libmitm
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingWriter records every write, accepting at most limit bytes of
+// each if limit is positive.
+type recordingWriter struct {
+	mu     sync.Mutex
+	writes []string
+	limit  int
+	err    error
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.limit > 0 && len(b) > w.limit {
+		w.writes = append(w.writes, string(b[:w.limit]))
+		return w.limit, w.err
+	}
+	w.writes = append(w.writes, string(b))
+	return len(b), nil
+}
+
+func (w *recordingWriter) recorded() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.writes...)
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	rw := &recordingWriter{}
+	c := &coalescingWriter{w: rw, delay: 20 * time.Millisecond, maxBytes: 8}
+	for _, s := range []string{"a", "b", "c"} {
+		if n, err := c.Write([]byte(s)); n != 1 || err != nil {
+			t.Fatalf("write %q: %d, %v", s, n, err)
+		}
+	}
+	if got := rw.recorded(); len(got) != 0 {
+		t.Fatalf("small writes passed through: %q", got)
+	}
+	waitFor(t, "the delayed flush", func() bool { return len(rw.recorded()) == 1 })
+	if got := rw.recorded(); got[0] != "abc" {
+		t.Errorf("flushed %q, want %q", got[0], "abc")
+	}
+
+	// A write reaching maxBytes flushes what is buffered and passes
+	// through.
+	c.Write([]byte("de"))
+	c.Write([]byte("fghijklm"))
+	if got := rw.recorded(); len(got) != 3 || got[1] != "de" || got[2] != "fghijklm" {
+		t.Errorf("writes %q, want the buffered and the large write", got)
+	}
+	if err := c.Flush(); err != nil {
+		t.Errorf("flush: %v", err)
+	}
+}
+
+func TestCoalescingWriterPartialWrite(t *testing.T) {
+	errPartial := errors.New("partial write")
+	rw := &recordingWriter{limit: 2, err: errPartial}
+	c := &coalescingWriter{w: rw, delay: time.Hour, maxBytes: 8}
+	c.Write([]byte("abcde"))
+	if err := c.Flush(); !errors.Is(err, errPartial) {
+		t.Fatalf("flush: %v, want %v", err, errPartial)
+	}
+	// The written bytes are dropped from the buffer, the others kept.
+	if !bytes.Equal(c.buf, []byte("cde")) {
+		t.Errorf("buffered %q after a partial write, want %q", c.buf, "cde")
+	}
+	if err := c.Flush(); !errors.Is(err, errPartial) {
+		t.Errorf("flush after a failure: %v", err)
+	}
+	if got := rw.recorded(); len(got) != 1 {
+		t.Errorf("writes %q, want one", got)
+	}
+
+	// A short write without an error is an error as well.
+	rw = &recordingWriter{limit: 2}
+	c = &coalescingWriter{w: rw, delay: time.Hour, maxBytes: 8}
+	c.Write([]byte("abcde"))
+	if err := c.Flush(); err == nil {
+		t.Error("short write flushed without an error")
+	}
+}
@@ -0,0 +1,86 @@
+package libmitm
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// StreamCodec compresses the upstream direction of TCP flows and
+// decompresses the downstream direction. Every connection gets a writer
+// and a reader of its own.
+type StreamCodec interface {
+	// NewWriter returns a writer compressing to w.
+	NewWriter(w io.Writer) StreamWriter
+	// NewReader returns a reader decompressing from r.
+	NewReader(r io.Reader) io.Reader
+}
+
+// StreamWriter is a compressing writer. Flush writes out everything
+// written so far in a form the peer can decompress right away, and Close
+// additionally terminates the stream.
+type StreamWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// NewFlateCodec returns a StreamCodec using DEFLATE (RFC 1951) at the given
+// compression level, see compress/flate.
+func NewFlateCodec(level int) (StreamCodec, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return flateCodec{level: level}, nil
+}
+
+type flateCodec struct {
+	level int
+}
+
+func (c flateCodec) NewWriter(w io.Writer) StreamWriter {
+	// The level was checked by NewFlateCodec.
+	fw, _ := flate.NewWriter(w, c.level)
+	return fw
+}
+
+func (c flateCodec) NewReader(r io.Reader) io.Reader {
+	return flate.NewReader(r)
+}
+
+// WithStreamCompression compresses what TCP flows send upstream with codec
+// and decompresses what the upstream sends back. This is not transparent:
+// the upstream must speak the same codec, as the end of a site-to-site
+// tunnel does, so it is only useful with a dedicated upstream, typically
+// via WithDialer. Data is flushed after every write so that interactive
+// protocols are not delayed, and the stream is terminated properly before
+// the upstream is closed. UDP flows are not compressed.
+func WithStreamCompression(codec StreamCodec) Option {
+	return func(t *TUN) error {
+		if codec == nil {
+			return errors.New("stream codec must not be nil")
+		}
+		t.compression = codec
+		return nil
+	}
+}
+
+// compressingWriter flushes the compressor after every write.
+type compressingWriter struct {
+	sw StreamWriter
+}
+
+func (c *compressingWriter) Write(b []byte) (int, error) {
+	n, err := c.sw.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.sw.Flush()
+}
+
+// downstreamReader returns the reader for data from remote.
+func (t *TUN) downstreamReader(network string, remote io.Reader) io.Reader {
+	if network != "tcp" || t.compression == nil {
+		return remote
+	}
+	return t.compression.NewReader(remote)
+}
@@ -0,0 +1,74 @@
+package libmitm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Connection ID schemes.
+const (
+	// ConnIDCounter numbers connections from 1 in order of arrival. IDs
+	// are unique within a TUN but restart with every process.
+	ConnIDCounter = iota
+
+	// ConnIDRandom assigns random (version 4) UUIDs.
+	ConnIDRandom
+
+	// ConnIDTupleHash derives the ID from the 4-tuple and the start time
+	// of the connection, so the same input always yields the same ID.
+	// The start time adds entropy that tells reconnections of the same
+	// tuple apart; IDs are the first 64 bits of a SHA-256, so collisions
+	// between distinct connections become likely only around 2^32 IDs.
+	ConnIDTupleHash
+)
+
+type connIDConfig struct {
+	scheme  int
+	counter atomic.Uint64
+}
+
+// WithConnIDScheme selects how connection IDs are generated. The default
+// is ConnIDCounter.
+func WithConnIDScheme(scheme int) Option {
+	return func(t *TUN) error {
+		switch scheme {
+		case ConnIDCounter, ConnIDRandom, ConnIDTupleHash:
+			t.connID.scheme = scheme
+			return nil
+		default:
+			return fmt.Errorf("unknown connection ID scheme: %d", scheme)
+		}
+	}
+}
+
+func (c *connIDConfig) next(network string, id stack.TransportEndpointID, start time.Time) string {
+	switch c.scheme {
+	case ConnIDRandom:
+		var u [16]byte
+		rand.Read(u[:])
+		u[6] = u[6]&0x0f | 0x40
+		u[8] = u[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+	case ConnIDTupleHash:
+		h := sha256.New()
+		h.Write([]byte(network))
+		h.Write([]byte(id.RemoteAddress))
+		h.Write([]byte(id.LocalAddress))
+		var b [12]byte
+		binary.BigEndian.PutUint16(b[0:], id.RemotePort)
+		binary.BigEndian.PutUint16(b[2:], id.LocalPort)
+		binary.BigEndian.PutUint64(b[4:], uint64(start.UnixNano()))
+		h.Write(b[:])
+		return hex.EncodeToString(h.Sum(nil)[:8])
+	default:
+		return strconv.FormatUint(c.counter.Add(1), 10)
+	}
+}
@@ -0,0 +1,107 @@
+package libmitm
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// idRecorder records the connection ID each handler receives, keyed by
+// the client address of the connection.
+type idRecorder struct {
+	mu                          sync.Mutex
+	established, closed, metric map[string]string
+	// sources maps the local address of upstreams to the client address,
+	// which close handlers do not get.
+	sources map[string]string
+}
+
+func newIDRecorder() *idRecorder {
+	return &idRecorder{
+		established: make(map[string]string),
+		closed:      make(map[string]string),
+		metric:      make(map[string]string),
+		sources:     make(map[string]string),
+	}
+}
+
+func (r *idRecorder) put(m map[string]string, source, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m[source] = id
+}
+
+func (r *idRecorder) Handle(localAddr, originalRemoteIp string) {}
+
+func (r *idRecorder) HandleFlow(localAddr string, flow *Flow) {
+	source := net.JoinHostPort(flow.Source, strconv.Itoa(flow.SourcePort))
+	r.put(r.established, source, flow.ID)
+	r.put(r.sources, localAddr, source)
+}
+
+func (r *idRecorder) Closed(localAddr, message string, err error) {}
+
+func (r *idRecorder) ClosedFlow(id, localAddr, message string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed[r.sources[localAddr]] = id
+}
+
+func (r *idRecorder) ConnectionClosed(stats *ConnStats) {
+	r.put(r.metric, stats.Source, stats.ID)
+}
+
+func (r *idRecorder) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.metric)
+}
+
+// TestConnIDs checks that every handler gets the same ID for a flow, and
+// that IDs differ across flows, with each scheme.
+func TestConnIDs(t *testing.T) {
+	const flows = 5
+	upstream := echoServer(t)
+	for _, scheme := range []int{ConnIDCounter, ConnIDRandom, ConnIDTupleHash} {
+		r := newIDRecorder()
+		c := startTestTUN(t,
+			withRedirectors(FixedRedirector(upstream), nil),
+			WithConnIDScheme(scheme),
+			func(t *TUN) error {
+				t.TcpEstablishHandler, t.CloseHandler, t.MetricsHandler = r, r, r
+				return nil
+			},
+		)
+		for i := 0; i < flows; i++ {
+			conn, err := c.dialTCP(t, testRemote(80))
+			if err != nil {
+				t.Fatalf("scheme %d: dial: %v", scheme, err)
+			}
+			roundTrip(t, conn, "flow")
+			conn.Close()
+		}
+		waitFor(t, "the flows to close", func() bool { return r.len() == flows })
+
+		r.mu.Lock()
+		seen := make(map[string]bool)
+		for source, id := range r.established {
+			if seen[id] {
+				t.Errorf("scheme %d: id %s reused", scheme, id)
+			}
+			seen[id] = true
+			if r.closed[source] != id || r.metric[source] != id {
+				t.Errorf("scheme %d: flow from %s established as %s, closed as %s, measured as %s",
+					scheme, source, id, r.closed[source], r.metric[source])
+			}
+		}
+		if len(seen) != flows {
+			t.Errorf("scheme %d: %d flows established, want %d", scheme, len(seen), flows)
+		}
+		r.mu.Unlock()
+	}
+
+	if err := (&TUN{}).Apply(WithConnIDScheme(ConnIDTupleHash + 1)); err == nil {
+		t.Error("accepted an unknown scheme")
+	}
+}
@@ -0,0 +1,53 @@
+package libmitm
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type connLimit struct {
+	max int64
+
+	inFlight atomic.Int64
+}
+
+// WithMaxConnections refuses new connections while n connections are
+// being forwarded, so that a burst of connections cannot exhaust the
+// goroutines and file descriptors of the process. TCP connections are
+// refused with a RST and the first datagram of a UDP flow is dropped;
+// both are reported as EventConnectionLimit. Connections are admitted
+// again as soon as others close.
+func WithMaxConnections(n int) Option {
+	return func(t *TUN) error {
+		if n <= 0 {
+			return errors.New("connection limit must be positive")
+		}
+		t.connLimit.max = int64(n)
+		return nil
+	}
+}
+
+// ConnectionsInFlight returns the number of connections being forwarded,
+// if WithMaxConnections is set.
+func (t *TUN) ConnectionsInFlight() int64 {
+	return t.connLimit.inFlight.Load()
+}
+
+// acquireConn admits a new connection over network with the given ID. It
+// returns false, reporting the rejection, if the limit is reached, and
+// otherwise a function releasing the connection's slot.
+func (t *TUN) acquireConn(network string, id stack.TransportEndpointID) (func(), bool) {
+	if t.connLimit.max <= 0 {
+		return func() {}, true
+	}
+	if t.connLimit.inFlight.Add(1) > t.connLimit.max {
+		t.connLimit.inFlight.Add(-1)
+		t.emit(newEvent(EventConnectionLimit, t.newFlow(network, id), "connection limit reached"))
+		return nil, false
+	}
+	return func() {
+		t.connLimit.inFlight.Add(-1)
+	}, true
+}
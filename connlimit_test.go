@@ -0,0 +1,52 @@
+package libmitm
+
+import (
+	"net"
+	"testing"
+)
+
+// TestMaxConnections checks that a connection over the limit is refused
+// until one of the connections in flight closes.
+func TestMaxConnections(t *testing.T) {
+	events := make(chan *Event, 16)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(echoServer(t)), nil),
+		WithMaxConnections(2),
+		withEventChannel(events),
+	)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := c.dialTCP(t, testRemote(80))
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		defer conn.Close()
+		roundTrip(t, conn, "within the limit")
+		conns = append(conns, conn)
+	}
+	if n := c.tun.ConnectionsInFlight(); n != 2 {
+		t.Errorf("%d connections in flight, want 2", n)
+	}
+
+	if conn, err := c.dialTCP(t, testRemote(80)); err == nil {
+		conn.Close()
+		t.Fatal("connected over the limit")
+	}
+	waitForEvent(t, events, EventConnectionLimit)
+
+	conns[0].Close()
+	waitFor(t, "the closed connection to free its slot", func() bool {
+		return c.tun.ConnectionsInFlight() == 1
+	})
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial after a connection closed: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "admitted again")
+
+	if err := (&TUN{}).Apply(WithMaxConnections(0)); err == nil {
+		t.Error("accepted a limit of 0")
+	}
+}
@@ -0,0 +1,77 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type connRateLimit struct {
+	tcp *rate.Limiter
+	udp *rate.Limiter
+
+	rejected atomic.Int64
+}
+
+// WithConnectionRateLimit limits how fast new connections are forwarded
+// to rps per second, with bursts of up to burst connections, so that a
+// burst of flows does not hammer the upstream proxy. TCP and UDP flows
+// draw from one shared token bucket. Connections over the limit are
+// refused rather than delayed: TCP connections with a RST and UDP flows
+// by dropping their first datagram, both reported as EventConnectionLimit.
+func WithConnectionRateLimit(rps, burst int) Option {
+	return func(t *TUN) error {
+		if rps <= 0 || burst <= 0 {
+			return errors.New("connection rate and burst must be positive")
+		}
+		l := rate.NewLimiter(rate.Limit(rps), burst)
+		t.connRate.tcp, t.connRate.udp = l, l
+		return nil
+	}
+}
+
+// WithNetworkConnectionRateLimit is like WithConnectionRateLimit, but
+// limits only the connections over network, "tcp" or "udp", with a token
+// bucket of their own. Set after WithConnectionRateLimit, it replaces the
+// shared limit for that network.
+func WithNetworkConnectionRateLimit(network string, rps, burst int) Option {
+	return func(t *TUN) error {
+		if rps <= 0 || burst <= 0 {
+			return errors.New("connection rate and burst must be positive")
+		}
+		l := rate.NewLimiter(rate.Limit(rps), burst)
+		switch network {
+		case "tcp":
+			t.connRate.tcp = l
+		case "udp":
+			t.connRate.udp = l
+		default:
+			return fmt.Errorf("unknown network %q", network)
+		}
+		return nil
+	}
+}
+
+// ConnectionsRateLimited returns the number of connections refused by the
+// connection rate limits.
+func (t *TUN) ConnectionsRateLimited() int64 {
+	return t.connRate.rejected.Load()
+}
+
+// allowConnRate reports whether a new connection over network with the
+// given ID is within the rate limit, reporting the rejection if not.
+func (t *TUN) allowConnRate(network string, id stack.TransportEndpointID) bool {
+	l := t.connRate.tcp
+	if network == "udp" {
+		l = t.connRate.udp
+	}
+	if l == nil || l.Allow() {
+		return true
+	}
+	t.connRate.rejected.Add(1)
+	t.emit(newEvent(EventConnectionLimit, t.newFlow(network, id), "connection rate limit reached"))
+	return false
+}
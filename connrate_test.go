@@ -0,0 +1,49 @@
+package libmitm
+
+import (
+	"testing"
+	"time"
+)
+
+// TestConnectionRateLimit checks that TCP and UDP flows over the shared
+// rate are refused and that a connection is admitted again once the
+// bucket refills.
+func TestConnectionRateLimit(t *testing.T) {
+	events := make(chan *Event, 16)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(echoServer(t)), FixedRedirector(udpEchoServer(t))),
+		WithConnectionRateLimit(1, 2),
+		withEventChannel(events),
+	)
+
+	for i := 0; i < 2; i++ {
+		conn, err := c.dialTCP(t, testRemote(80))
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		defer conn.Close()
+		roundTrip(t, conn, "within the burst")
+	}
+	if conn, err := c.dialTCP(t, testRemote(80)); err == nil {
+		conn.Close()
+		t.Fatal("connected over the rate")
+	}
+	waitForEvent(t, events, EventConnectionLimit)
+
+	udp := c.dialUDP(t, testRemote(53))
+	if _, err := udp.Write([]byte("over the rate")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, events, EventConnectionLimit)
+	if n := c.tun.ConnectionsRateLimited(); n != 2 {
+		t.Errorf("%d connections rate limited, want 2", n)
+	}
+
+	time.Sleep(time.Second)
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial after the bucket refilled: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "admitted again")
+}
@@ -0,0 +1,161 @@
+package libmitm
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// activeConn is a forwarded connection with an established upstream.
+type activeConn struct {
+	flow   *Flow
+	local  net.Conn
+	remote net.Conn
+	stats  *flowStats
+
+	closing atomic.Bool
+	export  flowExportState
+}
+
+// connRegistry tracks active connections by ID.
+type connRegistry struct {
+	mu    sync.RWMutex
+	conns map[string]*activeConn
+}
+
+func (r *connRegistry) add(c *activeConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[string]*activeConn)
+	}
+	r.conns[c.flow.ID] = c
+}
+
+func (r *connRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+func (r *connRegistry) get(id string) *activeConn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.conns[id]
+}
+
+// each calls fn for every connection. fn must not add or remove
+// connections.
+func (r *connRegistry) each(fn func(c *activeConn)) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, c := range r.conns {
+		fn(c)
+	}
+}
+
+// ConnInfo describes an active forwarded connection.
+type ConnInfo struct {
+	// ID is the connection ID, see WithConnIDScheme.
+	ID string
+	// Network is "tcp" or "udp".
+	Network         string
+	Source          string
+	SourcePort      int
+	Destination     string
+	DestinationPort int
+	// Upstream is the remote address of the upstream connection, or the
+	// address it was dialed at if the dialer's connection does not report
+	// one.
+	Upstream string
+	// UpBytes counts the bytes from the client to the upstream so far,
+	// DownBytes the bytes back.
+	UpBytes   int64
+	DownBytes int64
+	// StartTime is when the upstream was established, in milliseconds
+	// since the Unix epoch.
+	StartTime int64
+}
+
+// ActiveConnections returns the connections being forwarded with an
+// established upstream, in no particular order.
+func (t *TUN) ActiveConnections() []ConnInfo {
+	var infos []ConnInfo
+	t.conns.each(func(c *activeConn) {
+		info := ConnInfo{
+			ID:              c.flow.ID,
+			Network:         c.flow.Network,
+			Source:          c.flow.Source,
+			SourcePort:      c.flow.SourcePort,
+			Destination:     c.flow.Destination,
+			DestinationPort: c.flow.DestinationPort,
+			Upstream:        c.flow.upstream,
+			UpBytes:         int64(c.stats.up.Load()),
+			DownBytes:       int64(c.stats.down.Load()),
+			StartTime:       c.stats.start.UnixMilli(),
+		}
+		if addr := c.remote.RemoteAddr(); addr != nil {
+			info.Upstream = addr.String()
+		}
+		infos = append(infos, info)
+	})
+	return infos
+}
+
+// CloseConnection gracefully closes both sides of the connection with the
+// given ID. It reports whether the connection was found.
+func (t *TUN) CloseConnection(id string) bool {
+	c := t.conns.get(id)
+	if c == nil {
+		return false
+	}
+	if c.closing.CompareAndSwap(false, true) {
+		c.local.Close()
+		c.remote.Close()
+	}
+	return true
+}
+
+// ResetConnection aborts the connection with the given ID: a TCP client
+// receives a RST instead of a FIN and unsent data on both sides is
+// discarded, which breaks stuck transfers without waiting for buffers to
+// drain. UDP connections are simply closed. An EventConnectionReset is
+// reported. It reports whether the connection was found; resetting a
+// connection that is already closing does nothing.
+func (t *TUN) ResetConnection(id string) bool {
+	c := t.conns.get(id)
+	if c == nil {
+		return false
+	}
+	if !c.closing.CompareAndSwap(false, true) {
+		return true
+	}
+
+	if c.flow.ep != nil {
+		c.flow.ep.SocketOptions().SetLinger(tcpip.LingerOption{Enabled: true, Timeout: 0})
+	}
+	if tc, ok := c.remote.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.local.Close()
+	c.remote.Close()
+
+	t.emit(newEvent(EventConnectionReset, c.flow, "connection reset on request"))
+	return true
+}
+
+// emitClosed reports the end of c with its counters.
+func (t *TUN) emitClosed(c *activeConn) {
+	if t.EventHandler == nil {
+		return
+	}
+	e := newEvent(EventConnectionClosed, c.flow, "connection closed")
+	e.Duration = durationMillis(time.Since(c.stats.start))
+	up, down := c.stats.packets()
+	e.UpBytes, e.DownBytes = int64(c.stats.up.Load()), int64(c.stats.down.Load())
+	e.UpPackets, e.DownPackets = int64(up), int64(down)
+	t.emit(e)
+}
@@ -0,0 +1,59 @@
+package libmitm
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestActiveConnections checks that open connections are listed with
+// their tuples and counters, and leave the list once closed.
+func TestActiveConnections(t *testing.T) {
+	upstream := echoServer(t)
+	c := startTestTUN(t, withRedirectors(FixedRedirector(upstream), nil))
+	start := time.Now().UnixMilli()
+
+	conns := make(map[int]net.Conn)
+	for _, port := range []int{80, 443} {
+		conn, err := c.dialTCP(t, testRemote(port))
+		if err != nil {
+			t.Fatalf("dial %d: %v", port, err)
+		}
+		defer conn.Close()
+		roundTrip(t, conn, "port "+strconv.Itoa(port))
+		conns[port] = conn
+	}
+
+	infos := c.tun.ActiveConnections()
+	if len(infos) != 2 {
+		t.Fatalf("%d active connections, want 2", len(infos))
+	}
+	for _, info := range infos {
+		conn, ok := conns[info.DestinationPort]
+		if !ok {
+			t.Fatalf("listed a connection to port %d", info.DestinationPort)
+		}
+		msg := len("port " + strconv.Itoa(info.DestinationPort))
+		if got, want := net.JoinHostPort(info.Source, strconv.Itoa(info.SourcePort)), conn.LocalAddr().String(); got != want {
+			t.Errorf("port %d: source %s, want %s", info.DestinationPort, got, want)
+		}
+		if info.Network != "tcp" || info.Destination != testRemoteAddr || info.Upstream != upstream {
+			t.Errorf("port %d: %s to %s through %s", info.DestinationPort, info.Network, info.Destination, info.Upstream)
+		}
+		if info.UpBytes != int64(msg) || info.DownBytes != int64(msg) {
+			t.Errorf("port %d: %d bytes up and %d down, want %d each", info.DestinationPort, info.UpBytes, info.DownBytes, msg)
+		}
+		if info.StartTime < start || info.StartTime > time.Now().UnixMilli() {
+			t.Errorf("port %d: started at %d, not during the test", info.DestinationPort, info.StartTime)
+		}
+	}
+
+	conns[80].Close()
+	waitFor(t, "the closed connection to leave the list", func() bool {
+		return len(c.tun.ActiveConnections()) == 1
+	})
+	if info := c.tun.ActiveConnections()[0]; info.DestinationPort != 443 {
+		t.Errorf("the connection to port %d remained", info.DestinationPort)
+	}
+}
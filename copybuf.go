@@ -0,0 +1,67 @@
+package libmitm
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// defaultCopyBufferSize is the size of the buffers connections are copied
+// with unless WithCopyBufferSize is given, that of io.Copy.
+const defaultCopyBufferSize = 32 << 10
+
+type copyBuffers struct {
+	size int
+	pool sync.Pool
+}
+
+// WithCopyBufferSize sets the size of the buffers each direction of a
+// connection is copied with, 32 KiB by default. The buffers are pooled
+// across connections. A size below the MTU is raised to it, so that a
+// datagram of the TUN always fits.
+func WithCopyBufferSize(n int) Option {
+	return func(t *TUN) error {
+		if n <= 0 {
+			return errors.New("copy buffer size must be positive")
+		}
+		t.copyBuffers.size = n
+		return nil
+	}
+}
+
+// init sets the buffer size for a TUN of the given MTU.
+func (c *copyBuffers) init(mtu int) {
+	if c.size == 0 {
+		c.size = defaultCopyBufferSize
+	}
+	if c.size < mtu {
+		c.size = mtu
+	}
+	size := c.size
+	c.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+}
+
+// copy copies from src to dst like io.Copy, with a pooled buffer that is
+// returned once the copy, and with it every write of the buffer, is done.
+// The ReadFrom and WriteTo methods dst and src may have are hidden, since
+// io.CopyBuffer would use them instead of the buffer, and e.g. the
+// ReadFrom of a *net.TCPConn falls back to io.Copy for sources it cannot
+// splice from.
+func (c *copyBuffers) copy(dst io.Writer, src io.Reader) (int64, error) {
+	b := c.pool.Get().(*[]byte)
+	defer c.pool.Put(b)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *b)
+}
+
+// writerOnly hides every method of a Writer but Write.
+type writerOnly struct {
+	io.Writer
+}
+
+// readerOnly hides every method of a Reader but Read.
+type readerOnly struct {
+	io.Reader
+}
@@ -0,0 +1,82 @@
+package libmitm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readerFromWriter is a writer whose ReadFrom must not be used.
+type readerFromWriter struct {
+	t *testing.T
+	bytes.Buffer
+}
+
+func (w *readerFromWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.t.Error("copy used ReadFrom instead of the pooled buffer")
+	return w.Buffer.ReadFrom(r)
+}
+
+func TestCopyBuffersBypass(t *testing.T) {
+	var c copyBuffers
+	c.init(testMTU)
+	dst := &readerFromWriter{t: t}
+	// A strings.Reader has a WriteTo method as well.
+	n, err := c.copy(dst, strings.NewReader("pooled"))
+	if err != nil || n != 6 || dst.String() != "pooled" {
+		t.Errorf("copied %d bytes %q, %v", n, dst.String(), err)
+	}
+}
+
+// TestCopyLargePayload moves a multi-megabyte payload through the TUN and
+// back with small copy buffers.
+func TestCopyLargePayload(t *testing.T) {
+	upstream := echoServer(t)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithCopyBufferSize(4096),
+	)
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	payload := make([]byte, 4<<20)
+	rand.Read(payload)
+	go conn.Write(payload)
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("payload corrupted")
+	}
+}
+
+// sink is a writer without a ReadFrom method.
+type sink struct{}
+
+func (sink) Write(b []byte) (int, error) { return len(b), nil }
+
+// BenchmarkCopy compares the allocations of copying a connection with a
+// pooled buffer to io.Copy, which allocates a buffer per copy.
+func BenchmarkCopy(b *testing.B) {
+	payload := make([]byte, 64<<10)
+	b.Run("pooled", func(b *testing.B) {
+		var c copyBuffers
+		c.init(testMTU)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c.copy(sink{}, bytes.NewReader(payload))
+		}
+	})
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.Copy(sink{}, readerOnly{bytes.NewReader(payload)})
+		}
+	})
+}
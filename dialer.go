@@ -0,0 +1,65 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Dialer establishes the upstream side of a forwarded connection.
+// *net.Dialer satisfies this interface.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// WithDialer sets the dialer used for upstream connections. By default a
+// zero net.Dialer is used.
+func WithDialer(d Dialer) Option {
+	return func(t *TUN) error {
+		t.dialer = d
+		return nil
+	}
+}
+
+type flowAddrsKey struct{}
+
+// flowAddrs holds the addresses of an intercepted flow as seen by the
+// client.
+type flowAddrs struct {
+	src net.Addr
+	dst net.Addr
+}
+
+// withFlowAddrs returns a child context carrying the original addresses
+// of the flow identified by id.
+func withFlowAddrs(ctx context.Context, network string, id stack.TransportEndpointID) context.Context {
+	return context.WithValue(ctx, flowAddrsKey{}, flowAddrs{
+		src: netAddr(network, id.RemoteAddress, id.RemotePort),
+		dst: netAddr(network, id.LocalAddress, id.LocalPort),
+	})
+}
+
+// OriginalSource returns the client address of the flow being dialed, if
+// ctx was passed to Dialer.DialContext by the forwarder.
+func OriginalSource(ctx context.Context) (net.Addr, bool) {
+	a, ok := ctx.Value(flowAddrsKey{}).(flowAddrs)
+	return a.src, ok
+}
+
+// OriginalDestination returns the destination the client originally
+// addressed, if ctx was passed to Dialer.DialContext by the forwarder.
+// It is unaffected by redirection.
+func OriginalDestination(ctx context.Context) (net.Addr, bool) {
+	a, ok := ctx.Value(flowAddrsKey{}).(flowAddrs)
+	return a.dst, ok
+}
+
+func netAddr(network string, addr tcpip.Address, port uint16) net.Addr {
+	ip := net.IP([]byte(addr))
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip, Port: int(port)}
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
@@ -0,0 +1,84 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type dialRetry struct {
+	attempts int
+	backoff  time.Duration
+
+	retries atomic.Int64
+}
+
+// WithDialRetry dials the upstream of a flow up to attempts times in all
+// when a dial fails transiently, i.e. times out, fails a DNS lookup
+// temporarily, or finds the network or host unreachable or the
+// connection reset. Refused connections and upstreams refused by this
+// package's own policies are not retried. Retries wait backoff, doubled
+// after each retry, and all attempts together stay within the establish
+// timeout. Meanwhile a TCP client sees an established connection whose
+// data is buffered, and the first datagram of a UDP flow waits to be
+// read. Retries are counted by DialRetries.
+func WithDialRetry(attempts int, backoff time.Duration) Option {
+	return func(t *TUN) error {
+		if attempts < 1 || backoff < 0 {
+			return errors.New("dial attempts must be positive and backoff must not be negative")
+		}
+		t.dialRetry.attempts = attempts
+		t.dialRetry.backoff = backoff
+		return nil
+	}
+}
+
+// DialRetries returns the number of upstream dials retried after a
+// transient failure.
+func (t *TUN) DialRetries() int64 {
+	return t.dialRetry.retries.Load()
+}
+
+// dialWithRetry dials the upstream of flow as decided, retrying
+// transient failures as configured by WithDialRetry.
+func (t *TUN) dialWithRetry(ctx context.Context, flow *Flow, decision Decision, dialer Dialer) (net.Conn, error) {
+	backoff := t.dialRetry.backoff
+	for attempt := 1; ; attempt++ {
+		conn, err := t.dialDecision(ctx, flow, decision, dialer)
+		if err == nil || attempt >= t.dialRetry.attempts || ctx.Err() != nil || !isTransientDialError(err) {
+			return conn, err
+		}
+		t.log().Debugf("dial %s failed transiently, retrying in %s: %v", decision.Address, backoff, err)
+		t.dialRetry.retries.Add(1)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w (retry canceled: %v)", err, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// isTransientDialError reports whether a dial that failed with err may
+// succeed when retried.
+func isTransientDialError(err error) bool {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errMaintenance), errors.Is(err, errACLDenied), errors.Is(err, errCircuitOpen):
+		return false
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyDialer fails its first dials, as many as failures, with err, and
+// dials for real afterwards. It counts every dial.
+type flakyDialer struct {
+	failures int32
+	err      error
+	dials    atomic.Int32
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.dials.Add(1) <= d.failures {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", d.err)}
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+// TestDialRetry checks that TCP and UDP flows connect after transient dial
+// failures.
+func TestDialRetry(t *testing.T) {
+	tcpUpstream, udpUpstream := echoServer(t), udpEchoServer(t)
+	d := &flakyDialer{failures: 2, err: syscall.ENETUNREACH}
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(tcpUpstream), FixedRedirector(udpUpstream)),
+		WithDialer(d),
+		WithDialRetry(3, 10*time.Millisecond),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "after retrying")
+	if n := c.tun.DialRetries(); n != 2 {
+		t.Errorf("%d tcp retries, want 2", n)
+	}
+
+	d.dials.Store(0)
+	roundTrip(t, c.dialUDP(t, testRemote(5000)), "first datagram")
+	if n := c.tun.DialRetries(); n != 4 {
+		t.Errorf("%d retries after the udp flow, want 4", n)
+	}
+}
+
+// TestDialRetryRefused checks that a refused dial is not retried.
+func TestDialRetryRefused(t *testing.T) {
+	d := &flakyDialer{failures: 1, err: syscall.ECONNREFUSED}
+	var l captureLogger
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(echoServer(t)), nil),
+		WithDialer(d),
+		WithDialRetry(3, 10*time.Millisecond),
+		WithLogger(&l),
+	)
+
+	if conn, err := c.dialTCP(t, testRemote(80)); err == nil {
+		conn.Close()
+	}
+	waitFor(t, "the dial error", func() bool { return len(l.errors()) > 0 })
+	if n := d.dials.Load(); n != 1 || c.tun.DialRetries() != 0 {
+		t.Errorf("refused dial attempted %d times with %d retries", n, c.tun.DialRetries())
+	}
+}
+
+func TestIsTransientDialError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNRESET)}, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, true},
+		{&net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{&net.OpError{Op: "dial", Err: context.DeadlineExceeded}, true},
+		{fmt.Errorf("dial: %w", errACLDenied), false},
+		{errors.New("unknown"), false},
+	} {
+		if got := isTransientDialError(tc.err); got != tc.want {
+			t.Errorf("%v: transient %v, want %v", tc.err, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		attempts int
+		backoff  time.Duration
+	}{{0, time.Second}, {3, -time.Second}} {
+		if err := (&TUN{}).Apply(WithDialRetry(tc.attempts, tc.backoff)); err == nil {
+			t.Errorf("accepted %d attempts with backoff %s", tc.attempts, tc.backoff)
+		}
+	}
+}
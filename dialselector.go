@@ -0,0 +1,38 @@
+package libmitm
+
+import "errors"
+
+// DialerSelector chooses the dialer of an upstream by its network and
+// final address, e.g. to send some destinations direct and others through
+// a proxy. A nil result selects the TUN's dialer.
+type DialerSelector func(network, addr string) Dialer
+
+// WithDialerSelector consults fn for the dialer of every upstream after
+// redirection, so it sees the address actually dialed: the redirector's
+// choice, a weighted target, or a domain from WithFakeIP. Combined with
+// Flow.SNI or Flow.Host in a redirector, this routes by domain. A
+// Decision.Dialers chain takes precedence over fn.
+func WithDialerSelector(fn DialerSelector) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("dialer selector must not be nil")
+		}
+		t.dialerSelector = fn
+		return nil
+	}
+}
+
+// dialersFor returns the dialers to dial address with for flow: those of
+// its decision if any, and otherwise the one selected, falling back to
+// dialer.
+func (t *TUN) dialersFor(flow *Flow, address string, decided []Dialer, dialer Dialer) []Dialer {
+	if len(decided) > 0 {
+		return decided
+	}
+	if t.dialerSelector != nil {
+		if d := t.dialerSelector(flow.upstreamNetwork(), address); d != nil {
+			return []Dialer{d}
+		}
+	}
+	return []Dialer{dialer}
+}
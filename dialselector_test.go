@@ -0,0 +1,56 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// TestDialerSelector checks that flows to each selected network are dialed
+// with its dialer and other flows with the TUN's.
+func TestDialerSelector(t *testing.T) {
+	upstream := echoServer(t)
+	dialed := make(chan string, 8)
+	recording := func(name string) Dialer {
+		return dialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- name + " " + address
+			var d net.Dialer
+			return d.DialContext(ctx, network, upstream)
+		})
+	}
+	direct, proxy := recording("direct"), recording("proxy")
+	_, directNet, _ := net.ParseCIDR("198.51.100.0/24")
+	_, proxyNet, _ := net.ParseCIDR("203.0.113.0/24")
+	c := startTestTUN(t,
+		WithDialer(recording("default")),
+		WithDialerSelector(func(network, addr string) Dialer {
+			host, _, _ := net.SplitHostPort(addr)
+			ip := net.ParseIP(host)
+			switch {
+			case directNet.Contains(ip):
+				return direct
+			case proxyNet.Contains(ip):
+				return proxy
+			}
+			return nil
+		}),
+	)
+
+	for _, tc := range []struct {
+		addr, want string
+	}{
+		{"198.51.100.7:80", "direct 198.51.100.7:80"},
+		{"203.0.113.9:443", "proxy 203.0.113.9:443"},
+		{"192.0.2.1:80", "default 192.0.2.1:80"},
+	} {
+		conn, err := c.dialTCP(t, tc.addr)
+		if err != nil {
+			t.Fatalf("dial %s: %v", tc.addr, err)
+		}
+		roundTrip(t, conn, "hello")
+		conn.Close()
+		if got := <-dialed; got != tc.want {
+			t.Errorf("dialed %q, want %q", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS record types with a special meaning to the codec below.
+const (
+	DNSTypeA     = 1
+	DNSTypeNS    = 2
+	DNSTypeCNAME = 5
+	DNSTypeSOA   = 6
+	DNSTypePTR   = 12
+	DNSTypeMX    = 15
+	DNSTypeAAAA  = 28
+	DNSTypeSRV   = 33
+	DNSTypeOPT   = 41
+)
+
+const dnsHeaderLen = 12
+
+var errDNSMalformed = errors.New("malformed dns message")
+
+// DNSQuestion is an entry of the question section of a DNS message.
+type DNSQuestion struct {
+	// Name is the queried name in dotted form with a trailing dot.
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// DNSRecord is a resource record of a DNS message. Domain names inside
+// Data are stored uncompressed for the record types defined above, so
+// records can be moved between messages freely.
+type DNSRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// DNSMessage is a decoded DNS message. The section counts of the header
+// are not stored; they follow from the slices when the message is encoded.
+type DNSMessage struct {
+	ID uint16
+	// Flags holds the second 16 bits of the header: QR, opcode, AA, TC,
+	// RD, RA, Z, AD, CD and RCODE.
+	Flags      uint16
+	Questions  []DNSQuestion
+	Answers    []DNSRecord
+	Authority  []DNSRecord
+	Additional []DNSRecord
+}
+
+// IP returns the address of an A or AAAA record, or nil.
+func (r *DNSRecord) IP() net.IP {
+	switch {
+	case r.Type == DNSTypeA && len(r.Data) == net.IPv4len,
+		r.Type == DNSTypeAAAA && len(r.Data) == net.IPv6len:
+		return net.IP(r.Data)
+	}
+	return nil
+}
+
+// Target returns the domain name of a CNAME, NS or PTR record, or "".
+func (r *DNSRecord) Target() string {
+	switch r.Type {
+	case DNSTypeCNAME, DNSTypeNS, DNSTypePTR:
+		name, _, err := readDNSName(r.Data, 0)
+		if err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// NewDNSAddressRecord returns an A or AAAA record, depending on ip, for
+// name.
+func NewDNSAddressRecord(name string, ttl uint32, ip net.IP) DNSRecord {
+	r := DNSRecord{Name: name, Class: 1, TTL: ttl}
+	if ip4 := ip.To4(); ip4 != nil {
+		r.Type, r.Data = DNSTypeA, append([]byte(nil), ip4...)
+	} else {
+		r.Type, r.Data = DNSTypeAAAA, append([]byte(nil), ip.To16()...)
+	}
+	return r
+}
+
+// NewDNSNameRecord returns a CNAME, NS or PTR record, as given by typ,
+// pointing name at target.
+func NewDNSNameRecord(name string, typ uint16, ttl uint32, target string) DNSRecord {
+	return DNSRecord{Name: name, Type: typ, Class: 1, TTL: ttl, Data: appendDNSName(nil, target)}
+}
+
+// parseDNSMessage decodes the DNS message b.
+func parseDNSMessage(b []byte) (*DNSMessage, error) {
+	if len(b) < dnsHeaderLen {
+		return nil, errDNSMalformed
+	}
+	m := &DNSMessage{
+		ID:    binary.BigEndian.Uint16(b[0:]),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	off := dnsHeaderLen
+	for i := binary.BigEndian.Uint16(b[4:]); i > 0; i-- {
+		name, next, err := readDNSName(b, off)
+		if err != nil || next+4 > len(b) {
+			return nil, errDNSMalformed
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	for s, section := range []*[]DNSRecord{&m.Answers, &m.Authority, &m.Additional} {
+		for i := binary.BigEndian.Uint16(b[6+2*s:]); i > 0; i-- {
+			r, next, err := readDNSRecord(b, off)
+			if err != nil {
+				return nil, err
+			}
+			*section = append(*section, r)
+			off = next
+		}
+	}
+	return m, nil
+}
+
+func readDNSRecord(b []byte, off int) (DNSRecord, int, error) {
+	name, off, err := readDNSName(b, off)
+	if err != nil || off+10 > len(b) {
+		return DNSRecord{}, 0, errDNSMalformed
+	}
+	r := DNSRecord{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(b[off:]),
+		Class: binary.BigEndian.Uint16(b[off+2:]),
+		TTL:   binary.BigEndian.Uint32(b[off+4:]),
+	}
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if off+n > len(b) {
+		return DNSRecord{}, 0, errDNSMalformed
+	}
+	if r.Data, err = expandDNSData(b, off, n, r.Type); err != nil {
+		return DNSRecord{}, 0, err
+	}
+	return r, off + n, nil
+}
+
+// expandDNSData returns the n bytes of RDATA at b[off:] with any
+// compressed names of the known record types expanded.
+func expandDNSData(b []byte, off, n int, typ uint16) ([]byte, error) {
+	var fixed, names, trailer int
+	switch typ {
+	case DNSTypeNS, DNSTypeCNAME, DNSTypePTR:
+		names = 1
+	case DNSTypeMX:
+		fixed, names = 2, 1
+	case DNSTypeSRV:
+		fixed, names = 6, 1
+	case DNSTypeSOA:
+		names, trailer = 2, 20
+	default:
+		return append([]byte(nil), b[off:off+n]...), nil
+	}
+
+	end := off + n
+	if off+fixed > end {
+		return nil, errDNSMalformed
+	}
+	data := append([]byte(nil), b[off:off+fixed]...)
+	off += fixed
+	for ; names > 0; names-- {
+		name, next, err := readDNSName(b, off)
+		if err != nil || next > end {
+			return nil, errDNSMalformed
+		}
+		data = appendDNSName(data, name)
+		off = next
+	}
+	if off+trailer != end {
+		return nil, errDNSMalformed
+	}
+	return append(data, b[off:end]...), nil
+}
+
+// readDNSName reads the possibly compressed domain name at b[off:] and
+// returns it with the offset following it.
+func readDNSName(b []byte, off int) (string, int, error) {
+	var name strings.Builder
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errDNSMalformed
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			if name.Len() == 0 {
+				return ".", next, nil
+			}
+			return name.String(), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errDNSMalformed
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case l&0xc0 != 0 || off+1+l > len(b):
+			return "", 0, errDNSMalformed
+		default:
+			name.Write(b[off+1 : off+1+l])
+			name.WriteByte('.')
+			off += 1 + l
+		}
+	}
+}
+
+// appendDNSName appends name uncompressed in wire format.
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// pack encodes m without name compression, recomputing the section counts.
+// Records from the end of the message are left out to keep it within
+// limit bytes, setting the TC flag, as for any truncated UDP response.
+func (m *DNSMessage) pack(limit int) []byte {
+	b := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	for _, q := range m.Questions {
+		b = appendDNSName(b, q.Name)
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+
+	flags := m.Flags
+	for s, section := range [][]DNSRecord{m.Answers, m.Authority, m.Additional} {
+		count := 0
+		for _, r := range section {
+			before := len(b)
+			b = appendDNSName(b, r.Name)
+			b = binary.BigEndian.AppendUint16(b, r.Type)
+			b = binary.BigEndian.AppendUint16(b, r.Class)
+			b = binary.BigEndian.AppendUint32(b, r.TTL)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+			b = append(b, r.Data...)
+			if len(b) > limit {
+				b = b[:before]
+				flags |= 0x0200 // TC
+				break
+			}
+			count++
+		}
+		binary.BigEndian.PutUint16(b[6+2*s:], uint16(count))
+		if flags&0x0200 != 0 && count < len(section) {
+			break
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:], flags)
+	return b
+}
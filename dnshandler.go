@@ -0,0 +1,141 @@
+package libmitm
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// dnsHandlerMaxPending bounds the queries of a flow kept for their
+// responses; older ones are forgotten.
+const dnsHandlerMaxPending = 64
+
+// DNSHandler observes and filters the DNS traffic of UDP flows to port 53.
+type DNSHandler interface {
+	// HandleDNS is called with every upstream response and the query it
+	// answers. It returns the response to pass on to the client: resp,
+	// modified in place, a new message, or nil for resp as received.
+	// Returning an error answers the client with NXDOMAIN instead, e.g.
+	// to block the queried name.
+	HandleDNS(query, resp *DNSMessage) (*DNSMessage, error)
+}
+
+// WithDNSHandler passes the DNS queries and responses of every UDP flow to
+// port 53 to h, see DNSHandler. It runs after a WithDNSRewrite function.
+// Responses h leaves alone are passed on byte for byte; changed ones are
+// encoded anew, like those of WithDNSRewrite. Messages that cannot be
+// decoded are passed on unchanged without calling h.
+func WithDNSHandler(h DNSHandler) Option {
+	return func(t *TUN) error {
+		if h == nil {
+			return errors.New("dns handler must not be nil")
+		}
+		t.dnsHandler = h
+		return nil
+	}
+}
+
+// dnsHandlerReaders returns fromLocal and fromRemote, which read the
+// queries and responses of flow, wrapped to pass them to the DNS handler.
+// Flows that are not DNS over UDP are returned unchanged.
+func (t *TUN) dnsHandlerReaders(flow *Flow, fromLocal, fromRemote io.Reader) (io.Reader, io.Reader) {
+	if t.dnsHandler == nil || flow.Network != "udp" || flow.upstreamNetwork() != "udp" || flow.DestinationPort != dnsPort {
+		return fromLocal, fromRemote
+	}
+	p := &dnsPending{queries: make(map[uint16]*DNSMessage)}
+	return &dnsQueryReader{r: fromLocal, pending: p}, &dnsHandlerReader{r: fromRemote, h: t.dnsHandler, pending: p}
+}
+
+// dnsPending holds the queries of a flow awaiting their response.
+type dnsPending struct {
+	mu      sync.Mutex
+	queries map[uint16]*DNSMessage
+	order   []uint16
+}
+
+func (p *dnsPending) put(q *DNSMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.queries[q.ID]; !ok {
+		if len(p.order) == dnsHandlerMaxPending {
+			delete(p.queries, p.order[0])
+			p.order = p.order[1:]
+		}
+		p.order = append(p.order, q.ID)
+	}
+	p.queries[q.ID] = q
+}
+
+// take returns and forgets the query with id, or nil.
+func (p *dnsPending) take(id uint16) *DNSMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, ok := p.queries[id]
+	if !ok {
+		return nil
+	}
+	delete(p.queries, id)
+	for i, pending := range p.order {
+		if pending == id {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+	return q
+}
+
+type dnsQueryReader struct {
+	r       io.Reader
+	pending *dnsPending
+}
+
+// Read reads one query datagram and records it for its response.
+func (d *dnsQueryReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	if n == 0 {
+		return n, err
+	}
+	if m, perr := parseDNSMessage(b[:n]); perr == nil && m.Flags&0x8000 == 0 {
+		d.pending.put(m)
+	}
+	return n, err
+}
+
+type dnsHandlerReader struct {
+	r       io.Reader
+	h       DNSHandler
+	pending *dnsPending
+}
+
+// Read reads one response datagram and replaces it in b with the one the
+// handler returns.
+func (d *dnsHandlerReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	if n == 0 {
+		return n, err
+	}
+	resp, perr := parseDNSMessage(b[:n])
+	if perr != nil || resp.Flags&0x8000 == 0 {
+		return n, err
+	}
+	query := d.pending.take(resp.ID)
+	if query == nil {
+		// The query was not decoded or was forgotten; its question is
+		// echoed by the response.
+		query = &DNSMessage{ID: resp.ID, Flags: resp.Flags & 0x7900, Questions: resp.Questions}
+	}
+
+	m, herr := d.h.HandleDNS(query, resp)
+	switch {
+	case herr != nil:
+		m = &DNSMessage{
+			// QR, opcode, RD, RA and RCODE NXDOMAIN.
+			Flags:     0x8000 | query.Flags&0x7900 | 0x0080 | 3,
+			Questions: query.Questions,
+		}
+	case m == nil:
+		return n, err
+	}
+	m.ID = resp.ID
+	return copy(b, m.pack(dnsResponseLimit(m, n, len(b)))), err
+}
@@ -0,0 +1,78 @@
+package libmitm
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// dnsHandlerFunc is a DNSHandler calling itself.
+type dnsHandlerFunc func(query, resp *DNSMessage) (*DNSMessage, error)
+
+func (f dnsHandlerFunc) HandleDNS(query, resp *DNSMessage) (*DNSMessage, error) {
+	return f(query, resp)
+}
+
+// TestDNSHandler checks that responses the handler leaves alone pass
+// unchanged, that its rewrites reach the client, and that its errors
+// answer NXDOMAIN.
+func TestDNSHandler(t *testing.T) {
+	upstream := dnsServer(t, map[string][]net.IP{
+		"pass.example.":    {net.IPv4(192, 0, 2, 1)},
+		"rewrite.example.": {net.IPv4(192, 0, 2, 2)},
+		"block.example.":   {net.IPv4(192, 0, 2, 3)},
+	})
+	queried := make(chan string, 4)
+	h := dnsHandlerFunc(func(query, resp *DNSMessage) (*DNSMessage, error) {
+		queried <- query.Questions[0].Name
+		switch query.Questions[0].Name {
+		case "rewrite.example.":
+			resp.Answers = []DNSRecord{NewDNSAddressRecord("rewrite.example.", 60, net.IPv4(192, 0, 2, 99))}
+			return resp, nil
+		case "block.example.":
+			return nil, errors.New("blocked")
+		}
+		return nil, nil
+	})
+	c := startTestTUN(t, withRedirectors(nil, FixedRedirector(upstream)), WithDNSHandler(h))
+
+	conn := c.dialUDP(t, testRemote(dnsPort))
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	b := make([]byte, 512)
+	for i, tc := range []struct {
+		name  string
+		rcode uint16
+		want  net.IP
+	}{
+		{"pass.example.", 0, net.IPv4(192, 0, 2, 1)},
+		{"rewrite.example.", 0, net.IPv4(192, 0, 2, 99)},
+		{"block.example.", 3, nil},
+	} {
+		q := &DNSMessage{ID: uint16(i + 1), Flags: 0x0100, Questions: []DNSQuestion{{Name: tc.name, Type: DNSTypeA, Class: 1}}}
+		if _, err := conn.Write(q.pack(512)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		resp, err := parseDNSMessage(b[:n])
+		if err != nil || resp.ID != q.ID {
+			t.Fatalf("%s: response %+v, %v", tc.name, resp, err)
+		}
+		if name := <-queried; name != tc.name {
+			t.Errorf("handler got the query for %s, want %s", name, tc.name)
+		}
+		if rcode := resp.Flags & 0xf; resp.Flags&0x8000 == 0 || rcode != tc.rcode {
+			t.Errorf("%s: flags %#x, want a response with rcode %d", tc.name, resp.Flags, tc.rcode)
+		}
+		var got net.IP
+		if len(resp.Answers) == 1 {
+			got = resp.Answers[0].IP()
+		}
+		if len(resp.Answers) > 1 || !got.Equal(tc.want) {
+			t.Errorf("%s: answers %+v, want %v", tc.name, resp.Answers, tc.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package libmitm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+const dnsPort = 53
+
+type dnsRateLimit struct {
+	clients sourceLimiter
+	refused atomic.Int64
+}
+
+// WithDNSRateLimit limits the DNS queries each client IP may send over UDP
+// port 53 to perSecond, with bursts of up to burst queries. Queries over
+// the limit are not forwarded; the client is answered with REFUSED right
+// away so that it does not keep retrying. Refused queries are counted by
+// DNSQueriesRefused, and not in the traffic counters of their flow.
+//
+// The limit applies to every query read from the client, before it is
+// forwarded; there is no response cache in front of it that could answer
+// queries without counting them.
+func WithDNSRateLimit(perSecond float64, burst int) Option {
+	return func(t *TUN) error {
+		if perSecond <= 0 || burst <= 0 {
+			return errors.New("dns rate limit and burst must be positive")
+		}
+		t.dnsLimit.clients = sourceLimiter{perSecond: rate.Limit(perSecond), burst: burst}
+		return nil
+	}
+}
+
+// DNSQueriesRefused returns the number of DNS queries refused because the
+// client exceeded the rate set by WithDNSRateLimit.
+func (t *TUN) DNSQueriesRefused() int64 {
+	return t.dnsLimit.refused.Load()
+}
+
+// reader returns r, which reads the queries of flow, wrapped to apply the
+// limit and to answer refused queries on local. Flows that are not DNS over
+// UDP are returned unchanged.
+func (d *dnsRateLimit) reader(flow *Flow, local net.Conn, r io.Reader) io.Reader {
+	if !d.clients.enabled() || flow.Network != "udp" || flow.DestinationPort != dnsPort {
+		return r
+	}
+	return &dnsLimitReader{r: r, local: local, limit: d, client: flow.id.RemoteAddress}
+}
+
+type dnsLimitReader struct {
+	r      io.Reader
+	local  net.Conn
+	limit  *dnsRateLimit
+	client tcpip.Address
+}
+
+func (l *dnsLimitReader) Read(b []byte) (int, error) {
+	for {
+		n, err := l.r.Read(b)
+		if n == 0 || l.limit.clients.allow(l.client) {
+			return n, err
+		}
+		l.limit.refused.Add(1)
+		if resp := dnsRefused(b[:n]); resp != nil {
+			l.local.Write(resp)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// dnsRefused returns a REFUSED response to the DNS query q, echoing its
+// ID, opcode, RD flag and question section, or nil if q is not a query.
+func dnsRefused(q []byte) []byte {
+	const headerLen = 12
+	if len(q) < headerLen || q[2]&0x80 != 0 {
+		return nil
+	}
+	qdcount := int(q[4])<<8 | int(q[5])
+	end := headerLen
+	for i := 0; i < qdcount; i++ {
+		// Skip QNAME labels, then QTYPE and QCLASS.
+		for {
+			if end >= len(q) {
+				return nil
+			}
+			l := int(q[end])
+			if l&0xc0 != 0 {
+				// Compression pointers do not occur in questions
+				// of well-formed queries.
+				return nil
+			}
+			end += 1 + l
+			if l == 0 {
+				break
+			}
+		}
+		end += 4
+		if end > len(q) {
+			return nil
+		}
+	}
+
+	resp := make([]byte, end)
+	copy(resp, q[:end])
+	resp[2] = 0x80 | q[2]&0x79 // QR, opcode and RD
+	resp[3] = 5                // RCODE REFUSED
+	// ANCOUNT, NSCOUNT and ARCOUNT are zero.
+	for i := 6; i < headerLen; i++ {
+		resp[i] = 0
+	}
+	return resp
+}
@@ -0,0 +1,48 @@
+package libmitm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDNSRateLimit(t *testing.T) {
+	upstream := udpEchoServer(t)
+	events := make(chan *Event, 16)
+	c := startTestTUN(t,
+		withRedirectors(nil, FixedRedirector(upstream)),
+		WithDNSRateLimit(0.001, 1),
+		WithUDPTimeout(200*time.Millisecond),
+		withEventChannel(events),
+	)
+
+	conn := c.dialUDP(t, testRemote(dnsPort))
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	b := make([]byte, 512)
+	for i := 0; i < 3; i++ {
+		q := &DNSMessage{ID: uint16(i), Flags: 0x0100, Questions: []DNSQuestion{{Name: "example.com.", Type: DNSTypeA, Class: 1}}}
+		if _, err := conn.Write(q.pack(512)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		resp, err := parseDNSMessage(b[:n])
+		if err != nil || resp.ID != q.ID {
+			t.Fatalf("response %+v, %v", resp, err)
+		}
+		// The first query reaches the echo server, the others are
+		// refused.
+		if refused := resp.Flags&0x800f == 0x8005; refused != (i > 0) {
+			t.Errorf("query %d: flags %#x", i, resp.Flags)
+		}
+	}
+	if n := c.tun.DNSQueriesRefused(); n != 2 {
+		t.Errorf("%d queries refused, want 2", n)
+	}
+
+	e := waitForEvent(t, events, EventConnectionClosed)
+	if e.UpPackets != 1 || e.DownPackets != 1 {
+		t.Errorf("flow counted %d packets up and %d down, want only the forwarded query", e.UpPackets, e.DownPackets)
+	}
+}
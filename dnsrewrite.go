@@ -0,0 +1,85 @@
+package libmitm
+
+import (
+	"errors"
+	"io"
+)
+
+// DNSRewriteFunc rewrites the upstream response resp to the DNS query whose
+// first question is q. It may modify resp in place and return it, return a
+// new message, or return nil to pass the response on as received.
+type DNSRewriteFunc func(q DNSQuestion, resp *DNSMessage) *DNSMessage
+
+// WithDNSRewrite passes every DNS response received from upstream over UDP
+// port 53 to fn before it is returned to the client, e.g. to strip AAAA
+// records, flatten CNAME chains or overwrite answers. The message returned
+// by fn is encoded anew, so section counts and length follow from its
+// records; its ID is reset to that of the response. A response that no
+// longer fits the UDP payload size of the response, or 512 bytes if that
+// is larger, is truncated with the TC flag set.
+//
+// Responses that cannot be decoded, or that carry no question, are
+// returned unchanged.
+func WithDNSRewrite(fn DNSRewriteFunc) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("dns rewrite function must not be nil")
+		}
+		t.dnsRewrite = fn
+		return nil
+	}
+}
+
+// dnsRewriteReader returns r, which reads the responses of flow, wrapped
+// to apply the rewrite hook. Flows that are not DNS over UDP are returned
+// unchanged.
+func (t *TUN) dnsRewriteReader(flow *Flow, r io.Reader) io.Reader {
+	if t.dnsRewrite == nil || flow.Network != "udp" || flow.upstreamNetwork() != "udp" || flow.DestinationPort != dnsPort {
+		return r
+	}
+	return &dnsRewriteReader{r: r, fn: t.dnsRewrite}
+}
+
+type dnsRewriteReader struct {
+	r  io.Reader
+	fn DNSRewriteFunc
+}
+
+// Read reads one response datagram and replaces it in b with its
+// rewritten form.
+func (d *dnsRewriteReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	if n == 0 {
+		return n, err
+	}
+	m, perr := parseDNSMessage(b[:n])
+	if perr != nil || len(m.Questions) == 0 {
+		return n, err
+	}
+	id := m.ID
+	if rewritten := d.fn(m.Questions[0], m); rewritten != nil {
+		m = rewritten
+	}
+	m.ID = id
+	return copy(b, m.pack(dnsResponseLimit(m, n, len(b)))), err
+}
+
+// dnsResponseLimit returns the size a rewritten response m may take: the
+// UDP payload size of m, the size n of the original response or 512
+// bytes, whichever is larger, but at most size.
+func dnsResponseLimit(m *DNSMessage, n, size int) int {
+	limit := 512
+	if n > limit {
+		limit = n
+	}
+	for _, r := range m.Additional {
+		if r.Type == DNSTypeOPT && int(r.Class) > limit {
+			// The class of an OPT record is the UDP payload size.
+			limit = int(r.Class)
+		}
+	}
+	if limit > size {
+		limit = size
+	}
+	return limit
+}
@@ -0,0 +1,125 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type dnsTimeoutConfig struct {
+	timeout  time.Duration
+	fallback *net.Resolver
+
+	timeouts atomic.Int64
+}
+
+// WithDNSTimeout resolves upstream hostnames separately before dialing,
+// giving each lookup at most d, so that a hung resolver fails fast instead
+// of eating the connect and establish timeouts, which still bound the
+// whole dial. If fallback is not empty, lookups that time out or fail for
+// another reason than a missing name are retried once against the DNS
+// server at fallback, e.g. "1.1.1.1:53". Timed out lookups are counted by
+// DNSTimeouts.
+//
+// Only upstreams dialed with a *net.Dialer are resolved this way, using
+// its Resolver; other dialers resolve names themselves.
+func WithDNSTimeout(d time.Duration, fallback string) Option {
+	return func(t *TUN) error {
+		if d <= 0 {
+			return errors.New("dns timeout must be positive")
+		}
+		t.dnsTimeout.timeout = d
+		if fallback != "" {
+			if _, _, err := net.SplitHostPort(fallback); err != nil {
+				return err
+			}
+			t.dnsTimeout.fallback = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, fallback)
+				},
+			}
+		}
+		return nil
+	}
+}
+
+// DNSTimeouts returns the number of upstream hostname lookups that timed
+// out, counting primary and fallback lookups separately.
+func (t *TUN) DNSTimeouts() int64 {
+	return t.dnsTimeout.timeouts.Load()
+}
+
+// lookup resolves host with r, or the default resolver if r is nil, and
+// the fallback resolver if that fails, within the DNS timeout if one is
+// set.
+func (c *dnsTimeoutConfig) lookup(ctx context.Context, r *net.Resolver, host string) ([]net.IP, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := c.lookupWith(ctx, r, host)
+	var dnsErr *net.DNSError
+	if err == nil || c.fallback == nil || ctx.Err() != nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return ips, err
+	}
+	return c.lookupWith(ctx, c.fallback, host)
+}
+
+func (c *dnsTimeoutConfig) lookupWith(ctx context.Context, r *net.Resolver, host string) ([]net.IP, error) {
+	if c.timeout == 0 {
+		return r.LookupIP(ctx, "ip", host)
+	}
+	lctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	ips, err := r.LookupIP(lctx, "ip", host)
+	if err != nil && ctx.Err() == nil && errors.Is(lctx.Err(), context.DeadlineExceeded) {
+		c.timeouts.Add(1)
+		return nil, fmt.Errorf("dns lookup of %s timed out after %s: %w", host, c.timeout, err)
+	}
+	return ips, err
+}
+
+// resolveAndDial resolves the host of address with r, within the DNS
+// timeout if one is set, and dials the resolved addresses the private
+// upstream guard allows in turn, or races them if happy eyeballs are
+// enabled.
+func (t *TUN) resolveAndDial(ctx context.Context, flow *Flow, d Dialer, r *net.Resolver, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := t.dnsTimeout.lookup(ctx, r, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	var allowed []net.IP
+	for _, ip := range ips {
+		if t.privateUpstream.enabled && t.privateUpstream.blocked(ip) {
+			blocked := &errPrivateUpstream{address: address, ip: ip}
+			t.emit(newEvent(EventUpstreamBlocked, flow, blocked.Error()))
+			lastErr = blocked
+			continue
+		}
+		allowed = append(allowed, ip)
+	}
+	if t.happyEyeballs > 0 && flow.upstreamNetwork() == "tcp" && len(allowed) > 0 {
+		return raceDial(ctx, d, flow.upstreamNetwork(), allowed, port, t.happyEyeballs)
+	}
+	for _, ip := range allowed {
+		conn, err := d.DialContext(ctx, flow.upstreamNetwork(), net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
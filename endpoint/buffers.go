@@ -0,0 +1,194 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+)
+
+// WithReadBuffers reads every inbound packet into views of the given
+// sizes instead of the leading sizes of BufConfig, so that endpoints can
+// be tuned independently. sizes must be positive and add up to at least
+// the MTU, or to the largest coalesced segment with GSO; packets larger
+// than their sum are truncated.
+func WithReadBuffers(sizes []int) Option {
+	return func(e *endpoint) error {
+		if len(sizes) == 0 {
+			return errors.New("no read buffer sizes")
+		}
+		for _, size := range sizes {
+			if size <= 0 {
+				return fmt.Errorf("invalid read buffer size: %d", size)
+			}
+		}
+		e.readBuffers = append([]int(nil), sizes...)
+		return nil
+	}
+}
+
+// checkReadBuffers reports an error if the configured read buffers cannot
+// hold a packet of the MTU.
+func (e *endpoint) checkReadBuffers() error {
+	if e.readBuffers == nil {
+		return nil
+	}
+	total := 0
+	for _, size := range e.readBuffers {
+		total += size
+	}
+	if total < int(e.mtu) {
+		return fmt.Errorf("read buffers of %d bytes cannot hold the mtu of %d", total, e.mtu)
+	}
+	return nil
+}
+
+// bufConfig returns the sizes of the views a packet is read into: those
+// of WithReadBuffers, or else the leading sizes of BufConfig that add up
+// to hold a packet of the MTU, or all of them with GSO, whose coalesced
+// segments exceed the MTU. Sizes from BufConfig are copied, so that
+// changing it does not affect endpoints already created.
+func (e *endpoint) bufConfig() []int {
+	if e.readBuffers != nil {
+		return e.readBuffers
+	}
+	sizes := BufConfig
+	if !e.gso {
+		total := 0
+		for i, size := range BufConfig {
+			if total += size; total >= int(e.mtu) {
+				sizes = BufConfig[:i+1]
+				break
+			}
+		}
+	}
+	return append([]int(nil), sizes...)
+}
+
+const (
+	// adaptiveWindow is the number of packets between two evaluations of
+	// an adaptive buffer ladder.
+	adaptiveWindow = 1024
+
+	// adaptivePercentile is the percentage of recent packets the head
+	// buffer of an adaptive ladder is sized to hold.
+	adaptivePercentile = 90
+
+	// adaptiveMinBuffer is the smallest head buffer of an adaptive ladder.
+	adaptiveMinBuffer = 64
+)
+
+// WithAdaptiveBuffers makes every dispatcher keep a histogram of the sizes
+// of the packets it reads and reshape its read buffers to match: the first
+// view is sized to hold 90% of recent packets, so most packets take a
+// single iovec, and further views double in size up to the capacity of the
+// configured sizes, which stays the same. The histogram is evaluated every
+// 1024 packets and decays by half each time; the buffers are reshaped only
+// after two evaluations in a row agree, so that a bursty mix does not make
+// them thrash. Reshapes are counted in Stats.
+func WithAdaptiveBuffers(enabled bool) Option {
+	return func(e *endpoint) error {
+		e.adaptive = enabled
+		return nil
+	}
+}
+
+// newBufferLadder returns the adaptive ladder of a dispatcher reading into
+// sizes, or nil if the endpoint's buffers are not adaptive.
+func (e *endpoint) newBufferLadder(sizes []int) *bufferLadder {
+	if !e.adaptive {
+		return nil
+	}
+	l := &bufferLadder{head: sizes[0], reshapes: &e.reshapes}
+	for _, size := range sizes {
+		l.capacity += size
+	}
+	return l
+}
+
+// bufferLadder tracks the sizes of the packets read by a dispatcher to
+// shape its read buffers. It is only used by the dispatch loop.
+type bufferLadder struct {
+	// capacity is the total size of the buffers, which is kept.
+	capacity int
+	// head is the size of the first buffer, and candidate the head size
+	// chosen by the last evaluation if it differs, or 0.
+	head      int
+	candidate int
+
+	// hist counts recent packets by the bit length of their size.
+	hist [18]uint32
+	seen int
+
+	reshapes *atomic.Uint64
+}
+
+// observe records a packet of n bytes and reports whether the buffers
+// must be reshaped to sizes.
+func (l *bufferLadder) observe(n int) bool {
+	b := bits.Len(uint(n))
+	if b >= len(l.hist) {
+		b = len(l.hist) - 1
+	}
+	l.hist[b]++
+	if l.seen++; l.seen < adaptiveWindow {
+		return false
+	}
+	l.seen = 0
+	head := l.percentileSize()
+	for i := range l.hist {
+		l.hist[i] /= 2
+	}
+
+	switch head {
+	case l.head:
+		l.candidate = 0
+		return false
+	case l.candidate:
+		l.head, l.candidate = head, 0
+		l.reshapes.Add(1)
+		return true
+	default:
+		l.candidate = head
+		return false
+	}
+}
+
+// percentileSize returns the power of two holding adaptivePercentile of
+// the recorded packets, within the bounds of a head buffer.
+func (l *bufferLadder) percentileSize() int {
+	total := 0
+	for _, c := range l.hist {
+		total += int(c)
+	}
+	size, sum := l.capacity, 0
+	for b, c := range l.hist {
+		if sum += int(c); sum*100 >= total*adaptivePercentile {
+			size = 1 << b
+			break
+		}
+	}
+	if size < adaptiveMinBuffer {
+		size = adaptiveMinBuffer
+	}
+	if size > l.capacity {
+		size = l.capacity
+	}
+	return size
+}
+
+// sizes returns the current shape of the buffers: the head buffer followed
+// by buffers doubling in size until they add up to the capacity.
+func (l *bufferLadder) sizes() []int {
+	sizes := []int{l.head}
+	total := l.head
+	for next := 2 * l.head; total < l.capacity; next *= 2 {
+		size := next
+		if rest := l.capacity - total; size > rest {
+			size = rest
+		}
+		sizes = append(sizes, size)
+		total += size
+	}
+	return sizes
+}
@@ -0,0 +1,201 @@
+package endpoint
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestWithReadBuffers checks that endpoints read into the views of their
+// own sizes, unaffected by later changes to the sizes given or BufConfig.
+func TestWithReadBuffers(t *testing.T) {
+	small, large := []int{512, 1024}, []int{2048}
+	a, _ := socketEndpoint(t, WithReadBuffers(small))
+	b, _ := socketEndpoint(t, WithReadBuffers(large))
+	def, _ := socketEndpoint(t)
+	small[0], large[0] = 1, 1
+	saved := BufConfig
+	BufConfig = []int{4096}
+	defer func() { BufConfig = saved }()
+
+	for _, tc := range []struct {
+		name  string
+		e     *endpoint
+		sizes []int
+	}{
+		{"small", a, []int{512, 1024}},
+		{"large", b, []int{2048}},
+		{"default", def, []int{128, 256, 256, 512, 1024}},
+	} {
+		if sizes := readBufferSizes(t, tc.e); !reflect.DeepEqual(sizes, tc.sizes) {
+			t.Errorf("%s: read buffers %v, want %v", tc.name, sizes, tc.sizes)
+		}
+	}
+
+	for _, sizes := range [][]int{nil, {0, 2048}, {-1, 2048}, {512, 512}} {
+		if _, err := NewEndpoint(-1, 1500, WithReadBuffers(sizes)); err == nil {
+			t.Errorf("created an endpoint with read buffers %v", sizes)
+		}
+	}
+}
+
+// observeWindow records a full evaluation window of packets of n bytes in
+// l and returns the number of times it asked for a reshape.
+func observeWindow(l *bufferLadder, n int) int {
+	reshapes := 0
+	for i := 0; i < adaptiveWindow; i++ {
+		if l.observe(n) {
+			reshapes++
+		}
+	}
+	return reshapes
+}
+
+// TestBufferLadder checks that the head buffer follows the sizes of the
+// packets read, only after two evaluations agree, and that the buffers
+// keep their capacity.
+func TestBufferLadder(t *testing.T) {
+	e := &endpoint{mtu: 1500, adaptive: true}
+	sizes := e.bufConfig()
+	l := e.newBufferLadder(sizes)
+	capacity := 0
+	for _, size := range sizes {
+		capacity += size
+	}
+
+	for _, tc := range []struct {
+		name string
+		size int
+		head int
+	}{
+		{"near-mtu", 1400, 2048},
+		{"tiny", 40, adaptiveMinBuffer},
+		{"mid", 300, 512},
+	} {
+		for window := 0; l.head != tc.head; window++ {
+			if window == 8 {
+				t.Fatalf("%s: head stuck at %d, want %d", tc.name, l.head, tc.head)
+			}
+			head := l.head
+			if observeWindow(l, tc.size) > 0 && window == 0 {
+				t.Errorf("%s: reshaped to %d after a single evaluation", tc.name, l.head)
+			}
+			if l.head != head && l.head != tc.head {
+				t.Errorf("%s: reshaped to %d on the way to %d", tc.name, l.head, tc.head)
+			}
+		}
+		if observeWindow(l, tc.size) > 0 {
+			t.Errorf("%s: reshaped a settled ladder", tc.name)
+		}
+
+		shape := l.sizes()
+		total := 0
+		for _, size := range shape {
+			total += size
+		}
+		if shape[0] != tc.head || total != capacity {
+			t.Errorf("%s: sizes %v, want a head of %d and %d bytes", tc.name, shape, tc.head, capacity)
+		}
+	}
+	if n := e.reshapes.Load(); n != 3 {
+		t.Errorf("%d reshapes counted, want 3", n)
+	}
+
+	if l := (&endpoint{mtu: 1500}).newBufferLadder(sizes); l != nil {
+		t.Error("ladder without WithAdaptiveBuffers")
+	}
+}
+
+// TestAdaptiveBuffers checks that both dispatchers reshape their buffers
+// and deliver the packets read before and after intact.
+func TestAdaptiveBuffers(t *testing.T) {
+	for _, batch := range []int{1, 8} {
+		e, fd := socketEndpoint(t, WithAdaptiveBuffers(true), WithBatchSize(batch))
+		var r packetRecorder
+		e.Attach(&r)
+		var sent [][]byte
+		for i := 0; i < 3*adaptiveWindow; i++ {
+			// One packet in 16 is larger than the head buffer settles at.
+			size := 1400
+			if i%16 != 0 {
+				size = i % 40
+			}
+			b := ipv4Packet(1, uint16(i), size)
+			sent = append(sent, b)
+			writePackets(t, fd, b)
+		}
+
+		for i, b := range r.wait(t, len(sent)) {
+			if !bytes.Equal(b, sent[i]) {
+				t.Fatalf("batch %d: packet %d is %d bytes, want %d", batch, i, len(b), len(sent[i]))
+			}
+		}
+		if got := e.Stats().BufferReshapes; got == 0 {
+			t.Errorf("batch %d: buffers were not reshaped", batch)
+		}
+	}
+}
+
+// trafficMix returns packets of 16 flows, each sending large packets near
+// the MTU followed by small ones, over and over.
+func trafficMix(large, small int) [][]byte {
+	pkts := make([][]byte, 16*(large+small))
+	for i := range pkts {
+		size := 20 + i%24
+		if i/16%(large+small) < large {
+			size = 1400
+		}
+		pkts[i] = ipv4Packet(byte(i%16+1), uint16(i/16), size)
+	}
+	return pkts
+}
+
+func BenchmarkAdaptiveBuffers(b *testing.B) {
+	for _, mix := range []struct {
+		name string
+		pkts [][]byte
+	}{
+		// Bulk transfers, with an ack for every other segment.
+		{"bulk", trafficMix(2, 1)},
+		// Chatty flows, with an occasional full segment.
+		{"small", trafficMix(1, 15)},
+	} {
+		b.Run(mix.name+"/static", func(b *testing.B) { benchmarkPackets(b, mix.pkts) })
+		b.Run(mix.name+"/adaptive", func(b *testing.B) { benchmarkPackets(b, mix.pkts, WithAdaptiveBuffers(true)) })
+	}
+}
+
+// TestAdaptiveBuffersPartialBatch checks that reshaping the buffers after
+// a batch shorter than the message headers leaves none of the headers
+// unread by that batch pointing at released views.
+func TestAdaptiveBuffersPartialBatch(t *testing.T) {
+	e, fd := socketEndpoint(t, WithAdaptiveBuffers(true), WithBatchSize(8))
+	var r packetRecorder
+	e.Attach(&r)
+	var sent [][]byte
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			b := ipv4Packet(1, uint16(len(sent)), 8)
+			sent = append(sent, b)
+			writePackets(t, fd, b)
+		}
+		r.wait(t, len(sent))
+	}
+	// The second evaluation reshapes the buffers, on the last packet of
+	// a batch of at most 3.
+	send(2*adaptiveWindow - 3)
+	send(3)
+	if got := e.Stats().BufferReshapes; got != 1 {
+		t.Fatalf("%d reshapes, want 1", got)
+	}
+	send(8)
+
+	for i, b := range r.wait(t, len(sent)) {
+		if !bytes.Equal(b, sent[i]) {
+			t.Fatalf("packet %d is %d bytes, want %d", i, len(b), len(sent[i]))
+		}
+	}
+	if got := e.Stats().Malformed; got != 0 {
+		t.Errorf("%d packets dropped as malformed", got)
+	}
+}
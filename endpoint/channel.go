@@ -0,0 +1,121 @@
+package endpoint
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// channelQueueLen is the number of outbound packets a ChannelEndpoint
+// holds before it drops further ones.
+const channelQueueLen = 1024
+
+var _ stack.LinkEndpoint = (*ChannelEndpoint)(nil)
+
+// ChannelEndpoint is an in-memory link endpoint standing in for a TUN
+// device, e.g. to drive the stack from tests: raw IP packets are injected
+// with InjectInbound and the packets the stack sends are read with
+// ReadOutbound. It needs no fd, so closing it is all there is to stop it.
+type ChannelEndpoint struct {
+	*channel.Endpoint
+
+	closeOnce      sync.Once
+	malformed      atomic.Uint64
+	unknownVersion atomic.Uint64
+}
+
+// NewChannelEndpoint returns a ChannelEndpoint with the given MTU.
+func NewChannelEndpoint(mtu uint32) *ChannelEndpoint {
+	return &ChannelEndpoint{Endpoint: channel.New(channelQueueLen, mtu, "")}
+}
+
+// InjectInbound delivers the IP packet b to the stack as if it had been
+// read from a TUN device, and returns once the stack handled it. Packets
+// that are not IPv4 or IPv6, and packets injected while the endpoint is
+// not attached, are dropped.
+func (e *ChannelEndpoint) InjectInbound(b []byte) {
+	var p tcpip.NetworkProtocolNumber
+	var min int
+	if len(b) == 0 {
+		e.malformed.Add(1)
+		return
+	}
+	switch header.IPVersion(b) {
+	case header.IPv4Version:
+		p, min = header.IPv4ProtocolNumber, header.IPv4MinimumSize
+	case header.IPv6Version:
+		p, min = header.IPv6ProtocolNumber, header.IPv6MinimumSize
+	default:
+		e.unknownVersion.Add(1)
+		return
+	}
+	if len(b) < min {
+		e.malformed.Add(1)
+		return
+	}
+	if !e.IsAttached() {
+		return
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: bufferv2.MakeWithData(append([]byte(nil), b...)),
+	})
+	defer pkt.DecRef()
+	e.Endpoint.InjectInbound(p, pkt)
+}
+
+// ReadOutbound returns the next packet the stack sent, or nil if there is
+// none.
+func (e *ChannelEndpoint) ReadOutbound() []byte {
+	return packetBytes(e.Read())
+}
+
+// ReadOutboundContext is like ReadOutbound, but waits for a packet until
+// ctx is done.
+func (e *ChannelEndpoint) ReadOutboundContext(ctx context.Context) []byte {
+	return packetBytes(e.ReadContext(ctx))
+}
+
+func packetBytes(pkt stack.PacketBufferPtr) []byte {
+	if pkt.IsNil() {
+		return nil
+	}
+	defer pkt.DecRef()
+	v := pkt.ToView()
+	defer v.Release()
+	return append([]byte(nil), v.AsSlice()...)
+}
+
+// Stop detaches e from the stack, so packets injected afterwards are
+// dropped.
+func (e *ChannelEndpoint) Stop() {
+	e.Attach(nil)
+}
+
+// Close stops e and discards the packets not read yet. Packets sent
+// afterwards are dropped. It may be called more than once, e.g. by
+// TUN.Shutdown and TUN.Close.
+func (e *ChannelEndpoint) Close() {
+	e.closeOnce.Do(func() {
+		e.Stop()
+		e.Endpoint.Close()
+	})
+}
+
+// ReadRetries returns 0, as a ChannelEndpoint has no fd to read.
+func (e *ChannelEndpoint) ReadRetries() uint64 {
+	return 0
+}
+
+// Stats returns a snapshot of the endpoint's counters.
+func (e *ChannelEndpoint) Stats() Stats {
+	return Stats{
+		Malformed:      e.malformed.Load(),
+		UnknownVersion: e.unknownVersion.Load(),
+	}
+}
@@ -0,0 +1,145 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+var (
+	clientAddr = tcpip.Address(net.ParseIP("10.0.0.1").To4())
+	serverAddr = tcpip.Address(net.ParseIP("10.0.0.2").To4())
+)
+
+// newChannelStack returns a stack attached to a ChannelEndpoint that
+// listens on port 80 of serverAddr.
+func newChannelStack(t *testing.T) (*stack.Stack, *ChannelEndpoint) {
+	t.Helper()
+	ep := NewChannelEndpoint(1500)
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	t.Cleanup(func() {
+		ep.Close()
+		s.Close()
+	})
+	if err := s.CreateNIC(1, ep); err != nil {
+		t.Fatalf("create nic: %v", err)
+	}
+	addr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: serverAddr, PrefixLen: 24},
+	}
+	if err := s.AddProtocolAddress(1, addr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("add address: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+	l, err := gonet.ListenTCP(s, tcpip.FullAddress{NIC: 1, Addr: serverAddr, Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return s, ep
+}
+
+// tcpSegment returns an IPv4 packet carrying a TCP segment without payload
+// from clientAddr to port 80 of serverAddr.
+func tcpSegment(srcPort uint16, seq uint32, flags header.TCPFlags) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     clientAddr,
+		DstAddr:     serverAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	seg := header.TCP(b[header.IPv4MinimumSize:])
+	seg.Encode(&header.TCPFields{
+		SrcPort:    srcPort,
+		DstPort:    80,
+		SeqNum:     seq,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, clientAddr, serverAddr, uint16(len(seg)))
+	seg.SetChecksum(^seg.CalculateChecksum(xsum))
+	return b
+}
+
+func TestChannelEndpointHandshake(t *testing.T) {
+	_, ep := newChannelStack(t)
+
+	const seq = 1000
+	ep.InjectInbound(tcpSegment(40000, seq, header.TCPFlagSyn))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := ep.ReadOutboundContext(ctx)
+	if b == nil {
+		t.Fatal("no reply to SYN")
+	}
+	ip := header.IPv4(b)
+	if !ip.IsValid(len(b)) || ip.TransportProtocol() != header.TCPProtocolNumber {
+		t.Fatalf("reply is not a TCP segment: %x", b)
+	}
+	if ip.SourceAddress() != serverAddr || ip.DestinationAddress() != clientAddr {
+		t.Errorf("reply from %s to %s, want from %s to %s", ip.SourceAddress(), ip.DestinationAddress(), serverAddr, clientAddr)
+	}
+	seg := header.TCP(ip.Payload())
+	if seg.Flags() != header.TCPFlagSyn|header.TCPFlagAck {
+		t.Errorf("reply flags %s, want SYN-ACK", seg.Flags())
+	}
+	if seg.SourcePort() != 80 || seg.DestinationPort() != 40000 {
+		t.Errorf("reply from port %d to %d, want from 80 to 40000", seg.SourcePort(), seg.DestinationPort())
+	}
+	if seg.AckNumber() != seq+1 {
+		t.Errorf("reply acknowledges %d, want %d", seg.AckNumber(), seq+1)
+	}
+}
+
+func TestChannelEndpointDrops(t *testing.T) {
+	_, ep := newChannelStack(t)
+
+	ep.InjectInbound(nil)
+	ep.InjectInbound([]byte{0x45, 0})
+	ep.InjectInbound(make([]byte, 40))
+	if got, want := ep.Stats(), (Stats{Malformed: 2, UnknownVersion: 1}); got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+	if b := ep.ReadOutbound(); b != nil {
+		t.Errorf("stack replied to a dropped packet: %x", b)
+	}
+}
+
+func TestChannelEndpointStop(t *testing.T) {
+	_, ep := newChannelStack(t)
+
+	ep.Stop()
+	ep.InjectInbound(tcpSegment(40001, 1, header.TCPFlagSyn))
+	time.Sleep(50 * time.Millisecond)
+	if b := ep.ReadOutbound(); b != nil {
+		t.Errorf("stopped endpoint delivered a packet: %x", b)
+	}
+}
+
+func TestChannelEndpointCloseTwice(t *testing.T) {
+	_, ep := newChannelStack(t)
+
+	ep.Close()
+	ep.Close()
+	if b := ep.ReadOutbound(); b != nil {
+		t.Errorf("closed endpoint returned a packet: %x", b)
+	}
+}
@@ -0,0 +1,124 @@
+package endpoint
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestDeliveryModeUnknown(t *testing.T) {
+	if _, err := NewEndpoint(-1, 1500, WithDeliveryMode(DeliveryQueued+1)); err == nil {
+		t.Error("created an endpoint with an unknown delivery mode")
+	}
+}
+
+// TestDeliveryModes checks that both modes deliver every packet, and that
+// the packets of each address pair stay in order.
+func TestDeliveryModes(t *testing.T) {
+	const flows, perFlow = 8, 64
+	for _, mode := range []DeliveryMode{DeliveryInline, DeliveryQueued} {
+		e, fd := socketEndpoint(t, WithDeliveryMode(mode))
+		var r packetRecorder
+		e.Attach(&r)
+		if (e.pool != nil) != (mode == DeliveryQueued) {
+			t.Errorf("mode %d: worker pool %v", mode, e.pool)
+		}
+		for id := 0; id < perFlow; id++ {
+			for src := 1; src <= flows; src++ {
+				writePackets(t, fd, ipv4Packet(byte(src), uint16(id), 8))
+			}
+		}
+
+		next := make(map[tcpip.Address]uint16)
+		for _, b := range r.wait(t, flows*perFlow) {
+			ip := header.IPv4(b)
+			if id := ip.ID(); id != next[ip.SourceAddress()] {
+				t.Fatalf("mode %d: packet %d from %s, want %d", mode, id, ip.SourceAddress(), next[ip.SourceAddress()])
+			}
+			next[ip.SourceAddress()]++
+		}
+
+		e.Attach(nil)
+		if e.pool != nil {
+			t.Errorf("mode %d: worker pool left after detaching", mode)
+		}
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	hash := func(b []byte) uint32 {
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(b)})
+		defer pkt.DecRef()
+		return flowHash(header.IPv4ProtocolNumber, pkt)
+	}
+	if a, b := hash(ipv4Packet(1, 1, 8)), hash(ipv4Packet(1, 2, 100)); a != b {
+		t.Errorf("packets of one address pair hash to %d and %d", a, b)
+	}
+	if a, b := hash(ipv4Packet(1, 1, 8)), hash(ipv4Packet(2, 1, 8)); a == b {
+		t.Errorf("packets of different address pairs both hash to %d", a)
+	}
+	if h := hash([]byte{0x45, 0}); h != 0 {
+		t.Errorf("truncated packet hashes to %d", h)
+	}
+}
+
+// countingDispatcher counts the packets delivered to it after checking
+// their IPv4 header checksum, a stand-in for the work of a stack.
+type countingDispatcher struct {
+	n atomic.Int64
+}
+
+func (d *countingDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	if h, ok := pkt.Data().PullUp(header.IPv4MinimumSize); ok {
+		header.IPv4(h).IsChecksumValid()
+	}
+	d.n.Add(1)
+}
+
+func (d *countingDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, stack.PacketBufferPtr) {}
+
+// benchmarkDelivery measures the rate at which an endpoint with opts reads
+// packets of 16 flows from its fd and delivers them.
+func benchmarkDelivery(b *testing.B, opts ...Option) {
+	pkts := make([][]byte, 16)
+	for i := range pkts {
+		pkts[i] = ipv4Packet(byte(i+1), 0, 1000)
+	}
+	benchmarkPackets(b, pkts, opts...)
+}
+
+// benchmarkPackets measures the rate at which an endpoint with opts reads
+// pkts, over and over, from its fd and delivers them.
+func benchmarkPackets(b *testing.B, pkts [][]byte, opts ...Option) {
+	e, fd := socketEndpoint(b, opts...)
+	var d countingDispatcher
+	e.Attach(&d)
+	total := 0
+	for _, pkt := range pkts {
+		total += len(pkt)
+	}
+
+	b.SetBytes(int64(total / len(pkts)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := unix.Write(fd, pkts[i%len(pkts)]); err != nil {
+				return
+			}
+		}
+	}()
+	for d.n.Load() < int64(b.N) {
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+func BenchmarkDelivery(b *testing.B) {
+	b.Run("inline", func(b *testing.B) { benchmarkDelivery(b, WithDeliveryMode(DeliveryInline)) })
+	b.Run("queued", func(b *testing.B) { benchmarkDelivery(b, WithDeliveryMode(DeliveryQueued)) })
+}
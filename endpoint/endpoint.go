@@ -1,7 +1,9 @@
 package endpoint
 
 import (
+	"errors"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/bufferv2"
@@ -21,20 +23,84 @@ type endpoint struct {
 	mtu uint32
 	wg  sync.WaitGroup
 
-	inbound    *readVDispatcher
+	inbound    []linkDispatcher
 	dispatcher stack.NetworkDispatcher
+
+	// stopped is set once Stop was called.
+	stopOnce sync.Once
+	stopped  atomic.Bool
+
+	// delivery is the mode used to hand inbound packets to dispatcher.
+	// pool is only set while attached in DeliveryQueued mode.
+	delivery DeliveryMode
+	pool     *deliveryPool
+
+	// queues are the further queues of a multi-queue TUN read besides fd.
+	queues []int
+
+	// socket is set if fd is a socket, which allows recvmmsg and sendmmsg.
+	socket bool
+
+	// batchSize is the number of packets read per recvmmsg call, or 0 to
+	// read them one at a time with readv.
+	batchSize int
+
+	// readBuffers are the sizes set by WithReadBuffers, or nil.
+	readBuffers []int
+
+	// adaptive is set by WithAdaptiveBuffers, and reshapes counts the
+	// read buffers it reshaped.
+	adaptive bool
+	reshapes atomic.Uint64
+
+	// gso is set if packets on fd are prefixed with a virtio_net_hdr.
+	gso bool
+
+	// readRetries counts reads retried after a transient error.
+	readRetries atomic.Uint64
+
+	// malformed and unknownVersion count dropped inbound packets, see
+	// Stats.
+	malformed      atomic.Uint64
+	unknownVersion atomic.Uint64
+	dropLog        dropLog
 }
 
-func NewEndpoint(dev int32, mtu int32) (*endpoint, error) {
+func NewEndpoint(dev int32, mtu int32, opts ...Option) (*endpoint, error) {
 	e := &endpoint{
 		fd:  int(dev),
 		mtu: uint32(mtu),
 	}
-	i, err := newReadVDispatcher(e.fd, e)
-	if err != nil {
+	for _, opt := range opts {
+		if err := opt(e); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.checkReadBuffers(); err != nil {
 		return nil, err
 	}
-	e.inbound = i
+	for _, fd := range append([]int{e.fd}, e.queues...) {
+		socket, err := isSocket(fd)
+		if err != nil {
+			return nil, err
+		}
+		if fd == e.fd {
+			e.socket = socket
+		}
+		if e.gso && socket {
+			return nil, errors.New("gso requires a tun device")
+		}
+		i, err := newDispatcher(fd, socket, e)
+		if err != nil {
+			return nil, err
+		}
+		e.inbound = append(e.inbound, i)
+	}
+	if e.gso {
+		if err := enableOffload(e.fd); err != nil {
+			return nil, err
+		}
+	}
 	return e, nil
 }
 
@@ -43,37 +109,84 @@ func (e *endpoint) InjectInbound(networkProtocol tcpip.NetworkProtocolNumber, pk
 }
 
 func (e *endpoint) InjectOutbound(dest tcpip.Address, packet *bufferv2.View) tcpip.Error {
+	if e.gso {
+		return rawfile.NonBlockingWriteIovec(e.fd, e.iovecsOf([][]byte{packet.AsSlice()}))
+	}
 	return rawfile.NonBlockingWrite(e.fd, packet.AsSlice())
 }
 
-// Attach launches the goroutine that reads packets from io.ReadWriter and
+// Attach launches a goroutine per queue that reads packets from its fd and
 // dispatches them via the provided dispatcher.
 func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
 	if dispatcher == nil && e.dispatcher != nil {
-		e.inbound.stop()
-		e.Wait()
+		e.Stop()
+		if e.pool != nil {
+			e.pool.close()
+			e.pool = nil
+		}
 		e.dispatcher = nil
 		return
 	}
 	if dispatcher != nil && e.dispatcher == nil {
 		e.dispatcher = dispatcher
-		e.wg.Add(1)
-		go func() {
-			e.dispatchLoop(e.inbound)
-			e.wg.Done()
-		}()
+		if e.delivery == DeliveryQueued {
+			e.pool = newDeliveryPool(dispatcher)
+		}
+		if e.stopped.Load() {
+			return
+		}
+		for _, i := range e.inbound {
+			e.wg.Add(1)
+			go func(i linkDispatcher) {
+				e.dispatchLoop(i)
+				e.wg.Done()
+			}(i)
+		}
 	}
 }
 
+// Stop stops reading from the fd and its queues: it wakes every dispatch
+// loop blocked in a read, waits for the loops to return and frees their
+// resources. Stopping is final: an endpoint attached again reads nothing.
+// Stop is safe to call more than once, and detaching the endpoint stops
+// it too.
+func (e *endpoint) Stop() {
+	e.stopOnce.Do(func() {
+		e.stopped.Store(true)
+		for _, i := range e.inbound {
+			i.stop()
+		}
+		e.Wait()
+		for _, i := range e.inbound {
+			i.close()
+		}
+	})
+}
+
 // IsAttached implements stack.LinkEndpoint.IsAttached.
 func (e *endpoint) IsAttached() bool {
 	return e.dispatcher != nil
 }
 
+// deliver hands an inbound packet to the network stack according to the
+// configured delivery mode.
+func (e *endpoint) deliver(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	if e.pool != nil {
+		e.pool.deliver(protocol, pkt)
+		return
+	}
+	e.dispatcher.DeliverNetworkPacket(protocol, pkt)
+}
+
 // dispatchLoop reads packets from the file descriptor in a loop and dispatches
-// them to the network stack.
-func (e *endpoint) dispatchLoop(inboundDispatcher *readVDispatcher) tcpip.Error {
+// them to the network stack. It returns nil once the dispatcher is stopped.
+func (e *endpoint) dispatchLoop(inboundDispatcher linkDispatcher) tcpip.Error {
 	for {
+		// A busy fd is read without polling the stop fd.
+		if e.stopped.Load() {
+			inboundDispatcher.release()
+			return nil
+		}
 		cont, err := inboundDispatcher.dispatch()
 		if err != nil || !cont {
 			inboundDispatcher.release()
@@ -82,26 +195,49 @@ func (e *endpoint) dispatchLoop(inboundDispatcher *readVDispatcher) tcpip.Error
 	}
 }
 
+// WritePackets writes pkts to the file descriptor, each as a message of
+// its own. A socket gets them in batches with sendmmsg, other fds one
+// writev per packet. Packets larger than the MTU are not written. It
+// returns the number of packets written before the first error.
 func (e *endpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
-	// Preallocate to avoid repeated reallocation as we append to batch.
-	// batchSz is 47 because when SWGSO is in use then a single 65KB TCP
-	// segment can get split into 46 segments of 1420 bytes and a single 216
-	// byte segment.
-	const batchSz = 47
-	batch := make([]unix.Iovec, 0, batchSz)
-	for _, pkt := range pkts.AsSlice() {
-		views := pkt.AsSlices()
-		for _, v := range views {
-			batch = rawfile.AppendIovecFromBytes(batch, v, len(views))
-		}
+	if e.socket && pkts.Len() > 1 {
+		return e.sendPackets(pkts.AsSlice())
 	}
-	err := rawfile.NonBlockingWriteIovec(e.fd, batch)
-	if err != nil {
-		return 0, err
+	for i, pkt := range pkts.AsSlice() {
+		if uint32(pkt.Size()) > e.mtu {
+			return i, &tcpip.ErrMessageTooLong{}
+		}
+		iovecs := e.iovecsOf(pkt.AsSlices())
+		if err := rawfile.NonBlockingWriteIovec(e.fd, iovecs); err != nil {
+			return i, err
+		}
 	}
 	return pkts.Len(), nil
 }
 
+// iovecsOf returns the iovecs to write a packet made of views with,
+// preceded by an empty vnet header with GSO.
+func (e *endpoint) iovecsOf(views [][]byte) []unix.Iovec {
+	max := len(views)
+	if e.gso {
+		max++
+	}
+	iovecs := make([]unix.Iovec, 0, max)
+	if e.gso {
+		iovecs = rawfile.AppendIovecFromBytes(iovecs, emptyVnetHdr[:], max)
+	}
+	for _, v := range views {
+		iovecs = rawfile.AppendIovecFromBytes(iovecs, v, max)
+	}
+	return iovecs
+}
+
+// ReadRetries returns the number of fd reads retried after a transient
+// condition such as EINTR.
+func (e *endpoint) ReadRetries() uint64 {
+	return e.readRetries.Load()
+}
+
 // MTU implements stack.LinkEndpoint.MTU.
 func (e *endpoint) MTU() uint32 {
 	return e.mtu
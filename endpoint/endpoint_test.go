@@ -0,0 +1,146 @@
+package endpoint
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// socketEndpoint returns an endpoint on one end of a packet socketpair and
+// the other end, which stands in for the TUN device. Both are closed when
+// the test ends.
+func socketEndpoint(tb testing.TB, opts ...Option) (*endpoint, int) {
+	tb.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		tb.Fatalf("socketpair: %v", err)
+	}
+	// The endpoint polls on EAGAIN, like a TUN device opened non-blocking.
+	err = unix.SetNonblock(fds[0], true)
+	var e *endpoint
+	if err == nil {
+		e, err = NewEndpoint(int32(fds[0]), 1500, opts...)
+	}
+	if err != nil {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+		tb.Fatalf("new endpoint: %v", err)
+	}
+	tb.Cleanup(func() {
+		e.Attach(nil)
+		e.Stop()
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+	return e, fds[1]
+}
+
+// ipv4Packet returns an IPv4 packet from 10.0.0.src whose Identification
+// field is id, followed by payload bytes of padding.
+func ipv4Packet(src byte, id uint16, payload int) []byte {
+	b := make([]byte, header.IPv4MinimumSize+payload)
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		ID:          id,
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.Address([]byte{10, 0, 0, src}),
+		DstAddr:     tcpip.Address([]byte{10, 0, 0, 254}),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	return b
+}
+
+// writePackets writes each of pkts to fd as a message of its own.
+func writePackets(tb testing.TB, fd int, pkts ...[]byte) {
+	tb.Helper()
+	for _, b := range pkts {
+		if _, err := unix.Write(fd, b); err != nil {
+			tb.Fatalf("write: %v", err)
+		}
+	}
+}
+
+// packetRecorder is a stack.NetworkDispatcher recording the packets
+// delivered to it.
+type packetRecorder struct {
+	mu      sync.Mutex
+	packets [][]byte
+}
+
+func (r *packetRecorder) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	v := pkt.ToView()
+	b := append([]byte(nil), v.AsSlice()...)
+	v.Release()
+	r.mu.Lock()
+	r.packets = append(r.packets, b)
+	r.mu.Unlock()
+}
+
+func (r *packetRecorder) DeliverLinkPacket(tcpip.NetworkProtocolNumber, stack.PacketBufferPtr) {}
+
+// len returns the number of packets delivered so far.
+func (r *packetRecorder) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.packets)
+}
+
+// wait waits for n packets to be delivered and returns them.
+func (r *packetRecorder) wait(tb testing.TB, n int) [][]byte {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.len() < n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("%d of %d packets delivered", r.len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.packets
+}
+
+// TestEndpointStop checks that Stop wakes a dispatch loop blocked reading
+// a pipe, that the loop exits, and that stopping again is safe.
+func TestEndpointStop(t *testing.T) {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_NONBLOCK); err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	e, err := NewEndpoint(int32(fds[0]), 1500)
+	if err != nil {
+		t.Fatalf("new endpoint: %v", err)
+	}
+	var r packetRecorder
+	e.Attach(&r)
+	writePackets(t, fds[1], ipv4Packet(1, 0, 8))
+	r.wait(t, 1)
+
+	stopped := make(chan struct{})
+	go func() {
+		e.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch loop did not exit")
+	}
+	e.Stop()
+	e.Attach(nil)
+
+	writePackets(t, fds[1], ipv4Packet(1, 1, 8))
+	time.Sleep(50 * time.Millisecond)
+	if n := r.len(); n != 1 {
+		t.Errorf("%d packets delivered, want only the one before stopping", n)
+	}
+}
@@ -0,0 +1,109 @@
+package endpoint
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// virtioNetHdrSize is the size of the virtio_net_hdr a TUN device created
+// with IFF_VNET_HDR puts in front of every packet.
+const virtioNetHdrSize = 10
+
+// Flags and GSO types of virtio_net_hdr, declared in linux/virtio_net.h.
+const (
+	virtioNetHdrFNeedsCsum = 1
+	virtioNetHdrFDataValid = 2
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+)
+
+// emptyVnetHdr prefixes outbound packets with GSO. It asks for neither
+// segmentation nor checksum offload, as the stack finishes every packet.
+var emptyVnetHdr [virtioNetHdrSize]byte
+
+// Offload flags of TUNSETOFFLOAD, declared in linux/if_tun.h.
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+)
+
+// WithGSO makes the endpoint exchange packets with a TUN device created
+// with IFF_VNET_HDR, and enables checksum and TCP segmentation offload on
+// it, so that the kernel hands over TCP segments coalesced up to 64KiB
+// instead of one per MTU. The virtio_net_hdr in front of every packet read
+// is stripped before the packet is delivered to the stack; outbound
+// packets get an empty one. NewEndpoint fails if the fd is a socket or
+// the device lacks IFF_VNET_HDR, which can only be set when the device is
+// created.
+func WithGSO(enabled bool) Option {
+	return func(e *endpoint) error {
+		e.gso = enabled
+		return nil
+	}
+}
+
+// enableOffload checks that the TUN device fd prefixes packets with a
+// virtio_net_hdr and enables the offloads the read path can take.
+func enableOffload(fd int) error {
+	ifr, err := unix.NewIfreq("")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.TUNGETIFF, ifr); err != nil {
+		return fmt.Errorf("gso: get tun flags: %w", err)
+	}
+	if ifr.Uint16()&unix.IFF_VNET_HDR == 0 {
+		return errors.New("gso: tun device was not created with IFF_VNET_HDR")
+	}
+	if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6); err != nil {
+		return fmt.Errorf("gso: set tun offload: %w", err)
+	}
+	return nil
+}
+
+// virtioNetHdr is declared in linux/virtio_net.h. Its fields are in host
+// byte order, which is little-endian on every platform Android runs on.
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func parseVirtioNetHdr(b []byte) virtioNetHdr {
+	return virtioNetHdr{
+		flags:      b[0],
+		gsoType:    b[1],
+		hdrLen:     binary.LittleEndian.Uint16(b[2:]),
+		gsoSize:    binary.LittleEndian.Uint16(b[4:]),
+		csumStart:  binary.LittleEndian.Uint16(b[6:]),
+		csumOffset: binary.LittleEndian.Uint16(b[8:]),
+	}
+}
+
+// apply honors h for pkt, the packet it was read with. A coalesced TCP
+// segment is delivered as is, as the stack takes segments larger than the
+// MSS; its checksum is only partial, which is why the kernel, having
+// built it, is trusted with the checksums of packets that need or have a
+// valid one. It reports false for segmentation the stack cannot take.
+func (h virtioNetHdr) apply(pkt stack.PacketBufferPtr) bool {
+	switch h.gsoType &^ virtioNetHdrGSOECN {
+	case virtioNetHdrGSONone, virtioNetHdrGSOTCPv4, virtioNetHdrGSOTCPv6:
+	default:
+		return false
+	}
+	if h.flags&(virtioNetHdrFNeedsCsum|virtioNetHdrFDataValid) != 0 {
+		pkt.RXChecksumValidated = true
+	}
+	return true
+}
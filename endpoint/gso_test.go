@@ -0,0 +1,122 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// pipe returns a non-blocking pipe, closed when the test ends.
+func pipe(t *testing.T) (r, w int) {
+	t.Helper()
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_NONBLOCK); err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	t.Cleanup(func() {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+	return fds[0], fds[1]
+}
+
+// vnetHdr returns a virtio_net_hdr with flags, gsoType and gsoSize.
+func vnetHdr(flags, gsoType uint8, gsoSize uint16) []byte {
+	b := make([]byte, virtioNetHdrSize)
+	b[0], b[1] = flags, gsoType
+	binary.LittleEndian.PutUint16(b[4:], gsoSize)
+	return b
+}
+
+// checksumRecorder is a packetRecorder also recording whether the
+// checksums of each packet were validated.
+type checksumRecorder struct {
+	packetRecorder
+	validated []bool
+}
+
+func (r *checksumRecorder) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	r.validated = append(r.validated, pkt.RXChecksumValidated)
+	r.packetRecorder.DeliverNetworkPacket(protocol, pkt)
+}
+
+// TestGSORead checks that the virtio_net_hdr in front of every packet read
+// is stripped, and that coalesced TCP segments larger than the MTU are
+// delivered whole while other segmentation is dropped.
+func TestGSORead(t *testing.T) {
+	// NewEndpoint only takes a TUN device with GSO, so the dispatcher
+	// reads from a pipe.
+	r, w := pipe(t)
+	e := &endpoint{mtu: 1500, gso: true}
+	d, err := newReadVDispatcher(r, e)
+	if err != nil {
+		t.Fatalf("new dispatcher: %v", err)
+	}
+	defer d.close()
+	defer d.release()
+	var rec checksumRecorder
+	e.dispatcher = &rec
+
+	for _, tc := range []struct {
+		name      string
+		hdr       []byte
+		pkt       []byte
+		delivered bool
+		validated bool
+	}{
+		{"plain", vnetHdr(0, virtioNetHdrGSONone, 0), ipv4Packet(1, 1, 100), true, false},
+		{"needs checksum", vnetHdr(virtioNetHdrFNeedsCsum, virtioNetHdrGSONone, 0), ipv4Packet(1, 2, 100), true, true},
+		{"coalesced", vnetHdr(virtioNetHdrFNeedsCsum, virtioNetHdrGSOTCPv4, 1460), ipv4Packet(1, 3, 4000), true, true},
+		{"coalesced ecn", vnetHdr(virtioNetHdrFNeedsCsum, virtioNetHdrGSOTCPv4|virtioNetHdrGSOECN, 1460), ipv4Packet(1, 4, 3000), true, true},
+		// UDP fragmentation offload, which the stack cannot take.
+		{"udp", vnetHdr(virtioNetHdrFNeedsCsum, 3, 1460), ipv4Packet(1, 5, 3000), false, false},
+		{"header only", vnetHdr(0, virtioNetHdrGSONone, 0), nil, false, false},
+	} {
+		before, malformed := rec.len(), e.malformed.Load()
+		writePackets(t, w, append(tc.hdr, tc.pkt...))
+		if cont, err := d.dispatch(); !cont || err != nil {
+			t.Fatalf("%s: dispatch: %t, %v", tc.name, cont, err)
+		}
+		if !tc.delivered {
+			if rec.len() != before || e.malformed.Load() != malformed+1 {
+				t.Errorf("%s: delivered instead of dropped", tc.name)
+			}
+			continue
+		}
+		if rec.len() != before+1 {
+			t.Fatalf("%s: not delivered", tc.name)
+		}
+		if got := rec.packets[before]; !bytes.Equal(got, tc.pkt) {
+			t.Errorf("%s: delivered %d bytes, want the %d bytes after the header", tc.name, len(got), len(tc.pkt))
+		}
+		if rec.validated[before] != tc.validated {
+			t.Errorf("%s: checksums validated %t, want %t", tc.name, rec.validated[before], tc.validated)
+		}
+	}
+}
+
+// TestGSOWrite checks that outbound packets get an empty virtio_net_hdr.
+func TestGSOWrite(t *testing.T) {
+	r, w := pipe(t)
+	e := &endpoint{fd: w, mtu: 1500, gso: true}
+	pkt := ipv4Packet(1, 1, 100)
+	if _, err := e.WritePackets(packetList(pkt)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	b := make([]byte, 2048)
+	n, err := unix.Read(r, b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if want := append(make([]byte, virtioNetHdrSize), pkt...); !bytes.Equal(b[:n], want) {
+		t.Errorf("wrote %x, want %x", b[:n], want)
+	}
+
+	if _, err := NewEndpoint(int32(r), 1500, WithGSO(true)); err == nil {
+		t.Error("created a gso endpoint on a pipe")
+	}
+}
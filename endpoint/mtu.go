@@ -0,0 +1,25 @@
+package endpoint
+
+import "fmt"
+
+const (
+	// minMTU is the smallest MTU every IPv4 host must accept (RFC 791).
+	minMTU = 576
+	// maxMTU is the largest IP packet.
+	maxMTU = 65535
+)
+
+// WithMTU overrides the MTU given to NewEndpoint, which is the MTU the
+// stack sees and thus bounds the MSS it advertises. Lower it to that of
+// the link the traffic leaves on, such as 1492 for PPPoE, to keep packets
+// from being fragmented. It must be at least 576, and at least 1280 for
+// IPv6 to work. Read buffers are sized to hold a packet of the MTU.
+func WithMTU(mtu uint32) Option {
+	return func(e *endpoint) error {
+		if mtu < minMTU || mtu > maxMTU {
+			return fmt.Errorf("mtu %d out of range [%d, %d]", mtu, minMTU, maxMTU)
+		}
+		e.mtu = mtu
+		return nil
+	}
+}
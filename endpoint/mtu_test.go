@@ -0,0 +1,47 @@
+package endpoint
+
+import (
+	"reflect"
+	"testing"
+)
+
+// readBufferSizes returns the sizes of the views the first dispatcher of e
+// reads into.
+func readBufferSizes(t *testing.T, e *endpoint) []int {
+	t.Helper()
+	d, ok := e.inbound[0].(*readVDispatcher)
+	if !ok {
+		t.Fatalf("dispatcher %T, want readv", e.inbound[0])
+	}
+	var sizes []int
+	for _, iov := range d.buf.nextIovecs() {
+		sizes = append(sizes, int(iov.Len))
+	}
+	return sizes
+}
+
+func TestWithMTU(t *testing.T) {
+	for _, tc := range []struct {
+		mtu   uint32
+		sizes []int
+	}{
+		{1500, []int{128, 256, 256, 512, 1024}},
+		{1492, []int{128, 256, 256, 512, 1024}},
+		{576, []int{128, 256, 256}},
+		{9000, []int{128, 256, 256, 512, 1024, 2048, 4096, 8192}},
+	} {
+		e, _ := socketEndpoint(t, WithMTU(tc.mtu))
+		if got := e.MTU(); got != tc.mtu {
+			t.Errorf("mtu %d: endpoint reports %d", tc.mtu, got)
+		}
+		if sizes := readBufferSizes(t, e); !reflect.DeepEqual(sizes, tc.sizes) {
+			t.Errorf("mtu %d: read buffers %v, want %v", tc.mtu, sizes, tc.sizes)
+		}
+	}
+
+	for _, mtu := range []uint32{0, minMTU - 1, maxMTU + 1} {
+		if _, err := NewEndpoint(-1, 1500, WithMTU(mtu)); err == nil {
+			t.Errorf("created an endpoint with mtu %d", mtu)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package endpoint
+
+// Option configures an endpoint created by NewEndpoint.
+type Option func(*endpoint) error
@@ -5,11 +5,12 @@ import (
 	"gvisor.dev/gvisor/pkg/bufferv2"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
-	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
 // BufConfig defines the shape of the buffer used to read packets from the NIC.
+// It is the default for endpoints without WithReadBuffers; changing it only
+// affects endpoints created afterwards.
 var BufConfig = []int{128, 256, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768}
 
 type iovecBuffer struct {
@@ -26,11 +27,15 @@ type iovecBuffer struct {
 	iovecs []unix.Iovec
 
 	// sizes is an array of buffer sizes for the underlying views. sizes is
-	// immutable.
+	// immutable; setSizes replaces it.
 	sizes []int
 
 	// skipsVnetHdr is true if virtioNetHdr is to skipped.
-	// skipsVnetHdr bool
+	skipsVnetHdr bool
+
+	// vnetHdr holds the virtioNetHdr of the last packet read if
+	// skipsVnetHdr is set.
+	vnetHdr [virtioNetHdrSize]byte
 
 	// pulledIndex is the index of the last []byte buffer pulled from the
 	// underlying buffer storage during a call to pullBuffers. It is -1
@@ -38,18 +43,32 @@ type iovecBuffer struct {
 	// pulledIndex int
 }
 
-func newIovecBuffer(sizes []int) *iovecBuffer {
-	b := &iovecBuffer{
-		views: make([]*bufferv2.View, len(sizes)),
-		sizes: sizes,
-	}
+func newIovecBuffer(sizes []int, skipsVnetHdr bool) *iovecBuffer {
+	b := &iovecBuffer{skipsVnetHdr: skipsVnetHdr}
+	b.setSizes(sizes)
+	return b
+}
+
+// setSizes reshapes b to views of sizes, releasing the views it owns. The
+// iovecs returned by nextIovecs before must no longer be used.
+func (b *iovecBuffer) setSizes(sizes []int) {
+	b.release()
+	b.views = make([]*bufferv2.View, len(sizes))
+	b.sizes = sizes
 	niov := len(b.views)
+	if b.skipsVnetHdr {
+		niov++
+	}
 	b.iovecs = make([]unix.Iovec, niov)
-	return b
 }
 
 func (b *iovecBuffer) nextIovecs() []unix.Iovec {
 	vnetHdrOff := 0
+	if b.skipsVnetHdr {
+		b.iovecs[0] = unix.Iovec{Base: &b.vnetHdr[0]}
+		b.iovecs[0].SetLen(virtioNetHdrSize)
+		vnetHdrOff++
+	}
 
 	for i := range b.views {
 		if b.views[i] != nil {
@@ -64,42 +83,79 @@ func (b *iovecBuffer) nextIovecs() []unix.Iovec {
 }
 
 // pullBuffer extracts the enough underlying storage from b.buffer to hold n
-// bytes. It removes this storage from b.buffer, returns a new buffer
-// that holds the storage, and updates pulledIndex to indicate which part
-// of b.buffer's storage must be reallocated during the next call to
-// nextIovecs.
+// bytes. It removes this storage from b.buffer and returns a new buffer
+// that holds the storage; the views removed are reallocated during the
+// next call to nextIovecs.
+//
+// Views and their chunks come from the pools of the bufferv2 package: the
+// returned buffer owns the pulled views and gives them back to the pools
+// once the packet is released, so that only views left in b stay owned
+// by it. The last pulled view is capped to the packet rather than split,
+// so no part of it remains shared with b.
 func (b *iovecBuffer) pullBuffer(n int) bufferv2.Buffer {
-	var views []*bufferv2.View
+	var pulled bufferv2.Buffer
 	c := 0
-	// Remove the used views from the buffer.
 	for i, v := range b.views {
 		c += v.Size()
 		if c >= n {
-			b.views[i].CapLength(v.Size() - (c - n))
-			views = append(views, b.views[:i+1]...)
-			break
+			v.CapLength(v.Size() - (c - n))
 		}
-	}
-	for i := range views {
-		b.views[i] = nil
-	}
-	pulled := bufferv2.Buffer{}
-	for _, v := range views {
 		pulled.Append(v)
+		b.views[i] = nil
+		if c >= n {
+			break
+		}
 	}
 	pulled.Truncate(int64(n))
 	return pulled
 }
 
+// pullPacket pulls the n bytes read into b as a packet. If b skips a vnet
+// header, the header is stripped and applied to the packet. It returns a
+// nil packet if the packet must be dropped.
+func (b *iovecBuffer) pullPacket(n int) stack.PacketBufferPtr {
+	if !b.skipsVnetHdr {
+		return stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: b.pullBuffer(n),
+		})
+	}
+	if n <= virtioNetHdrSize {
+		return stack.PacketBufferPtr{}
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: b.pullBuffer(n - virtioNetHdrSize),
+	})
+	if !parseVirtioNetHdr(b.vnetHdr[:]).apply(pkt) {
+		pkt.DecRef()
+		return stack.PacketBufferPtr{}
+	}
+	return pkt
+}
+
+// release gives the views still owned by b back to their pool. b must not
+// be used afterwards.
 func (b *iovecBuffer) release() {
-	for _, v := range b.views {
+	for i, v := range b.views {
 		if v != nil {
 			v.Release()
-			v = nil
+			b.views[i] = nil
 		}
 	}
 }
 
+// linkDispatcher reads inbound packets from a file descriptor and
+// dispatches them.
+type linkDispatcher interface {
+	// stop makes a blocked dispatch return false; it may be called more
+	// than once until close.
+	stop()
+	dispatch() (bool, tcpip.Error)
+	// release frees the buffers once the dispatch loop returned.
+	release()
+	// close frees the stop signal once the dispatch loop returned.
+	close()
+}
+
 // readVDispatcher uses readv() system call to read inbound packets and
 // dispatches them.
 type readVDispatcher struct {
@@ -112,6 +168,9 @@ type readVDispatcher struct {
 
 	// buf is the iovec buffer that contains the packet contents.
 	buf *iovecBuffer
+
+	// ladder shapes buf with WithAdaptiveBuffers, or is nil.
+	ladder *bufferLadder
 }
 
 func newReadVDispatcher(fd int, e *endpoint) (*readVDispatcher, error) {
@@ -124,7 +183,9 @@ func newReadVDispatcher(fd int, e *endpoint) (*readVDispatcher, error) {
 		fd:     fd,
 		e:      e,
 	}
-	d.buf = newIovecBuffer(BufConfig)
+	sizes := e.bufConfig()
+	d.buf = newIovecBuffer(sizes, e.gso)
+	d.ladder = e.newBufferLadder(sizes)
 	return d, nil
 }
 
@@ -134,34 +195,51 @@ func (d *readVDispatcher) release() {
 
 // dispatch reads one packet from the file descriptor and dispatches it.
 func (d *readVDispatcher) dispatch() (bool, tcpip.Error) {
-	n, err := rawfile.BlockingReadvUntilStopped(d.efd, d.fd, d.buf.nextIovecs())
+	n, err := blockingReadvUntilStopped(d.efd, d.fd, d.buf.nextIovecs(), &d.e.readRetries)
 	if n <= 0 || err != nil {
 		return false, err
 	}
 
-	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
-		Payload: d.buf.pullBuffer(n),
-	})
+	pkt := d.buf.pullPacket(n)
+	if pkt.IsNil() {
+		d.e.drop(&d.e.malformed, "dropping packet with truncated or unsupported virtio_net_hdr")
+		return true, nil
+	}
 	defer pkt.DecRef()
+	if d.ladder != nil && d.ladder.observe(pkt.Size()) {
+		d.buf.setSizes(d.ladder.sizes())
+	}
 
-	var p tcpip.NetworkProtocolNumber
-	// We don't get any indication of what the packet is, so try to guess
-	// if it's an IPv4 or IPv6 packet.
-	// IP version information is at the first octet, so pulling up 1 byte.
+	if p, ok := d.e.packetProtocol(pkt); ok {
+		d.e.deliver(p, pkt)
+	}
+	return true, nil
+}
+
+// packetProtocol guesses the network protocol of pkt. We don't get any
+// indication of what the packet is, so try to guess if it's an IPv4 or
+// IPv6 packet. IP version information is at the first octet, so pulling
+// up 1 byte. Packets that are not IP or too short are counted as dropped.
+func (e *endpoint) packetProtocol(pkt stack.PacketBufferPtr) (tcpip.NetworkProtocolNumber, bool) {
 	h, ok := pkt.Data().PullUp(1)
 	if !ok {
-		return true, nil
+		e.drop(&e.malformed, "dropping empty packet")
+		return 0, false
 	}
-	switch header.IPVersion(h) {
+	var p tcpip.NetworkProtocolNumber
+	var min int
+	switch v := header.IPVersion(h); v {
 	case header.IPv4Version:
-		p = header.IPv4ProtocolNumber
+		p, min = header.IPv4ProtocolNumber, header.IPv4MinimumSize
 	case header.IPv6Version:
-		p = header.IPv6ProtocolNumber
+		p, min = header.IPv6ProtocolNumber, header.IPv6MinimumSize
 	default:
-		return true, nil
+		e.drop(&e.unknownVersion, "dropping packet of unknown IP version %d", v)
+		return 0, false
 	}
-
-	d.e.dispatcher.DeliverNetworkPacket(p, pkt)
-
-	return true, nil
+	if size := pkt.Data().Size(); size < min {
+		e.drop(&e.malformed, "dropping IPv%d packet of %d bytes", header.IPVersion(h), size)
+		return 0, false
+	}
+	return p, true
 }
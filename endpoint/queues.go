@@ -0,0 +1,20 @@
+package endpoint
+
+import "errors"
+
+// WithQueues reads inbound packets from the further queues fds of a
+// multi-queue TUN (IFF_MULTI_QUEUE) besides the fd given to NewEndpoint,
+// each on a goroutine of its own with its own buffers, all feeding the
+// same stack. Outbound packets are written to the fd given to
+// NewEndpoint. Detaching the endpoint stops every queue.
+func WithQueues(fds []int) Option {
+	return func(e *endpoint) error {
+		for _, fd := range fds {
+			if fd < 0 {
+				return errors.New("invalid queue fd")
+			}
+		}
+		e.queues = append(e.queues, fds...)
+		return nil
+	}
+}
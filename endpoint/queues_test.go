@@ -0,0 +1,80 @@
+package endpoint
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// TestQueues checks that packets arriving on either queue are delivered,
+// and that stopping the endpoint ends the dispatch loops of both.
+func TestQueues(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		t.Fatalf("set nonblock: %v", err)
+	}
+	baseline := runtime.NumGoroutine()
+	e, fd := socketEndpoint(t, WithQueues([]int{fds[0]}))
+	if len(e.inbound) != 2 {
+		t.Fatalf("%d dispatchers, want one per queue", len(e.inbound))
+	}
+	var r packetRecorder
+	e.Attach(&r)
+
+	// Each queue gets packets of its own source, read in parallel.
+	const n = 64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			unix.Write(fds[1], ipv4Packet(2, uint16(i), 8))
+		}
+	}()
+	for i := 0; i < n; i++ {
+		writePackets(t, fd, ipv4Packet(1, uint16(i), 8))
+	}
+	<-done
+	count := make(map[byte]int)
+	for _, b := range r.wait(t, 2*n) {
+		count[header.IPv4(b).SourceAddress()[3]]++
+	}
+	if count[1] != n || count[2] != n {
+		t.Errorf("delivered %d packets of the first queue and %d of the second, want %d each", count[1], count[2], n)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		e.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch loops did not exit")
+	}
+	// The loops return just before their goroutines exit.
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > baseline; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Errorf("%d goroutines after stopping, want %d", runtime.NumGoroutine(), baseline)
+			break
+		}
+	}
+	writePackets(t, fd, ipv4Packet(1, n, 8))
+	writePackets(t, fds[1], ipv4Packet(2, n, 8))
+	time.Sleep(50 * time.Millisecond)
+	if got := r.len(); got != 2*n {
+		t.Errorf("%d packets delivered, want only the %d before stopping", got, 2*n)
+	}
+
+	if _, err := NewEndpoint(-1, 1500, WithQueues([]int{-1})); err == nil {
+		t.Error("created an endpoint with an invalid queue")
+	}
+}
@@ -0,0 +1,43 @@
+package endpoint
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
+)
+
+// blockingReadvUntilStopped works like rawfile.BlockingReadvUntilStopped,
+// except that transient conditions are retried instead of being reported:
+// EINTR, and EAGAIN returned although poll reported the fd readable. Each
+// retry is counted in retries. Only genuine errors are returned.
+func blockingReadvUntilStopped(efd int, fd int, iovecs []unix.Iovec, retries *atomic.Uint64) (int, tcpip.Error) {
+	polled := false
+	for {
+		n, _, e := unix.RawSyscall(unix.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+		switch e {
+		case 0:
+			return int(n), nil
+		case unix.EINTR:
+			retries.Add(1)
+			continue
+		case unix.EAGAIN:
+			if polled {
+				retries.Add(1)
+			}
+		default:
+			return 0, rawfile.TranslateErrno(e)
+		}
+
+		stopped, e := rawfile.BlockingPollUntilStopped(efd, fd, unix.POLLIN)
+		if stopped {
+			return -1, nil
+		}
+		if e != 0 && e != unix.EINTR {
+			return 0, rawfile.TranslateErrno(e)
+		}
+		polled = e == 0
+	}
+}
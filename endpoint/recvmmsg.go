@@ -0,0 +1,182 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
+)
+
+// DefaultBatchSize is the number of packets read per system call when
+// batching is enabled with a size of 0.
+const DefaultBatchSize = 8
+
+// WithBatchSize reads up to n inbound packets per recvmmsg system call
+// instead of one per readv, or DefaultBatchSize if n is 0. recvmmsg only
+// works on sockets, e.g. one end of a socketpair standing in for the TUN;
+// for any other fd, such as a TUN device, the endpoint falls back to
+// readv.
+func WithBatchSize(n int) Option {
+	return func(e *endpoint) error {
+		if n < 0 {
+			return fmt.Errorf("invalid batch size: %d", n)
+		}
+		if n == 0 {
+			n = DefaultBatchSize
+		}
+		e.batchSize = n
+		return nil
+	}
+}
+
+// newDispatcher returns a recvmmsg dispatcher for fd if batching is
+// enabled and fd is a socket, and a readv dispatcher otherwise.
+func newDispatcher(fd int, socket bool, e *endpoint) (linkDispatcher, error) {
+	if e.batchSize > 1 && socket {
+		return newRecvMMsgDispatcher(fd, e, e.batchSize)
+	}
+	return newReadVDispatcher(fd, e)
+}
+
+// isSocket reports whether fd is a socket rather than e.g. a TUN device.
+func isSocket(fd int) (bool, error) {
+	_, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if errors.Is(err, unix.ENOTSOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// recvMMsgDispatcher uses the recvmmsg system call to read inbound packets
+// and dispatches them.
+type recvMMsgDispatcher struct {
+	stopFd
+	// fd is the file descriptor used to send and receive packets.
+	fd int
+
+	// e is the endpoint this dispatcher is attached to.
+	e *endpoint
+
+	// bufs is an array of iovec buffers that contain packet contents.
+	bufs []*iovecBuffer
+
+	// msgHdrs is an array of MMsgHdr objects where each MMsghdr is used to
+	// reference an array of iovecs in the iovecs field defined above. This
+	// array is passed as the parameter to recvmmsg call to retrieve
+	// potentially more than 1 packet per call.
+	msgHdrs []rawfile.MMsgHdr
+
+	// ladder shapes bufs with WithAdaptiveBuffers, or is nil.
+	ladder *bufferLadder
+}
+
+func newRecvMMsgDispatcher(fd int, e *endpoint, n int) (*recvMMsgDispatcher, error) {
+	stopFd, err := newStopFd()
+	if err != nil {
+		return nil, err
+	}
+	d := &recvMMsgDispatcher{
+		stopFd:  stopFd,
+		fd:      fd,
+		e:       e,
+		bufs:    make([]*iovecBuffer, n),
+		msgHdrs: make([]rawfile.MMsgHdr, n),
+	}
+	sizes := e.bufConfig()
+	for i := range d.bufs {
+		d.bufs[i] = newIovecBuffer(sizes, e.gso)
+	}
+	d.ladder = e.newBufferLadder(sizes)
+	return d, nil
+}
+
+func (d *recvMMsgDispatcher) release() {
+	for _, b := range d.bufs {
+		b.release()
+	}
+}
+
+// dispatch reads up to a batch of packets from the file descriptor and
+// dispatches them in order.
+func (d *recvMMsgDispatcher) dispatch() (bool, tcpip.Error) {
+	// Fill message headers.
+	for k := range d.msgHdrs {
+		if d.msgHdrs[k].Msg.Iovlen > 0 {
+			break
+		}
+		iovecs := d.bufs[k].nextIovecs()
+		d.msgHdrs[k].Len = 0
+		d.msgHdrs[k].Msg.Iov = &iovecs[0]
+		d.msgHdrs[k].Msg.SetIovlen(len(iovecs))
+	}
+
+	nMsgs, err := blockingRecvMMsgUntilStopped(d.efd, d.fd, d.msgHdrs, &d.e.readRetries)
+	if nMsgs <= 0 || err != nil {
+		return false, err
+	}
+
+	reshape := false
+	for k := 0; k < nMsgs; k++ {
+		pkt := d.bufs[k].pullPacket(int(d.msgHdrs[k].Len))
+		// Mark that this iovec has been processed.
+		d.msgHdrs[k].Msg.Iovlen = 0
+		if pkt.IsNil() {
+			d.e.drop(&d.e.malformed, "dropping packet with truncated or unsupported virtio_net_hdr")
+			continue
+		}
+		if d.ladder != nil && d.ladder.observe(pkt.Size()) {
+			reshape = true
+		}
+
+		if p, ok := d.e.packetProtocol(pkt); ok {
+			d.e.deliver(p, pkt)
+		}
+		pkt.DecRef()
+	}
+	// Reshaping releases the views of every buffer, including those of the
+	// message headers this batch did not use, so all of them are marked
+	// for refilling before the next read.
+	if reshape {
+		sizes := d.ladder.sizes()
+		for k, b := range d.bufs {
+			b.setSizes(sizes)
+			d.msgHdrs[k].Msg.Iovlen = 0
+		}
+	}
+	return true, nil
+}
+
+// blockingRecvMMsgUntilStopped is the recvmmsg counterpart of
+// blockingReadvUntilStopped.
+func blockingRecvMMsgUntilStopped(efd int, fd int, msgHdrs []rawfile.MMsgHdr, retries *atomic.Uint64) (int, tcpip.Error) {
+	polled := false
+	for {
+		n, _, e := unix.RawSyscall6(unix.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgHdrs[0])), uintptr(len(msgHdrs)), unix.MSG_DONTWAIT, 0, 0)
+		switch e {
+		case 0:
+			return int(n), nil
+		case unix.EINTR:
+			retries.Add(1)
+			continue
+		case unix.EAGAIN:
+			if polled {
+				retries.Add(1)
+			}
+		default:
+			return 0, rawfile.TranslateErrno(e)
+		}
+
+		stopped, e := rawfile.BlockingPollUntilStopped(efd, fd, unix.POLLIN)
+		if stopped {
+			return -1, nil
+		}
+		if e != 0 && e != unix.EINTR {
+			return 0, rawfile.TranslateErrno(e)
+		}
+		polled = e == 0
+	}
+}
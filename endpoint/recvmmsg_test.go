@@ -0,0 +1,62 @@
+package endpoint
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestWithBatchSize(t *testing.T) {
+	if _, err := NewEndpoint(-1, 1500, WithBatchSize(-1)); err == nil {
+		t.Error("created an endpoint with a negative batch size")
+	}
+
+	e, _ := socketEndpoint(t, WithBatchSize(0))
+	if d, ok := e.inbound[0].(*recvMMsgDispatcher); !ok || len(d.bufs) != DefaultBatchSize {
+		t.Errorf("socket with the default batch size got dispatcher %T", e.inbound[0])
+	}
+
+	// A pipe is not a socket, so the endpoint falls back to readv.
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_NONBLOCK); err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	e, err := NewEndpoint(int32(fds[0]), 1500, WithBatchSize(8))
+	if err != nil {
+		t.Fatalf("new endpoint: %v", err)
+	}
+	defer e.Stop()
+	if _, ok := e.inbound[0].(*readVDispatcher); !ok {
+		t.Errorf("pipe got dispatcher %T, want readv", e.inbound[0])
+	}
+}
+
+// TestRecvMMsgOrder checks that packets read in batches are all delivered,
+// intact and in order.
+func TestRecvMMsgOrder(t *testing.T) {
+	const n = 100
+	e, fd := socketEndpoint(t, WithBatchSize(8))
+	var sent [][]byte
+	for i := 0; i < n; i++ {
+		// Sizes vary so that packets span different numbers of views.
+		sent = append(sent, ipv4Packet(1, uint16(i), i*13%1400))
+	}
+	// Packets queued before attaching are read in full batches.
+	writePackets(t, fd, sent...)
+	var r packetRecorder
+	e.Attach(&r)
+	for i, b := range r.wait(t, n) {
+		if !bytes.Equal(b, sent[i]) {
+			t.Fatalf("packet %d is %d bytes with id %d, want %d bytes with id %d", i, len(b), header.IPv4(b).ID(), len(sent[i]), i)
+		}
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	b.Run("readv", func(b *testing.B) { benchmarkDelivery(b) })
+	b.Run("recvmmsg", func(b *testing.B) { benchmarkDelivery(b, WithBatchSize(DefaultBatchSize)) })
+}
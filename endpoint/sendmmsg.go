@@ -0,0 +1,44 @@
+package endpoint
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// sendPackets writes pkts to the socket fd with as few sendmmsg calls as
+// possible, one message per packet. When the kernel accepts fewer
+// messages than submitted, the remainder is submitted again.
+func (e *endpoint) sendPackets(pkts []stack.PacketBufferPtr) (int, tcpip.Error) {
+	mmsgHdrs := make([]rawfile.MMsgHdr, 0, len(pkts))
+	var tooLong bool
+	for _, pkt := range pkts {
+		if uint32(pkt.Size()) > e.mtu {
+			tooLong = true
+			break
+		}
+		iovecs := e.iovecsOf(pkt.AsSlices())
+		var mmsgHdr rawfile.MMsgHdr
+		if len(iovecs) > 0 {
+			mmsgHdr.Msg.Iov = &iovecs[0]
+			mmsgHdr.Msg.SetIovlen(len(iovecs))
+		}
+		mmsgHdrs = append(mmsgHdrs, mmsgHdr)
+	}
+
+	sent := 0
+	for sent < len(mmsgHdrs) {
+		n, err := rawfile.NonBlockingSendMMsg(e.fd, mmsgHdrs[sent:])
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			return sent, &tcpip.ErrWouldBlock{}
+		}
+		sent += n
+	}
+	if tooLong {
+		return sent, &tcpip.ErrMessageTooLong{}
+	}
+	return sent, nil
+}
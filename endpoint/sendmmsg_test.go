@@ -0,0 +1,115 @@
+package endpoint
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// outboundPacket returns b as a packet whose IP header and payload are
+// separate views, like the packets of a stack.
+func outboundPacket(b []byte) stack.PacketBufferPtr {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: header.IPv4MinimumSize,
+		Payload:            bufferv2.MakeWithData(b[header.IPv4MinimumSize:]),
+	})
+	copy(pkt.NetworkHeader().Push(header.IPv4MinimumSize), b)
+	return pkt
+}
+
+func packetList(pkts ...[]byte) stack.PacketBufferList {
+	var l stack.PacketBufferList
+	for _, b := range pkts {
+		l.PushBack(outboundPacket(b))
+	}
+	return l
+}
+
+// TestSendMMsg checks that packets written in a batch arrive as messages
+// of their own.
+func TestSendMMsg(t *testing.T) {
+	const n = 64
+	e, fd := socketEndpoint(t)
+	var sent [][]byte
+	for i := 0; i < n; i++ {
+		sent = append(sent, ipv4Packet(1, uint16(i), i*17%1400))
+	}
+	l := packetList(sent...)
+	defer l.DecRef()
+	if written, err := e.WritePackets(l); written != n || err != nil {
+		t.Fatalf("wrote %d packets, %v, want %d", written, err, n)
+	}
+	b := make([]byte, 2048)
+	for i := range sent {
+		m, err := unix.Read(fd, b)
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if !bytes.Equal(b[:m], sent[i]) {
+			t.Fatalf("message %d is %d bytes, want packet %d of %d bytes", i, m, i, len(sent[i]))
+		}
+	}
+}
+
+// TestSendMMsgTooLong checks that a batch stops at the first packet larger
+// than the MTU, after writing the packets before it.
+func TestSendMMsgTooLong(t *testing.T) {
+	e, fd := socketEndpoint(t)
+	l := packetList(ipv4Packet(1, 0, 8), ipv4Packet(1, 1, 8), ipv4Packet(1, 2, 1500), ipv4Packet(1, 3, 8))
+	defer l.DecRef()
+	written, err := e.WritePackets(l)
+	if _, ok := err.(*tcpip.ErrMessageTooLong); written != 2 || !ok {
+		t.Fatalf("wrote %d packets, %v, want 2 and a too long error", written, err)
+	}
+	unix.SetNonblock(fd, true)
+	b := make([]byte, 2048)
+	for i := 0; ; i++ {
+		if _, err := unix.Read(fd, b); err != nil {
+			if i != 2 {
+				t.Errorf("read %d messages, want 2", i)
+			}
+			break
+		}
+	}
+}
+
+// benchmarkWritePackets measures writing 1000 byte packets in lists of
+// batch packets.
+func benchmarkWritePackets(b *testing.B, batch int) {
+	e, fd := socketEndpoint(b)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, err := unix.Read(fd, buf); err != nil {
+				return
+			}
+		}
+	}()
+	pkts := make([][]byte, batch)
+	for i := range pkts {
+		pkts[i] = ipv4Packet(1, uint16(i), 1000)
+	}
+	b.SetBytes(int64(len(pkts[0])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batch {
+		for done := 0; done < len(pkts); {
+			l := packetList(pkts[done:]...)
+			n, err := e.WritePackets(l)
+			l.DecRef()
+			done += n
+			if _, ok := err.(*tcpip.ErrWouldBlock); ok || n == 0 {
+				unix.Poll([]unix.PollFd{{Fd: int32(e.fd), Events: unix.POLLOUT}}, -1)
+			}
+		}
+	}
+}
+
+func BenchmarkWritePackets(b *testing.B) {
+	b.Run("writev", func(b *testing.B) { benchmarkWritePackets(b, 1) })
+	b.Run("sendmmsg", func(b *testing.B) { benchmarkWritePackets(b, 64) })
+}
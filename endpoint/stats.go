@@ -0,0 +1,63 @@
+package endpoint
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Stats are the counters of an endpoint.
+type Stats struct {
+	// ReadRetries counts fd reads retried after a transient condition
+	// such as EINTR.
+	ReadRetries uint64
+	// Malformed counts inbound packets dropped because they are shorter
+	// than the IP header of their version or, with GSO, carry a
+	// virtio_net_hdr that cannot be honored.
+	Malformed uint64
+	// UnknownVersion counts inbound packets dropped because their IP
+	// version is neither 4 nor 6, which usually means the fd is not a
+	// TUN device in IFF_NO_PI mode.
+	UnknownVersion uint64
+	// BufferReshapes counts the times a dispatcher reshaped its read
+	// buffers with WithAdaptiveBuffers.
+	BufferReshapes uint64
+}
+
+// dropLog logs the first dropped packets.
+type dropLog struct {
+	logf      func(format string, v ...any)
+	remaining atomic.Int64
+}
+
+// WithDropLogger passes a description of each of the first n inbound
+// packets the endpoint drops to logf, to help debug a misconfigured TUN.
+// Drops are counted in Stats either way.
+func WithDropLogger(logf func(format string, v ...any), n int) Option {
+	return func(e *endpoint) error {
+		if logf == nil || n <= 0 {
+			return errors.New("drop logger must not be nil and its count positive")
+		}
+		e.dropLog.logf = logf
+		e.dropLog.remaining.Store(int64(n))
+		return nil
+	}
+}
+
+// Stats returns a snapshot of the endpoint's counters.
+func (e *endpoint) Stats() Stats {
+	return Stats{
+		ReadRetries:    e.readRetries.Load(),
+		Malformed:      e.malformed.Load(),
+		UnknownVersion: e.unknownVersion.Load(),
+		BufferReshapes: e.reshapes.Load(),
+	}
+}
+
+// drop counts a dropped inbound packet in counter and logs it while the
+// drop logger has occurrences left.
+func (e *endpoint) drop(counter *atomic.Uint64, format string, v ...any) {
+	counter.Add(1)
+	if e.dropLog.logf != nil && e.dropLog.remaining.Add(-1) >= 0 {
+		e.dropLog.logf(format, v...)
+	}
+}
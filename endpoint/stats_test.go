@@ -0,0 +1,25 @@
+package endpoint
+
+import "testing"
+
+// TestStatsDrops checks that the dispatcher of an fd endpoint counts a
+// truncated packet as malformed and a version 5 packet as of unknown
+// version, and delivers neither.
+func TestStatsDrops(t *testing.T) {
+	e, fd := socketEndpoint(t)
+	var r packetRecorder
+	e.Attach(&r)
+
+	truncated := ipv4Packet(1, 0, 0)[:10]
+	version5 := ipv4Packet(2, 0, 8)
+	version5[0] = 5<<4 | version5[0]&0xf
+	writePackets(t, fd, truncated, version5, ipv4Packet(3, 0, 8))
+	// Packets are read in order, so the last being delivered means the
+	// others were handled.
+	if pkts := r.wait(t, 1); len(pkts) != 1 || pkts[0][15] != 3 {
+		t.Fatalf("delivered %x, want only the valid packet", pkts)
+	}
+	if got := e.Stats(); got.Malformed != 1 || got.UnknownVersion != 1 {
+		t.Errorf("stats %+v, want 1 malformed and 1 of unknown version", got)
+	}
+}
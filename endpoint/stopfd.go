@@ -34,14 +34,22 @@ func newStopFd() (stopFd, error) {
 }
 
 // stop writes to the eventfd and notifies the dispatcher to stop. It does not
-// block.
+// block, and may be called more than once until close is called.
 func (s *stopFd) stop() {
 	increment := []byte{1, 0, 0, 0, 0, 0, 0, 0}
 	if n, err := unix.Write(s.efd, increment); n != len(increment) || err != nil {
 		// There are two possible errors documented in eventfd(2) for writing:
 		// 1. We are writing 8 bytes and not 0xffffffffffffff, thus no EINVAL.
-		// 2. stop is only supposed to be called once, it can't reach the limit,
-		// thus no EAGAIN.
+		// 2. Each call adds 1 to the counter, which never reaches the limit
+		// within the life of a process, thus no EAGAIN.
 		panic(fmt.Sprintf("write(efd) = (%d, %s), want (%d, nil)", n, err, len(increment)))
 	}
 }
+
+// close closes the eventfd. The dispatcher must have stopped.
+func (s *stopFd) close() {
+	if s.efd >= 0 {
+		unix.Close(s.efd)
+		s.efd = -1
+	}
+}
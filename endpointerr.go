@@ -0,0 +1,44 @@
+package libmitm
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// EndpointError describes a flow that was dropped because its client
+// facing endpoint could not be created.
+type EndpointError struct {
+	// Network is "tcp" or "udp".
+	Network         string
+	Source          string
+	SourcePort      int
+	Destination     string
+	DestinationPort int
+	// Err is the description of the stack's error.
+	Err string
+}
+
+// ErrorHandler receives the flows dropped because the stack failed to
+// create their endpoint, e.g. to count and alert on them. EndpointFailed
+// is called on the forwarder's goroutine and should return quickly.
+type ErrorHandler interface {
+	EndpointFailed(e *EndpointError)
+}
+
+// endpointFailed reports that the endpoint of the flow with the given ID
+// over network could not be created: to the error handler if set, and to
+// the log otherwise.
+func (t *TUN) endpointFailed(network string, id stack.TransportEndpointID, err tcpip.Error) {
+	if t.ErrorHandler == nil {
+		t.log().Errorf("%s: creating endpoint for %s to %s: %s", network, sourceId(id), addressId(id), err)
+		return
+	}
+	t.ErrorHandler.EndpointFailed(&EndpointError{
+		Network:         network,
+		Source:          id.RemoteAddress.String(),
+		SourcePort:      int(id.RemotePort),
+		Destination:     id.LocalAddress.String(),
+		DestinationPort: int(id.LocalPort),
+		Err:             err.String(),
+	})
+}
@@ -0,0 +1,47 @@
+package libmitm
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// errorChannel is an ErrorHandler sending the failures to a channel.
+type errorChannel chan *EndpointError
+
+func (c errorChannel) EndpointFailed(e *EndpointError) { c <- e }
+
+func TestErrorHandler(t *testing.T) {
+	errs := make(errorChannel, 4)
+	c := startTestTUN(t,
+		withRedirectors(nil, FixedRedirector(udpEchoServer(t))),
+		func(t *TUN) error { t.ErrorHandler = errs; return nil },
+	)
+	// Without routes the forwarder cannot connect the endpoint back to
+	// the client, so creating it fails.
+	c.tun.Stack().SetRouteTable(nil)
+
+	conn := c.dialUDP(t, testRemote(5000))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-errs:
+		want := EndpointError{
+			Network:         "udp",
+			Source:          testClientAddr,
+			SourcePort:      conn.LocalAddr().(*net.UDPAddr).Port,
+			Destination:     testRemoteAddr,
+			DestinationPort: 5000,
+			Err:             e.Err,
+		}
+		if *e != want {
+			t.Errorf("got %+v, want %+v", *e, want)
+		}
+		if e.Err == "" {
+			t.Error("error is empty")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("no endpoint error")
+	}
+}
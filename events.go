@@ -0,0 +1,102 @@
+package libmitm
+
+import "time"
+
+const (
+	// EventZeroWindow is reported when a client-facing TCP endpoint keeps
+	// advertising a zero receive window for longer than the configured
+	// threshold, which usually means the upstream is stalled.
+	EventZeroWindow = 1
+
+	// EventUpstreamSelected reports which dialer of a failover chain, or
+	// which of a Decision's weighted targets, connected the upstream.
+	EventUpstreamSelected = 2
+
+	// EventConnectionReset is reported when a connection is aborted by
+	// ResetConnection.
+	EventConnectionReset = 3
+
+	// EventConnectionClosed is reported when a forwarded connection ends,
+	// with its traffic counters.
+	EventConnectionClosed = 4
+
+	// EventUpstreamBlocked is reported when an upstream is refused by
+	// WithBlockPrivateUpstream.
+	EventUpstreamBlocked = 5
+
+	// EventMemoryRejected is reported when a new connection is refused
+	// because the memory budget set by WithMemoryBudget is exhausted.
+	EventMemoryRejected = 6
+
+	// EventCircuitOpen is reported when the circuit breaker set by
+	// WithCircuitBreaker stops dialing an upstream.
+	EventCircuitOpen = 7
+
+	// EventMaintenance is reported when a connection is held, refused or
+	// drained because its destination is under maintenance, see
+	// SetMaintenance.
+	EventMaintenance = 8
+
+	// EventConnectionLimit is reported when a new connection is refused
+	// because the limit set by WithMaxConnections or the rate set by
+	// WithConnectionRateLimit is reached.
+	EventConnectionLimit = 9
+
+	// EventACLDenied is reported when a dial is denied by the rules set by
+	// WithACL.
+	EventACLDenied = 10
+)
+
+// Event describes a notable occurrence on a forwarded connection.
+type Event struct {
+	// Kind is one of the Event* constants.
+	Kind int
+	// ID is the connection ID, see WithConnIDScheme.
+	ID string
+	// Network is "tcp" or "udp".
+	Network string
+	// Source is the client address of the connection.
+	Source string
+	// Destination is the address originally addressed by the client.
+	Destination string
+	// Duration is the length of the condition in milliseconds, where
+	// applicable.
+	Duration int64
+	// Message is a human readable description of the event.
+	Message string
+
+	// UpBytes and UpPackets count the traffic from the client to the
+	// upstream, DownBytes and DownPackets the traffic back, where
+	// applicable. TCP packet counts are approximate: they are the
+	// segments exchanged with the client, including pure ACKs.
+	UpBytes     int64
+	UpPackets   int64
+	DownBytes   int64
+	DownPackets int64
+}
+
+// newEvent returns an event of the given kind about flow.
+func newEvent(kind int, flow *Flow, message string) *Event {
+	return &Event{
+		Kind:        kind,
+		ID:          flow.ID,
+		Network:     flow.Network,
+		Source:      sourceId(flow.id),
+		Destination: addressId(flow.id),
+		Message:     message,
+	}
+}
+
+type EventHandler interface {
+	HandleEvent(e *Event)
+}
+
+func (t *TUN) emit(e *Event) {
+	if t.EventHandler != nil {
+		t.EventHandler.HandleEvent(e)
+	}
+}
+
+func durationMillis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
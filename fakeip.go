@@ -0,0 +1,312 @@
+package libmitm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+const (
+	// fakeIPTTL is the TTL of answers with fake IPs. It is short so that
+	// clients do not hold on to addresses the pool may reassign.
+	fakeIPTTL = 1
+	// fakeIPMaxPool bounds the number of addresses used from large
+	// ranges, such as IPv6 prefixes.
+	fakeIPMaxPool = 1 << 20
+)
+
+// FakeIPPool maps domain names onto synthetic addresses of a range.
+// Addresses are handed out in order; once the range is exhausted the
+// oldest mapping is reassigned, so its domain gets a new address the next
+// time it is queried.
+type FakeIPPool struct {
+	prefix *net.IPNet
+	base   *big.Int
+	size   uint32
+
+	mu       sync.Mutex
+	next     uint32
+	byDomain map[string]uint32
+	byIndex  map[uint32]string
+}
+
+// NewFakeIPPool returns a pool handing out the addresses of cidr, skipping
+// the first and, for IPv4, the last one.
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := prefix.Mask.Size()
+	hosts := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	if bits == 8*net.IPv4len {
+		hosts.Sub(hosts, big.NewInt(1))
+	}
+	hosts.Sub(hosts, big.NewInt(1))
+	if hosts.Sign() <= 0 {
+		return nil, fmt.Errorf("fake ip range %s is too small", cidr)
+	}
+	size := uint32(fakeIPMaxPool)
+	if hosts.IsUint64() && hosts.Uint64() < fakeIPMaxPool {
+		size = uint32(hosts.Uint64())
+	}
+	return &FakeIPPool{
+		prefix:   prefix,
+		base:     new(big.Int).SetBytes(prefix.IP),
+		size:     size,
+		byDomain: make(map[string]uint32),
+		byIndex:  make(map[uint32]string),
+	}, nil
+}
+
+// IP returns the fake address of domain, allocating one if needed.
+func (p *FakeIPPool) IP(domain string) net.IP {
+	domain = normalizeDomain(domain)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i, ok := p.byDomain[domain]; ok {
+		return p.ip(i)
+	}
+	i := p.next
+	p.next = (p.next + 1) % p.size
+	if old, ok := p.byIndex[i]; ok {
+		delete(p.byDomain, old)
+	}
+	p.byDomain[domain] = i
+	p.byIndex[i] = domain
+	return p.ip(i)
+}
+
+// Domain returns the domain mapped to the fake address ip, or "" if ip is
+// not mapped.
+func (p *FakeIPPool) Domain(ip net.IP) string {
+	i, ok := p.index(ip)
+	if !ok {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.byIndex[i]
+}
+
+// Contains reports whether ip is in the range of the pool.
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	return p.prefix.Contains(ip)
+}
+
+func (p *FakeIPPool) ip(i uint32) net.IP {
+	n := new(big.Int).Add(p.base, big.NewInt(int64(i)+1))
+	ip := make(net.IP, len(p.prefix.IP))
+	return n.FillBytes(ip)
+}
+
+func (p *FakeIPPool) index(ip net.IP) (uint32, bool) {
+	if len(p.prefix.IP) == net.IPv4len {
+		ip = ip.To4()
+	}
+	if ip == nil || !p.prefix.Contains(ip) {
+		return 0, false
+	}
+	off := new(big.Int).Sub(new(big.Int).SetBytes(ip), p.base)
+	if !off.IsUint64() || off.Uint64() == 0 || off.Uint64() > uint64(p.size) {
+		return 0, false
+	}
+	return uint32(off.Uint64() - 1), true
+}
+
+// Snapshot returns the mappings of the pool and its allocation position
+// encoded for Restore, e.g. to keep the fake addresses cached by clients
+// valid across a restart.
+func (p *FakeIPPool) Snapshot() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prefix := p.prefix.String()
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(prefix)))
+	b = append(b, prefix...)
+	b = binary.BigEndian.AppendUint32(b, p.next)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(p.byIndex)))
+	for i, domain := range p.byIndex {
+		b = binary.BigEndian.AppendUint32(b, i)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(domain)))
+		b = append(b, domain...)
+	}
+	return b
+}
+
+var errFakeIPSnapshot = errors.New("malformed fake ip snapshot")
+
+// Restore replaces the mappings of the pool with those of a snapshot taken
+// of a pool of the same range, and resumes allocating where that pool
+// stopped, so that new domains do not take over restored addresses before
+// the older ones.
+func (p *FakeIPPool) Restore(snapshot []byte) error {
+	b := snapshot
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return errFakeIPSnapshot
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	prefix := string(b[2 : 2+n])
+	b = b[2+n:]
+	if prefix != p.prefix.String() {
+		return fmt.Errorf("fake ip snapshot of %s restored into a pool of %s", prefix, p.prefix)
+	}
+	if len(b) < 8 {
+		return errFakeIPSnapshot
+	}
+	next, count := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+	b = b[8:]
+	if next >= p.size {
+		return errFakeIPSnapshot
+	}
+	byDomain := make(map[string]uint32)
+	byIndex := make(map[uint32]string)
+	for ; count > 0; count-- {
+		if len(b) < 6 || len(b) < 6+int(binary.BigEndian.Uint16(b[4:])) {
+			return errFakeIPSnapshot
+		}
+		i, n := binary.BigEndian.Uint32(b), int(binary.BigEndian.Uint16(b[4:]))
+		domain := string(b[6 : 6+n])
+		b = b[6+n:]
+		if _, dup := byDomain[domain]; dup || i >= p.size {
+			return errFakeIPSnapshot
+		}
+		if _, dup := byIndex[i]; dup {
+			return errFakeIPSnapshot
+		}
+		byDomain[domain] = i
+		byIndex[i] = domain
+	}
+	if len(b) != 0 {
+		return errFakeIPSnapshot
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next, p.byDomain, p.byIndex = next, byDomain, byIndex
+	return nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// WithFakeIP answers DNS queries sent over UDP port 53 locally instead of
+// forwarding them: A queries, or AAAA queries for an IPv6 range, are
+// answered with an address of cidr allocated per domain, all other
+// queries with an empty answer. Flows to such an address carry the
+// domain as Flow.Domain, and are dialed at the domain and the original
+// port unless the redirector chooses another upstream, so upstreams can be
+// chosen by domain rather than by resolved address. FakeIPDomain looks up
+// the domain of an address.
+func WithFakeIP(cidr string) Option {
+	return func(t *TUN) error {
+		p, err := NewFakeIPPool(cidr)
+		if err != nil {
+			return err
+		}
+		t.fakeIP = p
+		return nil
+	}
+}
+
+// WithFakeIPPool is WithFakeIP with a pool of the caller, which can then
+// be snapshot and restored across restarts.
+func WithFakeIPPool(p *FakeIPPool) Option {
+	return func(t *TUN) error {
+		if p == nil {
+			return errors.New("fake ip pool must not be nil")
+		}
+		t.fakeIP = p
+		return nil
+	}
+}
+
+// FakeIPDomain returns the domain the fake address ip was handed out for,
+// or "" if it was not or WithFakeIP is not set.
+func (t *TUN) FakeIPDomain(ip string) string {
+	if t.fakeIP == nil {
+		return ""
+	}
+	return t.fakeIP.Domain(net.ParseIP(ip))
+}
+
+// fakeDomain returns the domain of the fake destination address, or "".
+func (t *TUN) fakeDomain(addr tcpip.Address) string {
+	if t.fakeIP == nil {
+		return ""
+	}
+	return t.fakeIP.Domain(net.IP(addr))
+}
+
+// serveFakeDNS answers the DNS queries read from local until it is idle
+// for the UDP timeout of flow, closed or ctx is done.
+func (t *TUN) serveFakeDNS(ctx context.Context, flow *Flow, local net.Conn) {
+	defer local.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			local.Close()
+		case <-done:
+		}
+	}()
+	timeout := t.idleTimeout(flow, Decision{})
+	b := make([]byte, 65535)
+	for {
+		if timeout > 0 {
+			local.SetReadDeadline(time.Now().Add(timeout))
+		}
+		n, err := local.Read(b)
+		if err != nil {
+			return
+		}
+		if resp := t.fakeIP.answer(b[:n]); resp != nil {
+			local.Write(resp)
+		}
+	}
+}
+
+// answer returns the response to the DNS query q, or nil if q is not a
+// query.
+func (p *FakeIPPool) answer(q []byte) []byte {
+	m, err := parseDNSMessage(q)
+	if err != nil || m.Flags&0x8000 != 0 {
+		return nil
+	}
+	resp := &DNSMessage{
+		ID: m.ID,
+		// QR, opcode, RD and RA.
+		Flags:     0x8000 | m.Flags&0x7900 | 0x0080,
+		Questions: m.Questions,
+	}
+	if m.Flags&0x7800 != 0 {
+		resp.Flags |= 4 // NOTIMP
+		return resp.pack(512)
+	}
+
+	want := uint16(DNSTypeA)
+	if len(p.prefix.IP) == net.IPv6len {
+		want = DNSTypeAAAA
+	}
+	for _, q := range m.Questions {
+		if q.Type == want && q.Class == 1 {
+			resp.Answers = append(resp.Answers, NewDNSAddressRecord(q.Name, fakeIPTTL, p.IP(q.Name)))
+		}
+	}
+	limit := 512
+	for _, r := range m.Additional {
+		if r.Type == DNSTypeOPT && int(r.Class) > limit {
+			limit = int(r.Class)
+		}
+	}
+	return resp.pack(limit)
+}
@@ -0,0 +1,203 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFakeIPPoolAllocation(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, domain := range []string{"a.example", "b.example.", "C.Example"} {
+		want := net.IPv4(198, 18, 0, byte(i+1)).To4()
+		if ip := p.IP(domain); !ip.Equal(want) {
+			t.Errorf("ip of %s: %s, want %s", domain, ip, want)
+		}
+		if got := p.Domain(want); got != normalizeDomain(domain) {
+			t.Errorf("domain of %s: %q, want %q", want, got, normalizeDomain(domain))
+		}
+	}
+	if got := p.Domain(net.ParseIP("198.18.0.200")); got != "" {
+		t.Errorf("domain of an unallocated address: %q", got)
+	}
+	if got := p.Domain(net.ParseIP("192.0.2.1")); got != "" {
+		t.Errorf("domain of an address outside the range: %q", got)
+	}
+
+	p6, err := NewFakeIPPool("fd00:18::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, want := p6.IP("a.example"), net.ParseIP("fd00:18::1"); !ip.Equal(want) {
+		t.Errorf("ipv6 ip: %s, want %s", ip, want)
+	}
+}
+
+func TestFakeIPPoolReuse(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := p.IP("example.com")
+	p.IP("other.example")
+	for _, domain := range []string{"example.com", "EXAMPLE.com.", "example.com."} {
+		if ip := p.IP(domain); !ip.Equal(first) {
+			t.Errorf("ip of %s: %s, want the earlier %s", domain, ip, first)
+		}
+	}
+}
+
+func TestFakeIPPoolExhaustion(t *testing.T) {
+	// A /30 has two usable addresses.
+	p, err := NewFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := p.IP("a.example"), p.IP("b.example")
+	c := p.IP("c.example")
+	if !c.Equal(a) {
+		t.Errorf("third domain got %s, want the oldest address %s", c, a)
+	}
+	if got := p.Domain(a); got != "c.example" {
+		t.Errorf("reassigned address maps to %q", got)
+	}
+	if got := p.Domain(b); got != "b.example" {
+		t.Errorf("second address maps to %q", got)
+	}
+	if ip := p.IP("a.example"); !ip.Equal(b) {
+		t.Errorf("evicted domain got %s, want %s", ip, b)
+	}
+
+	if _, err := NewFakeIPPool("198.18.0.0/31"); err == nil {
+		t.Error("created a pool without usable addresses")
+	}
+}
+
+func TestFakeIPPoolSnapshot(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := p.IP("a.example"), p.IP("b.example")
+	snapshot := p.Snapshot()
+
+	restored, err := NewFakeIPPool("198.18.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.IP("stale.example")
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := restored.Domain(a); got != "a.example" {
+		t.Errorf("restored %s maps to %q", a, got)
+	}
+	if ip := restored.IP("b.example"); !ip.Equal(b) {
+		t.Errorf("restored b.example got %s, want %s", ip, b)
+	}
+	// Allocation resumes after the restored addresses.
+	if ip, want := restored.IP("c.example"), net.ParseIP("198.18.0.3").To4(); !ip.Equal(want) {
+		t.Errorf("new domain got %s, want %s", ip, want)
+	}
+	if ip := restored.IP("stale.example"); ip.Equal(a) || ip.Equal(b) {
+		t.Errorf("domain not in the snapshot took over %s", ip)
+	}
+
+	other, err := NewFakeIPPool("198.19.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Restore(snapshot); err == nil {
+		t.Error("restored a snapshot of another range")
+	}
+	for _, n := range []int{0, 1, len(snapshot) - 1} {
+		if err := restored.Restore(snapshot[:n]); err == nil {
+			t.Errorf("restored a snapshot truncated to %d bytes", n)
+		}
+	}
+}
+
+// queryFakeIP resolves domain through the fake DNS of the TUN of c.
+func queryFakeIP(t *testing.T, c *testClient, domain string) net.IP {
+	t.Helper()
+	conn := c.dialUDP(t, testRemote(dnsPort))
+	q := &DNSMessage{ID: 1, Flags: 0x0100, Questions: []DNSQuestion{{Name: domain, Type: DNSTypeA, Class: 1}}}
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := conn.Write(q.pack(512)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	b := make([]byte, 512)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	resp, err := parseDNSMessage(b[:n])
+	if err != nil || resp.ID != q.ID || len(resp.Answers) != 1 {
+		t.Fatalf("response %+v, %v", resp, err)
+	}
+	return resp.Answers[0].IP()
+}
+
+func TestFakeIPForward(t *testing.T) {
+	upstream := echoServer(t)
+	_, port, _ := net.SplitHostPort(upstream)
+	c := startTestTUN(t, WithFakeIP("198.18.0.0/15"))
+
+	ip := queryFakeIP(t, c, "localhost.")
+	if got := c.tun.FakeIPDomain(ip.String()); got != "localhost" {
+		t.Fatalf("domain of %s: %q", ip, got)
+	}
+	conn, err := c.dialTCP(t, net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "by domain")
+}
+
+// TestFakeIPShutdown checks that Shutdown does not wait for idle fake DNS
+// flows to time out.
+func TestFakeIPShutdown(t *testing.T) {
+	c := startTestTUN(t, WithFakeIP("198.18.0.0/15"), WithUDPTimeout(time.Minute))
+	queryFakeIP(t, c, "example.com.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.tun.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestFakeIPAnswer(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		typ     uint16
+		answers int
+	}{
+		{DNSTypeA, 1},
+		{DNSTypeAAAA, 0},
+		{DNSTypeMX, 0},
+	} {
+		q := &DNSMessage{ID: 7, Questions: []DNSQuestion{{Name: "example.com.", Type: tc.typ, Class: 1}}}
+		resp, err := parseDNSMessage(p.answer(q.pack(512)))
+		if err != nil {
+			t.Fatalf("type %d: %v", tc.typ, err)
+		}
+		if resp.Flags&0x8000 == 0 || resp.Flags&0xf != 0 || len(resp.Answers) != tc.answers {
+			t.Errorf("type %d: flags %#x, %d answers, want %d", tc.typ, resp.Flags, len(resp.Answers), tc.answers)
+		}
+	}
+	if resp := p.answer([]byte{0, 1, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0}); resp != nil {
+		t.Errorf("answered a response: %x", resp)
+	}
+	if n := len(p.byDomain); n != 1 {
+		t.Errorf("%d domains allocated, want 1", n)
+	}
+}
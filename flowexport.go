@@ -0,0 +1,418 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// FlowExportFormat is the wire format of exported flow records.
+type FlowExportFormat int
+
+const (
+	// FlowExportIPFIX exports IPFIX (RFC 7011) messages.
+	FlowExportIPFIX FlowExportFormat = iota
+	// FlowExportNetFlowV9 exports NetFlow v9 (RFC 3954) packets.
+	FlowExportNetFlowV9
+)
+
+const (
+	// defaultFlowActiveTimeout and defaultFlowInactiveTimeout are the
+	// usual defaults of NetFlow exporters.
+	defaultFlowActiveTimeout   = 30 * time.Minute
+	defaultFlowInactiveTimeout = 15 * time.Second
+
+	// flowExportInterval is how often flows are checked for timeouts and
+	// pending records are sent.
+	flowExportInterval = time.Second
+
+	// flowExportMaxMessage bounds the size of export datagrams so that
+	// they are not fragmented on common paths.
+	flowExportMaxMessage = 1400
+
+	// flowTemplateRefresh is how often templates are resent, since the
+	// collector may have missed them or restarted.
+	flowTemplateRefresh = time.Minute
+
+	flowTemplateIPv4 = 256
+	flowTemplateIPv6 = 257
+
+	// Values of the flowEndReason information element.
+	flowEndIdle   = 1
+	flowEndActive = 2
+	flowEndOfFlow = 3
+)
+
+// flowTemplates lists the information elements of each template as pairs
+// of element ID and length.
+var flowTemplates = []struct {
+	id     uint16
+	fields [][2]uint16
+}{
+	{flowTemplateIPv4, [][2]uint16{
+		{8, 4},   // sourceIPv4Address
+		{12, 4},  // destinationIPv4Address
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{1, 8},   // octetDeltaCount
+		{2, 8},   // packetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+		{136, 1}, // flowEndReason
+	}},
+	{flowTemplateIPv6, [][2]uint16{
+		{27, 16}, // sourceIPv6Address
+		{28, 16}, // destinationIPv6Address
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{1, 8},   // octetDeltaCount
+		{2, 8},   // packetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+		{136, 1}, // flowEndReason
+	}},
+}
+
+type flowExportConfig struct {
+	collector string
+	format    FlowExportFormat
+	active    time.Duration
+	inactive  time.Duration
+}
+
+// WithFlowExport exports a record of every forwarded flow to the collector
+// at the UDP address collector, in the given format. As usual for NetFlow,
+// records are unidirectional, so a connection yields one record per
+// direction, and long flows are split into several records:
+//
+//   - once a flow has been reported on for activeTimeout, the bytes
+//     forwarded since are reported with flowEndReason "active timeout";
+//   - once a flow has seen no data for inactiveTimeout, the bytes not yet
+//     reported are reported with flowEndReason "idle timeout";
+//   - when the connection closes, the rest is reported with flowEndReason
+//     "end of flow".
+//
+// Zero timeouts select the common defaults of 30 minutes and 15 seconds.
+// Records are batched and sent once per second. Packet counts of TCP flows
+// are the segments exchanged with the client and only approximate.
+func WithFlowExport(collector string, format FlowExportFormat, activeTimeout, inactiveTimeout time.Duration) Option {
+	return func(t *TUN) error {
+		if _, _, err := net.SplitHostPort(collector); err != nil {
+			return err
+		}
+		if format != FlowExportIPFIX && format != FlowExportNetFlowV9 {
+			return errors.New("unknown flow export format")
+		}
+		if activeTimeout < 0 || inactiveTimeout < 0 {
+			return errors.New("flow export timeouts must not be negative")
+		}
+		if activeTimeout == 0 {
+			activeTimeout = defaultFlowActiveTimeout
+		}
+		if inactiveTimeout == 0 {
+			inactiveTimeout = defaultFlowInactiveTimeout
+		}
+		t.flowExport = &flowExporter{config: flowExportConfig{
+			collector: collector,
+			format:    format,
+			active:    activeTimeout,
+			inactive:  inactiveTimeout,
+		}}
+		return nil
+	}
+}
+
+// flowRecord is one unidirectional flow record.
+type flowRecord struct {
+	src, dst         tcpip.Address
+	srcPort, dstPort uint16
+	protocol         uint8
+	bytes, packets   uint64
+	start, end       time.Time
+	reason           uint8
+}
+
+// flowExportState is the part of a connection already reported.
+type flowExportState struct {
+	mu                     sync.Mutex
+	from                   time.Time
+	up, down               uint64
+	upPackets, downPackets uint64
+	finished               bool
+}
+
+type flowExporter struct {
+	config flowExportConfig
+
+	conn net.Conn
+	boot time.Time
+
+	mu            sync.Mutex
+	pending       []flowRecord
+	sequence      uint32
+	templatesSent time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// start connects to the collector and starts exporting the flows of conns.
+func (e *flowExporter) start(conns *connRegistry) error {
+	conn, err := net.Dial("udp", e.config.collector)
+	if err != nil {
+		return err
+	}
+	e.conn = conn
+	e.boot = time.Now()
+	e.done = make(chan struct{})
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(flowExportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				conns.each(func(c *activeConn) {
+					e.check(c, now)
+				})
+				e.send(now)
+			case <-e.done:
+				e.send(time.Now())
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (e *flowExporter) stop() {
+	if e.done == nil {
+		return
+	}
+	close(e.done)
+	e.wg.Wait()
+	e.conn.Close()
+	e.done = nil
+}
+
+// check reports on c if one of the timeouts expired.
+func (e *flowExporter) check(c *activeConn, now time.Time) {
+	c.export.mu.Lock()
+	from := c.export.from
+	c.export.mu.Unlock()
+
+	switch {
+	case now.Sub(from) >= e.config.active:
+		e.report(c, flowEndActive, now)
+	case now.Sub(c.stats.lastActivity()) >= e.config.inactive:
+		e.report(c, flowEndIdle, now)
+	}
+}
+
+// finish reports the rest of the closed connection c.
+func (e *flowExporter) finish(c *activeConn) {
+	e.report(c, flowEndOfFlow, time.Now())
+}
+
+// report queues records for the bytes of c not reported yet.
+func (e *flowExporter) report(c *activeConn, reason uint8, now time.Time) {
+	c.export.mu.Lock()
+	defer c.export.mu.Unlock()
+	if c.export.finished {
+		return
+	}
+	c.export.finished = reason == flowEndOfFlow
+
+	up, down := c.stats.up.Load(), c.stats.down.Load()
+	upPackets, downPackets := c.stats.packets()
+	end := c.stats.lastActivity()
+	if end.After(now) {
+		end = now
+	}
+	if end.Before(c.export.from) {
+		end = c.export.from
+	}
+
+	protocol := uint8(header.TCPProtocolNumber)
+	if c.flow.Network == "udp" {
+		protocol = uint8(header.UDPProtocolNumber)
+	}
+	id := c.flow.id
+	var records []flowRecord
+	if n := up - c.export.up; n > 0 {
+		records = append(records, flowRecord{
+			src: id.RemoteAddress, srcPort: id.RemotePort,
+			dst: id.LocalAddress, dstPort: id.LocalPort,
+			protocol: protocol, bytes: n, packets: upPackets - c.export.upPackets,
+			start: c.export.from, end: end, reason: reason,
+		})
+	}
+	if n := down - c.export.down; n > 0 {
+		records = append(records, flowRecord{
+			src: id.LocalAddress, srcPort: id.LocalPort,
+			dst: id.RemoteAddress, dstPort: id.RemotePort,
+			protocol: protocol, bytes: n, packets: downPackets - c.export.downPackets,
+			start: c.export.from, end: end, reason: reason,
+		})
+	}
+	c.export.from, c.export.up, c.export.down = now, up, down
+	c.export.upPackets, c.export.downPackets = upPackets, downPackets
+	if len(records) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	e.pending = append(e.pending, records...)
+	e.mu.Unlock()
+}
+
+// send writes out the pending records.
+func (e *flowExporter) send(now time.Time) {
+	e.mu.Lock()
+	records := e.pending
+	e.pending = nil
+	withTemplates := now.Sub(e.templatesSent) >= flowTemplateRefresh
+	if withTemplates {
+		e.templatesSent = now
+	}
+	e.mu.Unlock()
+
+	for withTemplates || len(records) > 0 {
+		var msg []byte
+		msg, records = e.message(now, withTemplates, records)
+		e.conn.Write(msg)
+		withTemplates = false
+	}
+}
+
+// message encodes a message holding the templates if withTemplates is
+// set and as many of records as fit. It returns the records left.
+func (e *flowExporter) message(now time.Time, withTemplates bool, records []flowRecord) ([]byte, []flowRecord) {
+	ipfix := e.config.format == FlowExportIPFIX
+	headerLen := 20
+	if ipfix {
+		headerLen = 16
+	}
+	msg := make([]byte, headerLen, flowExportMaxMessage)
+	count := 0
+
+	if withTemplates {
+		setID := uint16(0)
+		if ipfix {
+			setID = 2
+		}
+		set := len(msg)
+		msg = binary.BigEndian.AppendUint16(msg, setID)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+		for _, tmpl := range flowTemplates {
+			msg = binary.BigEndian.AppendUint16(msg, tmpl.id)
+			msg = binary.BigEndian.AppendUint16(msg, uint16(len(tmpl.fields)))
+			for _, f := range tmpl.fields {
+				msg = binary.BigEndian.AppendUint16(msg, f[0])
+				msg = binary.BigEndian.AppendUint16(msg, f[1])
+			}
+			count++
+		}
+		binary.BigEndian.PutUint16(msg[set+2:], uint16(len(msg)-set))
+	}
+
+	dataRecords := 0
+	set, tmpl := -1, uint16(0)
+	for len(records) > 0 {
+		r := records[0]
+		if set < 0 || recordTemplate(r) != tmpl {
+			if set >= 0 {
+				msg = closeSet(msg, set)
+			}
+			// Leave room for the set header, a record and padding.
+			if len(msg)+4+recordLen(recordTemplate(r))+3 > flowExportMaxMessage {
+				set = -1
+				break
+			}
+			set, tmpl = len(msg), recordTemplate(r)
+			msg = binary.BigEndian.AppendUint16(msg, tmpl)
+			msg = binary.BigEndian.AppendUint16(msg, 0)
+		} else if len(msg)+recordLen(tmpl)+3 > flowExportMaxMessage {
+			break
+		}
+		msg = appendRecord(msg, r)
+		records = records[1:]
+		count++
+		dataRecords++
+	}
+	if set >= 0 {
+		msg = closeSet(msg, set)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ipfix {
+		binary.BigEndian.PutUint16(msg[0:], 10)
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+		// The IPFIX sequence number counts data records.
+		binary.BigEndian.PutUint32(msg[8:], e.sequence)
+		e.sequence += uint32(dataRecords)
+	} else {
+		binary.BigEndian.PutUint16(msg[0:], 9)
+		binary.BigEndian.PutUint16(msg[2:], uint16(count))
+		binary.BigEndian.PutUint32(msg[4:], uint32(now.Sub(e.boot)/time.Millisecond))
+		binary.BigEndian.PutUint32(msg[8:], uint32(now.Unix()))
+		// The NetFlow v9 sequence number counts packets.
+		binary.BigEndian.PutUint32(msg[12:], e.sequence)
+		e.sequence++
+	}
+	return msg, records
+}
+
+// closeSet pads the set starting at offset set in msg to a multiple of
+// four bytes and fills in its length.
+func closeSet(msg []byte, set int) []byte {
+	for (len(msg)-set)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	binary.BigEndian.PutUint16(msg[set+2:], uint16(len(msg)-set))
+	return msg
+}
+
+func recordTemplate(r flowRecord) uint16 {
+	if len(r.src) == header.IPv4AddressSize {
+		return flowTemplateIPv4
+	}
+	return flowTemplateIPv6
+}
+
+func recordLen(tmpl uint16) int {
+	n := 0
+	for _, t := range flowTemplates {
+		if t.id == tmpl {
+			for _, f := range t.fields {
+				n += int(f[1])
+			}
+		}
+	}
+	return n
+}
+
+func appendRecord(b []byte, r flowRecord) []byte {
+	b = append(b, r.src...)
+	b = append(b, r.dst...)
+	b = binary.BigEndian.AppendUint16(b, r.srcPort)
+	b = binary.BigEndian.AppendUint16(b, r.dstPort)
+	b = append(b, r.protocol)
+	b = binary.BigEndian.AppendUint64(b, r.bytes)
+	b = binary.BigEndian.AppendUint64(b, r.packets)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+	b = append(b, r.reason)
+	return b
+}
@@ -0,0 +1,68 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"libmitm/endpoint"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowExport(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer collector.Close()
+	upstream := echoServer(t)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithFlowExport(collector.LocalAddr().String(), FlowExportIPFIX, 0, 0),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	roundTrip(t, conn, "exported")
+	conn.Close()
+
+	collector.SetReadDeadline(time.Now().Add(testTimeout))
+	b := make([]byte, 65535)
+	n, _, err := collector.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if n < 16 || binary.BigEndian.Uint16(b) != 10 || int(binary.BigEndian.Uint16(b[2:])) != n {
+		t.Errorf("not an IPFIX message: %x", b[:n])
+	}
+}
+
+// TestFlowExportStartFailure checks that a failed Start does not leave the
+// exporter running.
+func TestFlowExportStartFailure(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer collector.Close()
+	// The MTU is too small for IPv6, which fails Start after the
+	// exporter started.
+	tun := &TUN{MTU: 1000, IPv6Config: IPv6Enable}
+	err = tun.Apply(
+		WithChannelEndpoint(endpoint.NewChannelEndpoint(1000)),
+		WithFlowExport(collector.LocalAddr().String(), FlowExportIPFIX, 0, 0),
+	)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := tun.Start(); err == nil {
+		tun.Close()
+		t.Fatal("started with an MTU below the IPv6 minimum")
+	}
+	if tun.flowExport.done != nil {
+		t.Error("exporter still running after a failed start")
+	}
+	// The final send of the stopped exporter ended its goroutine.
+	tun.flowExport.wg.Wait()
+}
@@ -0,0 +1,75 @@
+package libmitm
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// flowStats counts the bytes and packets forwarded by a connection.
+//
+// Packets are counted exactly for UDP, where every read is one datagram.
+// TCP hides segment boundaries from the byte stream, so for TCP the
+// segments the client-facing endpoint received and sent are counted
+// instead. These include pure ACKs and retransmissions and say nothing
+// about the segmentation towards the upstream, so they only approximate
+// the packets of the flow.
+type flowStats struct {
+	start time.Time
+
+	// up counts bytes from the client to the upstream, down the other
+	// way.
+	up, down atomic.Uint64
+	// upPackets and downPackets count UDP datagrams.
+	upPackets, downPackets atomic.Uint64
+	// segments are the client side endpoint's statistics of TCP flows.
+	segments *tcp.Stats
+	// last is the time of the last activity in UnixNano.
+	last atomic.Int64
+}
+
+func newFlowStats(flow *Flow) *flowStats {
+	s := &flowStats{start: time.Now()}
+	if flow.ep != nil {
+		s.segments, _ = flow.ep.Stats().(*tcp.Stats)
+	}
+	s.last.Store(s.start.UnixNano())
+	return s
+}
+
+// packets returns the packets forwarded upstream and downstream.
+func (s *flowStats) packets() (up, down uint64) {
+	if s.segments != nil {
+		return s.segments.SegmentsReceived.Value(), s.segments.SegmentsSent.Value()
+	}
+	return s.upPackets.Load(), s.downPackets.Load()
+}
+
+// lastActivity returns when data was last forwarded.
+func (s *flowStats) lastActivity() time.Time {
+	return time.Unix(0, s.last.Load())
+}
+
+// reader returns r wrapped to add the bytes read to bytes and the reads to
+// packets.
+func (s *flowStats) reader(r io.Reader, bytes, packets *atomic.Uint64) io.Reader {
+	return &countingReader{r: r, stats: s, bytes: bytes, packets: packets}
+}
+
+type countingReader struct {
+	r              io.Reader
+	stats          *flowStats
+	bytes, packets *atomic.Uint64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.bytes.Add(uint64(n))
+		c.packets.Add(1)
+		c.stats.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
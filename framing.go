@@ -0,0 +1,59 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// errDatagramTooLarge is returned for datagrams that do not fit a frame.
+var errDatagramTooLarge = errors.New("datagram exceeds 65535 bytes")
+
+// framedWriter writes each datagram written to it to a stream, prefixed
+// with its length as two bytes in network byte order, as DNS messages are
+// over TCP (RFC 1035, section 4.2.2).
+type framedWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (f *framedWriter) Write(b []byte) (int, error) {
+	if len(b) > 0xffff {
+		return 0, errDatagramTooLarge
+	}
+	// Frames are written whole, so that a coalescer or compressor
+	// below sees each of them at once.
+	f.buf = binary.BigEndian.AppendUint16(f.buf[:0], uint16(len(b)))
+	f.buf = append(f.buf, b...)
+	if _, err := f.w.Write(f.buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// framedReader reads the datagrams framed by a framedWriter from a stream,
+// one per Read. Datagrams larger than the buffer of a Read are dropped,
+// as a datagram socket would truncate them.
+type framedReader struct {
+	r      io.Reader
+	header [2]byte
+}
+
+func (f *framedReader) Read(b []byte) (int, error) {
+	for {
+		if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(f.header[:]))
+		if n > len(b) {
+			if _, err := io.CopyN(io.Discard, f.r, int64(n)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := io.ReadFull(f.r, b[:n]); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+}
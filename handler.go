@@ -1,11 +1,13 @@
 package libmitm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"libmitm/option"
-	"log"
 	"net"
+	"syscall"
 	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -22,11 +24,11 @@ const (
 	// receive window buffer size is used instead.
 	defaultWndSize = 0
 
-	// maxConnAttempts specifies the maximum number
-	// of in-flight tcp connection attempts.
-	maxConnAttempts = 2 << 10
+	// defaultMaxConnAttempts specifies the default maximum
+	// number of in-flight tcp connection attempts.
+	defaultMaxConnAttempts = 2 << 10
 
-	// tcpKeepaliveCount is the maximum number of
+	// tcpKeepaliveCount is the default maximum number of
 	// TCP keep-alive probes to send before giving up
 	// and killing the connection if no response is
 	// obtained from the other end.
@@ -43,9 +45,9 @@ const (
 	tcpKeepaliveInterval = 30 * time.Second
 )
 
-func withTCPHandler(dialer *net.Dialer, redirector Redirector, eh EstablishHandler) option.Option {
+func (t *TUN) withTCPHandler(dialer Dialer) option.Option {
 	return func(s *stack.Stack) error {
-		tcpForwarder := tcp.NewForwarder(s, defaultWndSize, maxConnAttempts, func(r *tcp.ForwarderRequest) {
+		tcpForwarder := tcp.NewForwarder(s, defaultWndSize, t.maxConnAttempts(), func(r *tcp.ForwarderRequest) {
 			var (
 				wq waiter.Queue
 				// 	ep  tcpip.Endpoint
@@ -53,32 +55,99 @@ func withTCPHandler(dialer *net.Dialer, redirector Redirector, eh EstablishHandl
 				id = r.ID()
 			)
 
+			if !t.handshakeLimit.allow(id.RemoteAddress) {
+				r.Complete(false)
+				return
+			}
+			if !t.admit(id) {
+				r.Complete(true)
+				return
+			}
+
+			release, ok := t.reserveMemory("tcp", id)
+			if !ok {
+				r.Complete(true)
+				return
+			}
+			releaseConn, ok := t.acquireConn("tcp", id)
+			if !ok {
+				release()
+				r.Complete(true)
+				return
+			}
+			if !t.allowConnRate("tcp", id) {
+				releaseConn()
+				release()
+				r.Complete(true)
+				return
+			}
+
 			// Perform a TCP three-way handshake.
 			ep, err := r.CreateEndpoint(&wq)
 			if err != nil {
+				releaseConn()
+				release()
+				t.endpointFailed("tcp", id, err)
 				r.Complete(true)
 				return
 			}
 			r.Complete(false)
+			// Endpoints of the forwarder skip the listener that counts
+			// passive openings, so count them here for Stats.
+			s.Stats().TCP.PassiveConnectionOpenings.Increment()
 
-			setSocketOptions(s, ep)
+			setSocketOptions(s, ep, t.keepaliveConfig())
 
-			var addr string
-			if redirector != nil {
-				addr = redirector.Redirect(id.RemoteAddress.String(), int(id.RemotePort), id.LocalAddress.String(), int(id.LocalPort))
-			}
-			if addr == "" {
-				addr = addressId(id)
-			}
+			t.forwarders.wg.Add(1)
+			go func() {
+				defer t.forwarders.wg.Done()
+				defer release()
+				defer releaseConn()
+				flow := t.newFlow("tcp", id)
+				flow.ep = ep
+				flow.TTL = t.ingressTTL.take(tcp.ProtocolNumber, id)
+				flow.mss = t.mss.take(id)
+				defer t.traceReadiness(flow, &wq)()
+				t.resolveProcess(flow)
+
+				done := make(chan struct{})
+				defer close(done)
+				if t.zeroWindow.interval > 0 {
+					go t.trackZeroWindow(ep, flow, done)
+				}
+
+				var local net.Conn = gonet.NewTCPConn(&wq, ep)
+				flow.Label, local = t.classifier.classify(local)
+				local = t.sniffSNI(flow, local)
+				local = t.sniffHost(flow, local)
+				decision, err := redirect(t.TcpRedirector, flow, id)
+				if err != nil {
+					t.log().Debugf("tcp: rejecting %s to %s: %v", sourceId(id), addressId(id), err)
+					// Refuse with a RST rather than a FIN.
+					ep.SocketOptions().SetLinger(tcpip.LingerOption{Enabled: true, Timeout: 0})
+					local.Close()
+					return
+				}
 
-			go connectionForwarder("tcp", gonet.NewTCPConn(&wq, ep), dialer, addr, eh, addressId(id))
+				t.connectionForwarder(t.forwarders.ctx, flow, local, dialer, decision, t.TcpEstablishHandler)
+			}()
 		})
-		s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+		s.SetTransportProtocolHandler(tcp.ProtocolNumber, t.ingressTTL.record(tcp.ProtocolNumber, t.inspectHandshake(t.mss.clamp(tcpForwarder.HandlePacket))))
 		return nil
 	}
 }
 
-func withUDPHandler(dialer *net.Dialer, redirector Redirector, eh EstablishHandler) option.Option {
+// withUDPHandler forwards UDP sessions. The stack hands every new client
+// 4-tuple to the forwarder once and demultiplexes later datagrams of that
+// tuple to the same endpoint, so each session gets exactly one upstream
+// socket dialed to a single destination. That socket must be connected:
+// the kernel then filters datagrams from any other peer, and a client port
+// talking to several destinations uses one session and socket per
+// destination. The client-side endpoint of a session is bound to the
+// original destination and connected to the client, so replies carry the
+// address and port the client targeted whatever upstream the session was
+// redirected to, and sessions of one client port never share replies.
+func (t *TUN) withUDPHandler(dialer Dialer) option.Option {
 	return func(s *stack.Stack) error {
 		udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
 			var (
@@ -86,49 +155,82 @@ func withUDPHandler(dialer *net.Dialer, redirector Redirector, eh EstablishHandl
 				id = r.ID()
 			)
 
+			release, ok := t.reserveMemory("udp", id)
+			if !ok {
+				return
+			}
+			releaseConn, ok := t.acquireConn("udp", id)
+			if !ok {
+				release()
+				return
+			}
+			if !t.allowConnRate("udp", id) {
+				releaseConn()
+				release()
+				return
+			}
+
 			ep, err := r.CreateEndpoint(&wq)
 			if err != nil {
-				log.Println(err.String())
+				releaseConn()
+				release()
+				t.endpointFailed("udp", id, err)
 				return
 			}
 
-			var addr string
-			if redirector != nil {
-				addr = redirector.Redirect(id.RemoteAddress.String(), int(id.RemotePort), id.LocalAddress.String(), int(id.LocalPort))
-			}
-			if addr == "" {
-				addr = addressId(id)
-			}
+			t.forwarders.wg.Add(1)
+			go func() {
+				defer t.forwarders.wg.Done()
+				defer release()
+				defer releaseConn()
+				flow := t.newFlow("udp", id)
+				flow.TTL = t.ingressTTL.take(udp.ProtocolNumber, id)
+				defer t.traceReadiness(flow, &wq)()
+				t.resolveProcess(flow)
+
+				var local net.Conn = gonet.NewUDPConn(s, &wq, ep)
+				if t.fakeIP != nil && flow.DestinationPort == dnsPort {
+					t.serveFakeDNS(t.forwarders.ctx, flow, local)
+					return
+				}
+				local = t.classifier.classifyDatagram(flow, local)
+				decision, err := redirect(t.UdpRedirector, flow, id)
+				if err != nil {
+					t.log().Debugf("udp: dropping %s to %s: %v", sourceId(id), addressId(id), err)
+					local.Close()
+					return
+				}
 
-			go connectionForwarder("udp", gonet.NewUDPConn(s, &wq, ep), dialer, addr, eh, addressId(id))
+				t.connectionForwarder(t.forwarders.ctx, flow, local, dialer, decision, t.UdpEstablishHandler)
+			}()
 		})
-		s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+		s.SetTransportProtocolHandler(udp.ProtocolNumber, t.ingressTTL.record(udp.ProtocolNumber, t.blockQUIC(udpForwarder.HandlePacket)))
 		return nil
 	}
 }
 
-func setSocketOptions(s *stack.Stack, ep tcpip.Endpoint) tcpip.Error {
-	{ /* TCP keepalive options */
+func setSocketOptions(s *stack.Stack, ep tcpip.Endpoint, keepalive KeepaliveConfig) tcpip.Error {
+	if !keepalive.Disabled { /* TCP keepalive options */
 		ep.SocketOptions().SetKeepAlive(true)
 
-		idle := tcpip.KeepaliveIdleOption(tcpKeepaliveIdle)
+		idle := tcpip.KeepaliveIdleOption(keepalive.Idle)
 		if err := ep.SetSockOpt(&idle); err != nil {
 			return err
 		}
 
-		interval := tcpip.KeepaliveIntervalOption(tcpKeepaliveInterval)
+		interval := tcpip.KeepaliveIntervalOption(keepalive.Interval)
 		if err := ep.SetSockOpt(&interval); err != nil {
 			return err
 		}
 
-		if err := ep.SetSockOptInt(tcpip.KeepaliveCountOption, tcpKeepaliveCount); err != nil {
+		if err := ep.SetSockOptInt(tcpip.KeepaliveCountOption, keepalive.Count); err != nil {
 			return err
 		}
 	}
 	{ /* TCP recv/send buffer size */
 		var ss tcpip.TCPSendBufferSizeRangeOption
 		if err := s.TransportProtocolOption(header.TCPProtocolNumber, &ss); err == nil {
-			ep.SocketOptions().SetReceiveBufferSize(int64(ss.Default), false)
+			ep.SocketOptions().SetSendBufferSize(int64(ss.Default), false)
 		}
 
 		var rs tcpip.TCPReceiveBufferSizeRangeOption
@@ -147,22 +249,162 @@ func addressId(id stack.TransportEndpointID) string {
 	}
 }
 
-func connectionForwarder(net string, local net.Conn, dialer *net.Dialer, addr string, eh EstablishHandler, ehMessage string) {
+func sourceId(id stack.TransportEndpointID) string {
+	if len(id.RemoteAddress) == 4 {
+		return fmt.Sprintf("%s:%d", id.RemoteAddress.String(), id.RemotePort)
+	} else {
+		return fmt.Sprintf("[%s]:%d", id.RemoteAddress.String(), id.RemotePort)
+	}
+}
+
+func (t *TUN) connectionForwarder(ctx context.Context, flow *Flow, local net.Conn, dialer Dialer, decision Decision, eh EstablishHandler) {
 	defer local.Close()
 
-	remote, err := dialer.Dial(net, addr)
+	network := flow.Network
+	ctx = withFlowAddrs(ctx, network, flow.id)
+	forwarding := ctx
+	t.hold.wait(ctx)
+	if t.establishTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.establishTimeout)
+		defer cancel()
+	}
+
+	remote, err := t.dialWithRetry(ctx, flow, decision, dialer)
+	if !errors.Is(err, errMaintenance) {
+		t.hold.dialed(err)
+	}
 	if err != nil {
-		log.Println("dial failed:", err)
+		t.log().Errorf("dial %s %s: %v", decision.Address, dialFailure(err), err)
+		if flow.ep != nil && forwarding.Err() == nil {
+			// The handshake with the client is complete already, so
+			// refuse with a RST rather than a FIN: the client fails fast
+			// as if the upstream had refused, instead of seeing a
+			// connection that is closed once it sends.
+			flow.ep.SocketOptions().SetLinger(tcpip.LingerOption{Enabled: true, Timeout: 0})
+		}
 		return
 	}
 	defer remote.Close()
+	defer closeOnDone(forwarding, local, remote)()
+
+	if flow.upstreamNetwork() == "udp" && remote.RemoteAddr() == nil {
+		// An unconnected socket would accept datagrams from any peer
+		// and relay them to the client as if they came from addr.
+		t.log().Errorf("dial %s failed: upstream udp socket is not connected", decision.Address)
+		return
+	}
+
+	conn := &activeConn{flow: flow, local: local, remote: remote, stats: newFlowStats(flow)}
+	conn.export.from = conn.stats.start
+	t.conns.add(conn)
+	defer t.conns.remove(flow.ID)
+	defer t.emitClosed(conn)
+	defer t.reportMetrics(conn)
+	if t.flowExport != nil {
+		defer t.flowExport.finish(conn)
+	}
+
+	if t.priority != nil && decision.Priority > 0 {
+		protocol := tcp.ProtocolNumber
+		if network == "udp" {
+			protocol = udp.ProtocolNumber
+		}
+		t.priority.setPriority(protocol, flow.id, true)
+		defer t.priority.setPriority(protocol, flow.id, false)
+	}
 
-	if eh != nil {
-		eh.Handle(remote.LocalAddr().String(), ehMessage)
+	var copyErr error
+	localAddr := remote.LocalAddr().String()
+	defer func() { t.reportClosed(localAddr, conn, copyErr) }()
+
+	if feh, ok := eh.(FlowEstablishHandler); ok {
+		feh.HandleFlow(localAddr, flow)
+	} else if eh != nil {
+		eh.Handle(localAddr, addressId(flow.id))
 	}
 
+	upstream, flush := t.upstreamWriter(flow.upstreamNetwork(), remote)
+	upstream = t.flowRateLimit(forwarding, flow.upstreamNetwork(), upstream)
+	toLocal := t.flowRateLimit(forwarding, network, local)
+	var fromLocal, fromRemote io.Reader = local, t.downstreamReader(flow.upstreamNetwork(), remote)
+	if network == "udp" && flow.upstreamNetwork() == "tcp" {
+		// Datagrams carried over a stream are framed to keep their
+		// boundaries.
+		upstream, fromRemote = &framedWriter{w: upstream}, &framedReader{r: fromRemote}
+	}
+	if timeout := t.idleTimeout(flow, decision); timeout > 0 {
+		idle := newIdleTimer(t.idleClock(), timeout, func() {
+			local.Close()
+			remote.Close()
+		})
+		defer idle.stop()
+		fromLocal, fromRemote = idle.reader(fromLocal), idle.reader(fromRemote)
+	}
+	// Refused DNS queries are not forwarded, so they are not counted as
+	// traffic of the flow.
+	fromLocal = t.dnsLimit.reader(flow, local, fromLocal)
+	fromLocal = conn.stats.reader(fromLocal, &conn.stats.up, &conn.stats.upPackets)
+	fromRemote = conn.stats.reader(fromRemote, &conn.stats.down, &conn.stats.downPackets)
+	fromRemote = t.dnsRewriteReader(flow, fromRemote)
+	fromLocal, fromRemote = t.dnsHandlerReaders(flow, fromLocal, fromRemote)
+	fromLocal = t.inspector.reader(flow.ID, DirectionUpstream, fromLocal)
+	fromRemote = t.inspector.reader(flow.ID, DirectionDownstream, fromRemote)
+
+	// A TCP direction that ends with EOF is half-closed so that the other
+	// one keeps flowing; the connection is closed once both ended.
+	downstream := make(chan struct{})
+	var downstreamErr error
 	go func() {
-		io.Copy(local, remote)
+		defer close(downstream)
+		_, downstreamErr = t.copyBuffers.copy(toLocal, fromRemote)
+		if downstreamErr == nil && network == "tcp" {
+			closeWrite(local)
+		}
 	}()
-	io.Copy(remote, local)
+	_, copyErr = t.copyBuffers.copy(upstream, fromLocal)
+	flush()
+	if copyErr == nil && network == "tcp" && closeWrite(remote) {
+		<-downstream
+	}
+	select {
+	case <-downstream:
+		if copyErr == nil {
+			copyErr = downstreamErr
+		}
+	default:
+	}
+}
+
+// dialFailure describes why a dial failed with err.
+func dialFailure(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errMaintenance):
+		return "refused for maintenance"
+	case errors.Is(err, errACLDenied):
+		return "denied by acl"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timed out"
+	default:
+		return "failed"
+	}
+}
+
+// closeWriter is implemented by connections that can be half-closed, such
+// as *net.TCPConn and *gonet.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the writing side of c and reports whether c
+// supports it.
+func closeWrite(c net.Conn) bool {
+	cw, ok := c.(closeWriter)
+	if ok {
+		cw.CloseWrite()
+	}
+	return ok
 }
@@ -0,0 +1,238 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+func TestForwardTCP(t *testing.T) {
+	upstream := echoServer(t)
+	c := startTestTUN(t, withRedirectors(FixedRedirector(upstream), nil))
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+	roundTrip(t, conn, "again")
+}
+
+func TestForwardUDP(t *testing.T) {
+	upstream := udpEchoServer(t)
+	c := startTestTUN(t, withRedirectors(nil, FixedRedirector(upstream)))
+
+	conn := c.dialUDP(t, testRemote(5000))
+	roundTrip(t, conn, "first")
+	roundTrip(t, conn, "second")
+}
+
+// TestSetSocketOptions checks that forwarded endpoints get the default
+// send and receive buffer sizes of the stack, each from its own range, and
+// the keepalive settings.
+func TestSetSocketOptions(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	defer s.Close()
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("new endpoint: %v", err)
+	}
+	defer ep.Close()
+	// The ranges change after the endpoint took the old defaults, so only
+	// setSocketOptions can apply the new ones.
+	send := tcpip.TCPSendBufferSizeRangeOption{Min: 4096, Default: 64 << 10, Max: 1 << 20}
+	receive := tcpip.TCPReceiveBufferSizeRangeOption{Min: 4096, Default: 256 << 10, Max: 1 << 20}
+	for _, opt := range []tcpip.SettableTransportProtocolOption{&send, &receive} {
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			t.Fatalf("set %T: %v", opt, err)
+		}
+	}
+
+	keepalive := KeepaliveConfig{Idle: 30 * time.Second, Interval: 10 * time.Second, Count: 3}
+	if err := setSocketOptions(s, ep, keepalive); err != nil {
+		t.Fatalf("set socket options: %v", err)
+	}
+	if got := ep.SocketOptions().GetSendBufferSize(); got != int64(send.Default) {
+		t.Errorf("send buffer size %d, want %d", got, send.Default)
+	}
+	if got := ep.SocketOptions().GetReceiveBufferSize(); got != int64(receive.Default) {
+		t.Errorf("receive buffer size %d, want %d", got, receive.Default)
+	}
+	if !ep.SocketOptions().GetKeepAlive() {
+		t.Error("keepalive is off")
+	}
+	var idle tcpip.KeepaliveIdleOption
+	if err := ep.GetSockOpt(&idle); err != nil || time.Duration(idle) != keepalive.Idle {
+		t.Errorf("keepalive idle %s, %v, want %s", time.Duration(idle), err, keepalive.Idle)
+	}
+	if count, err := ep.GetSockOptInt(tcpip.KeepaliveCountOption); err != nil || count != keepalive.Count {
+		t.Errorf("keepalive count %d, %v, want %d", count, err, keepalive.Count)
+	}
+}
+
+// TestHalfClose checks that an upstream half-closing its side leaves the
+// client able to upload, and that the client's half-close reaches the
+// upstream.
+func TestHalfClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	uploaded := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("download"))
+		c.(*net.TCPConn).CloseWrite()
+		b, _ := io.ReadAll(c)
+		uploaded <- string(b)
+	}()
+	c := startTestTUN(t, withRedirectors(FixedRedirector(l.Addr().String()), nil))
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if b, err := io.ReadAll(conn); err != nil || string(b) != "download" {
+		t.Fatalf("read %q, %v, want the download and EOF", b, err)
+	}
+	if _, err := conn.Write([]byte("upload")); err != nil {
+		t.Fatalf("write after EOF: %v", err)
+	}
+	conn.(*gonet.TCPConn).CloseWrite()
+	select {
+	case b := <-uploaded:
+		if b != "upload" {
+			t.Errorf("upstream read %q, want the upload", b)
+		}
+	case <-time.After(testTimeout):
+		t.Error("upstream did not see the client's half-close")
+	}
+}
+
+// TestUDPReplySource checks that replies to a client port talking to two
+// destinations come from the destination each datagram was sent to, even
+// when both are redirected to the same upstream.
+func TestUDPReplySource(t *testing.T) {
+	upstream := udpEchoServer(t)
+	c := startTestTUN(t, withRedirectors(nil, FixedRedirector(upstream)))
+
+	conn, err := gonet.DialUDP(c.stack, &tcpip.FullAddress{NIC: 1}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	dests := []string{testRemote(5001), testRemote(5002)}
+	for round := 0; round < 2; round++ {
+		for _, dest := range dests {
+			fa, _ := fullAddress(t, dest)
+			if _, err := conn.WriteTo([]byte(dest), &net.UDPAddr{IP: net.IP(fa.Addr), Port: int(fa.Port)}); err != nil {
+				t.Fatalf("write to %s: %v", dest, err)
+			}
+		}
+		for range dests {
+			b := make([]byte, 64)
+			n, from, err := conn.ReadFrom(b)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(b[:n]) != from.String() {
+				t.Errorf("reply to the datagram for %s came from %s", b[:n], from)
+			}
+		}
+	}
+}
+
+// TestUDPConnectedUpstream checks that the upstream socket of a UDP session
+// only relays datagrams from the destination it was dialed to.
+func TestUDPConnectedUpstream(t *testing.T) {
+	upstream, sources := udpSourceServer(t)
+	c := startTestTUN(t, withRedirectors(nil, FixedRedirector(upstream)))
+
+	conn := c.dialUDP(t, testRemote(5000))
+	roundTrip(t, conn, "first")
+	source, err := net.ResolveUDPAddr("udp", <-sources)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	stray, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer stray.Close()
+	if _, err := stray.WriteTo([]byte("stray"), source); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// A stray datagram relayed to the client would be read before the echo.
+	roundTrip(t, conn, "second")
+}
+
+// TestDialRefusedReset checks that a client whose upstream refuses the
+// connection gets a RST promptly, rather than a FIN or nothing.
+func TestDialRefusedReset(t *testing.T) {
+	c := startTestTUN(t, withRedirectors(FixedRedirector(closedAddress(t)), nil))
+
+	start := time.Now()
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if err == nil || err == io.EOF || !strings.Contains(err.Error(), "reset") {
+		t.Errorf("client got %v, want a reset", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("reset took %s", elapsed)
+	}
+}
+
+func TestDialFailure(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), "refused"},
+		{fmt.Errorf("dial: %w", errMaintenance), "refused for maintenance"},
+		{context.DeadlineExceeded, "timed out"},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, "timed out"},
+		{errors.New("no route"), "failed"},
+	} {
+		if got := dialFailure(tc.err); got != tc.want {
+			t.Errorf("%v: %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
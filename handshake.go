@@ -0,0 +1,51 @@
+package libmitm
+
+import (
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// handshakeStats counts unusual TCP handshakes seen by the forwarder.
+type handshakeStats struct {
+	synData        atomic.Int64
+	unexpectedSyns atomic.Int64
+}
+
+// SynDataSegments returns the number of SYN segments that carried data,
+// as sent by TCP Fast Open clients.
+func (t *TUN) SynDataSegments() int64 {
+	return t.handshakes.synData.Load()
+}
+
+// UnexpectedSynAcks returns the number of SYN-ACK segments received for
+// connections the stack never opened, e.g. from a simultaneous open.
+func (t *TUN) UnexpectedSynAcks() int64 {
+	return t.handshakes.unexpectedSyns.Load()
+}
+
+// inspectHandshake wraps a TCP transport protocol handler to detect
+// handshakes the forwarder does not handle like a plain SYN.
+//
+// The forwarder does not implement TCP Fast Open: data in a SYN is not
+// acknowledged by the SYN-ACK, so an RFC 7413 client retransmits it once
+// the connection is established and the first payload still reaches the
+// upstream. A SYN-ACK only arrives for a connection actively opened by the
+// peer and the stack never opens connections towards clients, so such a
+// segment, e.g. from a simultaneous open, is answered with a RST.
+func (t *TUN) inspectHandshake(next func(stack.TransportEndpointID, stack.PacketBufferPtr) bool) func(stack.TransportEndpointID, stack.PacketBufferPtr) bool {
+	return func(id stack.TransportEndpointID, pkt stack.PacketBufferPtr) bool {
+		h := header.TCP(pkt.TransportHeader().Slice())
+		if len(h) >= header.TCPMinimumSize && h.Flags().Contains(header.TCPFlagSyn) {
+			if h.Flags().Contains(header.TCPFlagAck) {
+				t.handshakes.unexpectedSyns.Add(1)
+				t.log().Infof("tcp: unexpected SYN-ACK from %s to %s", sourceId(id), addressId(id))
+			} else if n := pkt.Data().Size(); n > 0 {
+				t.handshakes.synData.Add(1)
+				t.log().Debugf("tcp: SYN with %d bytes of data from %s to %s (fast open), awaiting retransmission", n, sourceId(id), addressId(id))
+			}
+		}
+		return next(id, pkt)
+	}
+}
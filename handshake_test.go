@@ -0,0 +1,95 @@
+package libmitm
+
+import (
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// rawClientPort is the port of the connections of raw TCP tests.
+const rawClientPort = 40000
+
+// tcpPacket returns an IPv4 packet carrying a TCP segment from
+// rawClientPort of the client to port 80 of testRemoteAddr.
+func tcpPacket(flags header.TCPFlags, seq, ack uint32, payload string) []byte {
+	src := tcpip.Address(net.ParseIP(testClientAddr).To4())
+	dst := tcpip.Address(net.ParseIP(testRemoteAddr).To4())
+	b := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize+len(payload))
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	h := header.TCP(ip.Payload())
+	h.Encode(&header.TCPFields{
+		SrcPort:    rawClientPort,
+		DstPort:    80,
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	copy(h.Payload(), payload)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(len(h)))
+	h.SetChecksum(^h.CalculateChecksum(checksum.Checksum(h.Payload(), xsum)))
+	return b
+}
+
+// tcpReply returns a match for readOutbound accepting the TCP segments to
+// rawClientPort with all of flags set.
+func tcpReply(flags header.TCPFlags) func(b []byte) bool {
+	return func(b []byte) bool {
+		if header.IPVersion(b) != header.IPv4Version || header.IPv4(b).Protocol() != uint8(header.TCPProtocolNumber) {
+			return false
+		}
+		h := header.TCP(header.IPv4(b).Payload())
+		return h.DestinationPort() == rawClientPort && h.Flags().Contains(flags)
+	}
+}
+
+// TestSynData checks that the data of a fast open SYN is detected and left
+// unacknowledged, and reaches the upstream once the client retransmits it
+// on the established connection.
+func TestSynData(t *testing.T) {
+	tun, ep := startRawTUN(t, withRedirectors(FixedRedirector(echoServer(t)), nil))
+
+	const isn, early = 1000, "early data"
+	ep.InjectInbound(tcpPacket(header.TCPFlagSyn, isn, 0, early))
+	synAck := header.TCP(header.IPv4(readOutbound(t, ep, tcpReply(header.TCPFlagSyn|header.TCPFlagAck))).Payload())
+	if got := tun.SynDataSegments(); got != 1 {
+		t.Errorf("%d SYN data segments counted, want 1", got)
+	}
+	if ack := synAck.AckNumber(); ack != isn+1 {
+		t.Fatalf("SYN-ACK acknowledges %d, want only the SYN at %d", ack, isn+1)
+	}
+
+	ack := synAck.SequenceNumber() + 1
+	ep.InjectInbound(tcpPacket(header.TCPFlagAck, isn+1, ack, ""))
+	ep.InjectInbound(tcpPacket(header.TCPFlagAck|header.TCPFlagPsh, isn+1, ack, early))
+	echo := readOutbound(t, ep, func(b []byte) bool {
+		return tcpReply(header.TCPFlagAck)(b) && len(header.TCP(header.IPv4(b).Payload()).Payload()) > 0
+	})
+	if got := string(header.TCP(header.IPv4(echo).Payload()).Payload()); got != early {
+		t.Errorf("echoed %q, want %q", got, early)
+	}
+}
+
+// TestUnexpectedSynAck checks that a SYN-ACK for a connection the stack
+// never opened is counted and answered with a RST.
+func TestUnexpectedSynAck(t *testing.T) {
+	tun, ep := startRawTUN(t, withRedirectors(FixedRedirector(echoServer(t)), nil))
+
+	ep.InjectInbound(tcpPacket(header.TCPFlagSyn|header.TCPFlagAck, 1000, 2000, ""))
+	readOutbound(t, ep, tcpReply(header.TCPFlagRst))
+	if got := tun.UnexpectedSynAcks(); got != 1 {
+		t.Errorf("%d unexpected SYN-ACKs counted, want 1", got)
+	}
+}
@@ -0,0 +1,172 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultHappyEyeballsDelay is the head start of a connection attempt
+// over the next one, the Connection Attempt Delay recommended by RFC 8305.
+const DefaultHappyEyeballsDelay = 250 * time.Millisecond
+
+var _ Dialer = (*HappyEyeballsDialer)(nil)
+
+// HappyEyeballsDialer dials TCP hostnames as described by RFC 8305: it
+// resolves the host, interleaves its IPv6 and IPv4 addresses, and starts
+// a connection attempt to the next address whenever the previous one
+// failed or had Delay to complete, returning the first connection
+// established and canceling the others. Every attempt goes through Dialer
+// with a literal address, so it composes with HTTPConnectDialer or a
+// SOCKS5 dialer, which then connect by address. Other networks and
+// literal addresses are passed to Dialer unchanged.
+type HappyEyeballsDialer struct {
+	// Dialer dials each attempt. Nil means a zero net.Dialer.
+	Dialer Dialer
+	// Resolver resolves hostnames. Nil means net.DefaultResolver.
+	Resolver *net.Resolver
+	// Delay is the head start of each attempt. Zero means
+	// DefaultHappyEyeballsDelay.
+	Delay time.Duration
+}
+
+func (d *HappyEyeballsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if network != "tcp" || !isHostname(address) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return raceDial(ctx, dialer, network, ips, port, d.Delay)
+}
+
+// WithHappyEyeballs races the addresses of upstream hostnames of TCP flows
+// like HappyEyeballsDialer, giving each attempt a head start of delay, or
+// DefaultHappyEyeballsDelay if delay is zero, so that a slow or broken
+// address family does not hold up the dial. Hostnames are resolved with
+// the Resolver of a *net.Dialer, and within the timeout set by
+// WithDNSTimeout. Addresses rejected by WithBlockPrivateUpstream are left
+// out of the race rather than failing it.
+func WithHappyEyeballs(delay time.Duration) Option {
+	return func(t *TUN) error {
+		if delay < 0 {
+			return errors.New("happy eyeballs delay must not be negative")
+		}
+		if delay == 0 {
+			delay = DefaultHappyEyeballsDelay
+		}
+		t.happyEyeballs = delay
+		return nil
+	}
+}
+
+// raceDial dials port at ips over network with d, interleaving the
+// address families and starting the next attempt after delay or when the
+// previous one failed, and returns the first connection established.
+func raceDial(ctx context.Context, d Dialer, network string, ips []net.IP, port string, delay time.Duration) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses to dial on port %s", port)
+	}
+	if delay <= 0 {
+		delay = DefaultHappyEyeballsDelay
+	}
+	ips = interleaveFamilies(ips)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		address := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, network, address)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections of attempts that succeed
+				// before they see the cancellation.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if next < len(ips) && ctx.Err() == nil {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// interleaveFamilies orders ips alternating between IPv6 and IPv4
+// addresses, starting with the family of the first, and otherwise keeps
+// the order of the resolver.
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	firstIs4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
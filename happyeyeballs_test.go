@@ -0,0 +1,109 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialFunc is a Dialer calling itself.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// TestHappyEyeballsDeadFamily checks that an IPv6 address that never
+// answers does not hold up the dial of a live IPv4 address.
+func TestHappyEyeballsDeadFamily(t *testing.T) {
+	upstream := echoServer(t)
+	_, port, _ := net.SplitHostPort(upstream)
+	d := dialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(address); net.ParseIP(host).To4() == nil {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		var nd net.Dialer
+		return nd.DialContext(ctx, network, address)
+	})
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("127.0.0.1")}
+
+	start := time.Now()
+	conn, err := raceDial(context.Background(), d, "tcp", ips, port, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial took %s", elapsed)
+	}
+	if got := conn.RemoteAddr().String(); got != upstream {
+		t.Errorf("connected to %s, want %s", got, upstream)
+	}
+}
+
+// TestHappyEyeballsPrivateUpstream checks that addresses rejected by the
+// private upstream guard are left out of the race, even if they would
+// have won it.
+func TestHappyEyeballsPrivateUpstream(t *testing.T) {
+	allowed, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listen on 127.0.0.2: %v", err)
+	}
+	defer allowed.Close()
+	_, port, _ := net.SplitHostPort(allowed.Addr().String())
+	go func() {
+		for {
+			c, err := allowed.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("allowed"))
+			c.Close()
+		}
+	}()
+	// The blocked address accepts connections as well.
+	blocked, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Skipf("listen on 127.0.0.1: %v", err)
+	}
+	defer blocked.Close()
+	go func() {
+		for {
+			c, err := blocked.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("blocked"))
+			c.Close()
+		}
+	}()
+
+	r := testResolver(t, map[string][]net.IP{
+		"dual.test.": {net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")},
+	})
+	events := make(chan *Event, 16)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(net.JoinHostPort("dual.test", port)), nil),
+		WithDialer(&net.Dialer{Resolver: r}),
+		WithHappyEyeballs(time.Second),
+		WithBlockPrivateUpstream("127.0.0.2"),
+		withEventChannel(events),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	b := make([]byte, len("allowed"))
+	if _, err := conn.Read(b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(b) != "allowed" {
+		t.Errorf("connected to the %s address", b)
+	}
+	waitForEvent(t, events, EventUpstreamBlocked)
+}
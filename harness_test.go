@@ -0,0 +1,372 @@
+package libmitm
+
+import (
+	"context"
+	"io"
+	"libmitm/endpoint"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	testMTU = 1500
+
+	// testClientAddr and testClientAddr6 are the addresses of the apps
+	// behind the TUN, and testRemoteAddr a destination they connect to.
+	testClientAddr  = "10.0.0.1"
+	testClientAddr6 = "fd00::1"
+	testRemoteAddr  = "198.51.100.1"
+
+	testTimeout = 5 * time.Second
+)
+
+// testClient is a netstack standing in for the apps behind a TUN: the
+// packets it sends are injected into the TUN's channel endpoint, and the
+// packets the TUN sends are delivered to it.
+type testClient struct {
+	stack *stack.Stack
+	tun   *TUN
+	ep    *endpoint.ChannelEndpoint
+}
+
+// startTestTUN starts a TUN with opts on a channel endpoint and returns it
+// with a client attached to it. Both are closed when the test ends.
+func startTestTUN(t testing.TB, opts ...Option) *testClient {
+	t.Helper()
+	tun, ep := startRawTUN(t, opts...)
+	return newTestClient(t, tun, ep)
+}
+
+// startRawTUN starts a TUN with opts on a channel endpoint without a
+// client, for tests writing and reading raw packets on the endpoint. The
+// TUN is closed when the test ends.
+func startRawTUN(t testing.TB, opts ...Option) (*TUN, *endpoint.ChannelEndpoint) {
+	t.Helper()
+	ep := endpoint.NewChannelEndpoint(testMTU)
+	tun := &TUN{MTU: testMTU, IPv6Config: IPv6Enable}
+	if err := tun.Apply(append(opts, WithChannelEndpoint(ep))...); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := tun.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(tun.Close)
+	return tun, ep
+}
+
+// readOutbound returns the next packet the TUN sends on ep for which match
+// holds, skipping others.
+func readOutbound(t testing.TB, ep *endpoint.ChannelEndpoint, match func(b []byte) bool) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for {
+		b := ep.ReadOutboundContext(ctx)
+		if b == nil {
+			t.Fatal("timed out waiting for an outbound packet")
+		}
+		if match(b) {
+			return b
+		}
+	}
+}
+
+func newTestClient(t testing.TB, tun *TUN, ep *endpoint.ChannelEndpoint) *testClient {
+	t.Helper()
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+	})
+	link := channel.New(1024, testMTU, "")
+	if err := s.CreateNIC(1, link); err != nil {
+		t.Fatalf("create nic: %v", err)
+	}
+	for _, addr := range []tcpip.AddressWithPrefix{
+		{Address: tcpip.Address(net.ParseIP(testClientAddr).To4()), PrefixLen: 8},
+		{Address: tcpip.Address(net.ParseIP(testClientAddr6)), PrefixLen: 64},
+	} {
+		protocol := ipv4.ProtocolNumber
+		if len(addr.Address) == net.IPv6len {
+			protocol = ipv6.ProtocolNumber
+		}
+		pa := tcpip.ProtocolAddress{Protocol: protocol, AddressWithPrefix: addr}
+		if err := s.AddProtocolAddress(1, pa, stack.AddressProperties{}); err != nil {
+			t.Fatalf("add address %s: %v", addr, err)
+		}
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: 1},
+		{Destination: header.IPv6EmptySubnet, NIC: 1},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			pkt := link.ReadContext(ctx)
+			if pkt.IsNil() {
+				return
+			}
+			v := pkt.ToView()
+			ep.InjectInbound(v.AsSlice())
+			v.Release()
+			pkt.DecRef()
+		}
+	}()
+	go func() {
+		for {
+			b := ep.ReadOutboundContext(ctx)
+			if b == nil {
+				return
+			}
+			protocol := ipv4.ProtocolNumber
+			if header.IPVersion(b) == header.IPv6Version {
+				protocol = ipv6.ProtocolNumber
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(b)})
+			link.InjectInbound(protocol, pkt)
+			pkt.DecRef()
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		s.Close()
+	})
+	return &testClient{stack: s, tun: tun, ep: ep}
+}
+
+// withRedirectors sets the redirectors of the TUN, either of which may be
+// nil.
+func withRedirectors(tcp, udp Redirector) Option {
+	return func(t *TUN) error {
+		t.TcpRedirector, t.UdpRedirector = tcp, udp
+		return nil
+	}
+}
+
+// flowRedirector is a FlowRedirector calling itself.
+type flowRedirector func(f *Flow) *Decision
+
+func (r flowRedirector) Redirect(src string, srcPort int, dst string, dstPort int) string {
+	return ""
+}
+
+func (r flowRedirector) RedirectFlow(f *Flow) *Decision {
+	return r(f)
+}
+
+// eventChannel is an EventHandler sending events to a channel, dropping
+// them when it is full.
+type eventChannel chan *Event
+
+func (c eventChannel) HandleEvent(e *Event) {
+	select {
+	case c <- e:
+	default:
+	}
+}
+
+// withEventChannel sends the events of the TUN to events.
+func withEventChannel(events chan *Event) Option {
+	return func(t *TUN) error {
+		t.EventHandler = eventChannel(events)
+		return nil
+	}
+}
+
+// waitForEvent waits for an event of kind on events and returns it.
+func waitForEvent(t testing.TB, events chan *Event, kind int) *Event {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for event %d", kind)
+		}
+	}
+}
+
+// fullAddress parses addr, a host and port, for the client stack.
+func fullAddress(t testing.TB, addr string) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("parse %q: %v", addr, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("parse %q: %v", addr, err)
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.FullAddress{NIC: 1, Addr: tcpip.Address(ip4), Port: uint16(p)}, ipv4.ProtocolNumber
+	}
+	return tcpip.FullAddress{NIC: 1, Addr: tcpip.Address(ip), Port: uint16(p)}, ipv6.ProtocolNumber
+}
+
+// dialTCP connects the client to addr through the TUN.
+func (c *testClient) dialTCP(t testing.TB, addr string) (net.Conn, error) {
+	t.Helper()
+	fa, protocol := fullAddress(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	return gonet.DialContextTCP(ctx, c.stack, fa, protocol)
+}
+
+// dialUDP returns a client socket connected to addr through the TUN.
+func (c *testClient) dialUDP(t testing.TB, addr string) *gonet.UDPConn {
+	t.Helper()
+	fa, protocol := fullAddress(t, addr)
+	conn, err := gonet.DialUDP(c.stack, nil, &fa, protocol)
+	if err != nil {
+		t.Fatalf("dial udp %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// testRemote returns the address the client dials to reach port of
+// testRemoteAddr.
+func testRemote(port int) string {
+	return net.JoinHostPort(testRemoteAddr, strconv.Itoa(port))
+}
+
+// echoServer starts a TCP server on the loopback that echoes what it reads
+// and returns its address.
+func echoServer(t testing.TB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// udpEchoServer starts a UDP server on the loopback that echoes every
+// datagram and returns its address.
+func udpEchoServer(t testing.TB) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// dnsServer starts a DNS server on the loopback answering A and AAAA
+// queries for the names in hosts, given with a trailing dot, and returns
+// its address.
+func dnsServer(t testing.TB, hosts map[string][]net.IP) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			m, err := parseDNSMessage(b[:n])
+			if err != nil || len(m.Questions) != 1 {
+				continue
+			}
+			q := m.Questions[0]
+			m.Flags |= 0x8080 // QR, RA
+			for _, ip := range hosts[q.Name] {
+				if r := NewDNSAddressRecord(q.Name, 60, ip); r.Type == q.Type {
+					m.Answers = append(m.Answers, r)
+				}
+			}
+			pc.WriteTo(m.pack(512), addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// testResolver starts a DNS server like dnsServer and returns a resolver
+// using it.
+func testResolver(t testing.TB, hosts map[string][]net.IP) *net.Resolver {
+	t.Helper()
+	addr := dnsServer(t, hosts)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}
+}
+
+// roundTrip writes msg to conn and reads the echo of it.
+func roundTrip(t testing.TB, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(b) != msg {
+		t.Fatalf("read %q, want %q", b, msg)
+	}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,105 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamHold holds new connections while the upstream is unavailable.
+type upstreamHold struct {
+	maxHold   time.Duration
+	maxHeld   int64
+	threshold int64
+
+	mu sync.Mutex
+	// release is non-nil while holding and closed when holding ends.
+	release chan struct{}
+
+	held     atomic.Int64
+	failures atomic.Int64
+}
+
+// WithUpstreamHold lets new connections wait up to maxHold for the
+// upstream to recover while the TUN is holding, instead of failing right
+// away. At most maxHeld connections are held at once; others are dialed
+// immediately. Holding is toggled with SetUpstreamHold and, if
+// failureThreshold is positive, entered automatically after that many
+// consecutive dial failures. It ends on the first successful dial.
+func WithUpstreamHold(maxHold time.Duration, maxHeld, failureThreshold int) Option {
+	return func(t *TUN) error {
+		if maxHold <= 0 || maxHeld <= 0 || failureThreshold < 0 {
+			return errors.New("upstream hold: duration and capacity must be positive")
+		}
+		t.hold.maxHold = maxHold
+		t.hold.maxHeld = int64(maxHeld)
+		t.hold.threshold = int64(failureThreshold)
+		return nil
+	}
+}
+
+// SetUpstreamHold starts or stops holding new connections. Stopping
+// releases every held connection.
+func (t *TUN) SetUpstreamHold(holding bool) {
+	t.hold.set(holding)
+}
+
+// HeldConnections returns the number of connections currently held.
+func (t *TUN) HeldConnections() int64 {
+	return t.hold.held.Load()
+}
+
+func (h *upstreamHold) set(holding bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if holding && h.release == nil {
+		h.release = make(chan struct{})
+	} else if !holding && h.release != nil {
+		close(h.release)
+		h.release = nil
+	}
+}
+
+// wait blocks while holding, for at most maxHold.
+func (h *upstreamHold) wait(ctx context.Context) {
+	if h.maxHold <= 0 {
+		return
+	}
+	h.mu.Lock()
+	release := h.release
+	h.mu.Unlock()
+	if release == nil {
+		return
+	}
+
+	if h.held.Add(1) > h.maxHeld {
+		h.held.Add(-1)
+		return
+	}
+	defer h.held.Add(-1)
+
+	timer := time.NewTimer(h.maxHold)
+	defer timer.Stop()
+	select {
+	case <-release:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// dialed records the outcome of an upstream dial.
+func (h *upstreamHold) dialed(err error) {
+	if h.maxHold <= 0 {
+		return
+	}
+	if err == nil {
+		h.failures.Store(0)
+		h.set(false)
+		return
+	}
+	if h.threshold > 0 && h.failures.Add(1) >= h.threshold {
+		h.set(true)
+	}
+}
@@ -0,0 +1,145 @@
+package libmitm
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Dialer = (*HTTPConnectDialer)(nil)
+
+// ErrProxyAuth is returned by HTTPConnectDialer when the proxy answers
+// with 407 Proxy Authentication Required.
+var ErrProxyAuth = errors.New("proxy authentication required")
+
+// maxConnectResponse bounds the size of a CONNECT response header.
+const maxConnectResponse = 16 << 10
+
+// HTTPConnectDialer reaches TCP upstreams through an HTTP proxy by
+// tunneling them with CONNECT. It cannot carry UDP flows.
+type HTTPConnectDialer struct {
+	// ProxyAddr is the host and port of the proxy.
+	ProxyAddr string
+	// Username and Password are sent with Basic authentication if
+	// Username is not empty.
+	Username string
+	Password string
+	// HandshakeTimeout bounds the CONNECT exchange after the connection
+	// to the proxy is established. Zero means no limit beyond the
+	// context's deadline.
+	HandshakeTimeout time.Duration
+	// Forward dials the proxy. Nil means a zero net.Dialer. As the
+	// upstream dialer of a TUN, the TUN's socket controls are applied to
+	// it, e.g. to keep the proxy connection out of the TUN.
+	Forward *net.Dialer
+}
+
+func (d *HTTPConnectDialer) forwardDialer() *net.Dialer {
+	if d.Forward == nil {
+		return &net.Dialer{}
+	}
+	return d.Forward
+}
+
+func (d *HTTPConnectDialer) withForwardDialer(forward *net.Dialer) Dialer {
+	c := *d
+	c.Forward = forward
+	return &c
+}
+
+func (d *HTTPConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http connect: cannot tunnel %s, only tcp", network)
+	}
+
+	conn, err := d.forwardDialer().DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	hctx := ctx
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+	tunnel, err := d.connect(hctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http connect %s via %s: %w", address, d.ProxyAddr, err)
+	}
+	return tunnel, nil
+}
+
+// connect requests a tunnel to address on conn and returns the tunnel,
+// replaying any bytes the proxy sent after its response.
+func (d *HTTPConnectDialer) connect(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	defer watchHandshake(ctx, conn)()
+
+	var req strings.Builder
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if d.Username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		fmt.Fprintf(&req, "Proxy-Authorization: Basic %s\r\n", cred)
+	}
+	req.WriteString("\r\n")
+	if _, err := conn.Write([]byte(req.String())); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := readConnectResponse(r)
+	if err != nil {
+		return nil, err
+	}
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 3)[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed status line %q", status)
+	}
+	switch {
+	case code == 407:
+		return nil, fmt.Errorf("%w: %s", ErrProxyAuth, status)
+	case code < 200 || code > 299:
+		return nil, fmt.Errorf("proxy refused tunnel: %s", status)
+	}
+
+	if r.Buffered() == 0 {
+		return conn, nil
+	}
+	head, _ := r.Peek(r.Buffered())
+	return &peekedConn{Conn: conn, head: append([]byte(nil), head...)}, nil
+}
+
+// readConnectResponse reads the header of the response to a CONNECT
+// request from r and returns its status line.
+func readConnectResponse(r *bufio.Reader) (string, error) {
+	var status string
+	size := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if size += len(line); size > maxConnectResponse {
+			return "", errors.New("response header too large")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if status == "" {
+			if !strings.HasPrefix(line, "HTTP/") || len(strings.SplitN(line, " ", 3)) < 2 {
+				return "", fmt.Errorf("malformed status line %q", line)
+			}
+			status = line
+			continue
+		}
+		if line == "" {
+			return status, nil
+		}
+	}
+}
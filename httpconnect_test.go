@@ -0,0 +1,143 @@
+package libmitm
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// connectProxy is a fake HTTP proxy answering CONNECT requests. It
+// requires the credentials in auth, a "user:password" pair, if set.
+type connectProxy struct {
+	addr string
+	auth string
+	// targets receives the target of every CONNECT request.
+	targets chan string
+}
+
+func startConnectProxy(t *testing.T, auth string) *connectProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := &connectProxy{addr: l.Addr().String(), auth: auth, targets: make(chan string, 16)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) serve(c net.Conn) {
+	defer c.Close()
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	if p.auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(p.auth)) {
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n")
+		return
+	}
+	p.targets <- req.Host
+	up, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer up.Close()
+	io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(up, c)
+	io.Copy(c, up)
+}
+
+func TestHTTPConnectTunnel(t *testing.T) {
+	upstream := echoServer(t)
+	proxy := startConnectProxy(t, "user:secret")
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithDialer(&HTTPConnectDialer{ProxyAddr: proxy.addr, Username: "user", Password: "secret"}),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "tunneled")
+	if target := <-proxy.targets; target != upstream {
+		t.Errorf("proxy connected to %s, want %s", target, upstream)
+	}
+}
+
+func TestHTTPConnectAuthRequired(t *testing.T) {
+	proxy := startConnectProxy(t, "user:secret")
+	d := &HTTPConnectDialer{ProxyAddr: proxy.addr, Username: "user", Password: "wrong"}
+	_, err := d.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	if !errors.Is(err, ErrProxyAuth) {
+		t.Errorf("dial with wrong password: %v, want %v", err, ErrProxyAuth)
+	}
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	proxy := startConnectProxy(t, "")
+	d := &HTTPConnectDialer{ProxyAddr: proxy.addr, HandshakeTimeout: time.Second}
+	// Nothing listens on the discard port of the loopback.
+	_, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:9")
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("dial of a refused target: %v, want the proxy's 502", err)
+	}
+}
+
+func TestHTTPConnectUDP(t *testing.T) {
+	d := &HTTPConnectDialer{ProxyAddr: "127.0.0.1:1"}
+	if _, err := d.DialContext(context.Background(), "udp", "192.0.2.1:53"); err == nil {
+		t.Error("dialed udp through http connect")
+	}
+}
+
+// TestHTTPConnectForward checks that socket controls apply to the
+// connection to the proxy, and that the private upstream guard checks the
+// target rather than the proxy, which is on the loopback.
+func TestHTTPConnectForward(t *testing.T) {
+	upstream := echoServer(t)
+	_, port, _ := net.SplitHostPort(upstream)
+	proxy := startConnectProxy(t, "")
+	controlled := make(chan string, 16)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(net.JoinHostPort("localhost", port)), nil),
+		WithDialer(&HTTPConnectDialer{ProxyAddr: proxy.addr}),
+		WithUpstreamControl(func(network, address string, _ syscall.RawConn) error {
+			controlled <- address
+			return nil
+		}),
+		WithBlockPrivateUpstream("127.0.0.1"),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "controlled")
+	if address := <-controlled; address != proxy.addr {
+		t.Errorf("controls ran for %s, want the proxy %s", address, proxy.addr)
+	}
+	if target := <-proxy.targets; target != upstream {
+		t.Errorf("proxy connected to %s, want the checked address %s", target, upstream)
+	}
+}
@@ -0,0 +1,107 @@
+package libmitm
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// httpPort is the port whose TCP flows are sniffed for a Host header.
+	httpPort = 80
+
+	// hostSniffTimeout bounds how long the forwarder waits for the
+	// request headers.
+	hostSniffTimeout = 500 * time.Millisecond
+
+	// maxMethodLen bounds the request method of what is taken for HTTP.
+	maxMethodLen = 16
+)
+
+// WithHTTPHostSniffing reads the request line and headers of every TCP
+// flow to port 80 before it is redirected, up to maxBytes bytes, and
+// exposes the host of its Host header as Flow.Host to a FlowRedirector or
+// NetworkRedirector and to a FlowEstablishHandler, so that plaintext HTTP
+// can be routed and logged by domain. The bytes read are replayed to the
+// upstream unchanged. Reading stops at the end of the headers, at
+// maxBytes, after 500ms, or as soon as the flow does not start like an
+// HTTP request; Flow.Host is then taken from the complete header lines
+// read so far, if any.
+func WithHTTPHostSniffing(maxBytes int) Option {
+	return func(t *TUN) error {
+		if maxBytes <= 0 {
+			return errors.New("host sniffing: peek size must be positive")
+		}
+		t.hostSniff = maxBytes
+		return nil
+	}
+}
+
+// sniffHost sets the Host of flow from the request read from conn if
+// sniffing applies, and returns a connection that replays the bytes read.
+func (t *TUN) sniffHost(flow *Flow, conn net.Conn) net.Conn {
+	if t.hostSniff <= 0 || flow.DestinationPort != httpPort {
+		return conn
+	}
+	conn.SetReadDeadline(time.Now().Add(hostSniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 0, t.hostSniff)
+	for len(buf) < cap(buf) {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil || !looksLikeHTTP(buf) || bytes.Contains(buf, []byte("\r\n\r\n")) {
+			break
+		}
+	}
+	flow.Host = parseHost(buf)
+	if len(buf) == 0 {
+		return conn
+	}
+	return &peekedConn{Conn: conn, head: buf}
+}
+
+// looksLikeHTTP reports whether b is, or may be the beginning of, a
+// request line: a method of upper case letters followed by a space.
+func looksLikeHTTP(b []byte) bool {
+	i := 0
+	for i < len(b) && i <= maxMethodLen && 'A' <= b[i] && b[i] <= 'Z' {
+		i++
+	}
+	if i == len(b) {
+		return i <= maxMethodLen
+	}
+	return i > 0 && i <= maxMethodLen && b[i] == ' '
+}
+
+// parseHost returns the host of the Host header among the complete
+// header lines of the request head b, without a port, or "".
+func parseHost(b []byte) string {
+	if !looksLikeHTTP(b) {
+		return ""
+	}
+	lines := strings.Split(string(b), "\n")
+	if len(lines) < 3 {
+		return ""
+	}
+	// Skip the request line and the last line, which is incomplete or
+	// empty.
+	for _, line := range lines[1 : len(lines)-1] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "Host") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if host, _, err := net.SplitHostPort(value); err == nil {
+			return host
+		}
+		return strings.Trim(value, "[]")
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package libmitm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHost(t *testing.T) {
+	for _, tc := range []struct {
+		head string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com"},
+		{"POST /form HTTP/1.1\r\nUser-Agent: test\r\nhost:  example.com:8080 \r\n\r\n", "example.com"},
+		{"GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "2001:db8::1"},
+		{"GET / HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n", "2001:db8::1"},
+		// The Host line is incomplete.
+		{"GET / HTTP/1.1\r\nHost: exam", ""},
+		// The Host header follows the end of the headers.
+		{"GET / HTTP/1.1\r\n\r\nHost: example.com\r\n", ""},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", ""},
+		{"get / HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\r\nHost: example.com\r\n\r\n", ""},
+	} {
+		if got := parseHost([]byte(tc.head)); got != tc.want {
+			t.Errorf("host of %q: %q, want %q", tc.head, got, tc.want)
+		}
+	}
+}
+
+func TestLooksLikeHTTP(t *testing.T) {
+	for _, tc := range []struct {
+		b    string
+		want bool
+	}{
+		{"", true},
+		{"GE", true},
+		{"GET ", true},
+		{"OPTIONS * HTTP/1.1", true},
+		{" GET", false},
+		{"get ", false},
+		{"GET/", false},
+		{strings.Repeat("A", maxMethodLen+1), false},
+		{"\x00\x01", false},
+	} {
+		if got := looksLikeHTTP([]byte(tc.b)); got != tc.want {
+			t.Errorf("%q: %v, want %v", tc.b, got, tc.want)
+		}
+	}
+}
+
+// hostHandler is a FlowEstablishHandler sending the Host of every flow to
+// a channel.
+type hostHandler chan string
+
+func (h hostHandler) Handle(localAddr, originalRemoteIp string) {}
+
+func (h hostHandler) HandleFlow(localAddr string, flow *Flow) {
+	h <- flow.Host
+}
+
+func TestHTTPHostSniffing(t *testing.T) {
+	const peek = 256
+	upstream := echoServer(t)
+	for _, tc := range []struct {
+		name    string
+		request string
+		host    string
+	}{
+		{"get", "GET /index.html HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n", "example.com"},
+		// The request head is larger than the peek, so Host is never read.
+		{"large", "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("c", 2*peek) + "\r\nHost: example.com\r\n\r\n", ""},
+		{"binary", "\x00\x9f\x13\xfe binary garbage\r\nHost: example.com\r\n\r\n", ""},
+	} {
+		redirected, established := make(chan string, 1), make(hostHandler, 1)
+		redirector := flowRedirector(func(f *Flow) *Decision {
+			redirected <- f.Host
+			return &Decision{Address: upstream}
+		})
+		c := startTestTUN(t,
+			withRedirectors(redirector, nil),
+			WithHTTPHostSniffing(peek),
+			func(t *TUN) error {
+				t.TcpEstablishHandler = established
+				return nil
+			},
+		)
+
+		conn, err := c.dialTCP(t, testRemote(httpPort))
+		if err != nil {
+			t.Fatalf("%s: dial: %v", tc.name, err)
+		}
+		// The bytes read while sniffing are replayed to the upstream.
+		roundTrip(t, conn, tc.request)
+		conn.Close()
+		if host := <-redirected; host != tc.host {
+			t.Errorf("%s: redirector saw host %q, want %q", tc.name, host, tc.host)
+		}
+		if host := <-established; host != tc.host {
+			t.Errorf("%s: establish handler saw host %q, want %q", tc.name, host, tc.host)
+		}
+	}
+
+	if err := (&TUN{}).Apply(WithHTTPHostSniffing(0)); err == nil {
+		t.Error("accepted a peek size of 0")
+	}
+}
@@ -0,0 +1,190 @@
+package libmitm
+
+import (
+	"errors"
+
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// icmpReplyHopLimit is the TTL or hop limit of locally generated replies.
+const icmpReplyHopLimit = 64
+
+// ICMPHandler is consulted for every ICMP message from the TUN with its
+// type, code and the rest of the message after the checksum. If handled is
+// false, the message is left to the stack, which answers echo requests
+// itself unless WithICMPEchoForward is set. Otherwise the message is
+// consumed: a non-nil reply, a complete ICMP message starting with type
+// and code, is sent back to the sender with its checksum filled in, and a
+// nil reply drops the message silently.
+type ICMPHandler func(icmpType, code uint8, payload []byte) (reply []byte, handled bool)
+
+// WithICMPHandler intercepts ICMP messages from the TUN before the stack
+// processes them. It sees all ICMPv4 types and ICMPv6 types except the
+// Neighbor Discovery and Multicast Listener Discovery messages, which the
+// stack relies on; the type values of both versions differ, e.g. echo
+// requests are 8 over IPv4 and 128 over IPv6. Fragmented messages and
+// ICMPv6 messages behind extension headers are not intercepted.
+func WithICMPHandler(fn ICMPHandler) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("icmp handler must not be nil")
+		}
+		t.icmpHandler = fn
+		return nil
+	}
+}
+
+// icmpEndpoint passes inbound ICMP messages to an ICMPHandler and then
+// forwards echo requests if an icmpEchoForwarder is set.
+type icmpEndpoint struct {
+	stack.LinkEndpoint
+	handler ICMPHandler
+	echo    *icmpEchoForwarder
+}
+
+func (e *icmpEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	if dispatcher == nil {
+		e.LinkEndpoint.Attach(nil)
+		return
+	}
+	e.LinkEndpoint.Attach(&icmpDispatcher{NetworkDispatcher: dispatcher, e: e})
+}
+
+type icmpDispatcher struct {
+	stack.NetworkDispatcher
+	e *icmpEndpoint
+}
+
+func (d *icmpDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	if !d.e.intercept(protocol, pkt) {
+		d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+	}
+}
+
+// intercept offers pkt to the handler and reports whether it was consumed.
+func (e *icmpEndpoint) intercept(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) bool {
+	var (
+		src, dst tcpip.Address
+		msg      []byte
+	)
+	// Look at the protocol first to keep other packets cheap.
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		h, ok := pkt.Data().PullUp(header.IPv4MinimumSize)
+		if !ok || header.IPv4(h).TransportProtocol() != header.ICMPv4ProtocolNumber {
+			return false
+		}
+	case header.IPv6ProtocolNumber:
+		h, ok := pkt.Data().PullUp(header.IPv6MinimumSize)
+		if !ok || header.IPv6(h).TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return false
+		}
+	default:
+		return false
+	}
+
+	b, ok := pkt.Data().PullUp(pkt.Data().Size())
+	if !ok {
+		return false
+	}
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(b)
+		if !ip.IsValid(len(b)) || ip.More() || ip.FragmentOffset() != 0 {
+			return false
+		}
+		src, dst, msg = ip.SourceAddress(), ip.DestinationAddress(), ip.Payload()
+		if len(msg) < header.ICMPv4MinimumSize {
+			return false
+		}
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(b)
+		if !ip.IsValid(len(b)) {
+			return false
+		}
+		src, dst, msg = ip.SourceAddress(), ip.DestinationAddress(), ip.Payload()
+		if len(msg) < header.ICMPv6MinimumSize || icmpv6ForStack(header.ICMPv6Type(msg[0])) {
+			return false
+		}
+	}
+
+	if e.handler != nil {
+		reply, handled := e.handler(msg[0], msg[1], msg[4:])
+		if handled {
+			if len(reply) >= 4 {
+				e.reply(protocol, dst, src, reply)
+			}
+			return true
+		}
+	}
+	if e.echo != nil && isEchoRequest(protocol, msg) {
+		e.echo.forward(e, protocol, src, dst, msg)
+		return true
+	}
+	return false
+}
+
+// icmpv6ForStack reports whether ICMPv6 messages of type t are needed by
+// the stack.
+func icmpv6ForStack(t header.ICMPv6Type) bool {
+	switch t {
+	case header.ICMPv6RouterSolicit, header.ICMPv6RouterAdvert,
+		header.ICMPv6NeighborSolicit, header.ICMPv6NeighborAdvert,
+		header.ICMPv6RedirectMsg, header.ICMPv6MulticastListenerQuery,
+		header.ICMPv6MulticastListenerReport, header.ICMPv6MulticastListenerDone,
+		header.ICMPv6MulticastListenerV2Report:
+		return true
+	}
+	return false
+}
+
+// reply sends the ICMP message msg from src to dst.
+func (e *icmpEndpoint) reply(protocol tcpip.NetworkProtocolNumber, src, dst tcpip.Address, msg []byte) {
+	var pkt []byte
+	if protocol == header.IPv4ProtocolNumber {
+		pkt = make([]byte, header.IPv4MinimumSize+len(msg))
+		ip := header.IPv4(pkt)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(pkt)),
+			TTL:         icmpReplyHopLimit,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     src,
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		icmp := header.ICMPv4(ip.Payload())
+		copy(icmp, msg)
+		icmp.SetChecksum(0)
+		icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+	} else {
+		pkt = make([]byte, header.IPv6MinimumSize+len(msg))
+		ip := header.IPv6(pkt)
+		ip.Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(msg)),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          icmpReplyHopLimit,
+			SrcAddr:           src,
+			DstAddr:           dst,
+		})
+		icmp := header.ICMPv6(ip.Payload())
+		copy(icmp, msg)
+		icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: icmp,
+			Src:    src,
+			Dst:    dst,
+		}))
+	}
+
+	out := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: bufferv2.MakeWithData(pkt),
+	})
+	defer out.DecRef()
+	out.NetworkProtocolNumber = protocol
+	var pkts stack.PacketBufferList
+	pkts.PushBack(out)
+	e.LinkEndpoint.WritePackets(pkts)
+}
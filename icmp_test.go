@@ -0,0 +1,135 @@
+package libmitm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// echoRequest returns an IPv4 packet carrying an ICMP echo request from the
+// client to dst with the given sequence number and payload.
+func echoRequest(dst string, seq uint16, payload string) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(payload))
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     tcpip.Address(net.ParseIP(testClientAddr).To4()),
+		DstAddr:     tcpip.Address(net.ParseIP(dst).To4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(ip.Payload())
+	icmp.SetType(header.ICMPv4Echo)
+	icmp.SetIdent(0x1234)
+	icmp.SetSequence(seq)
+	copy(icmp.Payload(), payload)
+	icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+	return b
+}
+
+// isEchoReply matches the ICMPv4 echo replies to the client.
+func isEchoReply(b []byte) bool {
+	return header.IPVersion(b) == header.IPv4Version &&
+		header.IPv4(b).Protocol() == uint8(header.ICMPv4ProtocolNumber) &&
+		header.ICMPv4(header.IPv4(b).Payload()).Type() == header.ICMPv4EchoReply
+}
+
+// checkEchoReply checks that b answers the echo request with seq and
+// payload sent to dst.
+func checkEchoReply(t *testing.T, b []byte, dst string, seq uint16, payload string) {
+	t.Helper()
+	ip := header.IPv4(b)
+	icmp := header.ICMPv4(ip.Payload())
+	if src := net.IP(ip.SourceAddress()).String(); src != dst {
+		t.Errorf("reply from %s, want %s", src, dst)
+	}
+	if icmp.Ident() != 0x1234 || icmp.Sequence() != seq || string(icmp.Payload()) != payload {
+		t.Errorf("reply ident %#x seq %d payload %q, want %#x, %d, %q", icmp.Ident(), icmp.Sequence(), icmp.Payload(), 0x1234, seq, payload)
+	}
+	if checksum.Checksum(icmp, 0) != 0xffff {
+		t.Error("reply has an invalid checksum")
+	}
+}
+
+// TestICMPEchoStack checks that the stack answers echo requests itself by
+// default.
+func TestICMPEchoStack(t *testing.T) {
+	_, ep := startRawTUN(t)
+	ep.InjectInbound(echoRequest(testRemoteAddr, 1, "stack"))
+	checkEchoReply(t, readOutbound(t, ep, isEchoReply), testRemoteAddr, 1, "stack")
+}
+
+// TestICMPHandler checks that an ICMPHandler answers or drops the messages
+// it handles.
+func TestICMPHandler(t *testing.T) {
+	seen := make(chan []byte, 4)
+	_, ep := startRawTUN(t, WithICMPHandler(func(icmpType, code uint8, payload []byte) ([]byte, bool) {
+		seen <- append([]byte(nil), payload...)
+		if icmpType != uint8(header.ICMPv4Echo) || binary.BigEndian.Uint16(payload[2:]) == 2 {
+			return nil, true
+		}
+		reply := append([]byte{uint8(header.ICMPv4EchoReply), 0, 0, 0}, payload...)
+		copy(reply[8:], "handled")
+		return reply, true
+	}))
+
+	ep.InjectInbound(echoRequest(testRemoteAddr, 1, "request"))
+	checkEchoReply(t, readOutbound(t, ep, isEchoReply), testRemoteAddr, 1, "handled")
+	if payload := <-seen; !bytes.Equal(payload, []byte{0x12, 0x34, 0, 1, 'r', 'e', 'q', 'u', 'e', 's', 't'}) {
+		t.Errorf("handler got %x", payload)
+	}
+
+	// The stack would answer a request the handler dropped.
+	ep.InjectInbound(echoRequest(testRemoteAddr, 2, "dropped"))
+	<-seen
+	time.Sleep(50 * time.Millisecond)
+	if b := ep.ReadOutbound(); b != nil {
+		t.Errorf("sent %x for a dropped request", b)
+	}
+}
+
+// TestICMPEchoForward checks that echo requests are sent from a ping socket
+// under the dialer's control, and the replies relayed back.
+func TestICMPEchoForward(t *testing.T) {
+	opt := WithICMPEchoForward(time.Second)
+	if err := opt(&TUN{}); err != nil {
+		t.Skipf("ping sockets are not available: %v", err)
+	}
+	controlled := make(chan string, 4)
+	_, ep := startRawTUN(t, opt, WithDialer(&net.Dialer{
+		Control: func(network, address string, _ syscall.RawConn) error {
+			controlled <- network + " " + address
+			if address != "127.0.0.1" {
+				return errors.New("blocked")
+			}
+			return nil
+		},
+	}))
+
+	ep.InjectInbound(echoRequest("127.0.0.1", 7, "forwarded"))
+	checkEchoReply(t, readOutbound(t, ep, isEchoReply), "127.0.0.1", 7, "forwarded")
+	if got := <-controlled; got != "ip4:icmp 127.0.0.1" {
+		t.Errorf("controls ran for %s", got)
+	}
+
+	// The stack would answer a request the controls refused to send.
+	ep.InjectInbound(echoRequest(testRemoteAddr, 8, "refused"))
+	<-controlled
+	time.Sleep(50 * time.Millisecond)
+	if b := ep.ReadOutbound(); b != nil {
+		t.Errorf("sent %x for a refused request", b)
+	}
+
+	if err := (&TUN{}).Apply(WithICMPEchoForward(0)); err == nil {
+		t.Error("accepted a zero timeout")
+	}
+}
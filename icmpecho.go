@@ -0,0 +1,140 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// icmpEchoMaxInFlight bounds the echo requests being forwarded at once;
+// further requests are dropped.
+const icmpEchoMaxInFlight = 64
+
+// WithICMPEchoForward forwards echo requests from the TUN to their
+// destinations instead of letting the stack answer them, so ping and
+// connectivity checks reflect whether a destination is reachable. Each
+// request is sent from an unprivileged ICMP socket, which gets the
+// Control function of the dialer and the upstream socket controls, and
+// the reply is relayed back if it arrives within timeout. An ICMPHandler
+// sees echo requests first. It fails if the platform does not allow
+// unprivileged ICMP sockets, e.g. on Linux when the process's group is
+// outside net.ipv4.ping_group_range.
+func WithICMPEchoForward(timeout time.Duration) Option {
+	return func(t *TUN) error {
+		if timeout <= 0 {
+			return errors.New("icmp echo timeout must be positive")
+		}
+		fd, err := pingSocket(unix.AF_INET)
+		if err != nil {
+			return fmt.Errorf("icmp echo forwarding is not available: %w", err)
+		}
+		unix.Close(fd)
+		t.icmpEcho = &icmpEchoForwarder{
+			timeout: timeout,
+			slots:   make(chan struct{}, icmpEchoMaxInFlight),
+		}
+		return nil
+	}
+}
+
+// icmpEchoForwarder forwards echo requests through ping sockets.
+type icmpEchoForwarder struct {
+	timeout time.Duration
+	slots   chan struct{}
+	// control is the Control function of the upstream dialer, if any.
+	control controlFunc
+}
+
+// isEchoRequest reports whether msg is an echo request of protocol.
+func isEchoRequest(protocol tcpip.NetworkProtocolNumber, msg []byte) bool {
+	if len(msg) < header.ICMPv4MinimumSize || msg[1] != 0 {
+		return false
+	}
+	if protocol == header.IPv4ProtocolNumber {
+		return header.ICMPv4Type(msg[0]) == header.ICMPv4Echo
+	}
+	return header.ICMPv6Type(msg[0]) == header.ICMPv6EchoRequest
+}
+
+// forward sends the echo request msg from src to dst and relays the reply
+// through e in the background.
+func (f *icmpEchoForwarder) forward(e *icmpEndpoint, protocol tcpip.NetworkProtocolNumber, src, dst tcpip.Address, msg []byte) {
+	select {
+	case f.slots <- struct{}{}:
+	default:
+		return
+	}
+	req := append([]byte(nil), msg...)
+	go func() {
+		defer func() { <-f.slots }()
+		if reply := f.exchange(protocol, dst, req); reply != nil {
+			e.reply(protocol, dst, src, reply)
+		}
+	}()
+}
+
+// exchange sends req to dst and returns the matching reply, or nil if
+// none arrived in time.
+func (f *icmpEchoForwarder) exchange(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address, req []byte) []byte {
+	family, network, replyType := unix.AF_INET, "ip4:icmp", byte(header.ICMPv4EchoReply)
+	if protocol == header.IPv6ProtocolNumber {
+		family, network, replyType = unix.AF_INET6, "ip6:ipv6-icmp", byte(header.ICMPv6EchoReply)
+	}
+	fd, err := pingSocket(family)
+	if err != nil {
+		return nil
+	}
+	file := os.NewFile(uintptr(fd), "ping")
+	pc, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return nil
+	}
+	defer pc.Close()
+
+	addr := &net.UDPAddr{IP: net.IP(dst)}
+	if f.control != nil {
+		rc, err := pc.(*net.UDPConn).SyscallConn()
+		if err != nil || f.control(network, addr.IP.String(), rc) != nil {
+			return nil
+		}
+	}
+	// The kernel sets the identifier to that of the socket and fills in
+	// the checksum.
+	ident, seq := binary.BigEndian.Uint16(req[4:]), binary.BigEndian.Uint16(req[6:])
+	req[2], req[3] = 0, 0
+	if _, err := pc.WriteTo(req, addr); err != nil {
+		return nil
+	}
+
+	pc.SetReadDeadline(time.Now().Add(f.timeout))
+	b := make([]byte, 65535)
+	for {
+		n, _, err := pc.ReadFrom(b)
+		if err != nil {
+			return nil
+		}
+		reply := b[:n]
+		if n < header.ICMPv4MinimumSize || reply[0] != replyType || binary.BigEndian.Uint16(reply[6:]) != seq {
+			continue
+		}
+		binary.BigEndian.PutUint16(reply[4:], ident)
+		return reply
+	}
+}
+
+// pingSocket opens an unprivileged ICMP socket of family.
+func pingSocket(family int) (int, error) {
+	proto := unix.IPPROTO_ICMP
+	if family == unix.AF_INET6 {
+		proto = unix.IPPROTO_ICMPV6
+	}
+	return unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+}
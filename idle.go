@@ -0,0 +1,180 @@
+package libmitm
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// defaultUDPTimeout expires idle UDP sessions unless a timeout is
+// configured.
+const defaultUDPTimeout = 60 * time.Second
+
+type udpTimeoutConfig struct {
+	byPort   map[uint16]time.Duration
+	fallback time.Duration
+	set      bool
+}
+
+// WithUDPTimeout expires UDP sessions that saw no datagram in either
+// direction for d, closing the client endpoint and the upstream socket.
+// A zero d keeps sessions alive forever. Without this option or
+// WithUDPTimeoutByPort, sessions expire after 60 seconds. Datagrams of a
+// live session, keyed by its 4-tuple, keep reusing its upstream socket.
+func WithUDPTimeout(d time.Duration) Option {
+	return func(t *TUN) error {
+		if d < 0 {
+			return errors.New("udp timeout must not be negative")
+		}
+		t.udpTimeout.fallback = d
+		t.udpTimeout.set = true
+		return nil
+	}
+}
+
+// WithUDPTimeoutByPort expires idle UDP sessions after a timeout chosen by
+// the session's destination port, falling back to fallback for ports not
+// in timeouts. A zero timeout keeps sessions alive forever. This allows
+// e.g. reaping DNS sessions after seconds while voice sessions live for
+// minutes. A Decision.IdleTimeout overrides these for its flow.
+func WithUDPTimeoutByPort(timeouts map[uint16]time.Duration, fallback time.Duration) Option {
+	return func(t *TUN) error {
+		byPort := make(map[uint16]time.Duration, len(timeouts))
+		for port, d := range timeouts {
+			if d < 0 {
+				return errors.New("udp timeout must not be negative")
+			}
+			byPort[port] = d
+		}
+		if fallback < 0 {
+			return errors.New("udp timeout must not be negative")
+		}
+		t.udpTimeout = udpTimeoutConfig{byPort: byPort, fallback: fallback, set: true}
+		return nil
+	}
+}
+
+// WithTCPIdleTimeout closes TCP flows that carried no data in either
+// direction for d, closing the client endpoint and the upstream
+// connection. Every chunk copied in either direction restarts the timeout,
+// so busy flows live on however long they last. Unlike keepalive, which
+// only probes the client, it reaps flows whose peers are alive but silent,
+// e.g. behind a middlebox that answers probes. A zero d, the default,
+// keeps idle TCP flows open. A Decision.IdleTimeout overrides it for its
+// flow.
+func WithTCPIdleTimeout(d time.Duration) Option {
+	return func(t *TUN) error {
+		if d < 0 {
+			return errors.New("tcp idle timeout must not be negative")
+		}
+		t.tcpTimeout = d
+		return nil
+	}
+}
+
+// idleTimeout returns the idle timeout for flow routed by decision, or 0
+// if it never expires.
+func (t *TUN) idleTimeout(flow *Flow, decision Decision) time.Duration {
+	if decision.IdleTimeout != 0 {
+		if decision.IdleTimeout < 0 {
+			return 0
+		}
+		return decision.IdleTimeout
+	}
+	if flow.Network == "tcp" {
+		return t.tcpTimeout
+	}
+	if flow.Network != "udp" {
+		return 0
+	}
+	if !t.udpTimeout.set {
+		return defaultUDPTimeout
+	}
+	if d, ok := t.udpTimeout.byPort[uint16(flow.DestinationPort)]; ok {
+		return d
+	}
+	return t.udpTimeout.fallback
+}
+
+// clock is the source of time of idle timers. Tests replace it to expire
+// flows without waiting for their timeouts.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is the subset of *time.Timer used by idle timers.
+type clockTimer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// idleClock returns the clock of the idle timers of t.
+func (t *TUN) idleClock() clock {
+	if t.clock == nil {
+		return systemClock{}
+	}
+	return t.clock
+}
+
+// idleTimer calls onIdle once no activity was seen for timeout.
+type idleTimer struct {
+	clock   clock
+	timeout time.Duration
+	onIdle  func()
+
+	last  atomic.Int64
+	timer clockTimer
+}
+
+func newIdleTimer(c clock, timeout time.Duration, onIdle func()) *idleTimer {
+	i := &idleTimer{clock: c, timeout: timeout, onIdle: onIdle}
+	i.touch()
+	i.timer = c.AfterFunc(timeout, i.check)
+	return i
+}
+
+// touch records activity.
+func (i *idleTimer) touch() {
+	i.last.Store(i.clock.Now().UnixNano())
+}
+
+func (i *idleTimer) check() {
+	idle := i.clock.Now().Sub(time.Unix(0, i.last.Load()))
+	if idle >= i.timeout {
+		i.onIdle()
+		return
+	}
+	i.timer.Reset(i.timeout - idle)
+}
+
+func (i *idleTimer) stop() {
+	i.timer.Stop()
+}
+
+// reader returns r wrapped to record every successful read as activity.
+func (i *idleTimer) reader(r io.Reader) io.Reader {
+	return &activityReader{r: r, timer: i}
+}
+
+type activityReader struct {
+	r     io.Reader
+	timer *idleTimer
+}
+
+func (a *activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.timer.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,249 @@
+package libmitm
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// udpSourceServer starts a UDP echo server on the loopback that sends the
+// source address of every datagram it echoes to the returned channel.
+func udpSourceServer(t *testing.T) (string, chan string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	sources := make(chan string, 64)
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			sources <- addr.String()
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String(), sources
+}
+
+// TestUDPTimeout checks that an active UDP session keeps its upstream
+// socket, and that a silent one is reaped after the timeout, so that its
+// next datagram is sent from a new upstream socket.
+func TestUDPTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	upstream, sources := udpSourceServer(t)
+	c := startTestTUN(t,
+		withRedirectors(nil, FixedRedirector(upstream)),
+		WithUDPTimeout(timeout),
+	)
+
+	conn := c.dialUDP(t, testRemote(5000))
+	roundTrip(t, conn, "first")
+	first := <-sources
+	for end := time.Now().Add(3 * timeout); time.Now().Before(end); {
+		time.Sleep(timeout / 4)
+		roundTrip(t, conn, "active")
+		if source := <-sources; source != first {
+			t.Fatalf("active session moved from %s to %s", first, source)
+		}
+	}
+
+	time.Sleep(3 * timeout)
+	roundTrip(t, conn, "after idling")
+	if source := <-sources; source == first {
+		t.Errorf("silent session kept its upstream socket %s", source)
+	}
+}
+
+// TestTCPIdleTimeout checks that a TCP flow without traffic is closed
+// after the timeout, while one carrying data keeps going past it.
+func TestTCPIdleTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(echoServer(t)), nil),
+		WithTCPIdleTimeout(timeout),
+	)
+
+	idle, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer idle.Close()
+	roundTrip(t, idle, "then silence")
+	active, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer active.Close()
+
+	for end := time.Now().Add(3 * timeout); time.Now().Before(end); {
+		time.Sleep(timeout / 4)
+		roundTrip(t, active, "active")
+	}
+
+	idle.SetReadDeadline(time.Now().Add(testTimeout))
+	_, err = idle.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("read data from an idle flow")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("idle flow was not closed: %v", err)
+	}
+}
+
+// manualClock is a clock that only moves when advanced.
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	c      *manualClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	t := &manualTimer{c: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// advance moves the clock forward by d and runs the timers that expire.
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*manualTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.active
+	t.at = t.c.now.Add(d)
+	if !active {
+		t.active = true
+		t.c.timers = append(t.c.timers, t)
+	}
+	return active
+}
+
+func (t *manualTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.active
+	t.active = false
+	for i, other := range t.c.timers {
+		if other == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			break
+		}
+	}
+	return active
+}
+
+// TestUDPTimeoutByPort checks that sessions to two ports expire after the
+// timeouts of their ports, each moving to a new upstream socket.
+func TestUDPTimeoutByPort(t *testing.T) {
+	upstream, sources := udpSourceServer(t)
+	clock := &manualClock{now: time.Unix(1, 0)}
+	c := startTestTUN(t,
+		withRedirectors(nil, FixedRedirector(upstream)),
+		WithUDPTimeoutByPort(map[uint16]time.Duration{53: time.Second}, time.Minute),
+		func(t *TUN) error {
+			t.clock = clock
+			return nil
+		},
+	)
+	// exchange sends msg on conn and returns the upstream socket it was
+	// forwarded from.
+	exchange := func(conn net.Conn, msg string) string {
+		roundTrip(t, conn, msg)
+		return <-sources
+	}
+
+	dns, voice := c.dialUDP(t, testRemote(53)), c.dialUDP(t, testRemote(3478))
+	dnsSource, voiceSource := exchange(dns, "dns"), exchange(voice, "voice")
+
+	clock.advance(2 * time.Second)
+	if source := exchange(dns, "dns again"); source == dnsSource {
+		t.Errorf("port 53 session kept its upstream socket %s past its timeout", source)
+	}
+	if source := exchange(voice, "voice again"); source != voiceSource {
+		t.Errorf("port 3478 session moved from %s to %s before its timeout", voiceSource, source)
+	}
+
+	clock.advance(2 * time.Minute)
+	if source := exchange(voice, "voice at last"); source == voiceSource {
+		t.Errorf("port 3478 session kept its upstream socket %s past its timeout", source)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tcp := &Flow{Network: "tcp", DestinationPort: 443}
+	dns := &Flow{Network: "udp", DestinationPort: 53}
+	voice := &Flow{Network: "udp", DestinationPort: 3478}
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		flow     *Flow
+		decision Decision
+		want     time.Duration
+	}{
+		{"udp default", nil, dns, Decision{}, defaultUDPTimeout},
+		{"tcp default", nil, tcp, Decision{}, 0},
+		{"udp", []Option{WithUDPTimeout(time.Second)}, dns, Decision{}, time.Second},
+		{"udp forever", []Option{WithUDPTimeout(0)}, dns, Decision{}, 0},
+		{"tcp", []Option{WithTCPIdleTimeout(time.Minute)}, tcp, Decision{}, time.Minute},
+		{"by port", []Option{WithUDPTimeoutByPort(map[uint16]time.Duration{53: time.Second}, time.Minute)}, dns, Decision{}, time.Second},
+		{"by port fallback", []Option{WithUDPTimeoutByPort(map[uint16]time.Duration{53: time.Second}, time.Minute)}, voice, Decision{}, time.Minute},
+		{"decision", []Option{WithUDPTimeout(time.Second)}, dns, Decision{IdleTimeout: time.Hour}, time.Hour},
+		{"decision forever", []Option{WithUDPTimeout(time.Second)}, dns, Decision{IdleTimeout: NeverIdle}, 0},
+	} {
+		tun := &TUN{}
+		if err := tun.Apply(tc.opts...); err != nil {
+			t.Fatalf("%s: apply: %v", tc.name, err)
+		}
+		if got := tun.idleTimeout(tc.flow, tc.decision); got != tc.want {
+			t.Errorf("%s: timeout %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	for _, opt := range []Option{
+		WithUDPTimeout(-time.Second),
+		WithTCPIdleTimeout(-time.Second),
+		WithUDPTimeoutByPort(map[uint16]time.Duration{53: -time.Second}, 0),
+		WithUDPTimeoutByPort(nil, -time.Second),
+	} {
+		if err := (&TUN{}).Apply(opt); err == nil {
+			t.Error("accepted a negative timeout")
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package libmitm
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inspectorQueueLen is the number of chunks pending for a stream inspector
+// before further chunks are dropped.
+const inspectorQueueLen = 1024
+
+// Direction is the direction bytes of a flow travel in.
+type Direction int
+
+const (
+	// DirectionUpstream is from the client to the upstream.
+	DirectionUpstream Direction = iota + 1
+	// DirectionDownstream is from the upstream to the client.
+	DirectionDownstream
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionUpstream:
+		return "upstream"
+	case DirectionDownstream:
+		return "downstream"
+	}
+	return "unknown"
+}
+
+// StreamInspector observes the bytes of a flow, identified by its Flow ID,
+// as they are forwarded. b is a copy owned by the inspector.
+type StreamInspector func(id string, dir Direction, b []byte, at time.Time)
+
+type inspectedChunk struct {
+	id  string
+	dir Direction
+	b   []byte
+	at  time.Time
+}
+
+type streamInspector struct {
+	fn StreamInspector
+
+	queue     chan inspectedChunk
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	dropped atomic.Int64
+}
+
+// WithStreamInspector feeds fn every chunk forwarded in either direction,
+// read-only and with the time it was read. fn runs on a single goroutine
+// of its own, so it can neither modify nor stall the data: chunks are
+// queued, and dropped while the queue is full. Dropped chunks are counted
+// by InspectorDropped.
+func WithStreamInspector(fn StreamInspector) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("stream inspector must not be nil")
+		}
+		t.inspector.fn = fn
+		return nil
+	}
+}
+
+// InspectorDropped returns the number of chunks not delivered to the
+// stream inspector because it fell behind.
+func (t *TUN) InspectorDropped() int64 {
+	return t.inspector.dropped.Load()
+}
+
+func (s *streamInspector) start() {
+	if s.fn == nil {
+		return
+	}
+	s.queue = make(chan inspectedChunk, inspectorQueueLen)
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			select {
+			case c := <-s.queue:
+				s.fn(c.id, c.dir, c.b, c.at)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+func (s *streamInspector) stop() {
+	if s.queue == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+}
+
+// reader returns r wrapped to pass every chunk read to the inspector.
+func (s *streamInspector) reader(id string, dir Direction, r io.Reader) io.Reader {
+	if s.queue == nil {
+		return r
+	}
+	return &inspectingReader{r: r, s: s, id: id, dir: dir}
+}
+
+type inspectingReader struct {
+	r   io.Reader
+	s   *streamInspector
+	id  string
+	dir Direction
+}
+
+func (i *inspectingReader) Read(b []byte) (int, error) {
+	n, err := i.r.Read(b)
+	if n > 0 {
+		c := inspectedChunk{id: i.id, dir: i.dir, b: append([]byte(nil), b[:n]...), at: time.Now()}
+		select {
+		case i.s.queue <- c:
+		default:
+			i.s.dropped.Add(1)
+		}
+	}
+	return n, err
+}
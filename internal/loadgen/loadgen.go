@@ -0,0 +1,432 @@
+// Package loadgen drives a libmitm TUN with synthetic packets to measure
+// the dispatch and forwarding hot paths. It is meant to be used from the
+// benchmarks of this module, hence internal, and is not part of the
+// mobile bindings.
+//
+// The TUN reads from one end of a socket pair as it would from a TUN
+// device, so packets take the real read, dispatch and forwarding paths.
+// Upstream connections are answered by an in-memory echo server.
+package loadgen
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"libmitm"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	mtu = 1500
+
+	// serverPort is the destination port of generated packets.
+	serverPort = 7
+	// clientPort is the first source port of generated flows.
+	clientPort = 10000
+
+	// defaultTimeout is how long Run waits for outstanding responses.
+	defaultTimeout = 5 * time.Second
+
+	// maxPorts is the number of source ports from clientPort on.
+	maxPorts = 1<<16 - clientPort
+	// maxTCPPackets is the number of distinct TCP flows, one per client
+	// address of 10.1.0.0/16 and source port.
+	maxTCPPackets = 1 << 16 * maxPorts
+)
+
+var serverAddr = tcpip.Address("\x0a\x00\x00\x01")
+
+// Config describes a load run.
+type Config struct {
+	// Network is "udp", to send datagrams that are echoed back, or
+	// "tcp", to open connections: each packet is a SYN, answered by the
+	// handshake's SYN-ACK. The connection is then completed and reset.
+	Network string
+
+	// Packets is the number of packets to send. TCP runs are limited to
+	// one packet per client address and port, 65536 * 55536.
+	Packets int
+
+	// PacketsPerSecond paces sending. If zero, packets are sent as fast
+	// as the socket accepts them.
+	PacketsPerSecond int
+
+	// Flows is the number of UDP flows packets are spread over, at most
+	// 55536. It defaults to 1. Every TCP packet opens a flow of its own.
+	Flows int
+
+	// PayloadSize is the size of UDP payloads, at least 8 bytes.
+	PayloadSize int
+
+	// Timeout bounds the wait for responses after the last packet was
+	// sent. It defaults to five seconds.
+	Timeout time.Duration
+}
+
+// Result reports the outcome of a load run.
+type Result struct {
+	Sent     int
+	Received int
+	Elapsed  time.Duration
+
+	// PacketsPerSecond is the rate responses were received at.
+	PacketsPerSecond float64
+
+	// MeanLatency is the mean time from sending a packet to receiving
+	// its response.
+	MeanLatency time.Duration
+
+	// Allocs and AllocBytes are the heap allocations made during the
+	// run by the whole process.
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+// AllocsPerPacket returns the allocations made per packet sent.
+func (r Result) AllocsPerPacket() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Allocs) / float64(r.Sent)
+}
+
+// Harness is a started TUN and the client end of its device.
+type Harness struct {
+	tun    *libmitm.TUN
+	device *os.File
+	tunFd  int
+
+	mu      sync.Mutex
+	run     *run
+	started map[uint64]time.Time
+
+	done chan struct{}
+}
+
+// run is the state of the load run in progress.
+type run struct {
+	network  string
+	received atomic.Int64
+	latency  atomic.Int64
+	complete chan struct{}
+	want     int64
+}
+
+// New starts a TUN configured with opts whose upstream is an in-memory
+// echo server.
+func New(opts ...libmitm.Option) (*Harness, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socketpair: %w", err)
+	}
+	// The endpoint reads with raw syscalls and polls on EAGAIN, like a
+	// TUN device opened non-blocking.
+	for _, fd := range fds {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fds[0])
+			unix.Close(fds[1])
+			return nil, fmt.Errorf("socketpair: %w", err)
+		}
+	}
+
+	h := &Harness{
+		device:  os.NewFile(uintptr(fds[0]), "loadgen"),
+		tunFd:   fds[1],
+		started: make(map[uint64]time.Time),
+		done:    make(chan struct{}),
+	}
+	h.tun = &libmitm.TUN{
+		FileDescriber: int32(fds[1]),
+		MTU:           mtu,
+		IPv6Config:    libmitm.IPv6Enable,
+	}
+	opts = append([]libmitm.Option{libmitm.WithDialer(echoDialer{})}, opts...)
+	if err := h.tun.Apply(opts...); err != nil {
+		h.close()
+		return nil, err
+	}
+	if err := h.tun.Start(); err != nil {
+		h.close()
+		return nil, err
+	}
+	go h.readLoop()
+	return h, nil
+}
+
+// TUN returns the TUN under load, e.g. to read its counters.
+func (h *Harness) TUN() *libmitm.TUN {
+	return h.tun
+}
+
+// Close stops the TUN and releases the device.
+func (h *Harness) Close() {
+	h.tun.Close()
+	h.close()
+	<-h.done
+}
+
+func (h *Harness) close() {
+	h.device.Close()
+	unix.Close(h.tunFd)
+}
+
+// Run sends cfg.Packets packets and waits for their responses. Runs must
+// not overlap.
+func (h *Harness) Run(cfg Config) (Result, error) {
+	if cfg.Network != "udp" && cfg.Network != "tcp" {
+		return Result{}, errors.New("loadgen: network must be udp or tcp")
+	}
+	if cfg.Flows <= 0 {
+		cfg.Flows = 1
+	}
+	// Source ports would wrap around and flows collide.
+	if cfg.Flows > maxPorts {
+		return Result{}, fmt.Errorf("loadgen: more than %d flows", maxPorts)
+	}
+	if cfg.Network == "tcp" && int64(cfg.Packets) > maxTCPPackets {
+		return Result{}, fmt.Errorf("loadgen: more than %d tcp packets", int64(maxTCPPackets))
+	}
+	if cfg.PayloadSize < 8 {
+		cfg.PayloadSize = 8
+	}
+	if max := mtu - header.IPv4MinimumSize - header.UDPMinimumSize; cfg.PayloadSize > max {
+		return Result{}, fmt.Errorf("loadgen: payload size exceeds %d bytes", max)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	r := &run{network: cfg.Network, complete: make(chan struct{}), want: int64(cfg.Packets)}
+	h.mu.Lock()
+	h.run = r
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.run = nil
+		h.started = make(map[uint64]time.Time)
+		h.mu.Unlock()
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	sent := 0
+	buf := make([]byte, mtu)
+	for ; sent < cfg.Packets; sent++ {
+		if cfg.PacketsPerSecond > 0 {
+			due := start.Add(time.Duration(sent) * time.Second / time.Duration(cfg.PacketsPerSecond))
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		var pkt []byte
+		if cfg.Network == "udp" {
+			pkt = udpPacket(buf, clientAddr(0), uint16(clientPort+sent%cfg.Flows), cfg.PayloadSize, time.Now())
+		} else {
+			src, port := tcpFlow(sent)
+			h.mu.Lock()
+			h.started[flowKey(src, port)] = time.Now()
+			h.mu.Unlock()
+			pkt = tcpPacket(buf, src, port, 0, 0, header.TCPFlagSyn)
+		}
+		if _, err := h.device.Write(pkt); err != nil {
+			return Result{}, fmt.Errorf("loadgen: write: %w", err)
+		}
+	}
+
+	select {
+	case <-r.complete:
+	case <-time.After(cfg.Timeout):
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	res := Result{
+		Sent:       sent,
+		Received:   int(r.received.Load()),
+		Elapsed:    elapsed,
+		Allocs:     after.Mallocs - before.Mallocs,
+		AllocBytes: after.TotalAlloc - before.TotalAlloc,
+	}
+	if res.Received > 0 {
+		res.PacketsPerSecond = float64(res.Received) / elapsed.Seconds()
+		res.MeanLatency = time.Duration(r.latency.Load() / int64(res.Received))
+	}
+	return res, nil
+}
+
+// Benchmark runs b.N packets described by cfg through a TUN configured
+// with opts and reports the rate, latency and loss as metrics.
+func Benchmark(b *testing.B, cfg Config, opts ...libmitm.Option) {
+	h, err := New(opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Close()
+
+	cfg.Packets = b.N
+	b.ReportAllocs()
+	b.ResetTimer()
+	res, err := h.Run(cfg)
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(res.PacketsPerSecond, "pps")
+	b.ReportMetric(float64(res.MeanLatency.Nanoseconds()), "ns/rtt")
+	b.ReportMetric(float64(res.Sent-res.Received), "lost")
+}
+
+func (h *Harness) readLoop() {
+	defer close(h.done)
+	buf := make([]byte, 1<<16)
+	out := make([]byte, mtu)
+	for {
+		n, err := h.device.Read(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		ip := header.IPv4(buf[:n])
+		if n < header.IPv4MinimumSize || !ip.IsValid(n) {
+			continue
+		}
+
+		h.mu.Lock()
+		r := h.run
+		h.mu.Unlock()
+		if r == nil {
+			continue
+		}
+
+		switch ip.TransportProtocol() {
+		case header.UDPProtocolNumber:
+			u := header.UDP(ip.Payload())
+			if r.network != "udp" || len(u) < header.UDPMinimumSize+8 {
+				continue
+			}
+			sentAt := int64(binary.BigEndian.Uint64(u.Payload()))
+			r.received.Add(1)
+			r.latency.Add(now.UnixNano() - sentAt)
+		case header.TCPProtocolNumber:
+			t := header.TCP(ip.Payload())
+			if r.network != "tcp" || len(t) < header.TCPMinimumSize || t.Flags() != header.TCPFlagSyn|header.TCPFlagAck {
+				continue
+			}
+			src, port := ip.DestinationAddress(), t.DestinationPort()
+			h.mu.Lock()
+			sentAt, ok := h.started[flowKey(src, port)]
+			delete(h.started, flowKey(src, port))
+			h.mu.Unlock()
+			if !ok {
+				continue
+			}
+			r.received.Add(1)
+			r.latency.Add(int64(now.Sub(sentAt)))
+
+			// Complete the handshake, then tear the connection down.
+			h.device.Write(tcpPacket(out, src, port, 1, t.SequenceNumber()+1, header.TCPFlagAck))
+			h.device.Write(tcpPacket(out, src, port, 1, 0, header.TCPFlagRst))
+		default:
+			continue
+		}
+		if r.received.Load() == r.want {
+			close(r.complete)
+		}
+	}
+}
+
+// clientAddr returns the i-th client address in 10.1.0.0/16.
+func clientAddr(i int) tcpip.Address {
+	return tcpip.Address([]byte{10, 1, byte(i >> 8), byte(i)})
+}
+
+// tcpFlow returns the client address and port of the i-th TCP flow.
+func tcpFlow(i int) (tcpip.Address, uint16) {
+	return clientAddr(i % 65536), uint16(clientPort + i/65536)
+}
+
+func flowKey(addr tcpip.Address, port uint16) uint64 {
+	return uint64(binary.BigEndian.Uint32([]byte(addr)))<<16 | uint64(port)
+}
+
+// udpPacket builds a datagram to the server in buf whose payload starts
+// with the send time.
+func udpPacket(buf []byte, src tcpip.Address, port uint16, payloadSize int, now time.Time) []byte {
+	n := header.IPv4MinimumSize + header.UDPMinimumSize + payloadSize
+	pkt := buf[:n]
+	ipv4Header(pkt, src, header.UDPProtocolNumber)
+
+	u := header.UDP(pkt[header.IPv4MinimumSize:])
+	u.Encode(&header.UDPFields{
+		SrcPort: port,
+		DstPort: serverPort,
+		Length:  uint16(len(u)),
+	})
+	payload := u.Payload()
+	for i := range payload {
+		payload[i] = 0
+	}
+	binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+	// A zero checksum is valid over IPv4 and keeps generation cheap.
+	return pkt
+}
+
+// tcpPacket builds a segment without payload to the server in buf.
+func tcpPacket(buf []byte, src tcpip.Address, port uint16, seq, ack uint32, flags header.TCPFlags) []byte {
+	n := header.IPv4MinimumSize + header.TCPMinimumSize
+	pkt := buf[:n]
+	ipv4Header(pkt, src, header.TCPProtocolNumber)
+
+	t := header.TCP(pkt[header.IPv4MinimumSize:])
+	t.Encode(&header.TCPFields{
+		SrcPort:    port,
+		DstPort:    serverPort,
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 0xffff,
+	})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, serverAddr, uint16(len(t)))
+	t.SetChecksum(^t.CalculateChecksum(xsum))
+	return pkt
+}
+
+func ipv4Header(pkt []byte, src tcpip.Address, protocol tcpip.TransportProtocolNumber) {
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    uint8(protocol),
+		SrcAddr:     src,
+		DstAddr:     serverAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+}
+
+// echoDialer connects to an in-memory server echoing everything back.
+type echoDialer struct{}
+
+func (echoDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		io.Copy(server, server)
+	}()
+	return client, nil
+}
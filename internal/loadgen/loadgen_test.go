@@ -0,0 +1,45 @@
+package loadgen
+
+import "testing"
+
+func TestRun(t *testing.T) {
+	h, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, cfg := range []Config{
+		{Network: "udp", Packets: 100, Flows: 4, PayloadSize: 64},
+		{Network: "tcp", Packets: 50},
+	} {
+		res, err := h.Run(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", cfg.Network, err)
+		}
+		if res.Sent != cfg.Packets || res.Received != cfg.Packets {
+			t.Errorf("%s: sent %d and received %d of %d packets", cfg.Network, res.Sent, res.Received, cfg.Packets)
+		}
+		if res.PacketsPerSecond <= 0 || res.MeanLatency <= 0 {
+			t.Errorf("%s: rate %f, latency %s", cfg.Network, res.PacketsPerSecond, res.MeanLatency)
+		}
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	h, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, cfg := range []Config{
+		{Network: "icmp", Packets: 1},
+		{Network: "udp", Packets: 1, Flows: maxPorts + 1},
+		{Network: "udp", Packets: 1, PayloadSize: mtu},
+	} {
+		if _, err := h.Run(cfg); err == nil {
+			t.Errorf("ran %+v", cfg)
+		}
+	}
+}
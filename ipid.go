@@ -0,0 +1,94 @@
+package libmitm
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// IPIDMode selects how the IPv4 Identification field of packets sent to
+// the TUN is generated.
+type IPIDMode int
+
+const (
+	// IPIDStack keeps the IDs generated by gVisor, which are drawn from
+	// per-flow counters seeded by a hash of the addresses.
+	IPIDStack IPIDMode = iota
+	// IPIDSequential numbers all packets with a single global counter.
+	IPIDSequential
+	// IPIDRandom uses a random ID for every packet.
+	IPIDRandom
+	// IPIDZero sets the ID to zero on packets that have DF set, as Linux
+	// does. Other packets get sequential IDs.
+	IPIDZero
+)
+
+// WithIPIDMode rewrites the IPv4 Identification field of packets sent to
+// the TUN. gVisor has no option to choose its ID generator, so IDs are
+// rewritten on the link endpoint's write path and the header checksum is
+// recomputed. Fragments keep the stack's ID, since all fragments of a
+// datagram must share it.
+func WithIPIDMode(mode IPIDMode) Option {
+	return func(t *TUN) error {
+		if mode < IPIDStack || mode > IPIDZero {
+			return errors.New("unknown ip id mode")
+		}
+		t.ipIDMode = mode
+		return nil
+	}
+}
+
+// ipIDEndpoint rewrites the IPv4 ID of written packets.
+type ipIDEndpoint struct {
+	stack.LinkEndpoint
+	mode IPIDMode
+
+	next atomic.Uint32
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newIPIDEndpoint(lower stack.LinkEndpoint, mode IPIDMode) *ipIDEndpoint {
+	return &ipIDEndpoint{
+		LinkEndpoint: lower,
+		mode:         mode,
+		rnd:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (e *ipIDEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for _, pkt := range pkts.AsSlice() {
+		if pkt.NetworkProtocolNumber != header.IPv4ProtocolNumber {
+			continue
+		}
+		h := header.IPv4(pkt.NetworkHeader().Slice())
+		if len(h) < header.IPv4MinimumSize || h.More() || h.FragmentOffset() != 0 {
+			continue
+		}
+		h.SetID(e.id(h))
+		h.SetChecksum(0)
+		h.SetChecksum(^h.CalculateChecksum())
+	}
+	return e.LinkEndpoint.WritePackets(pkts)
+}
+
+func (e *ipIDEndpoint) id(h header.IPv4) uint16 {
+	switch e.mode {
+	case IPIDRandom:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return uint16(e.rnd.Uint32())
+	case IPIDZero:
+		if h.Flags()&header.IPv4FlagDontFragment != 0 {
+			return 0
+		}
+	}
+	return uint16(e.next.Add(1))
+}
@@ -0,0 +1,128 @@
+package libmitm
+
+import (
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// stackID is the ID of the packets handed to an ipIDEndpoint by tests.
+const stackID = 7
+
+// outboundIPv4 returns a packet as the stack writes it: an IPv4 header
+// with the given flags and fragment offset, followed by 8 bytes of payload.
+func outboundIPv4(flags uint8, fragmentOffset uint16) stack.PacketBufferPtr {
+	b := make([]byte, header.IPv4MinimumSize+8)
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength:    uint16(len(b)),
+		ID:             stackID,
+		Flags:          flags,
+		FragmentOffset: fragmentOffset,
+		TTL:            64,
+		Protocol:       uint8(header.UDPProtocolNumber),
+		SrcAddr:        tcpip.Address(net.ParseIP(testRemoteAddr).To4()),
+		DstAddr:        tcpip.Address(net.ParseIP(testClientAddr).To4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(b)})
+	pkt.NetworkProtocolNumber = header.IPv4ProtocolNumber
+	pkt.NetworkHeader().Consume(header.IPv4MinimumSize)
+	return pkt
+}
+
+// writeIDs writes four packets with DF set, one without and one fragment
+// through an ipIDEndpoint of mode, and returns the IDs they were sent with.
+func writeIDs(t *testing.T, mode IPIDMode) []uint16 {
+	t.Helper()
+	lower := channel.New(16, testMTU, "")
+	e := newIPIDEndpoint(lower, mode)
+	var pkts stack.PacketBufferList
+	for i := 0; i < 4; i++ {
+		pkts.PushBack(outboundIPv4(header.IPv4FlagDontFragment, 0))
+	}
+	pkts.PushBack(outboundIPv4(0, 0))
+	pkts.PushBack(outboundIPv4(header.IPv4FlagMoreFragments, 0))
+	defer pkts.DecRef()
+	if n, err := e.WritePackets(pkts); err != nil || n != pkts.Len() {
+		t.Fatalf("wrote %d packets: %v", n, err)
+	}
+
+	var ids []uint16
+	for {
+		pkt := lower.Read()
+		if pkt.IsNil() {
+			return ids
+		}
+		v := pkt.ToView()
+		ip := header.IPv4(v.AsSlice())
+		if !ip.IsChecksumValid() {
+			t.Errorf("mode %d: packet %d has an invalid header checksum", mode, len(ids))
+		}
+		ids = append(ids, ip.ID())
+		v.Release()
+		pkt.DecRef()
+	}
+}
+
+func TestIPIDMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode IPIDMode
+		want []uint16
+	}{
+		{IPIDSequential, []uint16{1, 2, 3, 4, 5, stackID}},
+		{IPIDZero, []uint16{0, 0, 0, 0, 1, stackID}},
+	} {
+		ids := writeIDs(t, tc.mode)
+		if len(ids) != len(tc.want) {
+			t.Fatalf("mode %d: %d packets sent, want %d", tc.mode, len(ids), len(tc.want))
+		}
+		for i, id := range ids {
+			if id != tc.want[i] {
+				t.Errorf("mode %d: ids %v, want %v", tc.mode, ids, tc.want)
+				break
+			}
+		}
+	}
+
+	ids := writeIDs(t, IPIDRandom)
+	if ids[5] != stackID {
+		t.Errorf("random ids rewrote the id of a fragment to %d", ids[5])
+	}
+	sequential := true
+	for i := 1; i < 5; i++ {
+		sequential = sequential && ids[i] == ids[i-1]+1
+	}
+	if sequential {
+		t.Errorf("random ids %v are sequential", ids[:5])
+	}
+
+	if err := (&TUN{}).Apply(WithIPIDMode(IPIDZero + 1)); err == nil {
+		t.Error("accepted an unknown ip id mode")
+	}
+}
+
+// TestIPIDModeTUN checks that the IDs of the packets the TUN generates are
+// rewritten, and kept without a mode.
+func TestIPIDModeTUN(t *testing.T) {
+	for _, mode := range []IPIDMode{IPIDStack, IPIDSequential} {
+		_, ep := startRawTUN(t, WithIPIDMode(mode))
+		var ids []uint16
+		for seq := uint32(1000); seq < 1003; seq++ {
+			// Every unexpected SYN-ACK is answered with a RST.
+			ep.InjectInbound(tcpPacket(header.TCPFlagSyn|header.TCPFlagAck, seq, 2000, ""))
+			rst := header.IPv4(readOutbound(t, ep, tcpReply(header.TCPFlagRst)))
+			ids = append(ids, rst.ID())
+		}
+		// The stack numbers the packets of a flow sequentially too, but
+		// starts at a hash of its addresses.
+		if sequential := ids[0] == 1 && ids[1] == 2 && ids[2] == 3; sequential != (mode == IPIDSequential) {
+			t.Errorf("mode %d: ids %v", mode, ids)
+		}
+	}
+}
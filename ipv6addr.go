@@ -0,0 +1,95 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// defaultIPv6LinkLocal is the link-local address WithIPv6LinkLocal assigns
+// when given none. A TUN has no link address to derive one from.
+const defaultIPv6LinkLocal = "fe80::1/64"
+
+// WithIPv6Addresses assigns the IPv6 addresses of cidrs, such as
+// "fd00::2/64", to the NIC. Flows are terminated whatever their
+// destination, as the NIC is promiscuous, so addresses are only needed
+// where the stack itself must own one, e.g. to answer echo requests to
+// the TUN's own address or as the source of the ICMPv6 messages it sends.
+// Duplicate address detection is off and the TUN resolves no neighbors,
+// so the addresses are usable at once and do not hold up forwarding.
+// Start fails if IPv6 is disabled.
+func WithIPv6Addresses(cidrs ...string) Option {
+	return func(t *TUN) error {
+		for _, cidr := range cidrs {
+			addr, err := parseIPv6Address(cidr)
+			if err != nil {
+				return err
+			}
+			t.ipv6Addrs = append(t.ipv6Addrs, addr)
+		}
+		return nil
+	}
+}
+
+// WithIPv6LinkLocal assigns the link-local address cidr to the NIC, or
+// fe80::1/64 if cidr is empty, like WithIPv6Addresses.
+func WithIPv6LinkLocal(cidr string) Option {
+	return func(t *TUN) error {
+		if cidr == "" {
+			cidr = defaultIPv6LinkLocal
+		}
+		addr, err := parseIPv6Address(cidr)
+		if err != nil {
+			return err
+		}
+		if !header.IsV6LinkLocalUnicastAddress(addr.AddressWithPrefix.Address) {
+			return fmt.Errorf("ipv6 address %s is not link-local", cidr)
+		}
+		t.ipv6Addrs = append(t.ipv6Addrs, addr)
+		return nil
+	}
+}
+
+func parseIPv6Address(cidr string) (tcpip.ProtocolAddress, error) {
+	addr, err := parseProtocolAddress(cidr)
+	if err != nil {
+		return tcpip.ProtocolAddress{}, err
+	}
+	if addr.Protocol != header.IPv6ProtocolNumber {
+		return tcpip.ProtocolAddress{}, fmt.Errorf("%s is not an ipv6 address", cidr)
+	}
+	return addr, nil
+}
+
+// parseProtocolAddress parses the IPv4 or IPv6 address and prefix length
+// of cidr.
+func parseProtocolAddress(cidr string) (tcpip.ProtocolAddress, error) {
+	ip, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return tcpip.ProtocolAddress{}, err
+	}
+	ones, _ := prefix.Mask.Size()
+	addr := tcpip.ProtocolAddress{
+		Protocol: header.IPv6ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address(ip.To16()),
+			PrefixLen: ones,
+		},
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		addr.Protocol = header.IPv4ProtocolNumber
+		addr.AddressWithPrefix.Address = tcpip.Address(ip4)
+	}
+	return addr, nil
+}
+
+// checkIPv6Addresses reports whether the IPv6 addresses can be assigned.
+func (t *TUN) checkIPv6Addresses() error {
+	if len(t.ipv6Addrs) > 0 && t.IPv6Config == IPv6Disable {
+		return errors.New("ipv6 addresses are set but ipv6 is disabled")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package libmitm
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// TestIPv6Forward checks that with IPv6 and link-local addresses assigned
+// to the NIC, TCP and UDP flows from an IPv6 client are forwarded to an
+// upstream on the IPv6 loopback.
+func TestIPv6Forward(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	pc, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+
+	flows := make(chan *Flow, 2)
+	redirector := func(upstream string) Redirector {
+		return flowRedirector(func(f *Flow) *Decision {
+			flows <- f
+			return &Decision{Address: upstream}
+		})
+	}
+	c := startTestTUN(t,
+		WithIPv6Addresses("fd00::2/64"),
+		WithIPv6LinkLocal(""),
+		withRedirectors(redirector(l.Addr().String()), redirector(pc.LocalAddr().String())),
+	)
+
+	conn, err := c.dialTCP(t, "[2001:db8::1]:80")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	roundTrip(t, conn, "hello")
+	conn.Close()
+	roundTrip(t, c.dialUDP(t, "[2001:db8::1]:53"), "hello")
+
+	for _, network := range []string{"tcp", "udp"} {
+		f := <-flows
+		if f.Network != network || f.Source != testClientAddr6 || f.Destination != "2001:db8::1" {
+			t.Errorf("flow %s from %s to %s, want %s from %s to 2001:db8::1", f.Network, f.Source, f.Destination, network, testClientAddr6)
+		}
+	}
+}
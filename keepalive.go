@@ -0,0 +1,57 @@
+package libmitm
+
+import (
+	"errors"
+	"time"
+)
+
+// KeepaliveConfig sets the TCP keepalive of the client-facing endpoints.
+// Zero fields keep their defaults: probes start after 60 seconds idle,
+// are sent every 30 seconds, and the connection is dropped after 9
+// unanswered probes.
+type KeepaliveConfig struct {
+	// Disabled turns keepalive off, so idle connections send no probes,
+	// which saves battery but keeps connections to vanished clients
+	// until they time out otherwise.
+	Disabled bool
+	// Idle is how long a connection must be idle before the first probe.
+	Idle time.Duration
+	// Interval is the time between probes.
+	Interval time.Duration
+	// Count is the number of unanswered probes after which the
+	// connection is dropped.
+	Count int
+}
+
+// WithKeepalive sets the TCP keepalive of the client-facing endpoints.
+func WithKeepalive(cfg KeepaliveConfig) Option {
+	return func(t *TUN) error {
+		if cfg.Idle < 0 || cfg.Interval < 0 || cfg.Count < 0 {
+			return errors.New("keepalive parameters must not be negative")
+		}
+		if cfg.Idle == 0 {
+			cfg.Idle = tcpKeepaliveIdle
+		}
+		if cfg.Interval == 0 {
+			cfg.Interval = tcpKeepaliveInterval
+		}
+		if cfg.Count == 0 {
+			cfg.Count = tcpKeepaliveCount
+		}
+		t.keepalive = &cfg
+		return nil
+	}
+}
+
+// keepaliveConfig returns the keepalive set by WithKeepalive or the
+// default one.
+func (t *TUN) keepaliveConfig() KeepaliveConfig {
+	if t.keepalive != nil {
+		return *t.keepalive
+	}
+	return KeepaliveConfig{
+		Idle:     tcpKeepaliveIdle,
+		Interval: tcpKeepaliveInterval,
+		Count:    tcpKeepaliveCount,
+	}
+}
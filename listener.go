@@ -0,0 +1,105 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+var (
+	_ net.Listener = (*MemoryListener)(nil)
+	_ Dialer       = (*MemoryListener)(nil)
+)
+
+// MemoryListener is a net.Listener backed by the forwarder instead of the
+// network. Installed as the TUN dialer with WithDialer, every intercepted
+// flow is handed to Accept as an in-memory connection, which makes it a
+// memory-backed upstream for embedded servers and tests.
+//
+// The accepted connection reports the client address as RemoteAddr and
+// the destination the client originally addressed as LocalAddr, so the
+// server can recover addressing just like with a transparent proxy.
+// UDP flows are delivered as a pipe where each datagram is one write.
+type MemoryListener struct {
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewMemoryListener creates a MemoryListener ready to accept flows.
+func NewMemoryListener() *MemoryListener {
+	return &MemoryListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next forwarded flow.
+func (l *MemoryListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener. Pending and future dials fail.
+func (l *MemoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the listener's placeholder address.
+func (l *MemoryListener) Addr() net.Addr {
+	return memoryAddr{}
+}
+
+// DialContext implements Dialer. It blocks until the flow is accepted, the
+// listener is closed or ctx is done.
+func (l *MemoryListener) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	conn := &memoryConn{Conn: server, local: memoryAddr{}, remote: memoryAddr{}}
+	if a, ok := OriginalDestination(ctx); ok {
+		conn.local = a
+	}
+	if a, ok := OriginalSource(ctx); ok {
+		conn.remote = a
+	}
+
+	select {
+	case l.conns <- conn:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.ErrClosed}
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	}
+}
+
+// memoryConn is the accepted side of a MemoryListener flow.
+type memoryConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string { return "memory" }
+func (memoryAddr) String() string  { return "memory" }
@@ -0,0 +1,41 @@
+package libmitm
+
+import "errors"
+
+// endpointDropLogs is the number of inbound packets dropped by the link
+// endpoint that are logged, as debug messages.
+const endpointDropLogs = 10
+
+// Logger receives the diagnostic messages of a TUN, such as failed
+// upstream dials.
+type Logger interface {
+	Debugf(format string, v ...any)
+	Infof(format string, v ...any)
+	Errorf(format string, v ...any)
+}
+
+// WithLogger sends the TUN's diagnostic messages to l. By default they are
+// discarded. The gVisor stack's own log is configured by WithStackLog.
+func WithLogger(l Logger) Option {
+	return func(t *TUN) error {
+		if l == nil {
+			return errors.New("logger must not be nil")
+		}
+		t.logger = l
+		return nil
+	}
+}
+
+// log returns the configured logger, or one discarding every message.
+func (t *TUN) log() Logger {
+	if t.logger == nil {
+		return nopLogger{}
+	}
+	return t.logger
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...any) {}
+func (nopLogger) Infof(string, ...any)  {}
+func (nopLogger) Errorf(string, ...any) {}
@@ -0,0 +1,69 @@
+package libmitm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureLogger is a Logger recording the messages it receives, each
+// prefixed with its level.
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) logf(level, format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, v...))
+}
+
+func (l *captureLogger) Debugf(format string, v ...any) { l.logf("debug", format, v...) }
+func (l *captureLogger) Infof(format string, v ...any)  { l.logf("info", format, v...) }
+func (l *captureLogger) Errorf(format string, v ...any) { l.logf("error", format, v...) }
+
+// errors returns the error messages logged so far.
+func (l *captureLogger) errors() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var errors []string
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, "error ") {
+			errors = append(errors, line)
+		}
+	}
+	return errors
+}
+
+func TestLoggerDialFailure(t *testing.T) {
+	upstream := closedAddress(t)
+	var l captureLogger
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithLogger(&l),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err == nil {
+		conn.Write([]byte("x"))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	waitFor(t, "the dial error", func() bool { return len(l.errors()) > 0 })
+	// The flow is over, so a second error would have been logged by now.
+	c.tun.Close()
+	if errors := l.errors(); len(errors) != 1 || !strings.Contains(errors[0], upstream) {
+		t.Errorf("error messages %q, want one about %s", errors, upstream)
+	}
+}
+
+func TestLoggerDefault(t *testing.T) {
+	if err := (&TUN{}).Apply(WithLogger(nil)); err == nil {
+		t.Error("accepted a nil logger")
+	}
+	if _, ok := (&TUN{}).log().(nopLogger); !ok {
+		t.Error("messages are not discarded by default")
+	}
+}
@@ -1,10 +1,14 @@
 package libmitm
 
 import (
+	"fmt"
 	"libmitm/endpoint"
-	"net"
 	"os"
+	"sync"
+	"time"
 
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
@@ -28,9 +32,89 @@ type TUN struct {
 	UdpRedirector       Redirector
 	TcpEstablishHandler EstablishHandler
 	UdpEstablishHandler EstablishHandler
+	EventHandler        EventHandler
+	MetricsHandler      MetricsHandler
+	ErrorHandler        ErrorHandler
+	CloseHandler        CloseHandler
 
-	file  *os.File
-	stack *stack.Stack
+	dialer           Dialer
+	dialControls     []controlFunc
+	establishTimeout time.Duration
+	connectTimeout   time.Duration
+	dialRetry        dialRetry
+	endpointOpts     []endpoint.Option
+	zeroWindow       zeroWindowConfig
+	classifier       classifierConfig
+	stackLog         stackLogConfig
+	coalesce         coalesceConfig
+	upstreamNoDelay  *bool
+	connID           connIDConfig
+	routeObserver    RouteObserver
+	hold             upstreamHold
+	processResolver  ProcessResolver
+	conns            connRegistry
+	udpTimeout       udpTimeoutConfig
+	tcpTimeout       time.Duration
+	clock            clock
+	priorityQueueLen int
+	priority         *priorityQDisc
+	handshakes       handshakeStats
+	globalRate       globalRateLimit
+	flowRate         int64
+	dnsLimit         dnsRateLimit
+	ipIDMode         IPIDMode
+	handshakeLimit   handshakeLimit
+	connAttempts     int
+	inspector        streamInspector
+	udpChecksum      udpChecksumConfig
+	readinessTrace   ReadinessTracer
+	flowExport       *flowExporter
+	privateUpstream  privateUpstreamGuard
+	dnsTimeout       dnsTimeoutConfig
+	dnsRewrite       DNSRewriteFunc
+	dnsHandler       DNSHandler
+	memory           memoryBudget
+	compression      StreamCodec
+	icmpHandler      ICMPHandler
+	icmpEcho         *icmpEchoForwarder
+	acceptCallback   AcceptCallback
+	ingressTTL       ingressTTLs
+	breaker          *circuitBreaker
+	mss              mssPolicy
+	maintenance      maintenanceSet
+	logger           Logger
+	forwarders       forwarders
+	fakeIP           *FakeIPPool
+	connLimit        connLimit
+	connRate         connRateLimit
+	acl              accessList
+	sniffTLS         bool
+	hostSniff        int
+	keepalive        *KeepaliveConfig
+	copyBuffers      copyBuffers
+	dialerSelector   DialerSelector
+	happyEyeballs    time.Duration
+	capture          packetCapture
+	ipv6Addrs        []tcpip.ProtocolAddress
+	tcpDisabled      bool
+	udpDisabled      bool
+	quic             quicBlocking
+
+	file    *os.File
+	link    linkEndpoint
+	channel *endpoint.ChannelEndpoint
+	stack   *stack.Stack
+	nicID   tcpip.NICID
+	routeMu sync.Mutex
+}
+
+// linkEndpoint is the endpoint.NewEndpoint or endpoint.ChannelEndpoint
+// link endpoint.
+type linkEndpoint interface {
+	stack.LinkEndpoint
+	ReadRetries() uint64
+	Stats() endpoint.Stats
+	Stop()
 }
 
 type Redirector interface {
@@ -41,7 +125,14 @@ type EstablishHandler interface {
 	Handle(localAddr string, originalRemoteIp string)
 }
 
-func (t *TUN) Start() error {
+// FlowEstablishHandler is an extended EstablishHandler that receives the
+// full Flow, e.g. to log its Host or SNI. When an establish handler
+// implements FlowEstablishHandler, HandleFlow is called instead of Handle.
+type FlowEstablishHandler interface {
+	HandleFlow(localAddr string, f *Flow)
+}
+
+func (t *TUN) Start() (err error) {
 	var opts stack.Options
 	switch t.IPv6Config {
 	case IPv6Disable:
@@ -81,24 +172,81 @@ func (t *TUN) Start() error {
 		}
 	}
 
-	dialer := &net.Dialer{}
-	var err error
-	ep, err := endpoint.NewEndpoint(t.FileDescriber, t.MTU)
+	if err := t.checkIPv6Addresses(); err != nil {
+		return err
+	}
+
+	t.stackLog.install()
+	t.copyBuffers.init(int(t.MTU))
+
+	dialer, err := t.upstreamDialer()
 	if err != nil {
 		return err
 	}
+	if t.flowExport != nil {
+		if err := t.flowExport.start(&t.conns); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				t.flowExport.stop()
+			}
+		}()
+	}
+	epOpts := t.endpointOpts
+	if t.logger != nil {
+		epOpts = append([]endpoint.Option{endpoint.WithDropLogger(t.logger.Debugf, endpointDropLogs)}, epOpts...)
+	}
+	var ep linkEndpoint
+	if t.channel != nil {
+		ep = t.channel
+	} else if ep, err = endpoint.NewEndpoint(t.FileDescriber, t.MTU, epOpts...); err != nil {
+		return err
+	}
+	if t.IPv6Config != IPv6Disable && ep.MTU() < header.IPv6MinimumMTU {
+		return fmt.Errorf("mtu %d is below the IPv6 minimum of %d; disable IPv6 or raise it", ep.MTU(), header.IPv6MinimumMTU)
+	}
+	t.link = ep
+	// Flows may arrive as soon as the stack exists, so the goroutines
+	// serving them start before it, and stop again if it cannot be created.
+	t.inspector.start()
+	t.forwarders.start()
 	t.stack, err = t.createStack(opts, ep, dialer)
-
+	if err != nil {
+		t.forwarders.stop()
+		t.inspector.stop()
+	}
 	return err
 }
 
+// ReadRetries returns the number of TUN reads retried after a transient
+// condition such as EINTR.
+func (t *TUN) ReadRetries() int64 {
+	if t.link == nil {
+		return 0
+	}
+	return int64(t.link.ReadRetries())
+}
+
 func (t *TUN) Close() {
+	t.forwarders.stop()
+	if t.link != nil {
+		t.link.Stop()
+	}
 	if t.file != nil {
 		t.file.Close()
 	}
+	if t.channel != nil {
+		t.channel.Close()
+	}
 	if t.stack != nil {
 		t.stack.Close()
 	}
+	t.inspector.stop()
+	if t.flowExport != nil {
+		t.flowExport.stop()
+	}
+	t.SetPacketCapture(nil)
 }
 
 func contains(s []string, e string) bool {
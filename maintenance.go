@@ -0,0 +1,209 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MaintenanceMode selects how connections to a destination under
+// maintenance are treated.
+type MaintenanceMode int
+
+const (
+	// MaintenanceOff ends maintenance of a destination.
+	MaintenanceOff MaintenanceMode = iota
+	// MaintenanceHold lets new connections wait until maintenance ends or,
+	// if one is set, the establish timeout expires.
+	MaintenanceHold
+	// MaintenanceRefuse refuses new connections; TCP clients receive a
+	// RST.
+	MaintenanceRefuse
+	// MaintenanceDrain refuses new connections like MaintenanceRefuse and
+	// gracefully closes the active ones.
+	MaintenanceDrain
+)
+
+var errMaintenance = errors.New("destination under maintenance")
+
+type maintenanceRule struct {
+	mode MaintenanceMode
+	ips  *net.IPNet
+	host string
+	port int
+	// changed is closed when the rule is replaced or removed.
+	changed chan struct{}
+}
+
+// maintenanceSet holds the destinations under maintenance by target.
+type maintenanceSet struct {
+	mu    sync.RWMutex
+	rules map[string]*maintenanceRule
+
+	affected atomic.Int64
+}
+
+// SetMaintenance puts the destinations matched by target into mode, or
+// takes them out of maintenance with MaintenanceOff, while the TUN is
+// running. target is a host name, IP address or CIDR range, optionally
+// with a port as in "10.0.0.0/8:443" or "[2001:db8::1]:53"; without a
+// port every port matches. Host names match upstream addresses given by
+// name, IPs and ranges match both the destination the client addressed
+// and the upstream dialed, for TCP and UDP alike. Setting a target again
+// replaces its mode, and connections held for it are re-evaluated.
+//
+// Every held, refused or drained connection is counted by
+// MaintenanceAffected and reported as EventMaintenance.
+func (t *TUN) SetMaintenance(target string, mode MaintenanceMode) error {
+	if mode < MaintenanceOff || mode > MaintenanceDrain {
+		return errors.New("unknown maintenance mode")
+	}
+	r, err := parseMaintenanceTarget(target)
+	if err != nil {
+		return err
+	}
+	r.mode = mode
+	t.maintenance.set(target, r)
+	if mode == MaintenanceDrain {
+		t.drainMaintenance(r)
+	}
+	return nil
+}
+
+// MaintenanceAffected returns the number of connections held, refused or
+// closed because their destination was under maintenance.
+func (t *TUN) MaintenanceAffected() int64 {
+	return t.maintenance.affected.Load()
+}
+
+func parseMaintenanceTarget(target string) (*maintenanceRule, error) {
+	r := &maintenanceRule{changed: make(chan struct{})}
+	host := target
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 0xffff {
+			return nil, fmt.Errorf("maintenance target %q: invalid port", target)
+		}
+		host, r.port = h, port
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.ips = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if strings.Contains(host, "/") {
+		_, n, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance target %q: %w", target, err)
+		}
+		r.ips = n
+	} else if host == "" {
+		return nil, fmt.Errorf("maintenance target %q: missing host", target)
+	} else {
+		r.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return r, nil
+}
+
+func (s *maintenanceSet) set(target string, r *maintenanceRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.rules[target]; old != nil {
+		close(old.changed)
+	}
+	if r.mode == MaintenanceOff {
+		delete(s.rules, target)
+		return
+	}
+	if s.rules == nil {
+		s.rules = make(map[string]*maintenanceRule)
+	}
+	s.rules[target] = r
+}
+
+// lookup returns the rule matching a connection of flow to the upstream
+// address, or nil.
+func (s *maintenanceSet) lookup(flow *Flow, address string) *maintenanceRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.rules {
+		if r.matchesFlow(flow, address) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *maintenanceRule) matchesFlow(flow *Flow, address string) bool {
+	if r.ips != nil && r.matches(flow.Destination, flow.DestinationPort) {
+		return true
+	}
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(p)
+	return r.matches(host, port)
+}
+
+func (r *maintenanceRule) matches(host string, port int) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	if r.ips == nil {
+		return strings.EqualFold(strings.TrimSuffix(host, "."), r.host)
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && r.ips.Contains(ip)
+}
+
+// admitMaintenance decides whether flow may dial address. It waits while
+// the destination is held and returns errMaintenance once it is refused.
+func (t *TUN) admitMaintenance(ctx context.Context, flow *Flow, address string) error {
+	counted := false
+	for {
+		r := t.maintenance.lookup(flow, address)
+		if r == nil {
+			return nil
+		}
+		if !counted {
+			counted = true
+			t.maintenance.affected.Add(1)
+		}
+		if r.mode != MaintenanceHold {
+			t.emit(newEvent(EventMaintenance, flow, fmt.Sprintf("connection to %s refused for maintenance", address)))
+			return fmt.Errorf("dial %s: %w", address, errMaintenance)
+		}
+		t.emit(newEvent(EventMaintenance, flow, fmt.Sprintf("connection to %s held for maintenance", address)))
+		select {
+		case <-r.changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// drainMaintenance gracefully closes the active connections matching r.
+func (t *TUN) drainMaintenance(r *maintenanceRule) {
+	var drained []*activeConn
+	t.conns.each(func(c *activeConn) {
+		if r.matchesFlow(c.flow, c.flow.upstream) {
+			drained = append(drained, c)
+		}
+	})
+	for _, c := range drained {
+		if !c.closing.CompareAndSwap(false, true) {
+			continue
+		}
+		t.maintenance.affected.Add(1)
+		c.local.Close()
+		c.remote.Close()
+		t.emit(newEvent(EventMaintenance, c.flow, fmt.Sprintf("connection to %s drained for maintenance", c.flow.upstream)))
+	}
+}
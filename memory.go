@@ -0,0 +1,130 @@
+package libmitm
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// MemoryCost is a rough model of the memory a connection costs, used to
+// enforce WithMemoryBudget.
+type MemoryCost struct {
+	// TCP and UDP are the base costs of a connection: the client side
+	// endpoint and its buffers, the upstream socket, the forwarding
+	// goroutines and their copy buffers.
+	TCP int64
+	UDP int64
+	// PerLayer is added for every enabled feature that wraps the
+	// connection with buffers or goroutines of its own, such as write
+	// coalescing, compression, classifiers, rate limiting or the stream
+	// inspector.
+	PerLayer int64
+}
+
+// DefaultMemoryCost returns the cost model used unless WithMemoryCost is
+// given. It assumes two 32 KiB copy buffers per connection, goroutine
+// stacks and moderately filled endpoint buffers.
+func DefaultMemoryCost() MemoryCost {
+	return MemoryCost{
+		TCP:      256 << 10,
+		UDP:      96 << 10,
+		PerLayer: 16 << 10,
+	}
+}
+
+type memoryBudget struct {
+	budget int64
+	cost   *MemoryCost
+
+	used atomic.Int64
+}
+
+// WithMemoryBudget refuses new connections while the estimated memory of
+// all connections exceeds bytes, rather than letting a flood of
+// connections exhaust the memory of small devices. TCP connections are
+// refused with a RST and the first datagram of a UDP flow is dropped;
+// both are reported as EventMemoryRejected. The estimate follows the
+// model set by WithMemoryCost, DefaultMemoryCost otherwise. It is not a
+// measurement: tune the model to the features in use.
+func WithMemoryBudget(bytes int64) Option {
+	return func(t *TUN) error {
+		if bytes <= 0 {
+			return errors.New("memory budget must be positive")
+		}
+		t.memory.budget = bytes
+		return nil
+	}
+}
+
+// WithMemoryCost sets the cost model of WithMemoryBudget.
+func WithMemoryCost(cost MemoryCost) Option {
+	return func(t *TUN) error {
+		if cost.TCP < 0 || cost.UDP < 0 || cost.PerLayer < 0 {
+			return errors.New("memory costs must not be negative")
+		}
+		t.memory.cost = &cost
+		return nil
+	}
+}
+
+// MemoryInUse returns the estimated memory of the current connections,
+// if WithMemoryBudget is set.
+func (t *TUN) MemoryInUse() int64 {
+	return t.memory.used.Load()
+}
+
+// connectionCost returns the estimated cost of a connection over network.
+func (t *TUN) connectionCost(network string) int64 {
+	cost := DefaultMemoryCost()
+	if t.memory.cost != nil {
+		cost = *t.memory.cost
+	}
+
+	n := cost.TCP
+	layers := 0
+	if network == "udp" {
+		n = cost.UDP
+		if t.classifier.udpFn != nil {
+			layers++
+		}
+	} else {
+		if t.classifier.fn != nil {
+			layers++
+		}
+		if t.coalesce.delay > 0 {
+			layers++
+		}
+		if t.compression != nil {
+			layers++
+		}
+	}
+	if t.globalRate.limiter != nil {
+		layers++
+	}
+	if t.flowRate > 0 {
+		layers += 2
+	}
+	if t.inspector.fn != nil {
+		layers++
+	}
+	return n + int64(layers)*cost.PerLayer
+}
+
+// reserveMemory accounts for a new connection over network with the given
+// ID. It returns false, reporting the rejection, if the budget is
+// exhausted, and otherwise a function releasing the reservation.
+func (t *TUN) reserveMemory(network string, id stack.TransportEndpointID) (func(), bool) {
+	if t.memory.budget <= 0 {
+		return func() {}, true
+	}
+	cost := t.connectionCost(network)
+	if t.memory.used.Add(cost) > t.memory.budget {
+		t.memory.used.Add(-cost)
+		t.emit(newEvent(EventMemoryRejected, t.newFlow(network, id), "memory budget exhausted"))
+		return nil, false
+	}
+	return func() {
+		t.memory.used.Add(-cost)
+	}, true
+}
@@ -0,0 +1,52 @@
+package libmitm
+
+import "time"
+
+// ConnStats describes a forwarded connection that ended.
+type ConnStats struct {
+	// ID is the connection ID, see WithConnIDScheme.
+	ID string
+	// Network is "tcp" or "udp".
+	Network string
+	// Source is the client address of the connection and Destination the
+	// address originally addressed by the client.
+	Source      string
+	Destination string
+	// Upstream is the remote address of the upstream connection, or empty
+	// if the dialer's connection does not report one.
+	Upstream string
+	// UpBytes counts the bytes from the client to the upstream, DownBytes
+	// the bytes back.
+	UpBytes   int64
+	DownBytes int64
+	// Duration is the lifetime of the connection in milliseconds, from
+	// the upstream being established until forwarding ended.
+	Duration int64
+}
+
+// MetricsHandler receives the traffic counters of every forwarded
+// connection when it ends. ConnectionClosed is called on the forwarding
+// goroutine and should return quickly.
+type MetricsHandler interface {
+	ConnectionClosed(stats *ConnStats)
+}
+
+// reportMetrics passes the counters of c to the metrics handler.
+func (t *TUN) reportMetrics(c *activeConn) {
+	if t.MetricsHandler == nil {
+		return
+	}
+	s := &ConnStats{
+		ID:          c.flow.ID,
+		Network:     c.flow.Network,
+		Source:      sourceId(c.flow.id),
+		Destination: addressId(c.flow.id),
+		UpBytes:     int64(c.stats.up.Load()),
+		DownBytes:   int64(c.stats.down.Load()),
+		Duration:    durationMillis(time.Since(c.stats.start)),
+	}
+	if addr := c.remote.RemoteAddr(); addr != nil {
+		s.Upstream = addr.String()
+	}
+	t.MetricsHandler.ConnectionClosed(s)
+}
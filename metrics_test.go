@@ -0,0 +1,76 @@
+package libmitm
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// metricsChannel is a MetricsHandler sending the stats of every closed
+// connection to a channel.
+type metricsChannel chan *ConnStats
+
+func (c metricsChannel) ConnectionClosed(stats *ConnStats) {
+	c <- stats
+}
+
+// TestMetricsHandler checks the counters reported for a connection that
+// moved a known number of bytes each way.
+func TestMetricsHandler(t *testing.T) {
+	const request, reply, delay = "how many bytes?", "fourteen bytes", 20 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(request)))
+		time.Sleep(delay)
+		io.WriteString(c, reply)
+	}()
+	metrics := make(metricsChannel, 1)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(l.Addr().String()), nil),
+		func(t *TUN) error {
+			t.MetricsHandler = metrics
+			return nil
+		},
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if b, err := io.ReadAll(conn); err != nil || string(b) != reply {
+		t.Fatalf("read %q, %v, want %q", b, err, reply)
+	}
+	// The upstream closed its side, and forwarding ends with the client's.
+	conn.Close()
+
+	var s *ConnStats
+	select {
+	case s = <-metrics:
+	case <-time.After(testTimeout):
+		t.Fatal("no metrics reported")
+	}
+	if s.UpBytes != int64(len(request)) || s.DownBytes != int64(len(reply)) {
+		t.Errorf("%d bytes up and %d down, want %d and %d", s.UpBytes, s.DownBytes, len(request), len(reply))
+	}
+	if s.Duration < delay.Milliseconds() {
+		t.Errorf("duration %dms, want at least %dms", s.Duration, delay.Milliseconds())
+	}
+	if s.Network != "tcp" || s.Destination != testRemote(80) || s.Upstream != l.Addr().String() {
+		t.Errorf("reported %s flow to %s through %s", s.Network, s.Destination, s.Upstream)
+	}
+}
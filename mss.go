@@ -0,0 +1,184 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// MSSMode selects how the maximum segment sizes of the client-facing and
+// the upstream side of a forwarded TCP connection relate.
+type MSSMode int
+
+const (
+	// MSSIndependent leaves each side to negotiate its own MSS.
+	MSSIndependent MSSMode = iota
+	// MSSMinBoth limits the upstream socket to the MSS the client
+	// announced, so that neither side sends segments larger than the
+	// client accepts.
+	MSSMinBoth
+	// MSSFixed limits both sides to a fixed MSS.
+	MSSFixed
+)
+
+type mssPolicy struct {
+	mode  MSSMode
+	fixed uint16
+
+	mu     sync.Mutex
+	synMSS map[stack.TransportEndpointID]mssEntry
+}
+
+type mssEntry struct {
+	mss uint16
+	at  time.Time
+}
+
+// WithMSSPolicy sets how the MSS of forwarded TCP connections is chosen;
+// mss is the size used by MSSFixed and ignored otherwise.
+//
+// Only part of the MSS can be influenced. On the client side, the MSS the
+// stack sends with is the one announced in the client's SYN, which
+// MSSFixed lowers by rewriting the SYN; the MSS the stack announces in
+// turn follows from the TUN's MTU, so set the MTU to bound it. On the
+// upstream side, TCP_MAXSEG is set on the socket before it connects,
+// which caps the MSS the OS announces and sends with, but the OS still
+// lowers it further after the peer's SYN-ACK or path MTU discovery.
+// Setting TCP_MAXSEG requires a *net.Dialer; other dialers keep their own
+// MSS.
+func WithMSSPolicy(mode MSSMode, mss int) Option {
+	return func(t *TUN) error {
+		switch mode {
+		case MSSIndependent, MSSMinBoth:
+		case MSSFixed:
+			if mss < header.TCPMinimumMSS || mss > header.TCPMaximumMSS {
+				return fmt.Errorf("mss must be between %d and %d", header.TCPMinimumMSS, header.TCPMaximumMSS)
+			}
+			t.mss.fixed = uint16(mss)
+		default:
+			return errors.New("unknown mss mode")
+		}
+		t.mss.mode = mode
+		return nil
+	}
+}
+
+// clamp wraps the TCP transport protocol handler next to record the MSS
+// announced in SYNs for MSSMinBoth, and to lower it for MSSFixed.
+func (p *mssPolicy) clamp(next func(stack.TransportEndpointID, stack.PacketBufferPtr) bool) func(stack.TransportEndpointID, stack.PacketBufferPtr) bool {
+	if p.mode == MSSIndependent {
+		return next
+	}
+	return func(id stack.TransportEndpointID, pkt stack.PacketBufferPtr) bool {
+		if isSyn(pkt) {
+			h := header.TCP(pkt.TransportHeader().Slice())
+			off, mss := findMSSOption(h)
+			switch p.mode {
+			case MSSMinBoth:
+				p.put(id, mss)
+			case MSSFixed:
+				if off > 0 && mss > p.fixed {
+					setTCPUint16(h, off, p.fixed)
+				}
+			}
+		}
+		return next(id, pkt)
+	}
+}
+
+func (p *mssPolicy) put(id stack.TransportEndpointID, mss uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.synMSS == nil {
+		p.synMSS = make(map[stack.TransportEndpointID]mssEntry)
+	}
+	now := time.Now()
+	if len(p.synMSS) >= ingressTTLMax {
+		for id, e := range p.synMSS {
+			if now.Sub(e.at) > ingressTTLExpiry {
+				delete(p.synMSS, id)
+			}
+		}
+		if len(p.synMSS) >= ingressTTLMax {
+			return
+		}
+	}
+	p.synMSS[id] = mssEntry{mss: mss, at: now}
+}
+
+// take returns and forgets the MSS recorded for the TCP flow id, or 0.
+func (p *mssPolicy) take(id stack.TransportEndpointID) uint16 {
+	if p.mode != MSSMinBoth {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.synMSS[id]
+	delete(p.synMSS, id)
+	return e.mss
+}
+
+// dialer returns d set up to cap the MSS of the upstream socket of flow.
+func (p *mssPolicy) dialer(flow *Flow, d Dialer) Dialer {
+	mss := p.fixed
+	if p.mode == MSSMinBoth {
+		mss = flow.mss
+	}
+	nd, ok := d.(*net.Dialer)
+	if p.mode == MSSIndependent || flow.upstreamNetwork() != "tcp" || mss == 0 || !ok {
+		return d
+	}
+	return appendControl(nd, func(network, address string, rc syscall.RawConn) error {
+		var err error
+		if cerr := rc.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG, int(mss))
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	})
+}
+
+// findMSSOption returns the offset of the value of the MSS option in the
+// TCP header h and the value, or 0 and the default MSS if there is none.
+func findMSSOption(h header.TCP) (int, uint16) {
+	end := int(h.DataOffset())
+	if end > len(h) {
+		return 0, header.TCPDefaultMSS
+	}
+	for i := header.TCPMinimumSize; i < end; {
+		switch h[i] {
+		case header.TCPOptionEOL:
+			return 0, header.TCPDefaultMSS
+		case header.TCPOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= end || h[i+1] < 2 {
+			break
+		}
+		if h[i] == header.TCPOptionMSS && h[i+1] == header.TCPOptionMSSLength && i+4 <= end {
+			return i + 2, uint16(h[i+2])<<8 | uint16(h[i+3])
+		}
+		i += int(h[i+1])
+	}
+	return 0, header.TCPDefaultMSS
+}
+
+// setTCPUint16 sets the 16 bits at h[off:] to v and updates the checksum
+// incrementally as in RFC 1624; off need not be even.
+func setTCPUint16(h header.TCP, off int, v uint16) {
+	start, end := off&^1, (off+3)&^1
+	old := checksum.Checksum(h[start:end], 0)
+	h[off], h[off+1] = byte(v>>8), byte(v)
+	sum := checksum.Combine(checksum.Combine(^h.Checksum(), ^old), checksum.Checksum(h[start:end], 0))
+	h.SetChecksum(^sum)
+}
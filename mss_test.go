@@ -0,0 +1,181 @@
+package libmitm
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// synSegment returns a SYN carrying options, without payload.
+func synSegment(options []byte) header.TCP {
+	h := header.TCP(make([]byte, header.TCPMinimumSize+len(options)))
+	h.Encode(&header.TCPFields{
+		SrcPort:    40000,
+		DstPort:    80,
+		DataOffset: uint8(len(h)),
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	copy(h[header.TCPMinimumSize:], options)
+	h.SetChecksum(^h.CalculateChecksum(0))
+	return h
+}
+
+func TestFindMSSOption(t *testing.T) {
+	for _, tc := range []struct {
+		options []byte
+		off     int
+		mss     uint16
+	}{
+		{nil, 0, header.TCPDefaultMSS},
+		{[]byte{2, 4, 0x05, 0xb4}, 22, 1460},
+		{[]byte{1, 1, 1, 2, 4, 0x05, 0xb4, 0}, 25, 1460},
+		{[]byte{3, 3, 7, 2, 4, 0x02, 0x00, 0}, 25, 512},
+		{[]byte{0, 0, 2, 4, 0x05, 0xb4, 0, 0}, 0, header.TCPDefaultMSS},
+		{[]byte{2, 0, 0, 0}, 0, header.TCPDefaultMSS},
+	} {
+		off, mss := findMSSOption(synSegment(tc.options))
+		if off != tc.off || mss != tc.mss {
+			t.Errorf("options %x: offset %d, mss %d, want %d, %d", tc.options, off, mss, tc.off, tc.mss)
+		}
+	}
+}
+
+func TestSetTCPUint16(t *testing.T) {
+	// An odd offset straddles two 16-bit words of the checksum.
+	for _, options := range [][]byte{{2, 4, 0x05, 0xb4}, {1, 2, 4, 0x05, 0xb4, 0, 0, 0}} {
+		h := synSegment(options)
+		off, _ := findMSSOption(h)
+		setTCPUint16(h, off, 1000)
+		if _, mss := findMSSOption(h); mss != 1000 {
+			t.Errorf("options %x: mss %d after setting 1000", options, mss)
+		}
+		if sum := checksum.Checksum(h, 0); sum != 0xffff {
+			t.Errorf("options %x: checksum off by %#x", options, ^sum)
+		}
+	}
+}
+
+func TestMSSPolicyClamp(t *testing.T) {
+	for _, tc := range []struct {
+		mode  MSSMode
+		fixed int
+		want  uint16
+	}{
+		{MSSIndependent, 0, 1460},
+		{MSSMinBoth, 0, 1460},
+		{MSSFixed, 1000, 1000},
+		{MSSFixed, 1500, 1460},
+	} {
+		tun := &TUN{}
+		if err := tun.Apply(WithMSSPolicy(tc.mode, tc.fixed)); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		var got uint16
+		clamp := tun.mss.clamp(func(_ stack.TransportEndpointID, pkt stack.PacketBufferPtr) bool {
+			_, got = findMSSOption(header.TCP(pkt.TransportHeader().Slice()))
+			return true
+		})
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: bufferv2.MakeWithData(synSegment([]byte{2, 4, 0x05, 0xb4})),
+		})
+		pkt.TransportHeader().Consume(header.TCPMinimumSize + 4)
+		id := stack.TransportEndpointID{LocalPort: 80, RemotePort: 40000}
+		clamp(id, pkt)
+		pkt.DecRef()
+		if got != tc.want {
+			t.Errorf("mode %d: stack sees mss %d, want %d", tc.mode, got, tc.want)
+		}
+		if mss := tun.mss.take(id); tc.mode == MSSMinBoth && mss != 1460 {
+			t.Errorf("recorded mss %d, want 1460", mss)
+		}
+	}
+}
+
+func TestWithMSSPolicyInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		mode MSSMode
+		mss  int
+	}{
+		{MSSFixed, 0},
+		{MSSFixed, header.TCPMaximumMSS + 1},
+		{MSSFixed + 1, 1000},
+	} {
+		if err := (&TUN{}).Apply(WithMSSPolicy(tc.mode, tc.mss)); err == nil {
+			t.Errorf("accepted mode %d with mss %d", tc.mode, tc.mss)
+		}
+	}
+}
+
+// mssServer starts a TCP echo server on the loopback that sends the MSS
+// of every connection it accepts to the returned channel.
+func mssServer(t *testing.T) (string, chan int) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	mss := make(chan int, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			rc, _ := c.(*net.TCPConn).SyscallConn()
+			rc.Control(func(fd uintptr) {
+				v, _ := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+				mss <- v
+			})
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), mss
+}
+
+// TestMSSPolicyUpstream checks the MSS the upstream sends with under each
+// policy. The client announces the MSS of testMTU, and the loopback allows
+// much larger segments.
+func TestMSSPolicyUpstream(t *testing.T) {
+	for _, tc := range []struct {
+		mode  MSSMode
+		fixed int
+		min   int
+		max   int
+	}{
+		{MSSIndependent, 0, testMTU, 1 << 16},
+		{MSSMinBoth, 0, 1, testMTU - header.IPv4MinimumSize - header.TCPMinimumSize},
+		{MSSFixed, 1000, 1, 1000},
+	} {
+		upstream, mss := mssServer(t)
+		c := startTestTUN(t,
+			withRedirectors(FixedRedirector(upstream), nil),
+			WithMSSPolicy(tc.mode, tc.fixed),
+		)
+		conn, err := c.dialTCP(t, testRemote(80))
+		if err != nil {
+			t.Fatalf("mode %d: dial: %v", tc.mode, err)
+		}
+		roundTrip(t, conn, "segment")
+		conn.Close()
+		if got := <-mss; got < tc.min || got > tc.max {
+			t.Errorf("mode %d: upstream mss %d, want between %d and %d", tc.mode, got, tc.min, tc.max)
+		}
+	}
+}
@@ -19,6 +19,12 @@ const (
 
 // withCreatingNIC creates NIC for stack.
 func WithCreatingNIC(nicID tcpip.NICID, ep stack.LinkEndpoint) Option {
+	return WithCreatingNICQDisc(nicID, ep, nil)
+}
+
+// WithCreatingNICQDisc creates NIC for stack with the given queueing
+// discipline for outbound packets.
+func WithCreatingNICQDisc(nicID tcpip.NICID, ep stack.LinkEndpoint, qdisc stack.QueueingDiscipline) Option {
 	return func(s *stack.Stack) error {
 		if err := s.CreateNICWithOptions(nicID, ep,
 			stack.NICOptions{
@@ -26,7 +32,7 @@ func WithCreatingNIC(nicID tcpip.NICID, ep stack.LinkEndpoint) Option {
 				// If no queueing discipline was specified
 				// provide a stub implementation that just
 				// delegates to the lower link endpoint.
-				QDisc: nil,
+				QDisc: qdisc,
 			}); err != nil {
 			return fmt.Errorf("create NIC: %s", err)
 		}
@@ -54,3 +60,13 @@ func WithSpoofing(nicID tcpip.NICID, v bool) Option {
 		return nil
 	}
 }
+
+// WithProtocolAddress assigns addr to the given NIC.
+func WithProtocolAddress(nicID tcpip.NICID, addr tcpip.ProtocolAddress) Option {
+	return func(s *stack.Stack) error {
+		if err := s.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+			return fmt.Errorf("add address %s: %s", addr.AddressWithPrefix, err)
+		}
+		return nil
+	}
+}
@@ -46,6 +46,11 @@ const (
 	// tcpRecovery is the loss detection algorithm used by TCP.
 	tcpRecovery = tcpip.TCPRACKLossDetection
 
+	// The initial congestion window is not configurable: gVisor fixes it
+	// at tcp.InitialCwnd (10 segments, RFC 6928) for every endpoint and
+	// exposes neither a stack nor an endpoint option for it. The upstream
+	// side is governed by the host's route settings (initcwnd).
+
 	// tcpMinBufferSize is the smallest size of a send/recv buffer.
 	tcpMinBufferSize = tcp.MinBufferSize
 
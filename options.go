@@ -0,0 +1,42 @@
+package libmitm
+
+import (
+	"errors"
+	"libmitm/endpoint"
+)
+
+// Option configures optional behaviour of a TUN. Options must be applied
+// with Apply before Start is called.
+type Option func(*TUN) error
+
+// Apply applies the given options to the TUN in order.
+func (t *TUN) Apply(opts ...Option) error {
+	for _, opt := range opts {
+		if err := opt(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithEndpointOptions sets options for the link endpoint created by Start.
+func WithEndpointOptions(opts ...endpoint.Option) Option {
+	return func(t *TUN) error {
+		t.endpointOpts = append(t.endpointOpts, opts...)
+		return nil
+	}
+}
+
+// WithChannelEndpoint makes Start attach the stack to ep instead of the
+// TUN device FileDescriber refers to, so that the TUN can be driven
+// without one, e.g. in tests. Endpoint options do not apply to ep, and
+// Close closes it.
+func WithChannelEndpoint(ep *endpoint.ChannelEndpoint) Option {
+	return func(t *TUN) error {
+		if ep == nil {
+			return errors.New("channel endpoint must not be nil")
+		}
+		t.channel = ep
+		return nil
+	}
+}
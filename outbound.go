@@ -0,0 +1,90 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithOutboundBind makes upstream sockets of both TCP and UDP flows
+// egress from a given address or device, so that on multi-homed hosts
+// and VPN setups forwarded traffic does not loop back into the TUN. Each
+// socket is bound to addr, which may be a *net.TCPAddr, *net.UDPAddr or
+// *net.IPAddr and is ignored if nil, and to device with SO_BINDTODEVICE
+// if it is not empty. An upstream of the other IP family than addr fails
+// to dial. Device binding is Linux only, and may require CAP_NET_RAW on
+// kernels before 5.7. Requires a *net.Dialer, or a SOCKS5 or HTTP CONNECT
+// dialer, whose connections to the proxy are bound instead.
+func WithOutboundBind(addr net.Addr, device string) Option {
+	return func(t *TUN) error {
+		var ip net.IP
+		var port int
+		switch a := addr.(type) {
+		case nil:
+		case *net.TCPAddr:
+			ip, port = a.IP, a.Port
+		case *net.UDPAddr:
+			ip, port = a.IP, a.Port
+		case *net.IPAddr:
+			ip = a.IP
+		default:
+			return fmt.Errorf("unsupported outbound address type %T", addr)
+		}
+		if device != "" && runtime.GOOS != "linux" && runtime.GOOS != "android" {
+			return fmt.Errorf("binding to device %s is not supported on %s", device, runtime.GOOS)
+		}
+		if ip == nil && device == "" {
+			return errors.New("outbound bind needs an address or a device")
+		}
+		t.dialControls = append(t.dialControls, func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = bindOutbound(int(fd), network, ip, port, device)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		})
+		return nil
+	}
+}
+
+// bindOutbound binds the socket fd created for network to ip and port, if
+// ip is set, and to device, if it is not empty.
+func bindOutbound(fd int, network string, ip net.IP, port int, device string) error {
+	if device != "" {
+		if err := unix.BindToDevice(fd, device); err != nil {
+			return fmt.Errorf("bind to device %s: %w", device, err)
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+	var sa unix.Sockaddr
+	family, _, _ := strings.Cut(network, ":")
+	if strings.HasSuffix(family, "6") {
+		if ip.To4() != nil {
+			return fmt.Errorf("outbound address %s cannot reach an ipv6 upstream", ip)
+		}
+		sa6 := &unix.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	} else {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return fmt.Errorf("outbound address %s cannot reach an ipv4 upstream", ip)
+		}
+		sa4 := &unix.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		return fmt.Errorf("bind to %s: %w", net.JoinHostPort(ip.String(), fmt.Sprint(port)), err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package libmitm
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestOutboundBind checks that TCP and UDP upstream sockets are bound to
+// the outbound address and device, on the loopback.
+func TestOutboundBind(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to a device requires linux")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	remotes := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		remotes <- c.RemoteAddr().String()
+		c.Close()
+	}()
+	udpUpstream, sources := udpSourceServer(t)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(l.Addr().String()), FixedRedirector(udpUpstream)),
+		WithOutboundBind(&net.IPAddr{IP: net.ParseIP("127.0.0.2")}, "lo"),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial tcp: %v", err)
+	}
+	defer conn.Close()
+	if host, _, _ := net.SplitHostPort(<-remotes); host != "127.0.0.2" {
+		t.Errorf("tcp upstream connected from %s, want 127.0.0.2", host)
+	}
+
+	roundTrip(t, c.dialUDP(t, testRemote(5000)), "bound")
+	if host, _, _ := net.SplitHostPort(<-sources); host != "127.0.0.2" {
+		t.Errorf("udp upstream sent from %s, want 127.0.0.2", host)
+	}
+}
+
+func TestOutboundBindInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		addr   net.Addr
+		device string
+	}{
+		{nil, ""},
+		{&net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, ""},
+	} {
+		if err := (&TUN{}).Apply(WithOutboundBind(tc.addr, tc.device)); err == nil {
+			t.Errorf("accepted %v and device %q", tc.addr, tc.device)
+		}
+	}
+}
+
+func TestOutboundBindFamily(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 loopback: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("connected"))
+			c.Close()
+		}
+	}()
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(l.Addr().String()), nil),
+		WithOutboundBind(&net.IPAddr{IP: net.ParseIP("127.0.0.1")}, ""),
+	)
+	// An IPv4 address cannot reach an IPv6 upstream, so the dial fails.
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("flow to an ipv6 upstream was forwarded from an ipv4 address")
+		}
+	}
+}
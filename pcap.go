@@ -0,0 +1,157 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// pcapQueueLen bounds the packets waiting to be written to a capture;
+	// further packets are dropped.
+	pcapQueueLen = 1024
+
+	// pcapSnapLen is the largest packet captured in full.
+	pcapSnapLen = 65535
+
+	// pcapLinkTypeRaw is LINKTYPE_RAW, packets starting with their IP
+	// header.
+	pcapLinkTypeRaw = 101
+)
+
+type packetCapture struct {
+	writer  atomic.Pointer[pcapWriter]
+	dropped atomic.Int64
+}
+
+// WithPacketCapture writes every IP packet read from or written to the
+// TUN to w as a pcap stream, see SetPacketCapture.
+func WithPacketCapture(w io.Writer) Option {
+	return func(t *TUN) error {
+		t.SetPacketCapture(w)
+		return nil
+	}
+}
+
+// SetPacketCapture starts writing every IP packet read from or written
+// to the TUN to w as a pcap stream with raw IP link type, which Wireshark
+// and tcpdump read, replacing any capture running, or stops capturing if
+// w is nil. It may be called at any time. Packets are copied and written
+// by a goroutine of their own, so a slow writer never stalls forwarding:
+// once pcapQueueLen packets are waiting, further ones are dropped and
+// counted by PacketCaptureDropped. After a write error nothing more is
+// written to w. Close stops the capture.
+func (t *TUN) SetPacketCapture(w io.Writer) {
+	var next *pcapWriter
+	if w != nil {
+		next = &pcapWriter{w: w, packets: make(chan pcapRecord, pcapQueueLen), stop: make(chan struct{})}
+		go next.run()
+	}
+	if prev := t.capture.writer.Swap(next); prev != nil {
+		close(prev.stop)
+	}
+}
+
+// PacketCaptureDropped returns the number of packets left out of captures
+// because the writer fell behind.
+func (t *TUN) PacketCaptureDropped() int64 {
+	return t.capture.dropped.Load()
+}
+
+// record queues a copy of pkt for the running capture, if any.
+func (c *packetCapture) record(pkt stack.PacketBufferPtr) {
+	w := c.writer.Load()
+	if w == nil || w.failed.Load() {
+		return
+	}
+	v := pkt.ToView()
+	b := v.AsSlice()
+	r := pcapRecord{at: time.Now(), size: len(b)}
+	if len(b) > pcapSnapLen {
+		b = b[:pcapSnapLen]
+	}
+	r.data = append([]byte(nil), b...)
+	v.Release()
+	select {
+	case w.packets <- r:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+type pcapRecord struct {
+	at   time.Time
+	size int
+	data []byte
+}
+
+type pcapWriter struct {
+	w       io.Writer
+	packets chan pcapRecord
+	stop    chan struct{}
+	failed  atomic.Bool
+}
+
+func (p *pcapWriter) run() {
+	var h [24]byte
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(h[4:], 2) // Version 2.4.
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:], pcapLinkTypeRaw)
+	if _, err := p.w.Write(h[:]); err != nil {
+		p.failed.Store(true)
+		return
+	}
+	for {
+		select {
+		case r := <-p.packets:
+			b := make([]byte, 16, 16+len(r.data))
+			binary.LittleEndian.PutUint32(b[0:], uint32(r.at.Unix()))
+			binary.LittleEndian.PutUint32(b[4:], uint32(r.at.Nanosecond()/1000))
+			binary.LittleEndian.PutUint32(b[8:], uint32(len(r.data)))
+			binary.LittleEndian.PutUint32(b[12:], uint32(r.size))
+			if _, err := p.w.Write(append(b, r.data...)); err != nil {
+				p.failed.Store(true)
+				return
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// captureEndpoint records the packets crossing the link endpoint.
+type captureEndpoint struct {
+	stack.LinkEndpoint
+	capture *packetCapture
+}
+
+func (e *captureEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	if dispatcher == nil {
+		e.LinkEndpoint.Attach(nil)
+		return
+	}
+	e.LinkEndpoint.Attach(&captureDispatcher{NetworkDispatcher: dispatcher, capture: e.capture})
+}
+
+func (e *captureEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for _, pkt := range pkts.AsSlice() {
+		e.capture.record(pkt)
+	}
+	return e.LinkEndpoint.WritePackets(pkts)
+}
+
+type captureDispatcher struct {
+	stack.NetworkDispatcher
+	capture *packetCapture
+}
+
+func (d *captureDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	d.capture.record(pkt)
+	d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+}
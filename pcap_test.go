@@ -0,0 +1,124 @@
+package libmitm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// parsePcap parses the pcap stream b and returns the packets of its
+// complete records.
+func parsePcap(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	if len(b) < 24 {
+		t.Fatalf("pcap of %d bytes has no global header", len(b))
+	}
+	if magic := binary.LittleEndian.Uint32(b); magic != 0xa1b2c3d4 {
+		t.Fatalf("magic %#x", magic)
+	}
+	major, minor := binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:])
+	snapLen, linkType := binary.LittleEndian.Uint32(b[16:]), binary.LittleEndian.Uint32(b[20:])
+	if major != 2 || minor != 4 || snapLen != pcapSnapLen || linkType != pcapLinkTypeRaw {
+		t.Fatalf("version %d.%d, snap length %d, link type %d", major, minor, snapLen, linkType)
+	}
+	var packets [][]byte
+	for b = b[24:]; len(b) >= 16; {
+		incl, orig := binary.LittleEndian.Uint32(b[8:]), binary.LittleEndian.Uint32(b[12:])
+		if incl > orig || incl > snapLen {
+			t.Fatalf("record of %d bytes captured of %d", incl, orig)
+		}
+		if len(b) < 16+int(incl) {
+			break
+		}
+		packets = append(packets, b[16:16+incl])
+		b = b[16+incl:]
+	}
+	return packets
+}
+
+// TestPacketCapture checks that the packets a TCP flow sends through the
+// TUN in both directions are captured.
+func TestPacketCapture(t *testing.T) {
+	upstream := echoServer(t)
+	var buf syncBuffer
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithPacketCapture(&buf),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "captured")
+
+	remote := net.ParseIP(testRemoteAddr).To4()
+	var in, out bool
+	waitFor(t, "packets in both directions", func() bool {
+		for _, p := range parsePcap(t, buf.Bytes()) {
+			ip := header.IPv4(p)
+			if !ip.IsValid(len(p)) {
+				continue
+			}
+			in = in || net.IP(ip.DestinationAddress()).Equal(remote)
+			out = out || net.IP(ip.SourceAddress()).Equal(remote)
+		}
+		return in && out
+	})
+}
+
+// blockedWriter is a Writer whose writes never return until it is closed.
+type blockedWriter chan struct{}
+
+func (w blockedWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
+
+// TestPacketCaptureBlocked checks that a capture whose writer blocks drops
+// packets rather than stalling forwarding, and that it can be stopped at
+// runtime.
+func TestPacketCaptureBlocked(t *testing.T) {
+	upstream := echoServer(t)
+	c := startTestTUN(t, withRedirectors(FixedRedirector(upstream), nil))
+	w := make(blockedWriter)
+	defer close(w)
+	c.tun.SetPacketCapture(w)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	for i := 0; c.tun.PacketCaptureDropped() == 0; i++ {
+		if i == 2*pcapQueueLen {
+			t.Fatal("no packets dropped")
+		}
+		roundTrip(t, conn, "flooding the capture")
+	}
+	c.tun.SetPacketCapture(nil)
+	roundTrip(t, conn, "after capturing")
+}
@@ -0,0 +1,225 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// priorityBatchSize is the maximum number of packets written to the
+	// link endpoint at once by the priority scheduler.
+	priorityBatchSize = 47
+
+	// priorityHighBurst is the number of consecutive high priority
+	// packets sent before a waiting low priority packet gets its turn,
+	// so that low priority flows are slowed down but never starved.
+	priorityHighBurst = 8
+)
+
+var _ stack.QueueingDiscipline = (*priorityQDisc)(nil)
+
+// WithPriorityScheduling enables a two-level egress queue in front of the
+// TUN: packets of flows whose Decision has a positive Priority are written
+// before those of other flows. queueLen packets can be pending per level;
+// packets beyond that are dropped like on a full device queue. To avoid
+// starvation, one low priority packet is let through after every
+// priorityHighBurst high priority packets while both levels are pending.
+func WithPriorityScheduling(queueLen int) Option {
+	return func(t *TUN) error {
+		if queueLen <= 0 {
+			return errors.New("priority queue length must be positive")
+		}
+		t.priorityQueueLen = queueLen
+		return nil
+	}
+}
+
+// flowKey identifies a flow by its client-facing endpoint ID.
+type flowKey struct {
+	protocol tcpip.TransportProtocolNumber
+	id       stack.TransportEndpointID
+}
+
+// priorityQDisc is a two-level strict priority queueing discipline with
+// starvation avoidance.
+type priorityQDisc struct {
+	lower stack.LinkWriter
+
+	// high holds the flows whose packets go to the high level.
+	high sync.Map // flowKey -> struct{}
+
+	highQ chan stack.PacketBufferPtr
+	lowQ  chan stack.PacketBufferPtr
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func newPriorityQDisc(lower stack.LinkWriter, queueLen int) *priorityQDisc {
+	q := &priorityQDisc{
+		lower: lower,
+		highQ: make(chan stack.PacketBufferPtr, queueLen),
+		lowQ:  make(chan stack.PacketBufferPtr, queueLen),
+		done:  make(chan struct{}),
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.dispatchLoop()
+	}()
+	return q
+}
+
+// setPriority moves the flow with the given protocol and ID to the high
+// level, or back to the low one.
+func (q *priorityQDisc) setPriority(protocol tcpip.TransportProtocolNumber, id stack.TransportEndpointID, high bool) {
+	k := flowKey{protocol: protocol, id: id}
+	if high {
+		q.high.Store(k, struct{}{})
+	} else {
+		q.high.Delete(k)
+	}
+}
+
+// WritePacket implements stack.QueueingDiscipline.WritePacket.
+func (q *priorityQDisc) WritePacket(pkt stack.PacketBufferPtr) tcpip.Error {
+	select {
+	case <-q.done:
+		return &tcpip.ErrClosedForSend{}
+	default:
+	}
+
+	queue := q.lowQ
+	if _, ok := q.high.Load(packetFlowKey(pkt)); ok {
+		queue = q.highQ
+	}
+	select {
+	case queue <- pkt.IncRef():
+		return nil
+	default:
+		pkt.DecRef()
+		return &tcpip.ErrNoBufferSpace{}
+	}
+}
+
+// Close implements stack.QueueingDiscipline.Close.
+func (q *priorityQDisc) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+	q.wg.Wait()
+}
+
+func (q *priorityQDisc) dispatchLoop() {
+	var (
+		batch  stack.PacketBufferList
+		streak int
+	)
+	for {
+		pkt, ok := q.next(&streak, true)
+		if !ok {
+			q.drain()
+			return
+		}
+		batch.PushBack(pkt)
+		for batch.Len() < priorityBatchSize {
+			pkt, ok := q.next(&streak, false)
+			if !ok {
+				break
+			}
+			batch.PushBack(pkt)
+		}
+		q.lower.WritePackets(batch)
+		batch.Reset()
+	}
+}
+
+// next dequeues the next packet to send, blocking if block is set. It
+// returns false if nothing is available or the qdisc was closed.
+func (q *priorityQDisc) next(streak *int, block bool) (stack.PacketBufferPtr, bool) {
+	if *streak >= priorityHighBurst {
+		select {
+		case pkt := <-q.lowQ:
+			*streak = 0
+			return pkt, true
+		default:
+		}
+	}
+	select {
+	case pkt := <-q.highQ:
+		*streak++
+		return pkt, true
+	default:
+	}
+	select {
+	case pkt := <-q.lowQ:
+		*streak = 0
+		return pkt, true
+	default:
+	}
+	if !block {
+		return stack.PacketBufferPtr{}, false
+	}
+
+	select {
+	case pkt := <-q.highQ:
+		*streak++
+		return pkt, true
+	case pkt := <-q.lowQ:
+		*streak = 0
+		return pkt, true
+	case <-q.done:
+		return stack.PacketBufferPtr{}, false
+	}
+}
+
+// drain releases packets still queued after close.
+func (q *priorityQDisc) drain() {
+	for {
+		select {
+		case pkt := <-q.highQ:
+			pkt.DecRef()
+		case pkt := <-q.lowQ:
+			pkt.DecRef()
+		default:
+			return
+		}
+	}
+}
+
+// packetFlowKey returns the key of the flow an outbound packet belongs to.
+// The packet's source is the flow's local, client-facing side.
+func packetFlowKey(pkt stack.PacketBufferPtr) flowKey {
+	k := flowKey{protocol: pkt.TransportProtocolNumber}
+	switch h := pkt.NetworkHeader().Slice(); pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber:
+		if len(h) < header.IPv4MinimumSize {
+			return k
+		}
+		k.id.LocalAddress = header.IPv4(h).SourceAddress()
+		k.id.RemoteAddress = header.IPv4(h).DestinationAddress()
+	case header.IPv6ProtocolNumber:
+		if len(h) < header.IPv6MinimumSize {
+			return k
+		}
+		k.id.LocalAddress = header.IPv6(h).SourceAddress()
+		k.id.RemoteAddress = header.IPv6(h).DestinationAddress()
+	default:
+		return k
+	}
+	switch k.protocol {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		// Both headers start with source and destination ports.
+		if h := pkt.TransportHeader().Slice(); len(h) >= 4 {
+			k.id.LocalPort = binary.BigEndian.Uint16(h[0:])
+			k.id.RemotePort = binary.BigEndian.Uint16(h[2:])
+		}
+	}
+	return k
+}
@@ -0,0 +1,115 @@
+package libmitm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// privateUpstreamGuard rejects upstreams in private address ranges.
+type privateUpstreamGuard struct {
+	enabled bool
+	allow   []*net.IPNet
+}
+
+// WithBlockPrivateUpstream refuses upstream connections to hostnames that
+// resolve to a loopback, private (RFC 1918 and IPv6 ULA), link-local or
+// unspecified address, which guards against SSRF through names pointing
+// into internal networks. With a *net.Dialer the resolved address is
+// checked before connecting. With a SOCKS5 or HTTP CONNECT dialer the
+// hostname is resolved locally and the proxy is asked to connect to an
+// allowed address, so that the check covers the target rather than the
+// proxy. With other dialers the connection is closed right after it was
+// established if its remote address is private. Upstreams given as IP
+// addresses are not affected, so clients can still reach local networks
+// directly. allow lists addresses or CIDR ranges exempt from the check.
+// Blocked connections are reported as EventUpstreamBlocked.
+func WithBlockPrivateUpstream(allow ...string) Option {
+	return func(t *TUN) error {
+		nets := make([]*net.IPNet, 0, len(allow))
+		for _, a := range allow {
+			if ip := net.ParseIP(a); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			_, n, err := net.ParseCIDR(a)
+			if err != nil {
+				return fmt.Errorf("private upstream exception %q: %w", a, err)
+			}
+			nets = append(nets, n)
+		}
+		t.privateUpstream = privateUpstreamGuard{enabled: true, allow: nets}
+		return nil
+	}
+}
+
+// errPrivateUpstream is returned for upstreams rejected by the guard.
+type errPrivateUpstream struct {
+	address string
+	ip      net.IP
+}
+
+func (e *errPrivateUpstream) Error() string {
+	return fmt.Sprintf("upstream %s resolved to private address %s", e.address, e.ip)
+}
+
+// applies reports whether the guard checks dials to address.
+func (g *privateUpstreamGuard) applies(address string) bool {
+	return g.enabled && isHostname(address)
+}
+
+// isHostname reports whether the host of address is a name rather than
+// an IP address.
+func isHostname(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	return err == nil && net.ParseIP(host) == nil
+}
+
+func (g *privateUpstreamGuard) blocked(ip net.IP) bool {
+	if !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range g.allow {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dial dials address with d, rejecting it if it resolves to a private
+// address.
+func (g *privateUpstreamGuard) dial(ctx context.Context, d Dialer, network, address string) (net.Conn, error) {
+	if nd, ok := d.(*net.Dialer); ok {
+		d = appendControl(nd, func(network, resolved string, c syscall.RawConn) error {
+			if host, _, err := net.SplitHostPort(resolved); err == nil {
+				if ip := net.ParseIP(host); ip != nil && g.blocked(ip) {
+					return &errPrivateUpstream{address: address, ip: ip}
+				}
+			}
+			return nil
+		})
+	}
+
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	switch a := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if ip != nil && g.blocked(ip) {
+		conn.Close()
+		return nil, &errPrivateUpstream{address: address, ip: ip}
+	}
+	return conn, nil
+}
@@ -0,0 +1,32 @@
+package libmitm
+
+import "errors"
+
+// ProcessResolver maps a flow to the local process that opened it, e.g.
+// by looking up its source port in /proc/net or via netlink. It reports
+// ok false if the process is unknown.
+type ProcessResolver func(f *Flow) (pid int, name string, ok bool)
+
+// WithProcessResolver calls fn for every new flow before redirection and
+// stores the result in Flow.PID and Flow.ProcessName, enabling per-app
+// routing in a FlowRedirector. fn runs on the flow's own goroutine and
+// delays its upstream dial, so lookups should be fast or cached.
+func WithProcessResolver(fn ProcessResolver) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("process resolver must not be nil")
+		}
+		t.processResolver = fn
+		return nil
+	}
+}
+
+// resolveProcess fills in the process fields of f.
+func (t *TUN) resolveProcess(f *Flow) {
+	if t.processResolver == nil {
+		return
+	}
+	if pid, name, ok := t.processResolver(f); ok {
+		f.PID, f.ProcessName = pid, name
+	}
+}
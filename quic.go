@@ -0,0 +1,147 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// quicPort is the port whose UDP flows are checked for QUIC.
+	quicPort = 443
+
+	// quicMinInitial is the smallest datagram carrying a client Initial
+	// packet, which RFC 9000 requires clients to pad to.
+	quicMinInitial = 1200
+
+	// quicMaxConnIDLen is the longest connection ID of QUIC version 1.
+	quicMaxConnIDLen = 20
+)
+
+// QUICMode selects how SetQUICBlocking handles QUIC flows.
+type QUICMode int
+
+const (
+	// QUICAllow forwards QUIC like any UDP flow.
+	QUICAllow QUICMode = iota
+
+	// QUICDrop drops QUIC flows silently; clients fall back to TCP once
+	// their handshake times out.
+	QUICDrop
+
+	// QUICReject answers QUIC flows with an ICMP port unreachable, which
+	// makes most clients fall back to TCP at once.
+	QUICReject
+)
+
+type quicBlocking struct {
+	mode    atomic.Int32
+	blocked atomic.Int64
+}
+
+// WithQUICBlocking sets how new UDP flows to port 443 that start with a
+// QUIC Initial packet are handled, see SetQUICBlocking.
+func WithQUICBlocking(mode QUICMode) Option {
+	return func(t *TUN) error {
+		return t.SetQUICBlocking(mode)
+	}
+}
+
+// SetQUICBlocking sets how new UDP flows to port 443 that start with a
+// QUIC Initial packet are handled: QUICAllow, the default, QUICDrop or
+// QUICReject, so that apps fall back to TCP, whose streams can be
+// intercepted. It may be called at any time; flows already forwarded are
+// not affected. Only long header Initial packets of QUIC versions 1 and
+// 2 and of drafts, padded to the 1200 bytes clients must send, are
+// matched, so other UDP traffic to port 443 passes. Blocked flows are
+// counted by QUICFlowsBlocked.
+func (t *TUN) SetQUICBlocking(mode QUICMode) error {
+	switch mode {
+	case QUICAllow, QUICDrop, QUICReject:
+		t.quic.mode.Store(int32(mode))
+		return nil
+	default:
+		return fmt.Errorf("unknown quic blocking mode: %d", mode)
+	}
+}
+
+// QUICFlowsBlocked returns the number of QUIC flows blocked by
+// SetQUICBlocking.
+func (t *TUN) QUICFlowsBlocked() int64 {
+	return t.quic.blocked.Load()
+}
+
+// blockQUIC wraps the UDP transport protocol handler, which sees the first
+// datagram of every new flow, to block QUIC flows. Returning false from it
+// makes the stack answer with an ICMP port unreachable.
+func (t *TUN) blockQUIC(next func(stack.TransportEndpointID, stack.PacketBufferPtr) bool) func(stack.TransportEndpointID, stack.PacketBufferPtr) bool {
+	return func(id stack.TransportEndpointID, pkt stack.PacketBufferPtr) bool {
+		mode := QUICMode(t.quic.mode.Load())
+		if mode == QUICAllow || id.LocalPort != quicPort || pkt.Data().Size() < quicMinInitial {
+			return next(id, pkt)
+		}
+		b, ok := pkt.Data().PullUp(pkt.Data().Size())
+		if !ok || !isQUICInitial(b) {
+			return next(id, pkt)
+		}
+		t.quic.blocked.Add(1)
+		t.log().Debugf("udp: blocking quic from %s to %s", sourceId(id), addressId(id))
+		return mode == QUICDrop
+	}
+}
+
+// isQUICInitial reports whether the datagram b starts with a QUIC Initial
+// packet whose header is consistent with the length of b.
+func isQUICInitial(b []byte) bool {
+	// Header form and fixed bit of a long header.
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 {
+		return false
+	}
+	typ := b[0] >> 4 & 3
+	switch v := binary.BigEndian.Uint32(b[1:]); {
+	case v == 1, v>>8 == 0xff0000:
+		if typ != 0 {
+			return false
+		}
+	case v == 0x6b3343cf:
+		// QUIC version 2 renumbered the packet types.
+		if typ != 1 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	r := tlsReader(b[5:])
+	if dcid, ok := r.vector(1); !ok || len(dcid) > quicMaxConnIDLen {
+		return false
+	}
+	if scid, ok := r.vector(1); !ok || len(scid) > quicMaxConnIDLen {
+		return false
+	}
+	token, ok := quicVarint(&r)
+	if !ok || token > uint64(len(r)) || !r.skip(int(token)) {
+		return false
+	}
+	length, ok := quicVarint(&r)
+	return ok && length > 0 && length <= uint64(len(r))
+}
+
+// quicVarint reads a QUIC variable-length integer from r.
+func quicVarint(r *tlsReader) (uint64, bool) {
+	if len(*r) == 0 {
+		return 0, false
+	}
+	n := 1 << ((*r)[0] >> 6)
+	if len(*r) < n {
+		return 0, false
+	}
+	v := uint64((*r)[0] & 0x3f)
+	for _, c := range (*r)[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	*r = (*r)[n:]
+	return v, true
+}
@@ -0,0 +1,80 @@
+package libmitm
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// quicInitial returns a padded QUIC Initial datagram of version with the
+// long header packet type typ.
+func quicInitial(version uint32, typ byte) []byte {
+	b := []byte{0xc0 | typ<<4 | 3, byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	b = append(b, 8, 1, 2, 3, 4, 5, 6, 7, 8) // destination connection ID
+	b = append(b, 0)                         // source connection ID
+	b = append(b, 0)                         // token length
+	length := quicMinInitial - len(b) - 2
+	b = append(b, 0x40|byte(length>>8), byte(length))
+	return append(b, make([]byte, length)...)
+}
+
+func TestIsQUICInitial(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"v1", quicInitial(1, 0), true},
+		{"v2", quicInitial(0x6b3343cf, 1), true},
+		{"draft", quicInitial(0xff00001d, 0), true},
+		{"v1 handshake", quicInitial(1, 2), false},
+		{"v2 with the v1 type", quicInitial(0x6b3343cf, 0), false},
+		{"unknown version", quicInitial(0x0a0a0a0a, 0), false},
+		{"short header", append([]byte{0x40}, quicInitial(1, 0)[1:]...), false},
+		{"truncated", quicInitial(1, 0)[:40], false},
+		{"dns", make([]byte, quicMinInitial), false},
+	} {
+		if got := isQUICInitial(tc.b); got != tc.want {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestQUICBlocking(t *testing.T) {
+	upstream := udpEchoServer(t)
+	for _, mode := range []QUICMode{QUICDrop, QUICReject} {
+		c := startTestTUN(t,
+			withRedirectors(nil, FixedRedirector(upstream)),
+			WithQUICBlocking(mode),
+		)
+		conn := c.dialUDP(t, testRemote(quicPort))
+		conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Write(quicInitial(1, 0)); err != nil {
+			t.Fatalf("mode %d: write: %v", mode, err)
+		}
+		if _, err := conn.Read(make([]byte, 2048)); err == nil {
+			t.Errorf("mode %d: quic flow was forwarded", mode)
+		}
+		if n := c.tun.QUICFlowsBlocked(); n != 1 {
+			t.Errorf("mode %d: %d flows blocked, want 1", mode, n)
+		}
+
+		// Other UDP traffic to the port passes.
+		other := c.dialUDP(t, testRemote(quicPort))
+		roundTrip(t, other, string(bytes.Repeat([]byte("x"), quicMinInitial)))
+	}
+
+	if err := (&TUN{}).SetQUICBlocking(QUICReject + 1); err == nil {
+		t.Error("set an unknown mode")
+	}
+}
+
+func TestQUICAllow(t *testing.T) {
+	upstream := udpEchoServer(t)
+	c := startTestTUN(t, withRedirectors(nil, FixedRedirector(upstream)))
+	conn := c.dialUDP(t, testRemote(quicPort))
+	roundTrip(t, conn, string(quicInitial(1, 0)))
+	if n := c.tun.QUICFlowsBlocked(); n != 0 {
+		t.Errorf("%d flows blocked by default", n)
+	}
+}
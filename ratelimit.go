@@ -0,0 +1,129 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitBurst is the token bucket size of bandwidth limiters, and the
+// largest write that draws from a bucket at once. It fits any datagram.
+const rateLimitBurst = 64 << 10
+
+type globalRateLimit struct {
+	limiter *rate.Limiter
+
+	throttled     atomic.Int64
+	throttledTime atomic.Int64
+}
+
+// WithGlobalRateLimit caps the total upstream bandwidth of all flows at
+// bytesPerSec with a single shared token bucket.
+//
+// Flows draw tokens in writes of at most rateLimitBurst bytes and wait in
+// line for them, so a greedy flow gets its next chunk only after the flows
+// already waiting: bandwidth is shared roughly equally among flows that
+// are sending, and a single flow cannot starve the others.
+func WithGlobalRateLimit(bytesPerSec int64) Option {
+	return func(t *TUN) error {
+		if bytesPerSec <= 0 {
+			return errors.New("global rate limit must be positive")
+		}
+		t.globalRate.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), rateLimitBurst)
+		return nil
+	}
+}
+
+// GlobalRateLimitThrottled returns how many upstream writes had to wait
+// for the global rate limit, and for how long in total, in milliseconds.
+func (t *TUN) GlobalRateLimitThrottled() (writes int64, millis int64) {
+	return t.globalRate.throttled.Load(), durationMillis(time.Duration(t.globalRate.throttledTime.Load()))
+}
+
+// WithPerFlowRateLimit caps each direction of every flow at bytesPerSec,
+// with bursts of up to 64KiB, e.g. for fair use or to emulate a slow
+// link. Each direction of a flow has a token bucket of its own, so one
+// direction waiting for tokens never holds up the other. It combines with
+// WithGlobalRateLimit, which still bounds the upstream total. Zero
+// disables the limit.
+func WithPerFlowRateLimit(bytesPerSec int64) Option {
+	return func(t *TUN) error {
+		if bytesPerSec < 0 {
+			return errors.New("per-flow rate limit must not be negative")
+		}
+		t.flowRate = bytesPerSec
+		return nil
+	}
+}
+
+// flowRateLimit returns w shaped to the per-flow rate limit, if one is
+// set. Writes of datagrams over network are not split, and waits for
+// tokens end with ctx.
+func (t *TUN) flowRateLimit(ctx context.Context, network string, w io.Writer) io.Writer {
+	if t.flowRate <= 0 {
+		return w
+	}
+	return &rateLimitedWriter{
+		ctx:     ctx,
+		w:       w,
+		limiter: rate.NewLimiter(rate.Limit(t.flowRate), rateLimitBurst),
+		split:   network == "tcp",
+	}
+}
+
+// rateLimitedWriter shapes writes to w with limiter.
+type rateLimitedWriter struct {
+	// ctx ends waits for tokens if set.
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+	// split allows dividing writes; it must be false for datagrams.
+	split bool
+
+	throttled     *atomic.Int64
+	throttledTime *atomic.Int64
+}
+
+func (l *rateLimitedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if l.split && len(chunk) > rateLimitBurst {
+			chunk = chunk[:rateLimitBurst]
+		}
+		if err := l.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := l.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (l *rateLimitedWriter) wait(n int) error {
+	if n > rateLimitBurst {
+		// Oversized datagrams are not delayed beyond a full bucket.
+		n = rateLimitBurst
+	}
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	start := time.Now()
+	if err := l.limiter.WaitN(ctx, n); err != nil {
+		return err
+	}
+	if waited := time.Since(start); waited > time.Millisecond && l.throttled != nil {
+		l.throttled.Add(1)
+		l.throttledTime.Add(int64(waited))
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package libmitm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestPerFlowRateLimit checks that a flow is shaped to the rate limit in
+// both directions and keeps flowing past the establish timeout.
+func TestPerFlowRateLimit(t *testing.T) {
+	const rate = 256 << 10
+	upstream := echoServer(t)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithPerFlowRateLimit(rate),
+		WithEstablishTimeout(100*time.Millisecond),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// A full bucket goes through at once, the rest at the rate.
+	msg := bytes.Repeat([]byte("x"), rateLimitBurst+rate)
+	start := time.Now()
+	go conn.Write(msg)
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("read after %v: %v", time.Since(start), err)
+	}
+	if !bytes.Equal(b, msg) {
+		t.Fatal("echo differs from the data sent")
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("%d bytes took %v at %d bytes/s, want about 1s", len(msg), elapsed, rate)
+	}
+}
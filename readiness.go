@@ -0,0 +1,45 @@
+package libmitm
+
+import (
+	"errors"
+
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// ReadinessTracer receives the readiness events of a forwarded endpoint,
+// identified by its Flow ID. events is a combination of waiter.EventIn,
+// EventOut, EventErr and EventHUp.
+type ReadinessTracer func(id string, events waiter.EventMask)
+
+// WithReadinessTrace reports every readiness notification of the client
+// side endpoints to fn, which helps diagnosing connections that never
+// become readable or writable. It is meant for debugging only: fn is
+// called synchronously from gVisor's notification path, with the waiter
+// queue locked, for every segment received and every window update, so it
+// must be fast and must not call back into the connection. Even a trivial
+// fn adds a callback to each of these events.
+func WithReadinessTrace(fn ReadinessTracer) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("readiness tracer must not be nil")
+		}
+		t.readinessTrace = fn
+		return nil
+	}
+}
+
+// traceReadiness subscribes the readiness tracer, if any, to wq for flow.
+// The returned function unsubscribes it.
+func (t *TUN) traceReadiness(flow *Flow, wq *waiter.Queue) func() {
+	if t.readinessTrace == nil {
+		return func() {}
+	}
+	fn, id := t.readinessTrace, flow.ID
+	entry := waiter.NewFunctionEntry(waiter.EventIn|waiter.EventOut|waiter.EventErr|waiter.EventHUp, func(mask waiter.EventMask) {
+		fn(id, mask)
+	})
+	wq.EventRegister(&entry)
+	return func() {
+		wq.EventUnregister(&entry)
+	}
+}
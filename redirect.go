@@ -0,0 +1,178 @@
+package libmitm
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Flow describes an intercepted connection that is about to be forwarded.
+type Flow struct {
+	// ID identifies the connection in events, metrics and the
+	// FlowEstablishHandler and FlowCloseHandler, see WithConnIDScheme.
+	ID string
+	// Network is "tcp" or "udp".
+	Network         string
+	Source          string
+	SourcePort      int
+	Destination     string
+	DestinationPort int
+
+	// Label is the result of the classifier for the first bytes of the
+	// flow, or empty if no classifier is configured.
+	Label string
+
+	// PID and ProcessName identify the local process that opened the
+	// flow, if a process resolver is configured and found it. PID is 0
+	// otherwise.
+	PID         int
+	ProcessName string
+
+	// TTL is the TTL or hop limit the first packet of the flow arrived
+	// with, if WithIngressTTL is set, and 0 otherwise.
+	TTL int
+
+	// Domain is the domain the destination address was handed out for,
+	// if it is a fake IP of WithFakeIP, and empty otherwise.
+	Domain string
+
+	// SNI is the server name of the flow's TLS ClientHello, if
+	// WithSNISniffing is set and found one, and empty otherwise.
+	SNI string
+
+	// Host is the host of the flow's HTTP Host header, if
+	// WithHTTPHostSniffing is set and found one, and empty otherwise.
+	Host string
+
+	id stack.TransportEndpointID
+	// target is the upstream chosen by a DatagramClassifier.
+	target string
+	// ep is the client-facing endpoint of TCP flows.
+	ep tcpip.Endpoint
+	// mss is the MSS the client announced, recorded for MSSMinBoth.
+	mss uint16
+	// upstream is the address the upstream was dialed at.
+	upstream string
+	// dialNetwork is the network the upstream is dialed over if it is
+	// not Network.
+	dialNetwork string
+}
+
+// Decision is the routing decision for a Flow.
+type Decision struct {
+	// Address is the upstream address to dial. If empty, the original
+	// destination is dialed.
+	Address string
+
+	// Dialers is an ordered failover chain of upstream dialers. Each is
+	// tried in turn until one connects, all within the establish
+	// timeout. If empty, the TUN's dialer is used.
+	Dialers []Dialer
+
+	// Priority schedules the flow's packets towards the client ahead of
+	// other flows when positive, see WithPriorityScheduling.
+	Priority int
+
+	// IdleTimeout overrides the idle timeout of the flow when non-zero:
+	// the flow is closed once no data moved in either direction for that
+	// long, or never if it is NeverIdle. It takes precedence over the
+	// timeouts set by WithUDPTimeoutByPort and WithTCPIdleTimeout.
+	IdleTimeout time.Duration
+
+	// Targets balances the flow over several upstream addresses instead
+	// of dialing Address, see WeightedTargets.
+	Targets *WeightedTargets
+
+	// Network dials the upstream over "tcp" or "udp" instead of the
+	// flow's own network if not empty. Each datagram of a UDP flow
+	// carried over TCP is written to the stream with its length as two
+	// bytes in network byte order in front, as DNS over TCP frames
+	// messages (RFC 1035, section 4.2.2), and the stream must frame the
+	// datagrams back the same way. Each read from a TCP flow carried over
+	// UDP is sent as a datagram, without framing.
+	Network string
+}
+
+// NeverIdle is a Decision.IdleTimeout exempting a flow from idle timeouts.
+const NeverIdle time.Duration = -1
+
+// FlowRedirector is an extended Redirector that receives the full Flow,
+// including its classification. When a TUN's redirector implements
+// FlowRedirector, RedirectFlow is called instead of Redirect.
+type FlowRedirector interface {
+	RedirectFlow(f *Flow) *Decision
+}
+
+// NetworkRedirector is an extended Redirector that can reject a flow or
+// carry it over another network. When a TUN's redirector implements
+// NetworkRedirector but not FlowRedirector, RedirectNetwork is called
+// instead of Redirect. A non-nil err rejects the flow: a TCP client gets
+// a RST and a UDP datagram is dropped, so the next one is redirected
+// again. An empty addr dials the original destination, and a non-empty
+// network is used as Decision.Network.
+type NetworkRedirector interface {
+	RedirectNetwork(f *Flow) (addr string, network string, err error)
+}
+
+func (t *TUN) newFlow(network string, id stack.TransportEndpointID) *Flow {
+	return &Flow{
+		ID:              t.connID.next(network, id, time.Now()),
+		Network:         network,
+		Source:          id.RemoteAddress.String(),
+		SourcePort:      int(id.RemotePort),
+		Destination:     id.LocalAddress.String(),
+		DestinationPort: int(id.LocalPort),
+		Domain:          t.fakeDomain(id.LocalAddress),
+		id:              id,
+	}
+}
+
+// redirect asks r for the routing decision of f. The returned decision
+// always has an upstream address. It returns an error if r rejected f.
+func redirect(r Redirector, f *Flow, id stack.TransportEndpointID) (Decision, error) {
+	var d Decision
+	switch r := r.(type) {
+	case nil:
+	case FlowRedirector:
+		if rd := r.RedirectFlow(f); rd != nil {
+			d = *rd
+		}
+	case NetworkRedirector:
+		var err error
+		d.Address, d.Network, err = r.RedirectNetwork(f)
+		if err != nil {
+			return Decision{}, err
+		}
+	default:
+		d.Address = r.Redirect(f.Source, f.SourcePort, f.Destination, f.DestinationPort)
+	}
+	switch d.Network {
+	case "", f.Network:
+	case "tcp", "udp":
+		f.dialNetwork = d.Network
+	default:
+		return Decision{}, fmt.Errorf("redirect: unsupported network %q", d.Network)
+	}
+	if d.Address == "" {
+		d.Address = f.target
+	}
+	if d.Address == "" && f.Domain != "" {
+		d.Address = net.JoinHostPort(f.Domain, strconv.Itoa(f.DestinationPort))
+	}
+	if d.Address == "" {
+		d.Address = addressId(id)
+	}
+	return d, nil
+}
+
+// upstreamNetwork returns the network the upstream of f is dialed over.
+func (f *Flow) upstreamNetwork() string {
+	if f.dialNetwork != "" {
+		return f.dialNetwork
+	}
+	return f.Network
+}
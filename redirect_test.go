@@ -0,0 +1,108 @@
+package libmitm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// networkRedirector is a NetworkRedirector returning fixed results.
+type networkRedirector struct {
+	addr, network string
+	err           error
+}
+
+func (r *networkRedirector) Redirect(src string, srcPort int, dst string, dstPort int) string {
+	return ""
+}
+
+func (r *networkRedirector) RedirectNetwork(f *Flow) (string, string, error) {
+	return r.addr, r.network, r.err
+}
+
+func TestRedirectReject(t *testing.T) {
+	r := &networkRedirector{err: errors.New("rejected")}
+	c := startTestTUN(t, withRedirectors(r, r))
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(testTimeout))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Error("rejected tcp flow was forwarded")
+		}
+	}
+
+	uc := c.dialUDP(t, testRemote(5000))
+	uc.Write([]byte("dropped"))
+	uc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := uc.Read(make([]byte, 16)); err == nil {
+		t.Error("rejected udp flow was answered")
+	}
+}
+
+// TestRedirectUDPOverTCP checks that datagrams carried over a stream keep
+// their boundaries. The echo server returns the frames as they are.
+func TestRedirectUDPOverTCP(t *testing.T) {
+	upstream := echoServer(t)
+	r := &networkRedirector{addr: upstream, network: "tcp"}
+	c := startTestTUN(t, withRedirectors(nil, r))
+
+	conn := c.dialUDP(t, testRemote(5000))
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	datagrams := [][]byte{[]byte("first"), []byte("second datagram"), bytes.Repeat([]byte{'x'}, 1200)}
+	for _, d := range datagrams {
+		if _, err := conn.Write(d); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	b := make([]byte, 2048)
+	for _, d := range datagrams {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !bytes.Equal(b[:n], d) {
+			t.Errorf("read datagram %q, want %q", b[:n], d)
+		}
+	}
+}
+
+func TestRedirectTCPOverUDP(t *testing.T) {
+	upstream := udpEchoServer(t)
+	r := &networkRedirector{addr: upstream, network: "udp"}
+	c := startTestTUN(t, withRedirectors(r, nil))
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "over udp")
+}
+
+func TestFramedReader(t *testing.T) {
+	var stream bytes.Buffer
+	w := &framedWriter{w: &stream}
+	for _, d := range []string{"a", "too large for the buffer", "", "bc"} {
+		if _, err := w.Write([]byte(d)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if _, err := w.Write(make([]byte, 1<<16)); err == nil {
+		t.Error("framed a datagram of 64 KiB")
+	}
+
+	r := &framedReader{r: &stream}
+	b := make([]byte, 4)
+	for _, want := range []string{"a", "", "bc"} {
+		n, err := r.Read(b)
+		if err != nil || string(b[:n]) != want {
+			t.Errorf("read %q, %v, want %q", b[:n], err, want)
+		}
+	}
+	if _, err := r.Read(b); err == nil {
+		t.Error("read past the end of the stream")
+	}
+}
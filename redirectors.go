@@ -0,0 +1,65 @@
+package libmitm
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+type fixedRedirector struct {
+	host string
+	port string
+}
+
+// FixedRedirector returns a Redirector sending every flow to addr,
+// whatever its original destination. If addr has no port, flows keep
+// their destination port; an IPv6 address without port may be given with
+// or without brackets. It is safe to share across TUNs.
+func FixedRedirector(addr string) Redirector {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return &fixedRedirector{host: host, port: port}
+	}
+	if len(addr) > 1 && addr[0] == '[' && addr[len(addr)-1] == ']' {
+		addr = addr[1 : len(addr)-1]
+	}
+	return &fixedRedirector{host: addr}
+}
+
+func (r *fixedRedirector) Redirect(src string, srcPort int, dst string, dstPort int) string {
+	port := r.port
+	if port == "" {
+		port = strconv.Itoa(dstPort)
+	}
+	return net.JoinHostPort(r.host, port)
+}
+
+type prefixRedirector struct {
+	fixed    *fixedRedirector
+	prefixes []*net.IPNet
+}
+
+// PrefixRedirector returns a Redirector sending the flows whose original
+// destination is in one of cidrs to addr, like FixedRedirector, and
+// leaving all other flows to their original destination. It is safe to
+// share across TUNs.
+func PrefixRedirector(addr string, cidrs []string) (Redirector, error) {
+	r := &prefixRedirector{fixed: FixedRedirector(addr).(*fixedRedirector)}
+	for _, cidr := range cidrs {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("prefix redirector: %w", err)
+		}
+		r.prefixes = append(r.prefixes, prefix)
+	}
+	return r, nil
+}
+
+func (r *prefixRedirector) Redirect(src string, srcPort int, dst string, dstPort int) string {
+	ip := net.ParseIP(dst)
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(ip) {
+			return r.fixed.Redirect(src, srcPort, dst, dstPort)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package libmitm
+
+import "testing"
+
+func TestFixedRedirector(t *testing.T) {
+	for _, tc := range []struct {
+		addr, want string
+	}{
+		{"192.0.2.1:8080", "192.0.2.1:8080"},
+		{"192.0.2.1", "192.0.2.1:443"},
+		{"example.com", "example.com:443"},
+		{"[2001:db8::1]:8080", "[2001:db8::1]:8080"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+		{"2001:db8::1", "[2001:db8::1]:443"},
+	} {
+		if got := FixedRedirector(tc.addr).Redirect("10.0.0.1", 40000, "198.51.100.1", 443); got != tc.want {
+			t.Errorf("%s: redirected to %s, want %s", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestPrefixRedirector(t *testing.T) {
+	r, err := PrefixRedirector("[2001:db8::1]", []string{"198.51.100.0/24", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		dst, want string
+	}{
+		{"198.51.100.7", "[2001:db8::1]:443"},
+		{"2001:db8:1::7", "[2001:db8::1]:443"},
+		{"192.0.2.1", ""},
+	} {
+		if got := r.Redirect("10.0.0.1", 40000, tc.dst, 443); got != tc.want {
+			t.Errorf("%s: redirected to %q, want %q", tc.dst, got, tc.want)
+		}
+	}
+	if _, err := PrefixRedirector("192.0.2.1", []string{"192.0.2.0"}); err == nil {
+		t.Error("accepted a prefix without length")
+	}
+}
@@ -0,0 +1,41 @@
+package libmitm
+
+import (
+	"errors"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// RouteObserver is called for every packet the stack sends, with the
+// destination of the route the stack resolved and the NIC it chose.
+type RouteObserver func(dst tcpip.Address, nic tcpip.NICID)
+
+// WithRouteObserver installs fn to observe route resolution of outgoing
+// packets. gVisor has no route lookup hook, so the observer sits on the
+// link endpoint's write path and sees the route attached to each packet.
+// It runs synchronously for every packet and should only be enabled for
+// debugging.
+func WithRouteObserver(fn RouteObserver) Option {
+	return func(t *TUN) error {
+		if fn == nil {
+			return errors.New("route observer must not be nil")
+		}
+		t.routeObserver = fn
+		return nil
+	}
+}
+
+// routeObservingEndpoint reports the egress route of written packets.
+type routeObservingEndpoint struct {
+	stack.LinkEndpoint
+	nicID    tcpip.NICID
+	observer RouteObserver
+}
+
+func (e *routeObservingEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for _, pkt := range pkts.AsSlice() {
+		e.observer(pkt.EgressRoute.RemoteAddress, e.nicID)
+	}
+	return e.LinkEndpoint.WritePackets(pkts)
+}
@@ -0,0 +1,67 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// forwarders tracks the goroutines forwarding connections of a TUN.
+type forwarders struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (f *forwarders) start() {
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+}
+
+// stop cancels the context of every forwarder, which closes both sides of
+// their connections.
+func (f *forwarders) stop() {
+	if f.cancel != nil {
+		f.cancel()
+	}
+}
+
+// wait waits until every forwarder returned or ctx is done.
+func (f *forwarders) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeOnDone closes local and remote once ctx is done, unblocking the
+// copies between them, until the returned function is called.
+func closeOnDone(ctx context.Context, local, remote net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			local.Close()
+			remote.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Shutdown stops forwarding: it closes both sides of every forwarded
+// connection, waits for the forwarders to return until ctx is done, and
+// then closes the TUN as Close does. It returns ctx's error if forwarders
+// were still running when ctx was done; the TUN is closed either way.
+func (t *TUN) Shutdown(ctx context.Context) error {
+	t.forwarders.stop()
+	err := t.forwarders.wait(ctx)
+	t.Close()
+	return err
+}
@@ -0,0 +1,93 @@
+package libmitm
+
+import (
+	"context"
+	"libmitm/endpoint"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestShutdown checks that Shutdown closes both sides of a forwarded
+// connection whose upstream never answers, and that its goroutines exit.
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	c := startTestTUN(t, withRedirectors(FixedRedirector(l.Addr().String()), nil))
+	baseline := runtime.NumGoroutine()
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("unanswered")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var remote net.Conn
+	select {
+	case remote = <-accepted:
+		defer remote.Close()
+	case <-time.After(testTimeout):
+		t.Fatal("upstream was not dialed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.tun.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+
+	remote.SetReadDeadline(time.Now().Add(testTimeout))
+	b := make([]byte, 64)
+	for {
+		if _, err := remote.Read(b); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Error("upstream side was not closed")
+			}
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := conn.Read(b); err == nil {
+		t.Error("client side was not closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("client side was not closed")
+	}
+	waitFor(t, "the forwarder goroutines to exit", func() bool {
+		return runtime.NumGoroutine() <= baseline
+	})
+}
+
+// TestStartFailure checks that a Start failing after the stream inspector
+// is configured leaves no goroutine behind.
+func TestStartFailure(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	ep := endpoint.NewChannelEndpoint(1000)
+	defer ep.Close()
+	tun := &TUN{MTU: 1000, IPv6Config: IPv6Enable}
+	err := tun.Apply(
+		WithChannelEndpoint(ep),
+		WithStreamInspector(func(string, Direction, []byte, time.Time) {}),
+	)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := tun.Start(); err == nil {
+		tun.Close()
+		t.Fatal("started with an mtu below the IPv6 minimum")
+	}
+	waitFor(t, "the inspector to exit", func() bool {
+		return runtime.NumGoroutine() <= baseline
+	})
+}
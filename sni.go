@@ -0,0 +1,169 @@
+package libmitm
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// sniPort is the port whose TCP flows are sniffed for an SNI.
+	sniPort = 443
+
+	// sniTimeout bounds how long the forwarder waits for a ClientHello.
+	sniTimeout = 500 * time.Millisecond
+
+	// sniMaxRecord is the largest TLS record read while sniffing, the
+	// maximum plaintext record size.
+	sniMaxRecord = 16384
+)
+
+// WithSNISniffing reads the TLS ClientHello of every TCP flow to port 443
+// before it is redirected and exposes its server name as Flow.SNI to a
+// FlowRedirector or NetworkRedirector, so that connections to bare IPs
+// can be routed by domain. The bytes read are replayed to the upstream
+// unchanged. Sniffing reads at most one TLS record and waits at most
+// 500ms, so flows that are not TLS or whose client is slow keep their
+// address based routing with an empty Flow.SNI.
+func WithSNISniffing() Option {
+	return func(t *TUN) error {
+		t.sniffTLS = true
+		return nil
+	}
+}
+
+// sniffSNI sets the SNI of flow from the ClientHello read from conn if
+// sniffing applies, and returns a connection that replays the bytes read.
+func (t *TUN) sniffSNI(flow *Flow, conn net.Conn) net.Conn {
+	if !t.sniffTLS || flow.DestinationPort != sniPort {
+		return conn
+	}
+	conn.SetReadDeadline(time.Now().Add(sniTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	head := make([]byte, 5, 5+sniMaxRecord)
+	n, _ := io.ReadFull(conn, head)
+	head = head[:n]
+	// A handshake record of TLS 1.0 or later.
+	if n == 5 && head[0] == 22 && head[1] == 3 {
+		if l := int(binary.BigEndian.Uint16(head[3:])); l <= sniMaxRecord {
+			n, _ = io.ReadFull(conn, head[5:5+l])
+			head = head[:5+n]
+			flow.SNI = parseSNI(head[5:])
+		}
+	}
+	if len(head) == 0 {
+		return conn
+	}
+	return &peekedConn{Conn: conn, head: head}
+}
+
+// parseSNI returns the host name of the server name extension of the TLS
+// ClientHello handshake message at the start of b, or "" if b does not
+// hold one.
+func parseSNI(b []byte) string {
+	r := tlsReader(b)
+	typ, _ := r.uint8()
+	hello, ok := r.vector(3)
+	if !ok || typ != 1 {
+		return ""
+	}
+
+	r = tlsReader(hello)
+	// Legacy version and random.
+	if !r.skip(2 + 32) {
+		return ""
+	}
+	if _, ok := r.vector(1); !ok { // Session ID.
+		return ""
+	}
+	if _, ok := r.vector(2); !ok { // Cipher suites.
+		return ""
+	}
+	if _, ok := r.vector(1); !ok { // Compression methods.
+		return ""
+	}
+	exts, ok := r.vector(2)
+	if !ok {
+		return ""
+	}
+
+	r = tlsReader(exts)
+	for len(r) > 0 {
+		typ, ok1 := r.uint16()
+		ext, ok2 := r.vector(2)
+		if !ok1 || !ok2 {
+			return ""
+		}
+		if typ != 0 {
+			continue
+		}
+		er := tlsReader(ext)
+		names, ok := er.vector(2)
+		if !ok {
+			return ""
+		}
+		nr := tlsReader(names)
+		for len(nr) > 0 {
+			nameType, ok1 := nr.uint8()
+			name, ok2 := nr.vector(2)
+			if !ok1 || !ok2 {
+				return ""
+			}
+			// A host name.
+			if nameType == 0 {
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// tlsReader reads the fields of a TLS message.
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector reads a vector with a length prefix of lenBytes bytes.
+func (r *tlsReader) vector(lenBytes int) ([]byte, bool) {
+	if len(*r) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	*r = (*r)[lenBytes:]
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
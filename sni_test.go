@@ -0,0 +1,98 @@
+package libmitm
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record a crypto/tls client sends to
+// serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(server, head); err != nil {
+		t.Fatalf("read record header: %v", err)
+	}
+	record := make([]byte, 5+int(head[3])<<8|int(head[4]))
+	copy(record, head)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatalf("read record: %v", err)
+	}
+	return record
+}
+
+func TestParseSNI(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	if got := parseSNI(hello[5:]); got != "example.com" {
+		t.Errorf("sni %q, want example.com", got)
+	}
+	// Without a server name, e.g. when connecting to an IP.
+	if got := parseSNI(clientHello(t, "192.0.2.1")[5:]); got != "" {
+		t.Errorf("sni of a hello without server name: %q", got)
+	}
+	for n := 0; n < len(hello)-5; n++ {
+		if got := parseSNI(hello[5 : 5+n]); got != "" {
+			t.Errorf("sni of a hello truncated to %d bytes: %q", n, got)
+		}
+	}
+	for _, b := range [][]byte{
+		nil,
+		{2, 0, 0, 0},
+		[]byte("GET / HTTP/1.1\r\n"),
+	} {
+		if got := parseSNI(b); got != "" {
+			t.Errorf("sni of %q: %q", b, got)
+		}
+	}
+}
+
+// sniRedirector returns a redirector sending flows to upstream and the SNI
+// of each flow to the returned channel.
+func sniRedirector(upstream string) (flowRedirector, chan string) {
+	snis := make(chan string, 16)
+	return func(f *Flow) *Decision {
+		snis <- f.SNI
+		return &Decision{Address: upstream}
+	}, snis
+}
+
+func TestSNISniffing(t *testing.T) {
+	upstream := echoServer(t)
+	hello := clientHello(t, "example.com")
+	for _, tc := range []struct {
+		name  string
+		write []byte
+		delay time.Duration
+		sni   string
+	}{
+		{"client hello", hello, 0, "example.com"},
+		{"not tls", []byte("plain text of a flow"), 0, ""},
+		{"short", hello[:3], 0, ""},
+		// The client says nothing until sniffing gave up.
+		{"slow", hello, sniTimeout + 100*time.Millisecond, ""},
+	} {
+		redirector, snis := sniRedirector(upstream)
+		c := startTestTUN(t, withRedirectors(redirector, nil), WithSNISniffing())
+
+		conn, err := c.dialTCP(t, testRemote(sniPort))
+		if err != nil {
+			t.Fatalf("%s: dial: %v", tc.name, err)
+		}
+		time.Sleep(tc.delay)
+		// The bytes read while sniffing are replayed to the upstream.
+		roundTrip(t, conn, string(tc.write))
+		conn.Close()
+		if sni := <-snis; sni != tc.sni {
+			t.Errorf("%s: sni %q, want %q", tc.name, sni, tc.sni)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// controlFunc is a net.Dialer Control function.
+type controlFunc func(network, address string, c syscall.RawConn) error
+
+// proxyDialer is implemented by dialers that reach upstreams through a
+// proxy they connect to with a *net.Dialer of their own, such as the
+// SOCKS5 and HTTP CONNECT dialers. Socket controls apply to the
+// connections to the proxy.
+type proxyDialer interface {
+	Dialer
+	// forwardDialer returns the dialer connecting to the proxy.
+	forwardDialer() *net.Dialer
+	// withForwardDialer returns a copy of the dialer connecting to the
+	// proxy with forward.
+	withForwardDialer(forward *net.Dialer) Dialer
+}
+
+// WithReusePort sets SO_REUSEPORT on upstream sockets before they are
+// bound. With a fixed local address this lets several sockets share the
+// same source port, which avoids "address already in use" on rapid
+// reconnects but also changes bind semantics: the kernel no longer refuses
+// conflicting binds. Linux and BSD only.
+func WithReusePort() Option {
+	return withSockoptInt(unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+// WithReuseAddr sets SO_REUSEADDR on upstream sockets before they are
+// bound, allowing a local address in TIME_WAIT to be bound again. Linux
+// and BSD only.
+func WithReuseAddr() Option {
+	return withSockoptInt(unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+}
+
+// WithUpstreamControl runs control on every upstream socket after it is
+// created and before it connects, so any socket option can be set through
+// rawConn. Controls compose rather than replace each other: the Control
+// or ControlContext function of the dialer passed to WithDialer runs
+// first, then the socket options of this package and every
+// WithUpstreamControl in the order the options were applied. An error
+// returned by any of them aborts the dial. Requires a *net.Dialer, or a
+// SOCKS5 or HTTP CONNECT dialer, whose connections to the proxy get the
+// controls.
+func WithUpstreamControl(control func(network, address string, rawConn syscall.RawConn) error) Option {
+	return func(t *TUN) error {
+		if control == nil {
+			return errors.New("upstream control must not be nil")
+		}
+		t.dialControls = append(t.dialControls, control)
+		return nil
+	}
+}
+
+func withSockoptInt(level, opt, value int) Option {
+	return func(t *TUN) error {
+		t.dialControls = append(t.dialControls, func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), level, opt, value)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		})
+		return nil
+	}
+}
+
+// upstreamDialer returns the dialer for upstream connections with the
+// configured socket controls installed, on the dialer itself or, for a
+// proxy dialer, on the dialer connecting to the proxy. Controls run after
+// any Control or ControlContext function already set on the dialer.
+func (t *TUN) upstreamDialer() (Dialer, error) {
+	dialer := t.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if len(t.dialControls) == 0 {
+		return dialer, nil
+	}
+
+	switch d := dialer.(type) {
+	case *net.Dialer:
+		return t.withDialControls(d), nil
+	case proxyDialer:
+		return d.withForwardDialer(t.withDialControls(d.forwardDialer())), nil
+	default:
+		return nil, errors.New("upstream socket options require a *net.Dialer or a proxy dialer")
+	}
+}
+
+// withDialControls returns a copy of nd running the configured socket
+// controls after its own Control or ControlContext function.
+func (t *TUN) withDialControls(nd *net.Dialer) *net.Dialer {
+	controls := t.dialControls
+	return appendControl(nd, func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// appendControl returns a copy of nd running control after its own
+// Control function, or after its ControlContext function if it has one,
+// as net.Dialer then ignores Control.
+func appendControl(nd *net.Dialer, control controlFunc) *net.Dialer {
+	d := *nd
+	if cc := nd.ControlContext; cc != nil {
+		d.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if err := cc(ctx, network, address, c); err != nil {
+				return err
+			}
+			return control(network, address, c)
+		}
+		return &d
+	}
+	prev := nd.Control
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if prev != nil {
+			if err := prev(network, address, c); err != nil {
+				return err
+			}
+		}
+		return control(network, address, c)
+	}
+	return &d
+}
+
+// dialerControl returns the function nd runs on its sockets, or nil.
+func dialerControl(nd *net.Dialer) controlFunc {
+	if cc := nd.ControlContext; cc != nil {
+		return func(network, address string, c syscall.RawConn) error {
+			return cc(context.Background(), network, address, c)
+		}
+	}
+	return nd.Control
+}
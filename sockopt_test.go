@@ -0,0 +1,105 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestControlContext checks that the controls of the TUN and the private
+// upstream guard apply to a dialer with a ControlContext function, which
+// net.Dialer runs instead of Control.
+func TestControlContext(t *testing.T) {
+	upstream := echoServer(t)
+	var dialerRan, controlRan atomic.Int32
+	dialer := &net.Dialer{
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			dialerRan.Add(1)
+			return nil
+		},
+	}
+	opts := []Option{
+		WithDialer(dialer),
+		WithUpstreamControl(func(network, address string, c syscall.RawConn) error {
+			controlRan.Add(1)
+			return nil
+		}),
+	}
+
+	t.Run("controls", func(t *testing.T) {
+		c := startTestTUN(t, append(opts, withRedirectors(FixedRedirector(upstream), nil))...)
+		conn, err := c.dialTCP(t, testRemote(80))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		roundTrip(t, conn, "controlled")
+		if dialerRan.Load() != 1 || controlRan.Load() != 1 {
+			t.Errorf("dialer control ran %d times, upstream control %d times, want once each", dialerRan.Load(), controlRan.Load())
+		}
+	})
+
+	// The guard rejects the address before connecting, so the private
+	// upstream never sees a connection.
+	t.Run("private upstream", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer l.Close()
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		events := make(chan *Event, 16)
+		c := startTestTUN(t, append(opts,
+			withRedirectors(FixedRedirector(net.JoinHostPort("localhost", port)), nil),
+			WithBlockPrivateUpstream(),
+			withEventChannel(events),
+		)...)
+		conn, err := c.dialTCP(t, testRemote(80))
+		if err == nil {
+			defer conn.Close()
+			conn.Write([]byte("x"))
+			if _, err = conn.Read(make([]byte, 1)); err == nil {
+				t.Fatal("blocked flow was forwarded")
+			}
+		}
+		waitForEvent(t, events, EventUpstreamBlocked)
+		// A connection would be queued by now.
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+			t.Error("private upstream was connected to")
+		}
+	})
+}
+
+func TestAppendControl(t *testing.T) {
+	var order []string
+	control := func(name string) controlFunc {
+		return func(network, address string, c syscall.RawConn) error {
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	nd := appendControl(&net.Dialer{Control: control("dialer")}, control("appended"))
+	nd.Control("tcp", "192.0.2.1:80", nil)
+	if len(order) != 2 || order[0] != "dialer" || order[1] != "appended" {
+		t.Errorf("controls ran in order %v", order)
+	}
+
+	order = nil
+	cc := func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		return control("context")(network, address, c)
+	}
+	nd = appendControl(&net.Dialer{ControlContext: cc}, control("appended"))
+	if nd.Control != nil {
+		t.Error("set Control next to ControlContext")
+	}
+	dialerControl(nd)("tcp", "192.0.2.1:80", nil)
+	if len(order) != 2 || order[0] != "context" || order[1] != "appended" {
+		t.Errorf("controls ran in order %v", order)
+	}
+}
@@ -0,0 +1,360 @@
+package libmitm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var _ Dialer = (*socks5Dialer)(nil)
+
+// SOCKS5 protocol constants of RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 1
+	socks5CmdAssociate = 3
+	socks5AddrIPv4     = 1
+	socks5AddrDomain   = 3
+	socks5AddrIPv6     = 4
+)
+
+var socks5Replies = [...]string{
+	1: "general server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Socks5Auth holds the credentials for username/password authentication
+// with a SOCKS5 proxy.
+type Socks5Auth struct {
+	Username string
+	Password string
+}
+
+type socks5Dialer struct {
+	proxy   string
+	auth    *Socks5Auth
+	forward *net.Dialer
+}
+
+// NewSOCKS5Dialer returns a Dialer that reaches upstreams through the
+// SOCKS5 proxy at proxyAddr, authenticating with auth unless it is nil.
+// TCP flows are tunneled with CONNECT. UDP flows get an association of
+// their own with UDP ASSOCIATE: datagrams are relayed to the proxy's relay
+// address, and the association ends when the flow's connection is
+// closed. Host names are resolved by the proxy. forward dials the proxy
+// and its relay, or a zero net.Dialer if it is nil; as the upstream
+// dialer of a TUN, it gets the TUN's socket controls, e.g. to keep the
+// proxy connection out of the TUN.
+func NewSOCKS5Dialer(proxyAddr string, auth *Socks5Auth, forward *net.Dialer) Dialer {
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	return &socks5Dialer{proxy: proxyAddr, auth: auth, forward: forward}
+}
+
+func (d *socks5Dialer) forwardDialer() *net.Dialer {
+	return d.forward
+}
+
+func (d *socks5Dialer) withForwardDialer(forward *net.Dialer) Dialer {
+	c := *d
+	c.forward = forward
+	return &c
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var cmd byte
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		cmd = socks5CmdConnect
+	case "udp", "udp4", "udp6":
+		cmd = socks5CmdAssociate
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network %q", network)
+	}
+	target, err := appendSocks5Addr(nil, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	request := target
+	if cmd == socks5CmdAssociate {
+		// The address datagrams will come from is not known before the
+		// relay socket is bound.
+		request = []byte{socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	bound, err := d.handshake(ctx, conn, cmd, request)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 %s via %s: %w", address, d.proxy, err)
+	}
+	if cmd == socks5CmdConnect {
+		return conn, nil
+	}
+
+	relay, err := socks5RelayAddr(bound, conn.RemoteAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pc, err := d.forward.DialContext(ctx, "udp", relay)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &socks5UDPConn{Conn: pc, ctrl: conn, header: append([]byte{0, 0, 0}, target...)}, nil
+}
+
+// handshake authenticates on conn and sends the request cmd for target.
+// It returns the bound address of the reply.
+func (d *socks5Dialer) handshake(ctx context.Context, conn net.Conn, cmd byte, target []byte) (string, error) {
+	defer watchHandshake(ctx, conn)()
+
+	methods := []byte{socks5Version, 1, socks5AuthNone}
+	if d.auth != nil {
+		methods = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return "", err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return "", err
+	}
+	if resp[0] != socks5Version {
+		return "", fmt.Errorf("unexpected protocol version %d", resp[0])
+	}
+	switch resp[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if d.auth == nil {
+			return "", errors.New("proxy requires authentication")
+		}
+		if err := d.authenticate(conn); err != nil {
+			return "", err
+		}
+	case socks5NoAcceptable:
+		return "", errors.New("no acceptable authentication method")
+	default:
+		return "", fmt.Errorf("unexpected authentication method %d", resp[1])
+	}
+
+	req := append([]byte{socks5Version, cmd, 0}, target...)
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return "", err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socks5Replies) {
+			return "", errors.New(socks5Replies[reply[1]])
+		}
+		return "", fmt.Errorf("request failed with code %d", reply[1])
+	}
+	return readSocks5Addr(conn, reply[3])
+}
+
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	u, p := d.auth.Username, d.auth.Password
+	if len(u) > 255 || len(p) > 255 {
+		return errors.New("username or password too long")
+	}
+	b := []byte{1, byte(len(u))}
+	b = append(b, u...)
+	b = append(b, byte(len(p)))
+	b = append(b, p...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// watchHandshake applies the deadline and cancellation of ctx to conn
+// until the returned function is called.
+func watchHandshake(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// appendSocks5Addr appends address in the ATYP, address and port format of
+// SOCKS5 requests.
+func appendSocks5Addr(b []byte, address string) ([]byte, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port in %q", address)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: host name too long in %q", address)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socks5AddrIPv4), ip4...)
+	} else {
+		b = append(append(b, socks5AddrIPv6), ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocks5Addr reads an address of type atyp from r.
+func readSocks5Addr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown address type %d", atyp)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socks5RelayAddr returns the address to send datagrams to for the bound
+// address of a UDP ASSOCIATE reply. An unspecified host stands for the
+// proxy itself.
+func socks5RelayAddr(bound string, proxy net.Addr) (string, error) {
+	host, port, err := net.SplitHostPort(bound)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if host, _, err = net.SplitHostPort(proxy.String()); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// socks5UDPConn is a UDP association with a single target. Every datagram
+// written is prefixed with the target's header; datagrams read have their
+// header stripped.
+type socks5UDPConn struct {
+	net.Conn
+	// ctrl is the TCP connection the association lives as long as.
+	ctrl   net.Conn
+	header []byte
+	buf    []byte
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(append(c.header[:len(c.header):len(c.header)], b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	if c.buf == nil {
+		c.buf = make([]byte, 65535)
+	}
+	for {
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		payload, ok := socks5UDPPayload(c.buf[:n])
+		if ok {
+			return copy(b, payload), nil
+		}
+	}
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
+
+// socks5UDPPayload strips the header of a relayed datagram, dropping
+// fragments, which are not supported.
+func socks5UDPPayload(b []byte) ([]byte, bool) {
+	if len(b) < 4 || b[2] != 0 {
+		return nil, false
+	}
+	off := 4
+	switch b[3] {
+	case socks5AddrIPv4:
+		off += net.IPv4len
+	case socks5AddrIPv6:
+		off += net.IPv6len
+	case socks5AddrDomain:
+		if len(b) < 5 {
+			return nil, false
+		}
+		off += 1 + int(b[4])
+	default:
+		return nil, false
+	}
+	off += 2
+	if off > len(b) {
+		return nil, false
+	}
+	return b[off:], true
+}
@@ -0,0 +1,292 @@
+package libmitm
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// socks5Server is a minimal SOCKS5 proxy supporting CONNECT and UDP
+// ASSOCIATE, optionally with username/password authentication.
+type socks5Server struct {
+	addr string
+	auth *Socks5Auth
+	// targets receives the target address of every request.
+	targets chan string
+}
+
+func startSOCKS5Server(t *testing.T, auth *Socks5Auth) *socks5Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &socks5Server{addr: l.Addr().String(), auth: auth, targets: make(chan string, 16)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) serve(c net.Conn) {
+	defer c.Close()
+	var head [2]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+	if s.auth == nil {
+		c.Write([]byte{socks5Version, socks5AuthNone})
+	} else {
+		c.Write([]byte{socks5Version, socks5AuthPassword})
+		var b [256]byte
+		io.ReadFull(c, b[:2])
+		user := make([]byte, b[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, b[:1])
+		pass := make([]byte, b[0])
+		io.ReadFull(c, pass)
+		if string(user) != s.auth.Username || string(pass) != s.auth.Password {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return
+	}
+	target, err := readSocks5Addr(c, req[3])
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case socks5CmdConnect:
+		s.targets <- target
+		up, err := net.Dial("tcp", target)
+		if err != nil {
+			c.Write([]byte{socks5Version, 5, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer up.Close()
+		c.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(up, c)
+		io.Copy(c, up)
+	case socks5CmdAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		bound, _ := appendSocks5Addr([]byte{socks5Version, 0, 0}, relay.LocalAddr().String())
+		c.Write(bound)
+		go s.relay(relay)
+		// The association ends with the control connection.
+		io.Copy(io.Discard, c)
+	}
+}
+
+// relay forwards the datagrams of one client through pc.
+func (s *socks5Server) relay(pc net.PacketConn) {
+	up, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer up.Close()
+	var client atomic.Value
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, from, err := up.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			reply, _ := appendSocks5Addr([]byte{0, 0, 0}, from.String())
+			if to, ok := client.Load().(net.Addr); ok {
+				pc.WriteTo(append(reply, b[:n]...), to)
+			}
+		}
+	}()
+	b := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		client.Store(from)
+		payload, ok := socks5UDPPayload(b[:n])
+		if !ok {
+			continue
+		}
+		target, err := readSocks5Addr(strings.NewReader(string(b[4:n])), b[3])
+		if err != nil {
+			continue
+		}
+		s.targets <- target
+		addr, err := net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			continue
+		}
+		up.WriteTo(payload, addr)
+	}
+}
+
+func TestSOCKS5TCP(t *testing.T) {
+	upstream := echoServer(t)
+	auth := &Socks5Auth{Username: "user", Password: "secret"}
+	proxy := startSOCKS5Server(t, auth)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithDialer(NewSOCKS5Dialer(proxy.addr, auth, nil)),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "through the proxy")
+	if target := <-proxy.targets; target != upstream {
+		t.Errorf("proxy connected to %s, want %s", target, upstream)
+	}
+}
+
+func TestSOCKS5UDP(t *testing.T) {
+	upstream := udpEchoServer(t)
+	proxy := startSOCKS5Server(t, nil)
+	c := startTestTUN(t,
+		withRedirectors(nil, FixedRedirector(upstream)),
+		WithDialer(NewSOCKS5Dialer(proxy.addr, nil, nil)),
+	)
+
+	conn := c.dialUDP(t, testRemote(5000))
+	roundTrip(t, conn, "first")
+	roundTrip(t, conn, "second")
+	if target := <-proxy.targets; target != upstream {
+		t.Errorf("proxy relayed to %s, want %s", target, upstream)
+	}
+}
+
+func TestSOCKS5AuthFailure(t *testing.T) {
+	proxy := startSOCKS5Server(t, &Socks5Auth{Username: "user", Password: "secret"})
+	d := NewSOCKS5Dialer(proxy.addr, &Socks5Auth{Username: "user", Password: "wrong"}, nil)
+	if _, err := d.DialContext(context.Background(), "tcp", "192.0.2.1:80"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("dial with wrong password: %v, want authentication failure", err)
+	}
+}
+
+// TestSOCKS5ForwardControls checks that socket controls apply to the
+// connection to the proxy.
+func TestSOCKS5ForwardControls(t *testing.T) {
+	upstream := echoServer(t)
+	proxy := startSOCKS5Server(t, nil)
+	var mu sync.Mutex
+	var controlled []string
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithDialer(NewSOCKS5Dialer(proxy.addr, nil, nil)),
+		WithUpstreamControl(func(network, address string, _ syscall.RawConn) error {
+			mu.Lock()
+			defer mu.Unlock()
+			controlled = append(controlled, address)
+			return nil
+		}),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "controlled")
+	mu.Lock()
+	defer mu.Unlock()
+	if len(controlled) != 1 || controlled[0] != proxy.addr {
+		t.Errorf("controls ran for %v, want the proxy %s", controlled, proxy.addr)
+	}
+}
+
+// TestSOCKS5PrivateUpstream checks that the private upstream guard checks
+// the target of a proxied flow rather than the proxy, which is on the
+// loopback.
+func TestSOCKS5PrivateUpstream(t *testing.T) {
+	upstream := echoServer(t)
+	_, port, _ := net.SplitHostPort(upstream)
+	target := net.JoinHostPort("localhost", port)
+
+	t.Run("blocked", func(t *testing.T) {
+		proxy := startSOCKS5Server(t, nil)
+		events := make(chan *Event, 16)
+		c := startTestTUN(t,
+			withRedirectors(FixedRedirector(target), nil),
+			WithDialer(NewSOCKS5Dialer(proxy.addr, nil, nil)),
+			WithBlockPrivateUpstream(),
+			withEventChannel(events),
+		)
+		conn, err := c.dialTCP(t, testRemote(80))
+		if err == nil {
+			defer conn.Close()
+			conn.Write([]byte("x"))
+			if _, err = conn.Read(make([]byte, 1)); err == nil {
+				t.Fatal("blocked flow was forwarded")
+			}
+		}
+		waitForEvent(t, events, EventUpstreamBlocked)
+		select {
+		case target := <-proxy.targets:
+			t.Errorf("proxy was asked to connect to %s", target)
+		default:
+		}
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		proxy := startSOCKS5Server(t, nil)
+		c := startTestTUN(t,
+			withRedirectors(FixedRedirector(target), nil),
+			WithDialer(NewSOCKS5Dialer(proxy.addr, nil, nil)),
+			WithBlockPrivateUpstream("127.0.0.1"),
+		)
+		conn, err := c.dialTCP(t, testRemote(80))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		roundTrip(t, conn, "allowed")
+		// The proxy connects to the address that was checked.
+		if got := <-proxy.targets; got != upstream {
+			t.Errorf("proxy connected to %s, want %s", got, upstream)
+		}
+	})
+}
+
+func TestSOCKS5Addr(t *testing.T) {
+	for _, addr := range []string{"192.0.2.1:80", "[2001:db8::1]:443", "example.com:53"} {
+		b, err := appendSocks5Addr(nil, addr)
+		if err != nil {
+			t.Fatalf("append %s: %v", addr, err)
+		}
+		got, err := readSocks5Addr(strings.NewReader(string(b[1:])), b[0])
+		if err != nil || got != addr {
+			t.Errorf("read back %s: %q, %v", addr, got, err)
+		}
+	}
+	if _, err := appendSocks5Addr(nil, "192.0.2.1:http"); err == nil {
+		t.Error("appended an address with a named port")
+	}
+}
@@ -0,0 +1,58 @@
+package libmitm
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// sourceLimitIdle is how long the limiter of a source is kept after it was
+// last used.
+const sourceLimitIdle = time.Minute
+
+// sourceLimiter keeps a token bucket per source address.
+type sourceLimiter struct {
+	perSecond rate.Limit
+	burst     int
+
+	mu      sync.Mutex
+	sources map[tcpip.Address]*sourceLimit
+	pruned  time.Time
+}
+
+type sourceLimit struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+func (l *sourceLimiter) enabled() bool {
+	return l.burst > 0
+}
+
+// allow reports whether src may perform another event now.
+func (l *sourceLimiter) allow(src tcpip.Address) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.pruned) > sourceLimitIdle {
+		for addr, s := range l.sources {
+			if now.Sub(s.seen) > sourceLimitIdle {
+				delete(l.sources, addr)
+			}
+		}
+		l.pruned = now
+	}
+	if l.sources == nil {
+		l.sources = make(map[tcpip.Address]*sourceLimit)
+	}
+	s := l.sources[src]
+	if s == nil {
+		s = &sourceLimit{limiter: rate.NewLimiter(l.perSecond, l.burst)}
+		l.sources[src] = s
+	}
+	s.seen = now
+	return s.limiter.AllowN(now, 1)
+}
@@ -6,26 +6,65 @@ import (
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
 
-func (t *TUN) createStack(options stack.Options, endpoint stack.LinkEndpoint, dialer *net.Dialer) (*stack.Stack, error) {
+func (t *TUN) createStack(options stack.Options, endpoint stack.LinkEndpoint, dialer Dialer) (*stack.Stack, error) {
 
 	s := stack.New(options)
 
 	// Generate unique NIC id.
 	nicID := tcpip.NICID(s.UniqueID())
+	t.nicID = nicID
+
+	// Capture packets as they cross the TUN, before any other wrapper.
+	endpoint = &captureEndpoint{LinkEndpoint: endpoint, capture: &t.capture}
+
+	if t.routeObserver != nil {
+		endpoint = &routeObservingEndpoint{LinkEndpoint: endpoint, nicID: nicID, observer: t.routeObserver}
+	}
+
+	if t.icmpHandler != nil || t.icmpEcho != nil {
+		if t.icmpEcho != nil {
+			if nd, ok := dialer.(*net.Dialer); ok {
+				t.icmpEcho.control = dialerControl(nd)
+			}
+		}
+		endpoint = &icmpEndpoint{LinkEndpoint: endpoint, handler: t.icmpHandler, echo: t.icmpEcho}
+	}
+	if t.udpChecksum.policy != UDPChecksumStack {
+		endpoint = &udpChecksumEndpoint{LinkEndpoint: endpoint, config: &t.udpChecksum}
+	}
+	if t.ipIDMode != IPIDStack {
+		endpoint = newIPIDEndpoint(endpoint, t.ipIDMode)
+	}
+
+	var qdisc stack.QueueingDiscipline
+	if t.priorityQueueLen > 0 {
+		t.priority = newPriorityQDisc(endpoint, t.priorityQueueLen)
+		qdisc = t.priority
+	}
+
+	// Important: We must initiate transport protocol handlers
+	// before creating NIC, otherwise NIC would dispatch packets
+	// to stack and cause race condition.
+	// Initiate transport protocol (TCP/UDP) with given handler.
+	tcpHandler, udpHandler := t.withTCPHandler(dialer), t.withUDPHandler(dialer)
+	if t.tcpDisabled {
+		tcpHandler = withDroppedTransport(tcp.ProtocolNumber)
+	}
+	if t.udpDisabled {
+		udpHandler = withDroppedTransport(udp.ProtocolNumber)
+	}
 
 	opts := []option.Option{option.WithDefault()}
 	opts = append(opts,
-		// Important: We must initiate transport protocol handlers
-		// before creating NIC, otherwise NIC would dispatch packets
-		// to stack and cause race condition.
-		// Initiate transport protocol (TCP/UDP) with given handler.
-		withTCPHandler(dialer, t.TcpRedirector, t.TcpEstablishHandler),
-		withUDPHandler(dialer, t.UdpRedirector, t.UdpEstablishHandler),
+		tcpHandler,
+		udpHandler,
 
 		// Create stack NIC and then bind link endpoint to it.
-		option.WithCreatingNIC(nicID, endpoint),
+		option.WithCreatingNICQDisc(nicID, endpoint, qdisc),
 
 		// In the past we did s.AddAddressRange to assign 0.0.0.0/0
 		// onto the interface. We need that to be able to terminate
@@ -49,6 +88,11 @@ func (t *TUN) createStack(options stack.Options, endpoint stack.LinkEndpoint, di
 		//
 		// Ref: https://github.com/google/gvisor/commit/8c0701462a84ff77e602f1626aec49479c308127
 		option.WithSpoofing(nicID, option.NicSpoofingEnabled),
+	)
+	for _, addr := range t.ipv6Addrs {
+		opts = append(opts, option.WithProtocolAddress(nicID, addr))
+	}
+	opts = append(opts,
 
 		// Add default route table for IPv4 and IPv6. This will handle
 		// all incoming ICMP packets.
@@ -0,0 +1,89 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// errNotStarted is returned by methods that need the stack before Start.
+var errNotStarted = errors.New("tun is not started")
+
+// Stack returns the gVisor stack of the TUN, or nil before Start, for
+// configuration this package does not wrap. The TUN's NIC is NICID.
+//
+// The stack is live once Start returns. Routes, addresses, protocol and
+// NIC options, and statistics are safe to change or read at any time;
+// changes apply to packets handled afterwards. The transport protocol
+// handlers of TCP and UDP belong to the TUN and must not be replaced, nor
+// may the NIC be removed, disabled or made non-promiscuous, or forwarding
+// stops. Handlers for other transport protocols can be registered, and
+// NICs added, at any time. The stack must not be closed; use Close.
+func (t *TUN) Stack() *stack.Stack {
+	return t.stack
+}
+
+// NICID returns the ID of the TUN's NIC in Stack, or 0 before Start.
+func (t *TUN) NICID() int32 {
+	return int32(t.nicID)
+}
+
+// AddRoute routes the destinations of cidr, such as "10.0.0.0/8", to the
+// TUN's NIC ahead of the default routes. Routes are kept ordered from the
+// longest prefix to the shortest, so the most specific one matches.
+func (t *TUN) AddRoute(cidr string) error {
+	if t.stack == nil {
+		return errNotStarted
+	}
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ip := prefix.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	subnet, err := tcpip.NewSubnet(tcpip.Address(ip), tcpip.AddressMask(prefix.Mask))
+	if err != nil {
+		return fmt.Errorf("route %s: %w", cidr, err)
+	}
+	if len(ip) == net.IPv4len && t.IPv6Config == IPv6Only || len(ip) == net.IPv6len && t.IPv6Config == IPv6Disable {
+		return fmt.Errorf("route %s: address family is disabled", cidr)
+	}
+
+	route := tcpip.Route{Destination: subnet, NIC: t.nicID}
+	t.routeMu.Lock()
+	defer t.routeMu.Unlock()
+	table := t.stack.GetRouteTable()
+	i := 0
+	for i < len(table) && table[i].Destination.Prefix() >= subnet.Prefix() {
+		i++
+	}
+	table = append(table[:i], append([]tcpip.Route{route}, table[i:]...)...)
+	t.stack.SetRouteTable(table)
+	return nil
+}
+
+// AddAddress assigns the IPv4 or IPv6 address and prefix length of cidr,
+// such as "10.0.0.2/24", to the TUN's NIC. See WithIPv6Addresses for why
+// an address may be needed.
+func (t *TUN) AddAddress(cidr string) error {
+	if t.stack == nil {
+		return errNotStarted
+	}
+	addr, err := parseProtocolAddress(cidr)
+	if err != nil {
+		return err
+	}
+	if addr.Protocol == header.IPv4ProtocolNumber && t.IPv6Config == IPv6Only || addr.Protocol == header.IPv6ProtocolNumber && t.IPv6Config == IPv6Disable {
+		return fmt.Errorf("address %s: address family is disabled", cidr)
+	}
+	if err := t.stack.AddProtocolAddress(t.nicID, addr, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("add address %s: %s", cidr, err)
+	}
+	return nil
+}
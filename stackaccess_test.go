@@ -0,0 +1,111 @@
+package libmitm
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// TestStackAccessNotStarted checks that the stack is not reachable before
+// Start.
+func TestStackAccessNotStarted(t *testing.T) {
+	var tun TUN
+	if tun.Stack() != nil || tun.NICID() != 0 {
+		t.Error("stack or NIC before start")
+	}
+	if err := tun.AddRoute("10.0.0.0/8"); !errors.Is(err, errNotStarted) {
+		t.Errorf("route before start: %v, want %v", err, errNotStarted)
+	}
+	if err := tun.AddAddress("10.0.0.2/8"); !errors.Is(err, errNotStarted) {
+		t.Errorf("address before start: %v, want %v", err, errNotStarted)
+	}
+}
+
+// TestAddRoute checks that routes are kept from the longest prefix to the
+// shortest and that flows are forwarded through an added route.
+func TestAddRoute(t *testing.T) {
+	errs := make(errorChannel, 4)
+	c := startTestTUN(t,
+		withRedirectors(nil, FixedRedirector(udpEchoServer(t))),
+		func(t *TUN) error { t.ErrorHandler = errs; return nil },
+	)
+	c.tun.Stack().SetRouteTable(nil)
+
+	// Without a route to the client its flows cannot be answered.
+	c.dialUDP(t, testRemote(5000)).Write([]byte("unrouted"))
+	select {
+	case <-errs:
+	case <-time.After(testTimeout):
+		t.Fatal("flow created without a route")
+	}
+
+	for _, cidr := range []string{"10.0.0.0/8", "0.0.0.0/0", "10.0.0.0/24", "fd00::/64", "10.0.0.0/16"} {
+		if err := c.tun.AddRoute(cidr); err != nil {
+			t.Fatalf("route %s: %v", cidr, err)
+		}
+	}
+	var prefixes []int
+	for _, r := range c.tun.Stack().GetRouteTable() {
+		if r.NIC != c.tun.nicID {
+			t.Errorf("route %s on NIC %d", r.Destination, r.NIC)
+		}
+		prefixes = append(prefixes, r.Destination.Prefix())
+	}
+	want := []int{64, 24, 16, 8, 0}
+	if len(prefixes) != len(want) {
+		t.Fatalf("route prefixes %v, want %v", prefixes, want)
+	}
+	for i := range want {
+		if prefixes[i] != want[i] {
+			t.Fatalf("route prefixes %v, want %v", prefixes, want)
+		}
+	}
+	roundTrip(t, c.dialUDP(t, testRemote(5000)), "routed")
+
+	if err := c.tun.AddRoute("10.0.0.0"); err == nil {
+		t.Error("accepted an address without a prefix length")
+	}
+}
+
+// TestAddAddress checks that the stack sends from an added address.
+func TestAddAddress(t *testing.T) {
+	c := startTestTUN(t)
+	listener, err := gonet.DialUDP(c.stack, &tcpip.FullAddress{NIC: 1, Port: 7000}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	client := &tcpip.FullAddress{NIC: c.tun.nicID, Addr: tcpip.Address(net.ParseIP(testClientAddr).To4()), Port: 7000}
+
+	// The stack owns no IPv4 address to send from.
+	if conn, err := gonet.DialUDP(c.tun.Stack(), nil, client, ipv4.ProtocolNumber); err == nil {
+		conn.Close()
+		t.Fatal("sent without an address")
+	}
+
+	if err := c.tun.AddAddress("10.0.0.2/8"); err != nil {
+		t.Fatalf("address: %v", err)
+	}
+	conn, err := gonet.DialUDP(c.tun.Stack(), nil, client, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("dial from the added address: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("from the stack")); err != nil {
+		t.Fatal(err)
+	}
+	listener.SetDeadline(time.Now().Add(testTimeout))
+	b := make([]byte, 64)
+	n, from, err := listener.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(b[:n]) != "from the stack" || from.(*net.UDPAddr).IP.String() != "10.0.0.2" {
+		t.Errorf("got %q from %s, want it from 10.0.0.2", b[:n], from)
+	}
+}
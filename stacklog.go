@@ -0,0 +1,56 @@
+package libmitm
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	glog "gvisor.dev/gvisor/pkg/log"
+)
+
+// Verbosity levels of the gVisor stack logger.
+const (
+	StackLogWarning = int(glog.Warning)
+	StackLogInfo    = int(glog.Info)
+	StackLogDebug   = int(glog.Debug)
+)
+
+type stackLogConfig struct {
+	logger *log.Logger
+	level  glog.Level
+}
+
+// WithStackLog routes the gVisor stack's internal log to l, keeping
+// messages up to the given verbosity. The netstack logs little: warnings
+// from the gonet adapters (e.g. failing to resolve an endpoint's remote
+// address), fragment reassembly accounting errors and, at debug level,
+// iptables error targets. Dropped and malformed packets are not logged
+// but counted in the stack statistics.
+//
+// gVisor's logger is process wide, so the last TUN started wins.
+func WithStackLog(l *log.Logger, level int) Option {
+	return func(t *TUN) error {
+		if level < StackLogWarning || level > StackLogDebug {
+			return fmt.Errorf("stack log: unknown level %d", level)
+		}
+		t.stackLog = stackLogConfig{logger: l, level: glog.Level(level)}
+		return nil
+	}
+}
+
+func (c *stackLogConfig) install() {
+	if c.logger == nil {
+		return
+	}
+	glog.SetTarget(&stackLogEmitter{logger: c.logger})
+	glog.SetLevel(c.level)
+}
+
+// stackLogEmitter implements glog.Emitter on top of a standard logger.
+type stackLogEmitter struct {
+	logger *log.Logger
+}
+
+func (e *stackLogEmitter) Emit(_ int, level glog.Level, _ time.Time, format string, v ...any) {
+	e.logger.Printf("gvisor %s: %s", level, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,108 @@
+package libmitm
+
+// StackStats is a snapshot of the counters of a TUN's network stack and
+// link endpoint. Counters are cumulative since Start unless noted.
+type StackStats struct {
+	// IPPacketsReceived counts the IP packets read from the TUN, and
+	// IPPacketsDelivered those handed to a transport protocol.
+	// IPPacketsSent counts the IP packets written to the TUN.
+	IPPacketsReceived  int64
+	IPPacketsDelivered int64
+	IPPacketsSent      int64
+	// IPMalformedPacketsReceived counts received IP packets with an
+	// invalid header, and IPOutgoingPacketErrors packets that could not
+	// be written.
+	IPMalformedPacketsReceived int64
+	IPOutgoingPacketErrors     int64
+	// DroppedPackets counts packets dropped by the transport layer.
+	DroppedPackets int64
+
+	// TCPConnectionsAccepted counts TCP connections from clients.
+	// TCPCurrentEstablished is the number of connections currently
+	// established.
+	TCPConnectionsAccepted int64
+	TCPCurrentEstablished  int64
+	// TCPEstablishedResets counts established connections reset, and
+	// TCPFailedConnectionAttempts handshakes that did not complete.
+	TCPEstablishedResets        int64
+	TCPFailedConnectionAttempts int64
+	// TCPResetsSent and TCPResetsReceived count RST segments.
+	TCPResetsSent     int64
+	TCPResetsReceived int64
+	// TCPInvalidSegmentsReceived counts malformed segments,
+	// TCPRetransmits retransmitted segments and TCPTimeouts
+	// retransmission timeouts.
+	TCPInvalidSegmentsReceived int64
+	TCPRetransmits             int64
+	TCPTimeouts                int64
+
+	// UDPPacketsReceived and UDPPacketsSent count datagrams.
+	UDPPacketsReceived int64
+	UDPPacketsSent     int64
+	// UDPReceiveBufferErrors counts datagrams dropped for a full receive
+	// buffer, and UDPMalformedPacketsReceived malformed datagrams.
+	UDPReceiveBufferErrors      int64
+	UDPMalformedPacketsReceived int64
+
+	// ICMPEchoRequestsReceived counts ICMPv4 and ICMPv6 echo requests
+	// from clients and ICMPEchoRepliesSent the replies of the stack.
+	ICMPEchoRequestsReceived int64
+	ICMPEchoRepliesSent      int64
+	// ICMPDestinationUnreachableSent counts the destination unreachable
+	// messages sent to clients, and ICMPInvalidReceived invalid ICMP
+	// messages.
+	ICMPDestinationUnreachableSent int64
+	ICMPInvalidReceived            int64
+
+	// LinkMalformedPackets and LinkUnknownVersionPackets count packets the
+	// link endpoint dropped before they reached the stack, and
+	// LinkReadRetries its reads retried after a transient condition.
+	LinkMalformedPackets      int64
+	LinkUnknownVersionPackets int64
+	LinkReadRetries           int64
+}
+
+// Stats returns a snapshot of the counters of the network stack and the
+// link endpoint, or zeros before Start.
+func (t *TUN) Stats() StackStats {
+	var st StackStats
+	if t.stack == nil {
+		return st
+	}
+	s := t.stack.Stats()
+	st.IPPacketsReceived = int64(s.IP.PacketsReceived.Value())
+	st.IPPacketsDelivered = int64(s.IP.PacketsDelivered.Value())
+	st.IPPacketsSent = int64(s.IP.PacketsSent.Value())
+	st.IPMalformedPacketsReceived = int64(s.IP.MalformedPacketsReceived.Value())
+	st.IPOutgoingPacketErrors = int64(s.IP.OutgoingPacketErrors.Value())
+	st.DroppedPackets = int64(s.DroppedPackets.Value())
+
+	st.TCPConnectionsAccepted = int64(s.TCP.PassiveConnectionOpenings.Value())
+	st.TCPCurrentEstablished = int64(s.TCP.CurrentEstablished.Value())
+	st.TCPEstablishedResets = int64(s.TCP.EstablishedResets.Value())
+	st.TCPFailedConnectionAttempts = int64(s.TCP.FailedConnectionAttempts.Value())
+	st.TCPResetsSent = int64(s.TCP.ResetsSent.Value())
+	st.TCPResetsReceived = int64(s.TCP.ResetsReceived.Value())
+	st.TCPInvalidSegmentsReceived = int64(s.TCP.InvalidSegmentsReceived.Value())
+	st.TCPRetransmits = int64(s.TCP.Retransmits.Value())
+	st.TCPTimeouts = int64(s.TCP.Timeouts.Value())
+
+	st.UDPPacketsReceived = int64(s.UDP.PacketsReceived.Value())
+	st.UDPPacketsSent = int64(s.UDP.PacketsSent.Value())
+	st.UDPReceiveBufferErrors = int64(s.UDP.ReceiveBufferErrors.Value())
+	st.UDPMalformedPacketsReceived = int64(s.UDP.MalformedPacketsReceived.Value())
+
+	v4, v6 := s.ICMP.V4, s.ICMP.V6
+	st.ICMPEchoRequestsReceived = int64(v4.PacketsReceived.EchoRequest.Value() + v6.PacketsReceived.EchoRequest.Value())
+	st.ICMPEchoRepliesSent = int64(v4.PacketsSent.EchoReply.Value() + v6.PacketsSent.EchoReply.Value())
+	st.ICMPDestinationUnreachableSent = int64(v4.PacketsSent.DstUnreachable.Value() + v6.PacketsSent.DstUnreachable.Value())
+	st.ICMPInvalidReceived = int64(v4.PacketsReceived.Invalid.Value() + v6.PacketsReceived.Invalid.Value())
+
+	if t.link != nil {
+		ls := t.link.Stats()
+		st.LinkMalformedPackets = int64(ls.Malformed)
+		st.LinkUnknownVersionPackets = int64(ls.UnknownVersion)
+		st.LinkReadRetries = int64(ls.ReadRetries)
+	}
+	return st
+}
@@ -0,0 +1,66 @@
+package libmitm
+
+import "testing"
+
+// TestStatsLinkDrops checks that packets the link endpoint drops show in
+// the TUN's stats.
+func TestStatsLinkDrops(t *testing.T) {
+	tun, ep := startRawTUN(t)
+	before := tun.Stats()
+
+	ep.InjectInbound([]byte{0x45, 0, 0, 20})
+	ep.InjectInbound(append([]byte{0x50}, make([]byte, 39)...))
+
+	st := tun.Stats()
+	if got := st.LinkMalformedPackets - before.LinkMalformedPackets; got != 1 {
+		t.Errorf("%d malformed packets counted, want 1", got)
+	}
+	if got := st.LinkUnknownVersionPackets - before.LinkUnknownVersionPackets; got != 1 {
+		t.Errorf("%d packets of unknown version counted, want 1", got)
+	}
+	if st.IPPacketsReceived != before.IPPacketsReceived {
+		t.Errorf("stack received %d dropped packets", st.IPPacketsReceived-before.IPPacketsReceived)
+	}
+}
+
+// TestStats checks that a snapshot is zero before Start and that TCP and
+// UDP traffic moves the IP, TCP and UDP counters.
+func TestStats(t *testing.T) {
+	var idle TUN
+	if st := idle.Stats(); st != (StackStats{}) {
+		t.Errorf("stats before start %+v, want zeros", st)
+	}
+
+	c := startTestTUN(t, withRedirectors(FixedRedirector(echoServer(t)), FixedRedirector(udpEchoServer(t))))
+	before := c.tun.Stats()
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	roundTrip(t, conn, "hello")
+	conn.Close()
+	udp := c.dialUDP(t, testRemote(53))
+	roundTrip(t, udp, "hello")
+	udp.Close()
+
+	st := c.tun.Stats()
+	for _, tc := range []struct {
+		name          string
+		before, after int64
+	}{
+		{"IPPacketsReceived", before.IPPacketsReceived, st.IPPacketsReceived},
+		{"IPPacketsDelivered", before.IPPacketsDelivered, st.IPPacketsDelivered},
+		{"IPPacketsSent", before.IPPacketsSent, st.IPPacketsSent},
+		{"TCPConnectionsAccepted", before.TCPConnectionsAccepted, st.TCPConnectionsAccepted},
+		{"UDPPacketsReceived", before.UDPPacketsReceived, st.UDPPacketsReceived},
+		{"UDPPacketsSent", before.UDPPacketsSent, st.UDPPacketsSent},
+	} {
+		if tc.after <= tc.before {
+			t.Errorf("%s did not increase from %d", tc.name, tc.before)
+		}
+	}
+	if st.TCPConnectionsAccepted-before.TCPConnectionsAccepted != 1 {
+		t.Errorf("%d TCP connections accepted, want 1", st.TCPConnectionsAccepted-before.TCPConnectionsAccepted)
+	}
+}
@@ -0,0 +1,97 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+type handshakeLimit struct {
+	global    *rate.Limiter
+	perSource sourceLimiter
+
+	dropped atomic.Int64
+}
+
+// WithMaxHandshakeRate limits how fast the TCP forwarder accepts new
+// handshakes across all clients to perSecond, with bursts of up to burst
+// handshakes. SYNs over the limit are dropped silently, without a RST, so
+// a flood looks like packet loss and legitimate clients retransmit their
+// SYN after a second or more.
+//
+// Since that retransmission delay is noticeable, burst should cover the
+// connections an app opens at once, e.g. when a browser loads a page;
+// perSecond then only needs to cover the sustained connection rate.
+func WithMaxHandshakeRate(perSecond float64, burst int) Option {
+	return func(t *TUN) error {
+		if perSecond <= 0 || burst <= 0 {
+			return errors.New("handshake rate and burst must be positive")
+		}
+		t.handshakeLimit.global = rate.NewLimiter(rate.Limit(perSecond), burst)
+		return nil
+	}
+}
+
+// WithMaxHandshakeRatePerSource is like WithMaxHandshakeRate, but applies
+// the limit to each source IP separately. Both limits can be combined.
+func WithMaxHandshakeRatePerSource(perSecond float64, burst int) Option {
+	return func(t *TUN) error {
+		if perSecond <= 0 || burst <= 0 {
+			return errors.New("handshake rate and burst must be positive")
+		}
+		t.handshakeLimit.perSource = sourceLimiter{perSecond: rate.Limit(perSecond), burst: burst}
+		return nil
+	}
+}
+
+// maxConnAttemptsLimit bounds WithMaxConnAttempts.
+const maxConnAttemptsLimit = 1 << 16
+
+// WithMaxConnAttempts sets how many TCP connection attempts the forwarder
+// handles at once, 2048 by default; SYNs beyond it are dropped silently,
+// so clients retransmit them later. An attempt lasts from its SYN until
+// the handshake completed or failed, including the time spent waiting on
+// an AcceptCallback, and each holds a goroutine, the SYN and the state of
+// a half-open endpoint, a few KiB in all. Memory-constrained embeds can
+// lower n to bound that memory under a SYN burst, at the cost of stalling
+// legitimate connections during one; busy servers can raise it up to
+// 65536.
+func WithMaxConnAttempts(n int) Option {
+	return func(t *TUN) error {
+		if n <= 0 || n > maxConnAttemptsLimit {
+			return fmt.Errorf("max connection attempts must be between 1 and %d", maxConnAttemptsLimit)
+		}
+		t.connAttempts = n
+		return nil
+	}
+}
+
+// maxConnAttempts returns the in-flight limit of the TCP forwarder.
+func (t *TUN) maxConnAttempts() int {
+	if t.connAttempts == 0 {
+		return defaultMaxConnAttempts
+	}
+	return t.connAttempts
+}
+
+// HandshakesDropped returns the number of SYNs dropped by the handshake
+// rate limits.
+func (t *TUN) HandshakesDropped() int64 {
+	return t.handshakeLimit.dropped.Load()
+}
+
+// allow reports whether a handshake from src may proceed.
+func (h *handshakeLimit) allow(src tcpip.Address) bool {
+	if h.perSource.enabled() && !h.perSource.allow(src) {
+		h.dropped.Add(1)
+		return false
+	}
+	if h.global != nil && !h.global.Allow() {
+		h.dropped.Add(1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package libmitm
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// TestMaxConnAttempts checks that SYNs beyond the in-flight limit are not
+// handled until an attempt completes.
+func TestMaxConnAttempts(t *testing.T) {
+	const limit = 2
+	upstream := echoServer(t)
+	var handled atomic.Int32
+	gate := make(chan struct{})
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(upstream), nil),
+		WithMaxConnAttempts(limit),
+		// Attempts stay in flight until the gate opens.
+		WithAcceptCallback(func(stack.TransportEndpointID) AcceptDecision {
+			handled.Add(1)
+			<-gate
+			return AcceptDecision{}
+		}),
+	)
+
+	conns := make(chan net.Conn, limit+1)
+	for i := 0; i < limit+1; i++ {
+		go func() {
+			conn, err := c.dialTCP(t, testRemote(80))
+			if err != nil {
+				conn = nil
+			}
+			conns <- conn
+		}()
+	}
+	waitFor(t, "the attempts within the limit", func() bool { return handled.Load() == limit })
+	time.Sleep(100 * time.Millisecond)
+	if n := handled.Load(); n != limit {
+		t.Fatalf("%d attempts handled at once, want %d", n, limit)
+	}
+
+	// The excess SYN is retransmitted and handled once the gate opens.
+	close(gate)
+	for i := 0; i < limit+1; i++ {
+		conn := <-conns
+		if conn == nil {
+			t.Fatal("connection failed")
+		}
+		roundTrip(t, conn, "admitted")
+		conn.Close()
+	}
+}
+
+func TestWithMaxConnAttemptsInvalid(t *testing.T) {
+	for _, n := range []int{-1, 0, maxConnAttemptsLimit + 1} {
+		if err := (&TUN{}).Apply(WithMaxConnAttempts(n)); err == nil {
+			t.Errorf("accepted %d attempts", n)
+		}
+	}
+	tun := &TUN{}
+	if n := tun.maxConnAttempts(); n != defaultMaxConnAttempts {
+		t.Errorf("default of %d attempts, want %d", n, defaultMaxConnAttempts)
+	}
+}
@@ -0,0 +1,146 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// WeightedTargets is a set of equivalent upstream addresses that flows are
+// spread over by smooth weighted round-robin: over any window of total
+// weight picks, each target is picked weight times, interleaved as evenly
+// as possible. A target failing failureThreshold consecutive dials is
+// skipped for cooldown. With WithCircuitBreaker, the breaker's health
+// state is used instead, so the targets skipped are those it holds open.
+// The same WeightedTargets should be returned in every Decision that
+// balances over it, since the rotation and health state live in it. It is
+// safe for concurrent use.
+type WeightedTargets struct {
+	// health tracks the failures of the targets if failureThreshold is
+	// positive.
+	health *circuitBreaker
+
+	mu      sync.Mutex
+	targets []*weightedTarget
+}
+
+type weightedTarget struct {
+	address string
+	weight  int
+	current int
+}
+
+// NewWeightedTargets returns an empty set of targets.
+func NewWeightedTargets(failureThreshold int, cooldown time.Duration) *WeightedTargets {
+	w := &WeightedTargets{}
+	if failureThreshold > 0 {
+		w.health = newCircuitBreaker(failureThreshold, 0, cooldown)
+	}
+	return w
+}
+
+// Add adds address with the given positive weight.
+func (w *WeightedTargets) Add(address string, weight int) error {
+	if weight <= 0 {
+		return errors.New("target weight must be positive")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.targets = append(w.targets, &weightedTarget{address: address, weight: weight})
+	return nil
+}
+
+// pick returns the next target not in tried that is healthy according to
+// health, which may be nil, or false if there is none. If all untried
+// targets are cooling down, the one recovering first is returned rather
+// than failing without a try.
+func (w *WeightedTargets) pick(tried map[string]bool, health *circuitBreaker) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	var best, recovering *weightedTarget
+	var recoveringAt time.Time
+	total := 0
+	for _, t := range w.targets {
+		if tried[t.address] {
+			continue
+		}
+		if health != nil {
+			if until := health.skipUntil(t.address); now.Before(until) {
+				if recovering == nil || until.Before(recoveringAt) {
+					recovering, recoveringAt = t, until
+				}
+				continue
+			}
+		}
+		t.current += t.weight
+		total += t.weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+	if best == nil {
+		if recovering == nil {
+			return "", false
+		}
+		return recovering.address, true
+	}
+	best.current -= total
+	return best.address, true
+}
+
+// report records the outcome of a dial to address.
+func (w *WeightedTargets) report(address string, err error) {
+	if w.health != nil {
+		w.health.report(address, err)
+	}
+}
+
+// dialDecision dials the upstream chosen by decision with its dialers, or
+// else the selected one or dialer, see dialersFor. With
+// weighted targets, further targets are tried after a failure while the
+// context allows, and the chosen one is reported as EventUpstreamSelected.
+func (t *TUN) dialDecision(ctx context.Context, flow *Flow, decision Decision, dialer Dialer) (net.Conn, error) {
+	if decision.Targets == nil {
+		return t.dialChain(ctx, flow, decision.Address, t.dialersFor(flow, decision.Address, decision.Dialers, dialer))
+	}
+
+	// The circuit breaker already tracks every dial, so the targets share
+	// its state rather than keeping their own.
+	health := decision.Targets.health
+	if t.breaker != nil {
+		health = t.breaker
+	}
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		address, ok := decision.Targets.pick(tried, health)
+		if !ok {
+			break
+		}
+		tried[address] = true
+		conn, err := t.dialChain(ctx, flow, address, t.dialersFor(flow, address, decision.Dialers, dialer))
+		if t.breaker == nil {
+			decision.Targets.report(address, err)
+		}
+		if err == nil {
+			t.emit(newEvent(EventUpstreamSelected, flow, fmt.Sprintf("target %s selected", address)))
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		return nil, errors.New("no upstream targets")
+	}
+	return nil, fmt.Errorf("all %d targets failed: %w", len(tried), lastErr)
+}
@@ -0,0 +1,74 @@
+package libmitm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWeightedTargets(t *testing.T) {
+	w := NewWeightedTargets(0, 0)
+	w.Add("192.0.2.1:80", 3)
+	w.Add("192.0.2.2:80", 1)
+	if err := w.Add("192.0.2.3:80", 0); err == nil {
+		t.Error("added a target without weight")
+	}
+	if err := w.Add("192.0.2.3", 1); err == nil {
+		t.Error("added a target without port")
+	}
+
+	var picks []string
+	for i := 0; i < 8; i++ {
+		address, ok := w.pick(nil, w.health)
+		if !ok {
+			t.Fatal("no target")
+		}
+		picks = append(picks, address)
+	}
+	// Smooth weighted round-robin interleaves the lighter target.
+	want := []string{"192.0.2.1:80", "192.0.2.1:80", "192.0.2.2:80", "192.0.2.1:80"}
+	for i, address := range picks {
+		if address != want[i%4] {
+			t.Fatalf("picks %v, want %v repeated", picks, want)
+		}
+	}
+
+	tried := map[string]bool{"192.0.2.1:80": true}
+	if address, _ := w.pick(tried, w.health); address != "192.0.2.2:80" {
+		t.Errorf("picked %s, want the untried target", address)
+	}
+	tried["192.0.2.2:80"] = true
+	if _, ok := w.pick(tried, w.health); ok {
+		t.Error("picked a target after all were tried")
+	}
+}
+
+func TestWeightedTargetsHealth(t *testing.T) {
+	w := NewWeightedTargets(2, 50*time.Millisecond)
+	w.Add("192.0.2.1:80", 1)
+	w.Add("192.0.2.2:80", 1)
+	errDial := errors.New("dial failed")
+
+	w.report("192.0.2.1:80", errDial)
+	w.report("192.0.2.1:80", errDial)
+	for i := 0; i < 4; i++ {
+		if address, _ := w.pick(nil, w.health); address != "192.0.2.2:80" {
+			t.Fatalf("picked %s while it cools down", address)
+		}
+	}
+	// With every target cooling down, the one recovering first is
+	// tried rather than none.
+	if address, ok := w.pick(map[string]bool{"192.0.2.2:80": true}, w.health); !ok || address != "192.0.2.1:80" {
+		t.Errorf("picked %q, %v, want the cooling target", address, ok)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		address, _ := w.pick(nil, w.health)
+		seen[address] = true
+	}
+	if !seen["192.0.2.1:80"] {
+		t.Error("target not picked again after the cooldown")
+	}
+}
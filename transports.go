@@ -0,0 +1,41 @@
+package libmitm
+
+import (
+	"libmitm/option"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// WithTCP enables or disables forwarding of TCP flows, which is enabled
+// by default. Segments of a disabled protocol are dropped silently, with
+// neither a RST nor an ICMP error, as if the network had lost them.
+func WithTCP(enabled bool) Option {
+	return func(t *TUN) error {
+		t.tcpDisabled = !enabled
+		return nil
+	}
+}
+
+// WithUDP enables or disables forwarding of UDP flows, which is enabled
+// by default, e.g. to block QUIC so that clients fall back to TCP once
+// their attempts time out. Datagrams of a disabled protocol are dropped
+// silently like those of WithTCP, including DNS queries, which a fake IP
+// pool set by WithFakeIP no longer answers.
+func WithUDP(enabled bool) Option {
+	return func(t *TUN) error {
+		t.udpDisabled = !enabled
+		return nil
+	}
+}
+
+// withDroppedTransport drops every packet of protocol that no endpoint
+// claims, instead of letting the stack answer it with an error.
+func withDroppedTransport(protocol tcpip.TransportProtocolNumber) option.Option {
+	return func(s *stack.Stack) error {
+		s.SetTransportProtocolHandler(protocol, func(stack.TransportEndpointID, stack.PacketBufferPtr) bool {
+			return true
+		})
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+func TestTCPOnly(t *testing.T) {
+	tcpUpstream := echoServer(t)
+	udpUpstream, sources := udpSourceServer(t)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(tcpUpstream), FixedRedirector(udpUpstream)),
+		WithUDP(false),
+	)
+
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "tcp still flows")
+
+	udp := c.dialUDP(t, testRemote(5000))
+	if _, err := udp.Write([]byte("dropped")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// A datagram answered with an ICMP error would fail the read early.
+	udp.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = udp.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("read of a dropped datagram: %v, want a timeout", err)
+	}
+	select {
+	case source := <-sources:
+		t.Errorf("datagram was forwarded from %s", source)
+	default:
+	}
+}
+
+func TestUDPOnly(t *testing.T) {
+	udpUpstream := udpEchoServer(t)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector(echoServer(t)), FixedRedirector(udpUpstream)),
+		WithTCP(false),
+	)
+
+	roundTrip(t, c.dialUDP(t, testRemote(5000)), "udp still flows")
+
+	// The SYN is dropped without a RST, so the dial times out.
+	fa, protocol := fullAddress(t, testRemote(80))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	conn, err := gonet.DialContextTCP(ctx, c.stack, fa, protocol)
+	if err == nil {
+		conn.Close()
+		t.Fatal("connected through a disabled tcp")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("dial failed before timing out: %v", err)
+	}
+}
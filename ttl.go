@@ -0,0 +1,117 @@
+package libmitm
+
+import (
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// ingressTTLMax bounds the number of recorded TTLs not yet claimed by
+	// a flow, e.g. of SYNs the forwarder dropped.
+	ingressTTLMax = 4096
+	// ingressTTLExpiry is when unclaimed TTLs may be discarded.
+	ingressTTLExpiry = 10 * time.Second
+)
+
+type ingressTTLEntry struct {
+	ttl uint8
+	at  time.Time
+}
+
+// ingressTTLs remembers the TTL of the first packet of new flows until the
+// forwarder picks it up.
+type ingressTTLs struct {
+	enabled bool
+
+	mu      sync.Mutex
+	entries map[flowKey]ingressTTLEntry
+}
+
+// WithIngressTTL records the TTL, or hop limit over IPv6, of the first
+// packet of every flow as Flow.TTL. Comparing it to the usual initial
+// values of 64, 128 and 255 estimates how many hops away the client is,
+// and a change hints at a change of the network in between.
+func WithIngressTTL() Option {
+	return func(t *TUN) error {
+		t.ingressTTL.enabled = true
+		return nil
+	}
+}
+
+// record wraps the transport protocol handler next of protocol to record
+// the TTL of the packets it is given, which start new flows.
+func (r *ingressTTLs) record(protocol tcpip.TransportProtocolNumber, next func(stack.TransportEndpointID, stack.PacketBufferPtr) bool) func(stack.TransportEndpointID, stack.PacketBufferPtr) bool {
+	if !r.enabled {
+		return next
+	}
+	return func(id stack.TransportEndpointID, pkt stack.PacketBufferPtr) bool {
+		if protocol != header.TCPProtocolNumber || isSyn(pkt) {
+			if ttl, ok := packetTTL(pkt); ok {
+				r.put(flowKey{protocol: protocol, id: id}, ttl)
+			}
+		}
+		return next(id, pkt)
+	}
+}
+
+func (r *ingressTTLs) put(k flowKey, ttl uint8) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = make(map[flowKey]ingressTTLEntry)
+	}
+	now := time.Now()
+	if len(r.entries) >= ingressTTLMax {
+		for k, e := range r.entries {
+			if now.Sub(e.at) > ingressTTLExpiry {
+				delete(r.entries, k)
+			}
+		}
+		if len(r.entries) >= ingressTTLMax {
+			return
+		}
+	}
+	r.entries[k] = ingressTTLEntry{ttl: ttl, at: now}
+}
+
+// take returns and forgets the TTL recorded for the flow with the given
+// protocol and ID, or 0 if there is none.
+func (r *ingressTTLs) take(protocol tcpip.TransportProtocolNumber, id stack.TransportEndpointID) int {
+	if !r.enabled {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := flowKey{protocol: protocol, id: id}
+	e, ok := r.entries[k]
+	if !ok {
+		return 0
+	}
+	delete(r.entries, k)
+	return int(e.ttl)
+}
+
+func isSyn(pkt stack.PacketBufferPtr) bool {
+	h := header.TCP(pkt.TransportHeader().Slice())
+	return len(h) >= header.TCPMinimumSize && h.Flags()&(header.TCPFlagSyn|header.TCPFlagAck) == header.TCPFlagSyn
+}
+
+// packetTTL returns the TTL or hop limit of pkt.
+func packetTTL(pkt stack.PacketBufferPtr) (uint8, bool) {
+	h := pkt.NetworkHeader().Slice()
+	switch pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber:
+		if len(h) >= header.IPv4MinimumSize {
+			return header.IPv4(h).TTL(), true
+		}
+	case header.IPv6ProtocolNumber:
+		if len(h) >= header.IPv6MinimumSize {
+			return header.IPv6(h).HopLimit(), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,148 @@
+package libmitm
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// UDPChecksumPolicy selects how UDP datagrams from the TUN with a missing
+// or invalid checksum are treated.
+type UDPChecksumPolicy int
+
+const (
+	// UDPChecksumStack keeps gVisor's behavior: over IPv4 a zero
+	// checksum means none and is accepted, while invalid checksums, and
+	// zero checksums over IPv6, are dropped.
+	UDPChecksumStack UDPChecksumPolicy = iota
+	// UDPChecksumRequire also drops IPv4 datagrams without checksum.
+	UDPChecksumRequire
+	// UDPChecksumRecompute accepts every datagram by replacing missing
+	// and invalid checksums with correct ones, for tunnels whose
+	// intermediate hops strip or break them.
+	UDPChecksumRecompute
+)
+
+// WithUDPChecksumPolicy sets how missing and invalid UDP checksums are
+// treated. Fragmented datagrams are checked by the stack alone after
+// reassembly and always follow UDPChecksumStack.
+func WithUDPChecksumPolicy(policy UDPChecksumPolicy) Option {
+	return func(t *TUN) error {
+		if policy < UDPChecksumStack || policy > UDPChecksumRecompute {
+			return errors.New("unknown udp checksum policy")
+		}
+		t.udpChecksum.policy = policy
+		return nil
+	}
+}
+
+// UDPChecksumDrops returns the number of UDP datagrams dropped for a
+// missing or invalid checksum.
+func (t *TUN) UDPChecksumDrops() int64 {
+	n := t.udpChecksum.dropped.Load()
+	if t.stack != nil {
+		n += int64(t.stack.Stats().UDP.ChecksumErrors.Value())
+	}
+	return n
+}
+
+type udpChecksumConfig struct {
+	policy  UDPChecksumPolicy
+	dropped atomic.Int64
+}
+
+// udpChecksumEndpoint applies a UDPChecksumPolicy to inbound packets.
+type udpChecksumEndpoint struct {
+	stack.LinkEndpoint
+	config *udpChecksumConfig
+}
+
+func (e *udpChecksumEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	if dispatcher == nil {
+		e.LinkEndpoint.Attach(nil)
+		return
+	}
+	e.LinkEndpoint.Attach(&udpChecksumDispatcher{NetworkDispatcher: dispatcher, config: e.config})
+}
+
+type udpChecksumDispatcher struct {
+	stack.NetworkDispatcher
+	config *udpChecksumConfig
+}
+
+func (d *udpChecksumDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	if !d.config.apply(protocol, pkt) {
+		d.config.dropped.Add(1)
+		return
+	}
+	d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+}
+
+// apply enforces the policy on pkt, fixing its checksum if needed. It
+// returns false if pkt must be dropped.
+func (c *udpChecksumConfig) apply(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) bool {
+	var (
+		src, dst tcpip.Address
+		hdrLen   int
+	)
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		h, ok := pkt.Data().PullUp(header.IPv4MinimumSize)
+		if !ok {
+			return true
+		}
+		ip := header.IPv4(h)
+		if ip.TransportProtocol() != header.UDPProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return true
+		}
+		src, dst, hdrLen = ip.SourceAddress(), ip.DestinationAddress(), int(ip.HeaderLength())
+	case header.IPv6ProtocolNumber:
+		h, ok := pkt.Data().PullUp(header.IPv6MinimumSize)
+		if !ok {
+			return true
+		}
+		// Datagrams behind extension headers are left to the stack.
+		ip := header.IPv6(h)
+		if ip.TransportProtocol() != header.UDPProtocolNumber {
+			return true
+		}
+		src, dst, hdrLen = ip.SourceAddress(), ip.DestinationAddress(), header.IPv6MinimumSize
+	default:
+		return true
+	}
+
+	b, ok := pkt.Data().PullUp(pkt.Data().Size())
+	if !ok || len(b) < hdrLen+header.UDPMinimumSize {
+		return true
+	}
+	u := header.UDP(b[hdrLen:])
+	if int(u.Length()) < header.UDPMinimumSize || int(u.Length()) > len(u) {
+		return true
+	}
+	u = u[:u.Length()]
+
+	if u.Checksum() == 0 {
+		switch {
+		case c.policy == UDPChecksumRequire && protocol == header.IPv4ProtocolNumber:
+			return false
+		case c.policy != UDPChecksumRecompute:
+			return true
+		}
+	} else if c.policy != UDPChecksumRecompute || u.IsChecksumValid(src, dst, checksum.Checksum(u.Payload(), 0)) {
+		return true
+	}
+
+	u.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, src, dst, u.Length())
+	xsum = ^u.CalculateChecksum(checksum.Checksum(u.Payload(), xsum))
+	if xsum == 0 {
+		// Zero means no checksum; its ones' complement twin is sent.
+		xsum = 0xffff
+	}
+	u.SetChecksum(xsum)
+	return true
+}
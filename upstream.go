@@ -0,0 +1,128 @@
+package libmitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// WithEstablishTimeout bounds the time spent establishing the upstream of
+// a forwarded connection, including every attempt of a failover chain.
+func WithEstablishTimeout(d time.Duration) Option {
+	return func(t *TUN) error {
+		if d <= 0 {
+			return errors.New("establish timeout must be positive")
+		}
+		t.establishTimeout = d
+		return nil
+	}
+}
+
+// WithConnectTimeout bounds each single upstream dial, like
+// net.Dialer.Timeout but for any Dialer and without touching the dialer's
+// keepalive settings. Within a failover chain every dialer gets up to d,
+// while WithEstablishTimeout bounds the whole chain; a dial ends at
+// whichever deadline comes first.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(t *TUN) error {
+		if d <= 0 {
+			return errors.New("connect timeout must be positive")
+		}
+		t.connectTimeout = d
+		return nil
+	}
+}
+
+// dialChain dials address with each dialer in order and returns the first
+// connection established. When more than one dialer is given, the one
+// that succeeded is reported as an EventUpstreamSelected.
+func (t *TUN) dialChain(ctx context.Context, flow *Flow, address string, dialers []Dialer) (net.Conn, error) {
+	var lastErr error
+	for i, d := range dialers {
+		conn, err := t.dial(ctx, flow, d, address)
+		if err == nil {
+			if len(dialers) > 1 {
+				t.emit(newEvent(EventUpstreamSelected, flow, fmt.Sprintf("dialer %d of %d connected to %s", i+1, len(dialers), address)))
+			}
+			return conn, nil
+		}
+		lastErr = err
+		// Every dialer would be denied the same address.
+		if ctx.Err() != nil || errors.Is(err, errACLDenied) {
+			break
+		}
+	}
+	if len(dialers) > 1 {
+		return nil, fmt.Errorf("failover chain of %d dialers exhausted: %w", len(dialers), lastErr)
+	}
+	return nil, lastErr
+}
+
+// dial dials address for flow with d, within the connect timeout if one is
+// set and unless the ACL denies the address, it is under maintenance or
+// the circuit breaker holds it open.
+func (t *TUN) dial(ctx context.Context, flow *Flow, d Dialer, address string) (net.Conn, error) {
+	if err := t.admitACL(flow, address); err != nil {
+		return nil, err
+	}
+	if err := t.admitMaintenance(ctx, flow, address); err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	var err error
+	if t.breaker == nil {
+		conn, err = t.dialUpstream(ctx, flow, d, address)
+	} else if !t.breaker.allow(address) {
+		return nil, fmt.Errorf("dial %s: %w", address, errCircuitOpen)
+	} else {
+		conn, err = t.dialUpstream(ctx, flow, d, address)
+		t.breakerReport(flow, address, err)
+	}
+	if err == nil {
+		flow.upstream = address
+	}
+	return conn, err
+}
+
+func (t *TUN) dialUpstream(ctx context.Context, flow *Flow, d Dialer, address string) (net.Conn, error) {
+	if t.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.connectTimeout)
+		defer cancel()
+	}
+	d = t.mss.dialer(flow, d)
+	if r, ok := t.upstreamResolver(flow, d, address); ok {
+		return t.resolveAndDial(ctx, flow, d, r, address)
+	}
+	if !t.privateUpstream.applies(address) {
+		return d.DialContext(ctx, flow.upstreamNetwork(), address)
+	}
+
+	conn, err := t.privateUpstream.dial(ctx, d, flow.upstreamNetwork(), address)
+	var blocked *errPrivateUpstream
+	if errors.As(err, &blocked) {
+		t.emit(newEvent(EventUpstreamBlocked, flow, blocked.Error()))
+	}
+	return conn, err
+}
+
+// upstreamResolver reports whether the host of address is resolved before
+// d dials it, and the resolver to use: with happy eyeballs, which race the
+// resolved addresses, with a DNS timeout, which is to bound the lookup
+// alone, and with a proxy dialer under the private upstream guard, which
+// is to check the address the proxy connects to rather than the proxy's.
+func (t *TUN) upstreamResolver(flow *Flow, d Dialer, address string) (*net.Resolver, bool) {
+	if !isHostname(address) {
+		return nil, false
+	}
+	resolve := t.happyEyeballs > 0 && flow.upstreamNetwork() == "tcp"
+	switch d := d.(type) {
+	case *net.Dialer:
+		return d.Resolver, resolve || t.dnsTimeout.timeout > 0
+	case proxyDialer:
+		return d.forwardDialer().Resolver, resolve || t.privateUpstream.enabled
+	}
+	return nil, resolve
+}
@@ -0,0 +1,75 @@
+package libmitm
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blackholeDialer is a Dialer whose dials never connect, like dials of a
+// non-routable address, until their context is done.
+var blackholeDialer = dialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+})
+
+// TestConnectTimeout checks that an upstream dial that never connects is
+// aborted near the connect timeout, logged, and the client closed.
+func TestConnectTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	var l captureLogger
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector("192.0.2.1:80"), nil),
+		WithDialer(blackholeDialer),
+		WithConnectTimeout(timeout),
+		WithLogger(&l),
+	)
+
+	start := time.Now()
+	conn, err := c.dialTCP(t, testRemote(80))
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("read from a flow whose dial timed out")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("client closed after %s, want about %s", elapsed, timeout)
+	}
+	waitFor(t, "the dial error", func() bool { return len(l.errors()) > 0 })
+	if msg := l.errors()[0]; !strings.Contains(msg, "timed out") {
+		t.Errorf("logged %q, want a timeout", msg)
+	}
+}
+
+// TestCloseAbortsDial checks that closing the TUN aborts dials in flight
+// rather than waiting for them to time out.
+func TestCloseAbortsDial(t *testing.T) {
+	dialing := make(chan struct{}, 1)
+	c := startTestTUN(t,
+		withRedirectors(FixedRedirector("192.0.2.1:80"), nil),
+		WithDialer(dialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialing <- struct{}{}
+			return blackholeDialer(ctx, network, address)
+		})),
+	)
+	go func() {
+		if conn, err := c.dialTCP(t, testRemote(80)); err == nil {
+			conn.Close()
+		}
+	}()
+	select {
+	case <-dialing:
+	case <-time.After(testTimeout):
+		t.Fatal("upstream was not dialed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.tun.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown with a dial in flight: %v", err)
+	}
+}
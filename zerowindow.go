@@ -0,0 +1,93 @@
+package libmitm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// zeroWindowConfig controls sampling of client-facing receive windows.
+type zeroWindowConfig struct {
+	interval  time.Duration
+	threshold time.Duration
+
+	// stalls counts zero-window episodes that lasted past threshold.
+	stalls atomic.Int64
+}
+
+// WithZeroWindowTracking samples the receive window of every forwarded TCP
+// endpoint each interval and reports an EventZeroWindow when it stays at
+// zero for longer than threshold. A zero window is normal backpressure
+// from a slow upstream; a prolonged one indicates an upstream stall rather
+// than a dead client.
+func WithZeroWindowTracking(interval, threshold time.Duration) Option {
+	return func(t *TUN) error {
+		if interval <= 0 || threshold < interval {
+			return errors.New("zero window tracking: threshold must not be shorter than a positive interval")
+		}
+		t.zeroWindow.interval = interval
+		t.zeroWindow.threshold = threshold
+		return nil
+	}
+}
+
+// ZeroWindowStalls returns the number of prolonged zero-window episodes
+// observed so far.
+func (t *TUN) ZeroWindowStalls() int64 {
+	return t.zeroWindow.stalls.Load()
+}
+
+// trackZeroWindow samples ep until done is closed.
+func (t *TUN) trackZeroWindow(ep tcpip.Endpoint, flow *Flow, done <-chan struct{}) {
+	stats, ok := ep.Stats().(*tcp.Stats)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(t.zeroWindow.interval)
+	defer ticker.Stop()
+
+	var (
+		lastAdvertised = stats.ReceiveErrors.ZeroRcvWindowState.Value()
+		lastQueued     = -1
+		since          time.Time
+		reported       bool
+	)
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			advertised := stats.ReceiveErrors.ZeroRcvWindowState.Value()
+			queued, err := ep.GetSockOptInt(tcpip.ReceiveQueueSizeOption)
+			if err != nil {
+				return
+			}
+
+			// The window is considered closed if a zero window was
+			// advertised since the last sample, or if it was closed
+			// before and nothing has been read from the queue since.
+			zero := advertised != lastAdvertised || (!since.IsZero() && queued > 0 && queued == lastQueued)
+			lastAdvertised, lastQueued = advertised, queued
+
+			if !zero {
+				since, reported = time.Time{}, false
+				continue
+			}
+			if since.IsZero() {
+				since = now
+			}
+			if d := now.Sub(since); !reported && d >= t.zeroWindow.threshold {
+				reported = true
+				t.zeroWindow.stalls.Add(1)
+				e := newEvent(EventZeroWindow, flow, fmt.Sprintf("zero receive window for %s with %d bytes queued", d, queued))
+				e.Duration = durationMillis(d)
+				t.emit(e)
+			}
+		}
+	}
+}